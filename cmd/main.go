@@ -1,16 +1,353 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"equinox/internal/audit"
+	"equinox/internal/authz"
+	"equinox/internal/certs"
+	"equinox/internal/config"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/health"
+	"equinox/internal/mw"
+	"equinox/internal/query"
+	"equinox/internal/ratelimit"
 	"equinox/internal/routers"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func LaunchRouter(host string, port int) {
-	r := routers.SetupRouter()
-	addr := fmt.Sprintf("%s:%d", host, port)
-	r.Run(addr)
+/*
+Serves h on ln until ctx is cancelled or the server fails, running the given
+background tasks, such as flushing series, alongside. On cancellation the
+server stops accepting connections and waits up to timeout for in-flight
+requests, such as ingestion, to finish. The tasks are then cancelled and
+waited for, and every series is flushed and closed, even if the wait for
+requests timed out.
+
+Returns nil on a clean shutdown, or an error describing everything that went
+wrong otherwise.
+*/
+func Serve(ctx context.Context, ln net.Listener, h http.Handler, timeout time.Duration,
+	tasks ...func(context.Context)) error {
+	srv := &http.Server{Handler: h}
+
+	tctx, stopTasks := context.WithCancel(ctx)
+	defer stopTasks()
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task func(context.Context)) {
+			defer wg.Done()
+			task(tctx)
+		}(task)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	var errs []error
+	select {
+	case err := <-serveErr:
+		// the server failed on its own; nothing is running to drain
+		errs = append(errs, fmt.Errorf("server failed: %s", err.Error()))
+	case <-ctx.Done():
+		log.Printf("shutting down, waiting up to %s for in-flight requests", timeout)
+		sctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := srv.Shutdown(sctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to drain requests: %s", err.Error()))
+		}
+	}
+
+	// the tasks may be using the series, so they have to finish first
+	stopTasks()
+	wg.Wait()
+
+	err := mw.GetSeriesMgr().CloseAll()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to close series: %s", err.Error()))
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+Listens on the configured address and serves the router until ctx is
+cancelled, using HTTPS if TLS is configured. The certificate files are
+reloaded whenever a signal arrives on reload, which is usually SIGHUP. See
+Serve for the background tasks and shutdown behaviour.
+*/
+func LaunchRouter(ctx context.Context, cfg *config.Config, reload <-chan os.Signal,
+	tasks ...func(context.Context)) error {
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if cfg.TLS.Enabled() {
+		r, err := certs.NewReloader(&cfg.TLS)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		go watchReload(ctx, r, reload)
+		ln = tls.NewListener(ln, r.TLSConfig())
+		log.Printf("listening on %s with TLS (client auth %s)", ln.Addr().String(), cfg.TLS.ClientAuth)
+	} else {
+		log.Printf("listening on %s", ln.Addr().String())
+	}
+
+	return Serve(ctx, ln, routers.SetupRouter(), time.Duration(cfg.ShutdownTimeout), tasks...)
+}
+
+// Reloads certificates on each signal until ctx is cancelled. A failed
+// reload is logged and the previous certificates stay in use.
+func watchReload(ctx context.Context, r *certs.Reloader, reload <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			err := r.Reload()
+			if err != nil {
+				log.Printf("certificate reload failed: %s", err.Error())
+				continue
+			}
+			log.Printf("certificates reloaded")
+		}
+	}
+}
+
+// Loads the authorization grants from the configuration. If auth is enabled
+// without any grants then every authenticated principal is given full access,
+// which matches the behaviour before grants existed.
+func SetupAuthz(cfg *config.AuthConfig) error {
+	grants := cfg.Grants
+	if cfg.Enabled && len(grants) == 0 {
+		log.Printf("warning: no auth.grants configured, all authenticated principals have full access")
+		grants = []authz.Grant{{
+			Principal: authz.Wildcard,
+			Pattern:   authz.Wildcard,
+			Scopes:    []authz.Scope{authz.ScopeAdmin},
+		}}
+	}
+	return authz.GetPolicy().Reset(grants)
+}
+
+/*
+Creates the data directory and registers the readiness checks reported at
+/readyz. The returned gate fails the wal_replayed check until it's marked done,
+which should happen once the WAL has been replayed and the data files opened.
+*/
+func SetupHealth(cfg *config.Config) (*health.Gate, error) {
+	err := os.MkdirAll(cfg.DataDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	ready := health.GetReadiness()
+	ready.Reset()
+	replayed := health.NewGate("WAL replay has not finished")
+	ready.Register("wal_replayed", replayed.Check)
+	ready.Register("data_files_open", mw.GetSeriesMgr().CheckAll)
+	ready.Register("data_dir_writable", health.DirWritable(cfg.DataDir))
+	if cfg.MinFreeBytes > 0 {
+		ready.Register("disk_free", health.MinFreeSpace(cfg.DataDir, uint64(cfg.MinFreeBytes)))
+	}
+	return replayed, nil
+}
+
+/*
+Has series created with the configured engine, keeping the files of
+disk-backed engines in a directory per series under data_dir/series, and
+reopens the series already there. Their writes go as far as the wal.fsync
+policy says before returning.
+*/
+func SetupSeries(cfg *config.Config) error {
+	dir := filepath.Join(cfg.DataDir, "series")
+	sm := mw.GetSeriesMgr()
+	sm.SetEngine(func(id string) (engine.PointIO, error) {
+		if id == "" || id == "." || id == ".." {
+			return nil, fmt.Errorf("invalid series id '%s'", id)
+		}
+		return engine.NewPointIO(cfg.Engine, filepath.Join(dir, url.PathEscape(id)), cfg.WAL.Durability())
+	})
+	if !engine.IsDiskEngine(cfg.Engine) {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, err := url.PathUnescape(e.Name())
+		if !e.IsDir() || err != nil {
+			continue
+		}
+		_, err = sm.Create(id)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("opened %d series in %s", sm.Size(), dir)
+	return nil
+}
+
+// Flushes every series every interval until ctx is cancelled, bounding how
+// much buffered data a crash can lose when wal.fsync is interval
+func FlushSeries(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		err := mw.GetSeriesMgr().FlushAll()
+		if err != nil {
+			log.Printf("flush failed:\n%s", err.Error())
+		}
+	}
+}
+
+// Drops data older than retention from every series that supports it and
+// vacuums them all, then again every interval until ctx is cancelled
+func EnforceRetention(ctx context.Context, retention, interval time.Duration) {
+	for {
+		n, err := mw.GetSeriesMgr().DropBefore(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("retention failed:\n%s", err.Error())
+		}
+		if n > 0 {
+			log.Printf("retention dropped %d points older than %s", n, retention)
+		}
+		err = mw.GetSeriesMgr().VacuumAll()
+		if err != nil {
+			log.Printf("vacuum failed:\n%s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+/*
+Sends log output, including the request log, to stderr in the configured
+format, and opens the audit log if one is configured. The returned function
+closes the audit log.
+*/
+func SetupLogging(cfg *config.LogConfig) (func() error, error) {
+	var h slog.Handler
+	if cfg.Format == "text" {
+		h = slog.NewTextHandler(os.Stderr, nil)
+	} else {
+		h = slog.NewJSONHandler(os.Stderr, nil)
+	}
+	slog.SetDefault(slog.New(h))
+
+	if cfg.AuditFile == "" {
+		query.SetDoneHook(nil)
+		return func() error { return nil }, nil
+	}
+	al, err := audit.Open(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %s", err.Error())
+	}
+	query.SetDoneHook(al.Query)
+	return al.Close, nil
 }
 
 func main() {
-	LaunchRouter("localhost", 8080)
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		config.Usage(os.Stderr)
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%s", err.Error())
+	}
+	config.Set(cfg)
+
+	closeAudit, err := SetupLogging(&cfg.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeAudit()
+
+	g, err := core.NewIdGenerator(cfg.IdGen, uint16(cfg.NodeId))
+	if err != nil {
+		log.Fatal(err)
+	}
+	core.SetIdGenerator(g)
+
+	err = SetupAuthz(&cfg.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ratelimit.GetQuotas().Reset(&cfg.Limits)
+
+	replayed, err := SetupHealth(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = SetupSeries(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// there's no WAL to replay yet, so the series are ready once they're open
+	replayed.Done()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var tasks []func(context.Context)
+	if cfg.WAL.Fsync == "interval" {
+		tasks = append(tasks, func(ctx context.Context) {
+			FlushSeries(ctx, time.Duration(cfg.WAL.FsyncInterval))
+		})
+	}
+	if cfg.Retention > 0 {
+		retention := time.Duration(cfg.Retention)
+		tasks = append(tasks, func(ctx context.Context) {
+			EnforceRetention(ctx, retention, min(retention, time.Hour))
+		})
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	err = LaunchRouter(ctx, cfg, hup, tasks...)
+	if err != nil {
+		log.Printf("unclean shutdown:\n%s", err.Error())
+		stop()
+		closeAudit()
+		os.Exit(1)
+	}
+	log.Printf("shutdown complete")
 }
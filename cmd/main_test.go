@@ -1,26 +1,65 @@
-package main_test
+package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"equinox/internal/authz"
+	"equinox/internal/certs"
+	"equinox/internal/config"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/file"
+	"equinox/internal/health"
+	"equinox/internal/metrics"
+	"equinox/internal/models"
+	"equinox/internal/mw"
+	"equinox/internal/query"
 	"equinox/internal/routers"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
-const host = "localhost"
-const port = "8080"
-
-func launchRouter(t *testing.T) {
-	r := routers.SetupRouter()
-	err := r.Run(host + ":" + port)
+// Starts serving h on a free port and returns its base URL, a function that
+// triggers shutdown, and a channel that receives Serve's result. The listener
+// is open before this returns so requests can be made straight away.
+func launchServer(t *testing.T, h http.Handler, timeout time.Duration) (string, context.CancelFunc, chan error) {
+	ln, err := net.Listen("tcp", "localhost:0")
 	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, ln, h, timeout)
+	}()
+
+	return "http://" + ln.Addr().String(), cancel, done
 }
 
-func getResponseText(t *testing.T, path string) string {
-	url := fmt.Sprintf("http://%s:%s%s", host, port, path)
+func waitServe(t *testing.T, done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "server did not shut down")
+		return nil
+	}
+}
+
+func getResponseText(t *testing.T, url string) string {
 	resp, err := http.Get(url)
 	assert.NoError(t, err)
 
@@ -34,8 +73,413 @@ func getResponseText(t *testing.T, path string) string {
 }
 
 func TestPing(t *testing.T) {
-	go launchRouter(t)
-	act := getResponseText(t, "/ping")
+	url, cancel, done := launchServer(t, routers.SetupRouter(), time.Second)
+	act := getResponseText(t, url+"/ping")
 	exp := `{"message":"Hello World"}`
 	assert.Equal(t, exp, act)
+
+	cancel()
+	assert.NoError(t, waitServe(t, done))
+
+	// no longer accepting connections
+	_, err := http.Get(url + "/ping")
+	assert.Error(t, err)
+}
+
+func TestReadiness(t *testing.T) {
+	cfg := config.Default()
+	cfg.DataDir = filepath.Join(t.TempDir(), "data")
+	cfg.MinFreeBytes = 1
+	replayed, err := SetupHealth(cfg)
+	assert.NoError(t, err)
+	defer health.GetReadiness().Reset()
+	assert.DirExists(t, cfg.DataDir)
+
+	url, cancel, done := launchServer(t, routers.SetupRouter(), time.Second)
+	defer func() {
+		cancel()
+		waitServe(t, done)
+	}()
+
+	// alive but not ready until startup finishes
+	assert.Contains(t, getResponseText(t, url+"/healthz"), `"alive":true`)
+	resp, err := http.Get(url + "/readyz")
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, string(b), `{"name":"wal_replayed","ok":false,"error":"WAL replay has not finished",`)
+
+	replayed.Done()
+	act := getResponseText(t, url+"/readyz")
+	for _, name := range []string{"wal_replayed", "data_files_open", "data_dir_writable", "disk_free"} {
+		assert.Contains(t, act, `{"name":"`+name+`","ok":true,`)
+	}
+
+	// losing the data directory makes the server unready
+	assert.NoError(t, os.RemoveAll(cfg.DataDir))
+	resp, err = http.Get(url + "/readyz")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+// engine that records whether it was closed
+type testClosingIO struct {
+	*engine.MemTree
+	closed bool
+}
+
+func (io *testClosingIO) Close() error {
+	io.closed = true
+	return nil
+}
+
+func TestShutdownDrains(t *testing.T) {
+	cio := &testClosingIO{MemTree: engine.NewMemTree()}
+	mgr := mw.GetSeriesMgr()
+	mgr.Add(&models.Series{Id: "shutdown", IO: cio})
+	defer mgr.Remove("shutdown")
+
+	started := make(chan bool)
+	release := make(chan bool)
+	r := gin.New()
+	r.GET("/slow", func(c *gin.Context) {
+		started <- true
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+
+	url, cancel, done := launchServer(t, r, 5*time.Second)
+	resp := make(chan string)
+	go func() {
+		resp <- getResponseText(t, url+"/slow")
+	}()
+
+	// shut down while the request is in flight; it must still complete and
+	// series can't be closed until it has
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, cio.closed)
+	release <- true
+
+	assert.Equal(t, "done", <-resp)
+	assert.NoError(t, waitServe(t, done))
+	assert.True(t, cio.closed)
+}
+
+func TestShutdownTasks(t *testing.T) {
+	cio := &testClosingIO{MemTree: engine.NewMemTree()}
+	mgr := mw.GetSeriesMgr()
+	mgr.Add(&models.Series{Id: "shutdown", IO: cio})
+	defer mgr.Remove("shutdown")
+
+	// a task that's still using the series for a while after cancellation
+	var closedDuring atomic.Bool
+	finished := make(chan bool, 2)
+	task := func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		closedDuring.Store(cio.closed)
+		finished <- true
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, ln, gin.New(), time.Second, task, task)
+	}()
+	cancel()
+	assert.NoError(t, waitServe(t, done))
+	assert.Len(t, finished, 2)
+	assert.False(t, closedDuring.Load())
+	assert.True(t, cio.closed)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+	started := make(chan bool)
+	r := gin.New()
+	r.GET("/stuck", func(c *gin.Context) {
+		started <- true
+		<-release
+	})
+
+	url, cancel, done := launchServer(t, r, 50*time.Millisecond)
+	go http.Get(url + "/stuck")
+	<-started
+	cancel()
+
+	err := waitServe(t, done)
+	assert.Error(t, err)
+	assert.Equal(t, "failed to drain requests: context deadline exceeded", err.Error())
+}
+
+func TestLaunchRouterError(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	// port already in use
+	cfg := config.Default()
+	cfg.Port = ln.Addr().(*net.TCPAddr).Port
+	err = LaunchRouter(context.Background(), cfg, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "address already in use")
+}
+
+func TestAuditLog(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	cfg := config.Default()
+	cfg.Log.AuditFile = filepath.Join(t.TempDir(), "audit.log")
+	closeAudit, err := SetupLogging(&cfg.Log)
+	assert.NoError(t, err)
+	defer query.SetDoneHook(nil)
+
+	mgr := mw.GetSeriesMgr()
+	mgr.Add(&models.Series{Id: "audited", IO: engine.NewMemTree()})
+	defer mgr.Remove("audited")
+
+	url, cancel, done := launchServer(t, routers.SetupRouter(), time.Second)
+	body := `{"start":"2024-01-10T23:00:00Z","end":"2024-01-10T23:30:00Z"}`
+	resp, err := http.Post(url+"/series/audited/query", "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, resp.Header.Get("X-Request-Id"), 16)
+	cancel()
+	assert.NoError(t, waitServe(t, done))
+	assert.NoError(t, closeAudit())
+
+	b, err := os.ReadFile(cfg.Log.AuditFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"msg":"query","principal":"ip:127.0.0.1","series":"audited","query":"[2024-01-10 23:00:00 +0000 UTC-2024-01-10 23:30:00 +0000 UTC] [true]","rows":0,"duration_ms":`)
+
+	// the audit file must be writable
+	cfg.Log.AuditFile = filepath.Join(t.TempDir(), "missing", "audit.log")
+	_, err = SetupLogging(&cfg.Log)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to open audit log: ")
+}
+
+func TestEnforceRetention(t *testing.T) {
+	io, err := engine.NewSharded(t.TempDir(), time.Hour)
+	assert.NoError(t, err)
+	defer io.Close()
+	now := time.Now()
+	for _, age := range []time.Duration{72 * time.Hour, 49 * time.Hour, time.Hour} {
+		assert.NoError(t, io.Add(core.NewPoint(now.Add(-age))))
+	}
+	mgr := mw.GetSeriesMgr()
+	mgr.Add(&models.Series{Id: "retained", IO: io})
+	defer mgr.Remove("retained")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	EnforceRetention(ctx, 48*time.Hour, time.Hour)
+	assert.Equal(t, 1, io.Len())
+
+	// the series are vacuumed too
+	var b strings.Builder
+	assert.NoError(t, metrics.Default().WriteText(&b))
+	assert.Contains(t, b.String(), `equinox_vacuum_duration_seconds_count{engine="Sharded"} `)
+}
+
+func TestSetupSeries(t *testing.T) {
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	cfg.Engine = "sharded"
+	cfg.WAL.Fsync = "always"
+	mgr := mw.GetSeriesMgr()
+	defer mgr.SetEngine(func(id string) (engine.PointIO, error) { return engine.NewMemTree(), nil })
+
+	assert.NoError(t, SetupSeries(cfg))
+	s, err := mgr.Create("host/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Sharded", s.IO.Name())
+	assert.NoError(t, s.IO.Add(core.NewPoint(time.Now())))
+	_, err = mgr.Create("..")
+	assert.Equal(t, "failed to create series '..': invalid series id '..'", err.Error())
+	assert.NoError(t, mgr.CloseAll())
+	mgr.Remove("host/1")
+	assert.DirExists(t, filepath.Join(cfg.DataDir, "series", "host%2F1"))
+
+	// series on disk are reopened
+	assert.NoError(t, SetupSeries(cfg))
+	defer mgr.Remove("host/1")
+	s, err = mgr.Get("host/1")
+	assert.NoError(t, err)
+	defer engine.Shutdown(s.IO)
+	assert.Equal(t, 1, s.IO.Len())
+
+	// in-memory engines have nothing to reopen
+	cfg.Engine = "memlist"
+	mgr.Remove("host/1")
+	assert.NoError(t, SetupSeries(cfg))
+	assert.False(t, mgr.Has("host/1"))
+}
+
+func TestFlushSeries(t *testing.T) {
+	dir := t.TempDir()
+	io, err := engine.NewPointIO("sharded", dir, file.DurabilityBuffer)
+	assert.NoError(t, err)
+	defer engine.Shutdown(io)
+	assert.NoError(t, io.Add(core.NewPoint(time.Now())))
+	mgr := mw.GetSeriesMgr()
+	mgr.Add(&models.Series{Id: "buffered", IO: io})
+	defer mgr.Remove("buffered")
+
+	// buffered points are written out by the next flush
+	reopen := func() int {
+		r, err := engine.NewSharded(dir, engine.DefaultShardWindow)
+		assert.NoError(t, err)
+		defer r.Close()
+		return r.Len()
+	}
+	assert.Equal(t, 0, reopen())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	FlushSeries(ctx, 10*time.Millisecond)
+	assert.Equal(t, 1, reopen())
+}
+
+func TestAuthEnabled(t *testing.T) {
+	cfg := config.Default()
+	cfg.Auth.Enabled = true
+	cfg.Auth.APIKeys = []string{"ops:s3cret"}
+	config.Set(cfg)
+	defer config.Set(nil)
+	assert.NoError(t, SetupAuthz(&cfg.Auth))
+	defer authz.GetPolicy().Reset(nil)
+
+	url, cancel, done := launchServer(t, routers.SetupRouter(), time.Second)
+	defer func() {
+		cancel()
+		waitServe(t, done)
+	}()
+
+	// public routes don't need credentials
+	getResponseText(t, url+"/ping")
+
+	resp, err := http.Get(url + "/admin/config")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest("GET", url+"/admin/config", nil)
+	req.Header.Set("X-API-Key", "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// everyone gets full access when no grants are configured
+	assert.Equal(t, []authz.Grant{{Principal: "*", Pattern: "*", Scopes: []authz.Scope{"admin"}}},
+		authz.GetPolicy().List())
+	cfg.Auth.Grants = []authz.Grant{{Principal: "ops", Pattern: "ops.*", Scopes: []authz.Scope{"write"}}}
+	assert.NoError(t, SetupAuthz(&cfg.Auth))
+	assert.Equal(t, cfg.Auth.Grants, authz.GetPolicy().List())
+
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := certs.GenerateTestCert(t, dir, "ca", "Test CA", nil)
+	certs.GenerateTestCert(t, dir, "server", "server-1", ca)
+	agent := certs.GenerateTestCert(t, dir, "agent", "agent-1", ca)
+	other := certs.GenerateTestCert(t, dir, "other", "agent-2", ca)
+
+	// find a free port
+	ln, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg := config.Default()
+	cfg.Port = port
+	cfg.TLS = config.TLSConfig{
+		CertFile:     dir + "/server.pem",
+		KeyFile:      dir + "/server-key.pem",
+		ClientCAFile: ca.CertFile,
+		ClientAuth:   "require",
+	}
+	cfg.Auth.Enabled = true
+	cfg.Auth.Grants = []authz.Grant{{Principal: "agent-1", Pattern: "*", Scopes: []authz.Scope{"admin"}}}
+	config.Set(cfg)
+	defer config.Set(nil)
+	assert.NoError(t, SetupAuthz(&cfg.Auth))
+	defer authz.GetPolicy().Reset(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan os.Signal)
+	done := make(chan error, 1)
+	go func() {
+		done <- LaunchRouter(ctx, cfg, reload)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, waitServe(t, done))
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	client := func(cert *certs.TestCert) *http.Client {
+		tc := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tc.Certificates = []tls.Certificate{cert.TLSCertificate()}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tc, DisableKeepAlives: true}}
+	}
+	url := fmt.Sprintf("https://localhost:%d/admin/config", port)
+
+	// wait for the server to come up
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		resp, err = client(agent).Get(url)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "server-1", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// the CN is the principal
+	resp, err = client(other).Get(url)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// a client certificate is required
+	_, err = client(nil).Get(url)
+	assert.Error(t, err)
+
+	// plain HTTP isn't served
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%d/ping", port))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// rotate the server certificate
+	certs.GenerateTestCert(t, dir, "server", "server-2", ca)
+	reload <- syscall.SIGHUP
+	cn := ""
+	for i := 0; i < 100 && cn != "server-2"; i++ {
+		resp, err = client(agent).Get(url)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		cn = resp.TLS.PeerCertificates[0].Subject.CommonName
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "server-2", cn)
 }
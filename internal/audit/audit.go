@@ -0,0 +1,44 @@
+package audit
+
+import (
+	"context"
+	"equinox/internal/config"
+	"equinox/internal/query"
+	"log/slog"
+	"time"
+)
+
+// Writes a JSON line for each query run, to a rotating file
+type Logger struct {
+	f   *RotatingFile
+	log *slog.Logger
+}
+
+// Opens the audit log configured in cfg
+func Open(cfg *config.LogConfig) (*Logger, error) {
+	f, err := OpenRotatingFile(cfg.AuditFile, cfg.AuditMaxBytes, cfg.AuditMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{f: f, log: slog.New(slog.NewJSONHandler(f, nil))}, nil
+}
+
+// Records a finished query and who ran it. Its signature matches
+// query.DoneFunc so it can be passed to query.SetDoneHook.
+func (l *Logger) Query(q *query.Query, src query.Source, rows int, d time.Duration, err error) {
+	attrs := []slog.Attr{
+		slog.String("principal", src.Principal),
+		slog.String("series", src.Series),
+		slog.String("query", q.String()),
+		slog.Int("rows", rows),
+		slog.Float64("duration_ms", float64(d.Microseconds())/1000),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	l.log.LogAttrs(context.Background(), slog.LevelInfo, "query", attrs...)
+}
+
+func (l *Logger) Close() error {
+	return l.f.Close()
+}
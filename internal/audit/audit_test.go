@@ -0,0 +1,44 @@
+package audit
+
+import (
+	"encoding/json"
+	"equinox/internal/config"
+	"equinox/internal/query"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerQuery(t *testing.T) {
+	cfg := config.Default().Log
+	cfg.AuditFile = filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(&cfg)
+	assert.NoError(t, err)
+
+	start := time.Date(2024, 1, 12, 13, 0, 0, 0, time.UTC)
+	q := query.NewQuery(start, start.Add(time.Hour), query.True())
+	l.Query(q, query.Source{Principal: "grafana", Series: "cpu"}, 42, 1500*time.Microsecond, nil)
+	l.Query(q, query.Source{}, 0, time.Millisecond, errors.New("disk gone"))
+	assert.NoError(t, l.Close())
+
+	lines := strings.Split(strings.TrimSpace(readFile(t, cfg.AuditFile)), "\n")
+	assert.Len(t, lines, 2)
+
+	var e map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, "query", e["msg"])
+	assert.Equal(t, "grafana", e["principal"])
+	assert.Equal(t, "cpu", e["series"])
+	assert.Equal(t, q.String(), e["query"])
+	assert.Equal(t, 42.0, e["rows"])
+	assert.Equal(t, 1.5, e["duration_ms"])
+	assert.NotContains(t, e, "error")
+
+	e = nil
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+	assert.Equal(t, "disk gone", e["error"])
+}
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+/*
+File that is rotated once it reaches maxBytes: path is renamed to path.1,
+path.1 to path.2 and so on, keeping at most maxFiles old files, and a new
+file is started at path. A single write is never split, so a file can exceed
+maxBytes by up to the size of one write. Safe for concurrent use.
+*/
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// Opens path for appending, creating it if needed
+func OpenRotatingFile(path string, maxBytes int64, maxFiles int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = st.Size()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, fs.ErrClosed
+	}
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		err := rf.rotate()
+		if err != nil {
+			return 0, fmt.Errorf("failed to rotate %s: %s", rf.path, err.Error())
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Renames the current file out of the way and opens a new one. Must be
+// called with the lock held.
+func (rf *RotatingFile) rotate() error {
+	err := rf.f.Close()
+	rf.f = nil
+	if err != nil {
+		return err
+	}
+
+	if rf.maxFiles == 0 {
+		err = os.Remove(rf.path)
+	} else {
+		// the oldest file is overwritten by the rename
+		for i := rf.maxFiles - 1; i >= 1 && err == nil; i-- {
+			err = os.Rename(rf.backup(i), rf.backup(i+1))
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err == nil {
+			err = os.Rename(rf.path, rf.backup(1))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// Name of the i-th most recent rotated file
+func (rf *RotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", rf.path, i)
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readFile(t *testing.T, path string) string {
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	assert.NoError(t, err)
+
+	write := func(s string) {
+		n, err := rf.Write([]byte(s))
+		assert.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+
+	write("aaaa\n")
+	write("bbbb\n")
+	assert.Equal(t, "aaaa\nbbbb\n", readFile(t, path))
+	assert.NoFileExists(t, path+".1")
+
+	// rotates before a write that would exceed the limit
+	write("cccc\n")
+	assert.Equal(t, "cccc\n", readFile(t, path))
+	assert.Equal(t, "aaaa\nbbbb\n", readFile(t, path+".1"))
+
+	// writes bigger than the limit aren't split
+	write("dddddddddddd\n")
+	assert.Equal(t, "dddddddddddd\n", readFile(t, path))
+	assert.Equal(t, "cccc\n", readFile(t, path+".1"))
+	assert.Equal(t, "aaaa\nbbbb\n", readFile(t, path+".2"))
+
+	// only maxFiles old files are kept
+	write("eeee\n")
+	assert.Equal(t, "eeee\n", readFile(t, path))
+	assert.Equal(t, "dddddddddddd\n", readFile(t, path+".1"))
+	assert.Equal(t, "cccc\n", readFile(t, path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	assert.NoError(t, rf.Close())
+	_, err = rf.Write([]byte("x"))
+	assert.Error(t, err)
+
+	// appends to an existing file and counts its size
+	rf, err = OpenRotatingFile(path, 10, 2)
+	assert.NoError(t, err)
+	write("ffff\n")
+	assert.Equal(t, "eeee\nffff\n", readFile(t, path))
+	write("g")
+	assert.Equal(t, "g", readFile(t, path))
+	assert.NoError(t, rf.Close())
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := OpenRotatingFile(path, 4, 0)
+	assert.NoError(t, err)
+	defer rf.Close()
+
+	rf.Write([]byte("abc"))
+	rf.Write([]byte("def"))
+	assert.Equal(t, "def", readFile(t, path))
+	assert.NoFileExists(t, path+".1")
+}
+
+func TestOpenRotatingFileError(t *testing.T) {
+	_, err := OpenRotatingFile(filepath.Join(t.TempDir(), "missing", "audit.log"), 10, 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,193 @@
+package authz
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+)
+
+// Access scopes that can be granted on series
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	ScopeAdmin Scope = "admin" // implies read and write
+)
+
+// Valid scopes
+var Scopes = []Scope{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// Matches any principal or any series
+const Wildcard = "*"
+
+/*
+Grants scopes on the series whose ids match Pattern to a principal. Patterns
+use path.Match syntax, so "team-a.*" matches every series starting with
+"team-a.". Principal is the name of an authenticated principal, or "*" for
+all of them.
+
+A principal with the admin scope on the pattern "*" is an administrator and
+can manage grants.
+*/
+type Grant struct {
+	Principal string  `json:"principal"`
+	Pattern   string  `json:"pattern"`
+	Scopes    []Scope `json:"scopes"`
+}
+
+// Returns an error describing what's wrong with the grant, or nil if it's
+// valid.
+func (g *Grant) Validate() error {
+	if g.Principal == "" {
+		return fmt.Errorf("grant must specify a principal")
+	}
+	if g.Pattern == "" {
+		return fmt.Errorf("grant must specify a series pattern")
+	}
+	if _, err := path.Match(g.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid series pattern '%s'", g.Pattern)
+	}
+	if len(g.Scopes) == 0 {
+		return fmt.Errorf("grant must specify at least one scope")
+	}
+	for _, s := range g.Scopes {
+		if !slices.Contains(Scopes, s) {
+			return fmt.Errorf("invalid scope '%s'", s)
+		}
+	}
+	return nil
+}
+
+// Returns true if the grant gives scope s, either directly or through admin
+func (g *Grant) has(s Scope) bool {
+	return slices.Contains(g.Scopes, s) || slices.Contains(g.Scopes, ScopeAdmin)
+}
+
+func (g *Grant) appliesTo(principal string) bool {
+	return g.Principal == Wildcard || g.Principal == principal
+}
+
+// Set of grants. Anything not granted is denied. Safe for concurrent use.
+type Policy struct {
+	mu     sync.RWMutex
+	grants []Grant
+}
+
+func NewPolicy() *Policy {
+	return &Policy{grants: []Grant{}}
+}
+
+// Singleton instance of Policy
+var policyInst *Policy
+var policyOnce sync.Once
+
+// Returns the singleton policy used by the server
+func GetPolicy() *Policy {
+	policyOnce.Do(func() {
+		policyInst = NewPolicy()
+	})
+	return policyInst
+}
+
+// Returns true if principal has scope s on the given series
+func (p *Policy) Allowed(principal string, series string, s Scope) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i := range p.grants {
+		g := &p.grants[i]
+		if !g.appliesTo(principal) || !g.has(s) {
+			continue
+		}
+		// the pattern was validated when the grant was added
+		if ok, _ := path.Match(g.Pattern, series); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if principal is an administrator, i.e. has the admin scope on
+// the pattern "*"
+func (p *Policy) IsAdmin(principal string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i := range p.grants {
+		g := &p.grants[i]
+		if g.appliesTo(principal) && g.Pattern == Wildcard && slices.Contains(g.Scopes, ScopeAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a grant. If principal already has a grant with the same pattern then
+// its scopes are replaced.
+func (p *Policy) Add(g Grant) error {
+	err := g.Validate()
+	if err != nil {
+		return err
+	}
+	g.Scopes = slices.Clone(g.Scopes)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.find(g.Principal, g.Pattern)
+	if i >= 0 {
+		p.grants[i] = g
+	} else {
+		p.grants = append(p.grants, g)
+	}
+	return nil
+}
+
+// Removes principal's grant for pattern, returning an error if there isn't
+// one
+func (p *Policy) Remove(principal string, pattern string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.find(principal, pattern)
+	if i < 0 {
+		return fmt.Errorf("no grant for principal '%s' on pattern '%s'", principal, pattern)
+	}
+	p.grants = slices.Delete(p.grants, i, i+1)
+	return nil
+}
+
+// Replaces all grants with the given ones. Nothing is changed if any of them
+// are invalid.
+func (p *Policy) Reset(gs []Grant) error {
+	np := NewPolicy()
+	for _, g := range gs {
+		err := np.Add(g)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.grants = np.grants
+	return nil
+}
+
+// Returns a copy of all grants in the order they were added
+func (p *Policy) List() []Grant {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	r := make([]Grant, len(p.grants))
+	for i, g := range p.grants {
+		r[i] = g
+		r[i].Scopes = slices.Clone(g.Scopes)
+	}
+	return r
+}
+
+// Index of the grant for principal and pattern, or -1. Must be called with
+// the lock held.
+func (p *Policy) find(principal string, pattern string) int {
+	return slices.IndexFunc(p.grants, func(g Grant) bool {
+		return g.Principal == principal && g.Pattern == pattern
+	})
+}
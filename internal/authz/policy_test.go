@@ -0,0 +1,93 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	p := NewPolicy()
+	assert.NoError(t, p.Add(Grant{Principal: "team-a", Pattern: "a.*", Scopes: []Scope{ScopeRead, ScopeWrite}}))
+	assert.NoError(t, p.Add(Grant{Principal: "team-a", Pattern: "shared", Scopes: []Scope{ScopeRead}}))
+	assert.NoError(t, p.Add(Grant{Principal: "team-b", Pattern: "b.*", Scopes: []Scope{ScopeAdmin}}))
+	assert.NoError(t, p.Add(Grant{Principal: "*", Pattern: "public.?", Scopes: []Scope{ScopeRead}}))
+
+	fn := func(principal string, series string, s Scope, exp bool) {
+		assert.Equal(t, exp, p.Allowed(principal, series, s), "%s %s %s", principal, series, s)
+	}
+
+	fn("team-a", "a.cpu", ScopeRead, true)
+	fn("team-a", "a.cpu", ScopeWrite, true)
+	fn("team-a", "a.cpu", ScopeAdmin, false)
+	fn("team-a", "b.cpu", ScopeRead, false)
+	fn("team-a", "shared", ScopeRead, true)
+	fn("team-a", "shared", ScopeWrite, false)
+	fn("team-b", "b.cpu", ScopeRead, true) // admin implies read and write
+	fn("team-b", "b.cpu", ScopeWrite, true)
+	fn("team-b", "a.cpu", ScopeWrite, false)
+	fn("team-c", "public.1", ScopeRead, true)
+	fn("team-c", "public.10", ScopeRead, false)
+	fn("team-c", "public.1", ScopeWrite, false)
+	fn("team-a", "a", ScopeRead, false)
+
+	assert.False(t, p.IsAdmin("team-b"))
+	assert.NoError(t, p.Add(Grant{Principal: "root", Pattern: "*", Scopes: []Scope{ScopeAdmin}}))
+	assert.True(t, p.IsAdmin("root"))
+	fn("root", "anything", ScopeWrite, true)
+}
+
+func TestPolicyManage(t *testing.T) {
+	p := NewPolicy()
+	assert.Equal(t, []Grant{}, p.List())
+
+	g := Grant{Principal: "ops", Pattern: "ops.*", Scopes: []Scope{ScopeRead}}
+	assert.NoError(t, p.Add(g))
+	assert.NoError(t, p.Add(Grant{Principal: "ci", Pattern: "*", Scopes: []Scope{ScopeWrite}}))
+
+	// re-adding replaces the scopes
+	g.Scopes = []Scope{ScopeWrite}
+	assert.NoError(t, p.Add(g))
+	assert.Equal(t, []Grant{g, {Principal: "ci", Pattern: "*", Scopes: []Scope{ScopeWrite}}}, p.List())
+	assert.False(t, p.Allowed("ops", "ops.cpu", ScopeRead))
+
+	// the policy keeps its own copies
+	g.Scopes[0] = ScopeAdmin
+	assert.False(t, p.Allowed("ops", "ops.cpu", ScopeAdmin))
+	p.List()[0].Scopes[0] = ScopeAdmin
+	assert.False(t, p.Allowed("ops", "ops.cpu", ScopeAdmin))
+
+	assert.NoError(t, p.Remove("ops", "ops.*"))
+	err := p.Remove("ops", "ops.*")
+	assert.Error(t, err)
+	assert.Equal(t, "no grant for principal 'ops' on pattern 'ops.*'", err.Error())
+	assert.Len(t, p.List(), 1)
+
+	// a bad grant leaves the policy unchanged
+	err = p.Reset([]Grant{g, {Principal: "x"}})
+	assert.Error(t, err)
+	assert.Len(t, p.List(), 1)
+	assert.NoError(t, p.Reset(nil))
+	assert.Len(t, p.List(), 0)
+}
+
+func TestGrantValidate(t *testing.T) {
+	fn := func(g Grant, msg string) {
+		err := g.Validate()
+		assert.Error(t, err)
+		if err != nil {
+			assert.Equal(t, msg, err.Error())
+		}
+	}
+
+	fn(Grant{Pattern: "*", Scopes: []Scope{ScopeRead}}, "grant must specify a principal")
+	fn(Grant{Principal: "a", Scopes: []Scope{ScopeRead}}, "grant must specify a series pattern")
+	fn(Grant{Principal: "a", Pattern: "a[", Scopes: []Scope{ScopeRead}}, "invalid series pattern 'a['")
+	fn(Grant{Principal: "a", Pattern: "*"}, "grant must specify at least one scope")
+	fn(Grant{Principal: "a", Pattern: "*", Scopes: []Scope{"delete"}}, "invalid scope 'delete'")
+}
+
+func TestPolicySingleton(t *testing.T) {
+	assert.NotNil(t, GetPolicy())
+	assert.Same(t, GetPolicy(), GetPolicy())
+}
@@ -0,0 +1,99 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"equinox/internal/config"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/*
+Holds the server certificate and client CA pool loaded from the files in a
+config.TLSConfig, and provides a tls.Config that always uses the most recently
+loaded ones. Calling Reload re-reads the files, so certificates can be rotated
+without restarting the server; connections already established keep the
+certificate they were made with.
+*/
+type Reloader struct {
+	cfg config.TLSConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// Creates a reloader and loads the files for the first time
+func NewReloader(cfg *config.TLSConfig) (*Reloader, error) {
+	r := &Reloader{cfg: *cfg}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Re-reads the certificate, key and client CA files. If any of them can't be
+// loaded then the error is returned and the previous ones stay in use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %s", err.Error())
+	}
+
+	var pool *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %s", err.Error())
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCA = pool
+	return nil
+}
+
+// Returns the currently loaded server certificate
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// Returns a server TLS configuration that picks up reloaded files for each
+// new connection
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   clientAuthType(r.cfg.ClientAuth),
+				ClientCAs:    r.clientCA,
+			}, nil
+		},
+	}
+}
+
+// Maps a config.TLSConfig ClientAuth mode to the tls package's equivalent
+func clientAuthType(mode string) tls.ClientAuthType {
+	switch mode {
+	case "request":
+		return tls.VerifyClientCertIfGiven
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
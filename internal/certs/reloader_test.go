@@ -0,0 +1,62 @@
+package certs
+
+import (
+	"crypto/tls"
+	"equinox/internal/config"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := GenerateTestCert(t, dir, "ca", "Test CA", nil)
+	srv := GenerateTestCert(t, dir, "server", "server-1", ca)
+
+	cfg := &config.TLSConfig{CertFile: srv.CertFile, KeyFile: srv.KeyFile, ClientCAFile: ca.CertFile, ClientAuth: "require"}
+	r, err := NewReloader(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, srv.Cert.Raw, r.Certificate().Certificate[0])
+
+	tc, err := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tc.ClientAuth)
+	assert.NotNil(t, tc.ClientCAs)
+	assert.Equal(t, srv.Cert.Raw, tc.Certificates[0].Certificate[0])
+
+	// rotate the certificate in place
+	srv2 := GenerateTestCert(t, dir, "server", "server-2", ca)
+	assert.NoError(t, r.Reload())
+	assert.Equal(t, srv2.Cert.Raw, r.Certificate().Certificate[0])
+	tc, _ = r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.Equal(t, srv2.Cert.Raw, tc.Certificates[0].Certificate[0])
+
+	// a broken file keeps the current certificate
+	assert.NoError(t, os.WriteFile(srv.KeyFile, []byte("garbage"), 0600))
+	err = r.Reload()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load certificate: ")
+	assert.Equal(t, srv2.Cert.Raw, r.Certificate().Certificate[0])
+}
+
+func TestReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := GenerateTestCert(t, dir, "ca", "Test CA", nil)
+	srv := GenerateTestCert(t, dir, "server", "server-1", ca)
+
+	_, err := NewReloader(&config.TLSConfig{CertFile: srv.CertFile, KeyFile: dir + "/missing.pem"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load certificate: open ")
+
+	_, err = NewReloader(&config.TLSConfig{CertFile: srv.CertFile, KeyFile: srv.KeyFile, ClientCAFile: srv.KeyFile})
+	assert.Error(t, err)
+	assert.Equal(t, "no certificates found in client CA file "+srv.KeyFile, err.Error())
+
+	// no client CA is fine without client auth
+	r, err := NewReloader(&config.TLSConfig{CertFile: srv.CertFile, KeyFile: srv.KeyFile, ClientAuth: "none"})
+	assert.NoError(t, err)
+	tc, _ := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.Equal(t, tls.NoClientCert, tc.ClientAuth)
+	assert.Nil(t, tc.ClientCAs)
+}
@@ -0,0 +1,87 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Certificate and key generated for tests, along with the paths of the PEM
+// files they were written to
+type TestCert struct {
+	Cert     *x509.Certificate
+	Key      *ecdsa.PrivateKey
+	CertFile string
+	KeyFile  string
+}
+
+// Returns a tls.Certificate for use by a client
+func (tc *TestCert) TLSCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.Cert.Raw}, PrivateKey: tc.Key, Leaf: tc.Cert}
+}
+
+var testSerial atomic.Int64
+
+/*
+Generates a certificate with the given common name and writes it and its key
+to dir as <name>.pem and <name>-key.pem. If ca is nil then the certificate is
+a self-signed CA; otherwise it's signed by ca and valid for localhost as both
+a server and a client.
+*/
+func GenerateTestCert(t *testing.T, dir string, name string, cn string, ca *TestCert) *TestCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial.Add(1)),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		tmpl.DNSNames = []string{"localhost"}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+		parent, signer = ca.Cert, ca.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	tc := &TestCert{
+		Cert:     cert,
+		Key:      key,
+		CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	err = os.WriteFile(tc.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile(tc.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	assert.NoError(t, err)
+
+	return tc
+}
@@ -0,0 +1,609 @@
+package config
+
+import (
+	"encoding/json"
+	"equinox/internal/authz"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/file"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server configuration. Settings are loaded from defaults, then an optional
+// JSON config file, then EQUINOX_* environment variables, then command-line
+// flags, with later sources overriding earlier ones. See settings for the
+// full list of names.
+type Config struct {
+	Host            string       `json:"host"`
+	Port            int          `json:"port"`
+	ShutdownTimeout Duration     `json:"shutdown_timeout"`
+	DataDir         string       `json:"data_dir"`
+	MinFreeBytes    int64        `json:"min_free_bytes"` // 0 disables the readiness check
+	Engine          string       `json:"engine"`
+	Retention       Duration     `json:"retention"` // 0 means keep data forever
+	IdGen           string       `json:"id_gen"`
+	NodeId          uint         `json:"node_id"`
+	TLS             TLSConfig    `json:"tls"`
+	WAL             WALConfig    `json:"wal"`
+	Auth            AuthConfig   `json:"auth"`
+	Limits          LimitsConfig `json:"limits"`
+	Log             LogConfig    `json:"log"`
+}
+
+// HTTPS settings. TLS is enabled when CertFile and KeyFile are set; both are
+// re-read on SIGHUP, as is ClientCAFile.
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"` // CA bundle for verifying client certificates
+	ClientAuth   string `json:"client_auth"`    // none, request or require
+}
+
+// Returns true if the server should serve HTTPS
+func (t *TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Returns true if client certificates are verified, in which case their
+// common name can be used as the auth principal
+func (t *TLSConfig) VerifiesClients() bool {
+	return t.ClientAuth == "request" || t.ClientAuth == "require"
+}
+
+// Write durability settings for disk-backed engines. Always syncs every
+// write, interval buffers writes and flushes every series each
+// FsyncInterval, and never leaves syncing to the OS until a series is closed.
+type WALConfig struct {
+	Fsync         string   `json:"fsync"` // always, interval or never
+	FsyncInterval Duration `json:"fsync_interval"`
+}
+
+// Returns the data file durability for the fsync policy
+func (w *WALConfig) Durability() file.Durability {
+	switch w.Fsync {
+	case "interval":
+		return file.DurabilityBuffer
+	case "never":
+		return file.DurabilityWrite
+	default:
+		return file.DurabilitySync
+	}
+}
+
+// Authentication settings
+type AuthConfig struct {
+	Enabled   bool     `json:"enabled"`
+	APIKeys   []string `json:"api_keys"` // "key" or "name:key"
+	JWTSecret string   `json:"jwt_secret"`
+
+	// Per-series access; see authz.Grant. Only settable in the config file.
+	Grants []authz.Grant `json:"grants"`
+}
+
+/*
+Ingestion rate limits and quotas. Principal limits apply to each
+authenticated principal, or to each client IP when auth is disabled; series
+limits apply to each series. Overrides replace the default rates for specific
+principal names or series ids. A rate of 0 means unlimited.
+*/
+type LimitsConfig struct {
+	Principal          Rate            `json:"principal"`
+	Series             Rate            `json:"series"`
+	PrincipalOverrides map[string]Rate `json:"principal_overrides"`
+	SeriesOverrides    map[string]Rate `json:"series_overrides"`
+
+	// How much traffic can be absorbed at once, as time at the full rate
+	Burst Duration `json:"burst"`
+
+	// Maximum number of points a series can hold; 0 means unlimited
+	MaxSeriesLen int `json:"max_series_len"`
+
+	// Maximum size of a compressed request body, such as a Prometheus remote
+	// write, and of the request once it's decompressed
+	MaxRequestBytes int `json:"max_request_bytes"`
+	MaxDecodedBytes int `json:"max_decoded_bytes"`
+}
+
+// Token bucket rates
+type Rate struct {
+	Points float64 `json:"points_per_sec"`
+	Bytes  float64 `json:"bytes_per_sec"`
+}
+
+// Logging settings. Requests are logged to stderr; queries are also written to
+// the audit file, if set, which is rotated once it reaches AuditMaxBytes.
+type LogConfig struct {
+	Format        string `json:"format"`          // json or text
+	AuditFile     string `json:"audit_file"`      // empty disables the audit log
+	AuditMaxBytes int64  `json:"audit_max_bytes"` // size at which the audit file is rotated
+	AuditMaxFiles int    `json:"audit_max_files"` // rotated audit files to keep
+}
+
+// Valid values for TLSConfig.ClientAuth
+var ClientAuthModes = []string{"none", "request", "require"}
+
+// Valid values for WALConfig.Fsync
+var FsyncPolicies = []string{"always", "interval", "never"}
+
+// Valid values for LogConfig.Format
+var LogFormats = []string{"json", "text"}
+
+// Returns the default configuration
+func Default() *Config {
+	return &Config{
+		Host:            "localhost",
+		Port:            8080,
+		ShutdownTimeout: Duration(30 * time.Second),
+		DataDir:         "./data",
+		MinFreeBytes:    100 << 20,
+		Engine:          "memtree",
+		IdGen:           "random",
+		TLS:             TLSConfig{ClientAuth: "none"},
+		WAL: WALConfig{
+			Fsync:         "interval",
+			FsyncInterval: Duration(time.Second),
+		},
+		Auth: AuthConfig{APIKeys: []string{}, Grants: []authz.Grant{}},
+		Limits: LimitsConfig{
+			PrincipalOverrides: map[string]Rate{},
+			SeriesOverrides:    map[string]Rate{},
+			Burst:              Duration(time.Second),
+			MaxRequestBytes:    16 << 20,
+			MaxDecodedBytes:    64 << 20,
+		},
+		Log: LogConfig{
+			Format:        "json",
+			AuditMaxBytes: 100 << 20,
+			AuditMaxFiles: 5,
+		},
+	}
+}
+
+// Validates the configuration, returning an error describing every problem
+// found or nil if it's valid.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		add("port %d must be between 1 and 65535", c.Port)
+	}
+	if c.ShutdownTimeout <= 0 {
+		add("shutdown_timeout must be positive")
+	}
+	if c.DataDir == "" {
+		add("data_dir cannot be empty")
+	}
+	if c.MinFreeBytes < 0 {
+		add("min_free_bytes cannot be negative")
+	}
+	if !slices.Contains(engine.Names, c.Engine) {
+		add("engine '%s' must be one of %s", c.Engine, strings.Join(engine.Names, ", "))
+	}
+	if c.Retention < 0 {
+		add("retention cannot be negative")
+	}
+	if c.NodeId > core.SnowflakeMaxNode {
+		add("node_id %d exceeds max of %d", c.NodeId, core.SnowflakeMaxNode)
+	} else if _, err := core.NewIdGenerator(c.IdGen, uint16(c.NodeId)); err != nil {
+		add("id_gen: %s", err.Error())
+	}
+	if c.TLS.Enabled() && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		add("tls.cert_file and tls.key_file must be set together")
+	}
+	if !slices.Contains(ClientAuthModes, c.TLS.ClientAuth) {
+		add("tls.client_auth '%s' must be one of %s", c.TLS.ClientAuth, strings.Join(ClientAuthModes, ", "))
+	}
+	if c.TLS.VerifiesClients() && (!c.TLS.Enabled() || c.TLS.ClientCAFile == "") {
+		add("tls.client_auth '%s' requires tls.cert_file, tls.key_file and tls.client_ca_file", c.TLS.ClientAuth)
+	}
+	if !slices.Contains(FsyncPolicies, c.WAL.Fsync) {
+		add("wal.fsync '%s' must be one of %s", c.WAL.Fsync, strings.Join(FsyncPolicies, ", "))
+	}
+	if c.WAL.Fsync == "interval" && c.WAL.FsyncInterval <= 0 {
+		add("wal.fsync_interval must be positive when wal.fsync is interval")
+	}
+	for i, k := range c.Auth.APIKeys {
+		if _, key, found := strings.Cut(k, ":"); k == "" || (found && key == "") {
+			add("auth.api_keys[%d] is empty", i)
+		}
+	}
+	for i := range c.Auth.Grants {
+		if err := c.Auth.Grants[i].Validate(); err != nil {
+			add("auth.grants[%d]: %s", i, err.Error())
+		}
+	}
+	if c.Auth.Enabled && len(c.Auth.APIKeys) == 0 && c.Auth.JWTSecret == "" && !c.TLS.VerifiesClients() {
+		add("auth is enabled but none of auth.api_keys, auth.jwt_secret or tls.client_auth is set")
+	}
+
+	checkRate := func(name string, r Rate) {
+		if r.Points < 0 || r.Bytes < 0 {
+			add("%s cannot be negative", name)
+		}
+	}
+	checkRate("limits.principal", c.Limits.Principal)
+	checkRate("limits.series", c.Limits.Series)
+	for k, r := range c.Limits.PrincipalOverrides {
+		checkRate(fmt.Sprintf("limits.principal_overrides[%s]", k), r)
+	}
+	for k, r := range c.Limits.SeriesOverrides {
+		checkRate(fmt.Sprintf("limits.series_overrides[%s]", k), r)
+	}
+	if c.Limits.Burst <= 0 {
+		add("limits.burst must be positive")
+	}
+	if c.Limits.MaxSeriesLen < 0 {
+		add("limits.max_series_len cannot be negative")
+	}
+	if c.Limits.MaxRequestBytes <= 0 {
+		add("limits.max_request_bytes must be positive")
+	}
+	if c.Limits.MaxDecodedBytes <= 0 {
+		add("limits.max_decoded_bytes must be positive")
+	}
+	if !slices.Contains(LogFormats, c.Log.Format) {
+		add("log.format '%s' must be one of %s", c.Log.Format, strings.Join(LogFormats, ", "))
+	}
+	if c.Log.AuditMaxBytes <= 0 {
+		add("log.audit_max_bytes must be positive")
+	}
+	if c.Log.AuditMaxFiles < 0 {
+		add("log.audit_max_files cannot be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Returns a copy of the configuration with secrets masked, suitable for
+// displaying to users.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Auth.APIKeys = make([]string, len(c.Auth.APIKeys))
+	for i := range r.Auth.APIKeys {
+		r.Auth.APIKeys[i] = redacted
+	}
+	if r.Auth.JWTSecret != "" {
+		r.Auth.JWTSecret = redacted
+	}
+	return &r
+}
+
+const redacted = "<redacted>"
+
+/****************************************************************************
+	Loading
+****************************************************************************/
+
+// Single configuration setting that can be given as an environment variable
+// or flag
+type setting struct {
+	name  string // flag name; the env var is EQUINOX_ + upper snake case
+	usage string
+	apply func(c *Config, v string) error
+}
+
+func (s *setting) env() string {
+	return "EQUINOX_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+var settings = []setting{
+	{"host", "address to listen on", func(c *Config, v string) error {
+		c.Host = v
+		return nil
+	}},
+	{"port", "port to listen on", func(c *Config, v string) error {
+		return parseInt(v, &c.Port)
+	}},
+	{"shutdown-timeout", "how long to wait for in-flight requests on shutdown", func(c *Config, v string) error {
+		return c.ShutdownTimeout.UnmarshalText([]byte(v))
+	}},
+	{"data-dir", "directory for data files", func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{"min-free-bytes", "free space needed in data-dir to report ready; 0 disables the check", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s'", v)
+		}
+		c.MinFreeBytes = n
+		return nil
+	}},
+	{"engine", "storage engine for series: memtree, memlist or sharded", func(c *Config, v string) error {
+		c.Engine = v
+		return nil
+	}},
+	{"retention", "how long to keep data, e.g. 30d; 0 keeps it forever", func(c *Config, v string) error {
+		return c.Retention.UnmarshalText([]byte(v))
+	}},
+	{"id-gen", "point id generator: random or snowflake", func(c *Config, v string) error {
+		c.IdGen = v
+		return nil
+	}},
+	{"node-id", "node id used by the snowflake id generator", func(c *Config, v string) error {
+		n, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s'", v)
+		}
+		c.NodeId = uint(n)
+		return nil
+	}},
+	{"tls-cert-file", "certificate file for serving HTTPS", func(c *Config, v string) error {
+		c.TLS.CertFile = v
+		return nil
+	}},
+	{"tls-key-file", "private key file for serving HTTPS", func(c *Config, v string) error {
+		c.TLS.KeyFile = v
+		return nil
+	}},
+	{"tls-client-ca-file", "CA bundle used to verify client certificates", func(c *Config, v string) error {
+		c.TLS.ClientCAFile = v
+		return nil
+	}},
+	{"tls-client-auth", "client certificate verification: none, request or require", func(c *Config, v string) error {
+		c.TLS.ClientAuth = v
+		return nil
+	}},
+	{"wal-fsync", "WAL fsync policy: always, interval or never", func(c *Config, v string) error {
+		c.WAL.Fsync = v
+		return nil
+	}},
+	{"wal-fsync-interval", "time between WAL fsyncs when wal-fsync is interval", func(c *Config, v string) error {
+		return c.WAL.FsyncInterval.UnmarshalText([]byte(v))
+	}},
+	{"limit-principal-points", "points per second each principal may write; 0 is unlimited", func(c *Config, v string) error {
+		return parseFloat(v, &c.Limits.Principal.Points)
+	}},
+	{"limit-principal-bytes", "bytes per second each principal may write; 0 is unlimited", func(c *Config, v string) error {
+		return parseFloat(v, &c.Limits.Principal.Bytes)
+	}},
+	{"limit-series-points", "points per second each series may receive; 0 is unlimited", func(c *Config, v string) error {
+		return parseFloat(v, &c.Limits.Series.Points)
+	}},
+	{"limit-series-bytes", "bytes per second each series may receive; 0 is unlimited", func(c *Config, v string) error {
+		return parseFloat(v, &c.Limits.Series.Bytes)
+	}},
+	{"limit-burst", "burst allowed above the rate limits, as time at the full rate", func(c *Config, v string) error {
+		return c.Limits.Burst.UnmarshalText([]byte(v))
+	}},
+	{"max-series-len", "maximum number of points per series; 0 is unlimited", func(c *Config, v string) error {
+		return parseInt(v, &c.Limits.MaxSeriesLen)
+	}},
+	{"max-request-bytes", "maximum size of a compressed request body", func(c *Config, v string) error {
+		return parseInt(v, &c.Limits.MaxRequestBytes)
+	}},
+	{"max-decoded-bytes", "maximum size of a compressed request once it's decompressed", func(c *Config, v string) error {
+		return parseInt(v, &c.Limits.MaxDecodedBytes)
+	}},
+	{"log-format", "request log format: json or text", func(c *Config, v string) error {
+		c.Log.Format = v
+		return nil
+	}},
+	{"audit-file", "file to write the query audit log to; empty disables it", func(c *Config, v string) error {
+		c.Log.AuditFile = v
+		return nil
+	}},
+	{"audit-max-bytes", "size at which the audit file is rotated", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s'", v)
+		}
+		c.Log.AuditMaxBytes = n
+		return nil
+	}},
+	{"audit-max-files", "number of rotated audit files to keep", func(c *Config, v string) error {
+		return parseInt(v, &c.Log.AuditMaxFiles)
+	}},
+	{"auth-enabled", "require authentication for protected routes", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s'", v)
+		}
+		c.Auth.Enabled = b
+		return nil
+	}},
+	{"auth-api-keys", "comma-separated list of accepted API keys, each optionally given as name:key", func(c *Config, v string) error {
+		c.Auth.APIKeys = splitList(v)
+		return nil
+	}},
+	{"auth-jwt-secret", "key used to verify HMAC-signed bearer tokens", func(c *Config, v string) error {
+		c.Auth.JWTSecret = v
+		return nil
+	}},
+}
+
+/*
+Loads the configuration from the given command-line arguments and environment.
+The config file is taken from the -config flag or EQUINOX_CONFIG variable; if
+neither is given then no file is read. getenv is usually os.LookupEnv.
+
+Returns an error if any source can't be read or parsed, or if the resulting
+configuration is invalid; every problem found is reported.
+*/
+func Load(args []string, getenv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+
+	fs := flag.NewFlagSet("equinox", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfgPath := fs.String("config", "", "path to JSON config file")
+	flagVals := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagVals[s.name] = fs.String(s.name, "", s.usage)
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// config file
+	path := *cfgPath
+	if path == "" {
+		path, _ = getenv("EQUINOX_CONFIG")
+	}
+	if path != "" {
+		err = c.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+
+	// environment
+	for _, s := range settings {
+		v, exists := getenv(s.env())
+		if !exists {
+			continue
+		}
+		if err := s.apply(c, v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", s.env(), err.Error()))
+		}
+	}
+
+	// flags that were explicitly given
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name != f.Name {
+				continue
+			}
+			if err := s.apply(c, *flagVals[s.name]); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %s", s.name, err.Error()))
+			}
+		}
+	})
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Prints usage for all settings to w
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "  -config\n\tpath to JSON config file (env EQUINOX_CONFIG)\n")
+	for _, s := range settings {
+		fmt.Fprintf(w, "  -%s\n\t%s (env %s)\n", s.name, s.usage, s.env())
+	}
+}
+
+// Overlays settings from the JSON file at path onto this configuration.
+// Unknown fields are an error so that typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %s", err.Error())
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid value '%s'", v)
+	}
+	*dst = n
+	return nil
+}
+
+func parseFloat(v string, dst *float64) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value '%s'", v)
+	}
+	*dst = f
+	return nil
+}
+
+// Splits a comma-separated list, dropping empty entries
+func splitList(v string) []string {
+	r := []string{}
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+/****************************************************************************
+	Current configuration
+****************************************************************************/
+
+var current *Config
+var currentMu sync.RWMutex
+
+// Returns the configuration the server is running with, or the defaults if
+// none has been set.
+func Get() *Config {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	if current == nil {
+		return Default()
+	}
+	return current
+}
+
+// Sets the configuration the server is running with
+func Set(c *Config) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = c
+}
+
+/****************************************************************************
+	Duration
+****************************************************************************/
+
+// time.Duration that marshals to and from strings like "90s" or "1h30m". A
+// "d" suffix is also accepted for whole days, e.g. "30d".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	s := string(text)
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid duration '%s'", s)
+		}
+		*d = Duration(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s'", s)
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"encoding/json"
+	"equinox/internal/authz"
+	"equinox/internal/file"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEnv(m map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, exists := m[k]
+		return v, exists
+	}
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "equinox.json")
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.NoError(t, err)
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c, err := Load(nil, testEnv(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), c)
+	assert.Equal(t, "localhost", c.Host)
+	assert.Equal(t, 8080, c.Port)
+	assert.Equal(t, Duration(30*time.Second), c.ShutdownTimeout)
+	assert.Equal(t, "memtree", c.Engine)
+	assert.Equal(t, Duration(0), c.Retention)
+	assert.Equal(t, "interval", c.WAL.Fsync)
+	assert.Equal(t, Duration(time.Second), c.WAL.FsyncInterval)
+	assert.Equal(t, file.DurabilityBuffer, c.WAL.Durability())
+	assert.False(t, c.Auth.Enabled)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"host": "0.0.0.0",
+		"port": 9000,
+		"data_dir": "/var/lib/equinox",
+		"retention": "30d",
+		"wal": {"fsync": "always"},
+		"auth": {
+			"enabled": true,
+			"api_keys": ["k1", "k2"],
+			"grants": [{"principal": "ops", "pattern": "*", "scopes": ["admin"]}]
+		}
+	}`)
+
+	// file only
+	c, err := Load([]string{"-config", path}, testEnv(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "0.0.0.0", c.Host)
+	assert.Equal(t, 9000, c.Port)
+	assert.Equal(t, "/var/lib/equinox", c.DataDir)
+	assert.Equal(t, Duration(30*24*time.Hour), c.Retention)
+	assert.Equal(t, "always", c.WAL.Fsync)
+	assert.Equal(t, file.DurabilitySync, c.WAL.Durability())
+	assert.Equal(t, Duration(time.Second), c.WAL.FsyncInterval) // default kept
+	assert.True(t, c.Auth.Enabled)
+	assert.Equal(t, []string{"k1", "k2"}, c.Auth.APIKeys)
+	assert.Equal(t, []authz.Grant{{Principal: "ops", Pattern: "*", Scopes: []authz.Scope{authz.ScopeAdmin}}}, c.Auth.Grants)
+
+	// env overrides file, flags override env
+	env := testEnv(map[string]string{
+		"EQUINOX_CONFIG":         path,
+		"EQUINOX_PORT":           "9001",
+		"EQUINOX_ENGINE":         "memlist",
+		"EQUINOX_AUTH_API_KEYS":  "k3, ,k4",
+		"EQUINOX_WAL_FSYNC":      "never",
+		"EQUINOX_MIN_FREE_BYTES": "1024",
+		"EQUINOX_AUDIT_FILE":     "/var/log/equinox/audit.log",
+	})
+	c, err = Load([]string{"-port", "9002", "-wal-fsync=interval", "-wal-fsync-interval", "250ms"}, env)
+	assert.NoError(t, err)
+	assert.Equal(t, "0.0.0.0", c.Host)
+	assert.Equal(t, 9002, c.Port)
+	assert.Equal(t, "memlist", c.Engine)
+	assert.Equal(t, []string{"k3", "k4"}, c.Auth.APIKeys)
+	assert.Equal(t, "interval", c.WAL.Fsync)
+	assert.Equal(t, Duration(250*time.Millisecond), c.WAL.FsyncInterval)
+	assert.Equal(t, int64(1024), c.MinFreeBytes)
+	assert.Equal(t, "/var/log/equinox/audit.log", c.Log.AuditFile)
+}
+
+func TestConfigErrors(t *testing.T) {
+	fn := func(args []string, env map[string]string, msg string) {
+		_, err := Load(args, testEnv(env))
+		assert.Error(t, err)
+		if err != nil {
+			assert.Equal(t, msg, err.Error())
+		}
+	}
+
+	fn([]string{"-bogus"}, nil, "flag provided but not defined: -bogus")
+	fn([]string{"-config", "/nonexistent/equinox.json"}, nil,
+		"failed to open config file: open /nonexistent/equinox.json: no such file or directory")
+
+	path := writeTestConfig(t, `{"prot": 80}`)
+	fn([]string{"-config", path}, nil,
+		"failed to parse config file "+path+`: json: unknown field "prot"`)
+
+	// parse errors from every source are all reported
+	fn([]string{"-port", "abc", "-retention", "1y"}, map[string]string{"EQUINOX_AUTH_ENABLED": "maybe"},
+		"EQUINOX_AUTH_ENABLED: invalid value 'maybe'\n-port: invalid value 'abc'\n-retention: invalid duration '1y'")
+
+	// validation errors are all reported
+	fn([]string{"-port", "70000", "-shutdown-timeout", "0s", "-engine", "disk", "-data-dir", "", "-node-id", "5000",
+		"-wal-fsync-interval", "0s", "-auth-enabled", "true", "-retention", "-1h"}, nil,
+		"port 70000 must be between 1 and 65535\n"+
+			"shutdown_timeout must be positive\n"+
+			"data_dir cannot be empty\n"+
+			"engine 'disk' must be one of memtree, memlist, sharded\n"+
+			"retention cannot be negative\n"+
+			"node_id 5000 exceeds max of 1023\n"+
+			"wal.fsync_interval must be positive when wal.fsync is interval\n"+
+			"auth is enabled but none of auth.api_keys, auth.jwt_secret or tls.client_auth is set")
+
+	fn([]string{"-tls-cert-file", "cert.pem", "-tls-client-auth", "always"}, nil,
+		"tls.cert_file and tls.key_file must be set together\n"+
+			"tls.client_auth 'always' must be one of none, request, require")
+	fn([]string{"-tls-cert-file", "cert.pem", "-tls-key-file", "key.pem", "-tls-client-auth", "require"}, nil,
+		"tls.client_auth 'require' requires tls.cert_file, tls.key_file and tls.client_ca_file")
+
+	fn([]string{"-auth-api-keys", "ops:k1,ci:"}, nil, "auth.api_keys[1] is empty")
+	path = writeTestConfig(t, `{"auth": {"grants": [{"principal": "ops", "pattern": "[", "scopes": ["read"]}, {"principal": "ci", "pattern": "*", "scopes": ["delete"]}]}}`)
+	fn([]string{"-config", path}, nil,
+		"auth.grants[0]: invalid series pattern '['\nauth.grants[1]: invalid scope 'delete'")
+	fn([]string{"-min-free-bytes", "-1"}, nil, "min_free_bytes cannot be negative")
+	fn([]string{"-min-free-bytes", "1G"}, nil, "-min-free-bytes: invalid value '1G'")
+	fn([]string{"-log-format", "xml", "-audit-max-bytes", "0", "-audit-max-files", "-1"}, nil,
+		"log.format 'xml' must be one of json, text\n"+
+			"log.audit_max_bytes must be positive\n"+
+			"log.audit_max_files cannot be negative")
+	fn([]string{"-id-gen", "uuid"}, nil, "id_gen: unrecognized id generator 'uuid'")
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := Default()
+	c.Auth.APIKeys = []string{"secret1", "secret2"}
+	c.Auth.JWTSecret = "shh"
+
+	r := c.Redacted()
+	assert.Equal(t, []string{"<redacted>", "<redacted>"}, r.Auth.APIKeys)
+	assert.Equal(t, "<redacted>", r.Auth.JWTSecret)
+	assert.Equal(t, []string{"secret1", "secret2"}, c.Auth.APIKeys) // original unchanged
+	assert.Equal(t, "shh", c.Auth.JWTSecret)
+
+	b, err := json.Marshal(Default().Redacted())
+	assert.NoError(t, err)
+	assert.Equal(t, `{"host":"localhost","port":8080,"shutdown_timeout":"30s","data_dir":"./data","min_free_bytes":104857600,"engine":"memtree","retention":"0s","id_gen":"random","node_id":0,"tls":{"cert_file":"","key_file":"","client_ca_file":"","client_auth":"none"},"wal":{"fsync":"interval","fsync_interval":"1s"},"auth":{"enabled":false,"api_keys":[],"jwt_secret":"","grants":[]},"limits":{"principal":{"points_per_sec":0,"bytes_per_sec":0},"series":{"points_per_sec":0,"bytes_per_sec":0},"principal_overrides":{},"series_overrides":{},"burst":"1s","max_series_len":0,"max_request_bytes":16777216,"max_decoded_bytes":67108864},"log":{"format":"json","audit_file":"","audit_max_bytes":104857600,"audit_max_files":5}}`, string(b))
+}
+
+func TestConfigCurrent(t *testing.T) {
+	assert.Equal(t, Default(), Get())
+
+	c := Default()
+	c.Port = 1234
+	Set(c)
+	defer Set(nil)
+	assert.Equal(t, 1234, Get().Port)
+}
+
+func TestConfigTLS(t *testing.T) {
+	c, err := Load(nil, testEnv(nil))
+	assert.NoError(t, err)
+	assert.False(t, c.TLS.Enabled())
+	assert.False(t, c.TLS.VerifiesClients())
+
+	// client certificates alone are enough for auth
+	c, err = Load([]string{"-auth-enabled=true", "-tls-client-auth", "request"}, testEnv(map[string]string{
+		"EQUINOX_TLS_CERT_FILE":      "cert.pem",
+		"EQUINOX_TLS_KEY_FILE":       "key.pem",
+		"EQUINOX_TLS_CLIENT_CA_FILE": "ca.pem",
+	}))
+	assert.NoError(t, err)
+	assert.True(t, c.TLS.Enabled())
+	assert.True(t, c.TLS.VerifiesClients())
+}
+
+func TestConfigLimits(t *testing.T) {
+	path := writeTestConfig(t, `{"limits": {
+		"principal": {"points_per_sec": 1000},
+		"principal_overrides": {"bulk-loader": {"points_per_sec": 0, "bytes_per_sec": 1e6}},
+		"series_overrides": {"cpu": {"points_per_sec": 10}},
+		"max_series_len": 5000,
+		"max_request_bytes": 1000
+	}}`)
+	c, err := Load([]string{"-config", path, "-limit-series-bytes", "2048.5", "-limit-burst", "5s", "-max-decoded-bytes", "4000"}, testEnv(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, Rate{Points: 1000}, c.Limits.Principal)
+	assert.Equal(t, Rate{Bytes: 2048.5}, c.Limits.Series)
+	assert.Equal(t, map[string]Rate{"bulk-loader": {Bytes: 1e6}}, c.Limits.PrincipalOverrides)
+	assert.Equal(t, map[string]Rate{"cpu": {Points: 10}}, c.Limits.SeriesOverrides)
+	assert.Equal(t, Duration(5*time.Second), c.Limits.Burst)
+	assert.Equal(t, 5000, c.Limits.MaxSeriesLen)
+	assert.Equal(t, 1000, c.Limits.MaxRequestBytes)
+	assert.Equal(t, 4000, c.Limits.MaxDecodedBytes)
+
+	path = writeTestConfig(t, `{"limits": {"series_overrides": {"cpu": {"bytes_per_sec": -1}}}}`)
+	_, err = Load([]string{"-config", path, "-limit-principal-points", "-5", "-limit-burst", "0s", "-max-series-len", "-1", "-max-request-bytes", "0"}, testEnv(nil))
+	assert.Error(t, err)
+	assert.Equal(t, "limits.principal cannot be negative\n"+
+		"limits.series_overrides[cpu] cannot be negative\n"+
+		"limits.burst must be positive\n"+
+		"limits.max_series_len cannot be negative\n"+
+		"limits.max_request_bytes must be positive", err.Error())
+
+	_, err = Load([]string{"-limit-series-points", "fast"}, testEnv(nil))
+	assert.Error(t, err)
+	assert.Equal(t, "-limit-series-points: invalid value 'fast'", err.Error())
+}
@@ -5,24 +5,33 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
-	"math/rand"
 )
 
+/*
+Base64 encoding used for the string form of ids. It uses the same characters
+as the URL-safe encoding but in ASCII order, so that as the value is written
+big-endian, strings sort in the same order as Cmp. With time-ordered ids such
+as snowflakes, the timestamp comes first and so ids sort by time wherever
+they're exported.
+*/
+var idEncoding = base64.NewEncoding("-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz")
+
 // Representation of an ID used for data points
 type Id struct {
 	val uint64
 }
 
-// Creates a new random ID
+// Creates a new ID using the current IdGenerator, which is random by default.
+// See SetIdGenerator.
 func NewId() *Id {
-	id := Id{val: rand.Uint64()}
+	id := Id{val: GetIdGenerator().Next()}
 	return &id
 }
 
-// Creates an Id struct from the specified string, which must be a Base64 Url
-// Encoding representing a uint64.
+// Creates an Id struct from the specified string, which must be a uint64 in
+// the encoding returned by String.
 func IdFromString(s string) (*Id, error) {
-	b, err := base64.URLEncoding.DecodeString(s)
+	b, err := idEncoding.DecodeString(s)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding string '%s': %s", s, err.Error())
 	}
@@ -45,7 +54,8 @@ func IdFromString(s string) (*Id, error) {
 	return &id, nil
 }
 
-// Returns string representation of an ID, which is a Base64 Url Encoding
+// Returns string representation of an ID, which is base64 encoded and sorts
+// in the same order as the ids. See idEncoding.
 func (id *Id) String() string {
 	var buf bytes.Buffer
 	err := binary.Write(&buf, binary.BigEndian, id.val)
@@ -53,7 +63,7 @@ func (id *Id) String() string {
 		panic(fmt.Sprintf("failed to write id %d to string", id.val))
 	}
 
-	return base64.URLEncoding.EncodeToString(buf.Bytes())
+	return idEncoding.EncodeToString(buf.Bytes())
 }
 
 // Clones this Id
@@ -1,6 +1,9 @@
 package core
 
 import (
+	"math"
+	"math/rand"
+	"slices"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -8,7 +11,7 @@ import (
 
 func TestIdString(t *testing.T) {
 	id := Id{val: 2822340188419286878}
-	exp := "Jyr3cq4KZ14="
+	exp := "8mfrRes9Ops="
 	assert.Equal(t, exp, id.String())
 }
 func TestIdClone(t *testing.T) {
@@ -20,7 +23,7 @@ func TestIdClone(t *testing.T) {
 
 func TestIdMarshal(t *testing.T) {
 	id := Id{val: 2822340188419286878}
-	exp := "Jyr3cq4KZ14="
+	exp := "8mfrRes9Ops="
 	act, err := id.MarshalText()
 	assert.NoError(t, err)
 	assert.Equal(t, exp, string(act))
@@ -93,3 +96,23 @@ func TestIdCmp(t *testing.T) {
 	fn(id1, id1, 0)
 	fn(id2, id2, 0)
 }
+
+func TestIdStringSorted(t *testing.T) {
+	// strings sort in the same order as the ids, including across bytes that
+	// are encoded differently by the standard base64 alphabets
+	vals := []uint64{0, 1, 61, 62, 63, 64, 0xff, 0xfc00, 1 << 40, 1<<63 - 1, 1 << 63, math.MaxUint64}
+	for i := 0; i < 500; i++ {
+		vals = append(vals, rand.Uint64())
+	}
+	ids := make([]*Id, len(vals))
+	strs := make([]string, len(vals))
+	for i, v := range vals {
+		ids[i] = &Id{val: v}
+		strs[i] = ids[i].String()
+	}
+	slices.SortFunc(ids, (*Id).Cmp)
+	slices.Sort(strs)
+	for i := range ids {
+		assert.Equal(t, ids[i].String(), strs[i])
+	}
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Interface for objects that generate the raw uint64 values backing an Id.
+// Implementations must be safe for concurrent use.
+type IdGenerator interface {
+	// Returns the next id value
+	Next() uint64
+
+	// Name of this generator
+	Name() string
+}
+
+// Generator used by NewId; defaults to random ids
+var idGen IdGenerator = NewRandomIdGen()
+var idGenMu sync.RWMutex
+
+// Sets the generator used by NewId. This should be called once at startup
+// before any points are created.
+func SetIdGenerator(g IdGenerator) {
+	idGenMu.Lock()
+	defer idGenMu.Unlock()
+	idGen = g
+}
+
+// Returns the generator currently used by NewId
+func GetIdGenerator() IdGenerator {
+	idGenMu.RLock()
+	defer idGenMu.RUnlock()
+	return idGen
+}
+
+// Creates the IdGenerator with the given name. Valid names are "random" and
+// "snowflake"; node is only used by the snowflake generator.
+func NewIdGenerator(name string, node uint16) (IdGenerator, error) {
+	switch name {
+	case "random":
+		return NewRandomIdGen(), nil
+	case "snowflake":
+		return NewSnowflakeIdGen(node)
+	default:
+		return nil, fmt.Errorf("unrecognized id generator '%s'", name)
+	}
+}
+
+/****************************************************************************
+	RandomIdGen
+****************************************************************************/
+
+// Generates uniformly random ids. These don't sort in any meaningful order.
+type RandomIdGen struct{}
+
+func NewRandomIdGen() *RandomIdGen {
+	return &RandomIdGen{}
+}
+
+func (g *RandomIdGen) Next() uint64 {
+	return rand.Uint64()
+}
+
+func (g *RandomIdGen) Name() string {
+	return "random"
+}
+
+/****************************************************************************
+	SnowflakeIdGen
+****************************************************************************/
+
+/*
+Snowflake id layout (most significant bit first):
+sign: 1 bit, always 0
+timestamp: 41 bits, milliseconds since SnowflakeEpoch (~69 years of range)
+node: 10 bits, so up to 1024 servers can generate ids without collisions
+sequence: 12 bits, so up to 4096 ids per millisecond per node
+*/
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeTsBits   = 41
+
+	SnowflakeMaxNode = (1 << snowflakeNodeBits) - 1
+	snowflakeMaxSeq  = (1 << snowflakeSeqBits) - 1
+	snowflakeMaxTs   = (1 << snowflakeTsBits) - 1
+)
+
+// Epoch used for the timestamp portion of snowflake ids
+var SnowflakeEpoch = time.Date(2024, 01, 01, 0, 0, 0, 0, time.UTC)
+
+// Generates time-ordered ids made up of timestamp, node id and a sequence
+// number. Ids from the same node are strictly increasing, and ids across
+// nodes sort by the millisecond in which they were generated.
+type SnowflakeIdGen struct {
+	mu   sync.Mutex
+	node uint64
+	last int64  // last timestamp (ms since epoch) we generated an id for
+	seq  uint64 // sequence within the last timestamp
+	now  func() time.Time
+}
+
+// Creates a new snowflake generator for the given node id, which must be
+// unique across all servers generating ids.
+func NewSnowflakeIdGen(node uint16) (*SnowflakeIdGen, error) {
+	if node > SnowflakeMaxNode {
+		return nil, fmt.Errorf("node id %d exceeds max of %d", node, SnowflakeMaxNode)
+	}
+	g := SnowflakeIdGen{node: uint64(node), last: -1, now: time.Now}
+	return &g, nil
+}
+
+func (g *SnowflakeIdGen) Next() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ts := g.now().Sub(SnowflakeEpoch).Milliseconds()
+	if ts < g.last {
+		// clock went backwards; keep using the last timestamp so that ids
+		// stay monotonic
+		ts = g.last
+	}
+
+	if ts == g.last {
+		g.seq = (g.seq + 1) & snowflakeMaxSeq
+		if g.seq == 0 {
+			// sequence exhausted for this millisecond so we borrow the next
+			// one; the clock will catch up
+			ts++
+		}
+	} else {
+		g.seq = 0
+	}
+	g.last = ts
+
+	return (uint64(ts)&snowflakeMaxTs)<<(snowflakeNodeBits+snowflakeSeqBits) |
+		g.node<<snowflakeSeqBits |
+		g.seq
+}
+
+func (g *SnowflakeIdGen) Name() string {
+	return "snowflake"
+}
+
+// Returns the time encoded in a snowflake id value, truncated to milliseconds
+func SnowflakeTime(v uint64) time.Time {
+	ms := int64(v >> (snowflakeNodeBits + snowflakeSeqBits))
+	return SnowflakeEpoch.Add(time.Duration(ms) * time.Millisecond)
+}
+
+// Returns the node encoded in a snowflake id value
+func SnowflakeNode(v uint64) uint16 {
+	return uint16((v >> snowflakeSeqBits) & SnowflakeMaxNode)
+}
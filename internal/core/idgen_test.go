@@ -0,0 +1,110 @@
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdGenFactory(t *testing.T) {
+	g, err := NewIdGenerator("random", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "random", g.Name())
+
+	g, err = NewIdGenerator("snowflake", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "snowflake", g.Name())
+
+	_, err = NewIdGenerator("snowflake", SnowflakeMaxNode+1)
+	assert.Error(t, err)
+	assert.Equal(t, "node id 1024 exceeds max of 1023", err.Error())
+
+	_, err = NewIdGenerator("foo", 0)
+	assert.Error(t, err)
+	assert.Equal(t, "unrecognized id generator 'foo'", err.Error())
+}
+
+func TestIdGenSnowflakeLayout(t *testing.T) {
+	g, err := NewSnowflakeIdGen(37)
+	assert.NoError(t, err)
+	ts := time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC)
+	g.now = func() time.Time { return ts }
+
+	v1 := g.Next()
+	v2 := g.Next()
+	assert.Equal(t, ts, SnowflakeTime(v1))
+	assert.Equal(t, uint16(37), SnowflakeNode(v1))
+	assert.Equal(t, v1+1, v2) // same ms => sequence increments
+
+	// clock goes backwards; ids should still increase
+	g.now = func() time.Time { return ts.Add(-time.Second) }
+	v3 := g.Next()
+	assert.Greater(t, v3, v2)
+
+	// clock moves forward; sequence resets
+	g.now = func() time.Time { return ts.Add(time.Second) }
+	v4 := g.Next()
+	assert.Equal(t, ts.Add(time.Second), SnowflakeTime(v4))
+	assert.Equal(t, uint64(0), v4&snowflakeMaxSeq)
+}
+
+func TestIdGenSnowflakeSeqOverflow(t *testing.T) {
+	g, _ := NewSnowflakeIdGen(1)
+	ts := time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC)
+	g.now = func() time.Time { return ts }
+
+	var last uint64
+	for i := 0; i < 3*(snowflakeMaxSeq+1); i++ {
+		v := g.Next()
+		if i > 0 {
+			assert.Greater(t, v, last)
+		}
+		last = v
+	}
+	assert.Equal(t, ts.Add(2*time.Millisecond), SnowflakeTime(last))
+}
+
+func TestIdGenSnowflakeNodes(t *testing.T) {
+	// ids from different nodes generated concurrently must not collide
+	seen := make(map[uint64]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for n := uint16(0); n < 4; n++ {
+		g, _ := NewSnowflakeIdGen(n)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				v := g.Next()
+				mu.Lock()
+				assert.False(t, seen[v])
+				seen[v] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 4000, len(seen))
+}
+
+func TestIdGenNewIdSorted(t *testing.T) {
+	g, _ := NewSnowflakeIdGen(3)
+	old := GetIdGenerator()
+	SetIdGenerator(g)
+	defer SetIdGenerator(old)
+
+	prev := NewId()
+	for i := 0; i < 500; i++ {
+		id := NewId()
+		assert.Equal(t, 1, id.Cmp(prev))
+		assert.Greater(t, id.String(), prev.String())
+
+		// string encoding roundtrips
+		id2, err := IdFromString(id.String())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, id.Cmp(id2))
+		prev = id
+	}
+}
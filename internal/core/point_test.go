@@ -73,7 +73,7 @@ func TestPointJSON(t *testing.T) {
 	p.Id.val = 485782                                             // need consistent ID
 	b, err := json.Marshal(p)
 	assert.NoError(t, err)
-	exp := `{"Ts":"2024-01-10T23:01:02.123456789Z","Vals":{"area":43.1,"temp":21.1},"Attrs":{"color":"red","shape":"square"},"Id":"AAAAAAAHaZY="}`
+	exp := `{"Ts":"2024-01-10T23:01:02.123456789Z","Vals":{"area":43.1,"temp":21.1},"Attrs":{"color":"red","shape":"square"},"Id":"-------6PON="}`
 	assert.Equal(t, exp, string(b))
 
 	// now try unmarshaling
@@ -0,0 +1,87 @@
+package ctl
+
+import (
+	"equinox/internal/authz"
+	"equinox/internal/config"
+	"equinox/internal/mw"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Returns the effective server configuration with secrets redacted
+func AdminConfig(c *gin.Context) {
+	if !authorizeAdmin(c) {
+		return
+	}
+	c.JSON(http.StatusOK, mw.Success(gin.H{"config": config.Get().Redacted()}))
+}
+
+// Lists all authorization grants
+func AdminGrantList(c *gin.Context) {
+	if !authorizeAdmin(c) {
+		return
+	}
+	c.JSON(http.StatusOK, mw.Success(gin.H{"grants": authz.GetPolicy().List()}))
+}
+
+// Adds the authz.Grant in the request body, replacing the scopes of any
+// existing grant for the same principal and pattern
+func AdminGrantAdd(c *gin.Context) {
+	if !authorizeAdmin(c) {
+		return
+	}
+
+	g := authz.Grant{}
+	err := c.BindJSON(&g)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	err = authz.GetPolicy().Add(g)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusCreated, mw.Success(gin.H{"grant": g}))
+}
+
+// Removes the grant given by the "principal" and "pattern" query parameters
+func AdminGrantRemove(c *gin.Context) {
+	if !authorizeAdmin(c) {
+		return
+	}
+
+	err := authz.GetPolicy().Remove(c.Query("principal"), c.Query("pattern"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, mw.Error(err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, mw.Success(nil))
+}
+
+// Creates the series given by the "id" path parameter with the configured
+// engine
+func AdminSeriesCreate(c *gin.Context) {
+	if !authorizeAdmin(c) {
+		return
+	}
+
+	sid := c.Param("id")
+	sm := mw.GetSeriesMgr()
+	if sm.Has(sid) {
+		c.JSON(http.StatusConflict, mw.Error(fmt.Sprintf("series '%s' already exists", sid)))
+		return
+	}
+	s, err := sm.Create(sid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusCreated, mw.Success(gin.H{"series": gin.H{"id": s.Id, "engine": s.IO.Name()}}))
+}
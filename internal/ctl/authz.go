@@ -0,0 +1,44 @@
+package ctl
+
+import (
+	"equinox/internal/authz"
+	"equinox/internal/middleware"
+	"equinox/internal/mw"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Returns an error if the caller doesn't have scope s on series sid.
+// Everything is allowed when authentication is disabled, since there's no
+// principal to check.
+func checkSeriesScope(c *gin.Context, sid string, s authz.Scope) error {
+	p := middleware.GetPrincipal(c)
+	if p == nil || authz.GetPolicy().Allowed(p.Name, sid, s) {
+		return nil
+	}
+	return fmt.Errorf("principal '%s' does not have %s access to series '%s'", p.Name, s, sid)
+}
+
+// Checks that the caller has scope s on series sid, responding with 403 if
+// not. Returns true if the request may proceed.
+func authorizeSeries(c *gin.Context, sid string, s authz.Scope) bool {
+	err := checkSeriesScope(c, sid, s)
+	if err != nil {
+		c.JSON(http.StatusForbidden, mw.Error(err.Error()))
+		return false
+	}
+	return true
+}
+
+// Checks that the caller is an administrator, responding with 403 if not.
+// Returns true if the request may proceed.
+func authorizeAdmin(c *gin.Context) bool {
+	p := middleware.GetPrincipal(c)
+	if p == nil || authz.GetPolicy().IsAdmin(p.Name) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, mw.Error(fmt.Sprintf("principal '%s' is not an administrator", p.Name)))
+	return false
+}
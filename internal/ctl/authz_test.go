@@ -0,0 +1,194 @@
+package ctl_test
+
+import (
+	"encoding/json"
+	"equinox/internal/authz"
+	"equinox/internal/config"
+	"equinox/internal/mw"
+	"equinox/internal/routers"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Enables auth with API keys for principals "a", "b" and "root", where "a"
+// can write to a.* and read shared, "b" can read b.* and "root" is an admin.
+// Returns a function that restores the previous state.
+func setupAuthz(t *testing.T) func() {
+	cfg := config.Default()
+	cfg.Auth.Enabled = true
+	cfg.Auth.APIKeys = []string{"a:key-a", "b:key-b", "root:key-root"}
+	config.Set(cfg)
+
+	err := authz.GetPolicy().Reset([]authz.Grant{
+		{Principal: "a", Pattern: "a.*", Scopes: []authz.Scope{authz.ScopeWrite}},
+		{Principal: "a", Pattern: "shared", Scopes: []authz.Scope{authz.ScopeRead}},
+		{Principal: "b", Pattern: "b.*", Scopes: []authz.Scope{authz.ScopeRead}},
+		{Principal: "root", Pattern: "*", Scopes: []authz.Scope{authz.ScopeAdmin}},
+	})
+	assert.NoError(t, err)
+
+	return func() {
+		config.Set(nil)
+		authz.GetPolicy().Reset(nil)
+	}
+}
+
+func authzRequest(t *testing.T, method string, path string, key string, body string) (int, string) {
+	router := routers.SetupRouter()
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestAuthzSeries(t *testing.T) {
+	defer setupAuthz(t)()
+	for _, sid := range []string{"a.cpu", "b.cpu", "shared"} {
+		setupDataSeries(sid)
+		defer teardownDataSeries(sid)
+	}
+
+	pt := `{"ts":"2024-01-10T23:01:02Z","vals":{"v":1}}`
+	code, _ := authzRequest(t, "POST", "/series/a.cpu/points", "key-a", pt)
+	assert.Equal(t, http.StatusCreated, code)
+	code, body := authzRequest(t, "POST", "/series/b.cpu/points", "key-a", pt)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, `{"status":"error","message":"principal 'a' does not have write access to series 'b.cpu'"}`, body)
+	code, _ = authzRequest(t, "POST", "/series/shared/points", "key-a", pt)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// checked before the series is looked up, so existence isn't revealed
+	code, _ = authzRequest(t, "POST", "/series/b.nope/points", "key-a", pt)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// write doesn't imply read
+	code, _ = authzRequest(t, "POST", "/series/a.cpu/query", "key-a", `{}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = authzRequest(t, "POST", "/series/shared/query", "key-a", `{}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = authzRequest(t, "POST", "/series/b.cpu/query", "key-b", `{}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = authzRequest(t, "POST", "/series/b.cpu/import", "key-b", ``)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// admins can do anything
+	code, _ = authzRequest(t, "POST", "/series/b.cpu/points", "key-root", pt)
+	assert.Equal(t, http.StatusCreated, code)
+}
+
+func TestAuthzMultiQuery(t *testing.T) {
+	defer setupAuthz(t)()
+	for _, sid := range []string{"a.cpu", "b.cpu", "b.mem", "shared"} {
+		setupQueryData(sid)
+		defer teardownDataSeries(sid)
+	}
+
+	series := func(key string, body string) []string {
+		code, resp := authzRequest(t, "POST", "/query", key, body)
+		assert.Equal(t, http.StatusOK, code)
+		var js mw.JSend
+		assert.NoError(t, json.Unmarshal([]byte(resp), &js))
+		res := make(map[string][]struct{ Series string })
+		assert.NoError(t, json.Unmarshal(js.Data, &res))
+		var r []string
+		for _, sp := range res["points"] {
+			if !slices.Contains(r, sp.Series) {
+				r = append(r, sp.Series)
+			}
+		}
+		return r
+	}
+
+	// globs only match series that can be read
+	body := `{"series":["*"],"start":"2024-01-10T23:00:00Z","end":"2024-01-10T23:30:00Z"}`
+	assert.Equal(t, []string{"b.cpu", "b.mem"}, series("key-b", body))
+	assert.Equal(t, []string{"shared"}, series("key-a", body))
+
+	code, resp := authzRequest(t, "POST", "/query", "key-a", `{"series":["shared","b.cpu"]}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, `{"status":"error","message":"principal 'a' does not have read access to series 'b.cpu'"}`, resp)
+}
+
+func TestAuthzIngest(t *testing.T) {
+	defer setupAuthz(t)()
+	setupDataSeries("a.cpu")
+	defer teardownDataSeries("a.cpu")
+	setupDataSeries("b.cpu")
+	defer teardownDataSeries("b.cpu")
+
+	// each series is checked separately
+	code, body := authzRequest(t, "POST", "/write", "key-a", "a.cpu v=1 1\nb.cpu v=1 1")
+	assert.Equal(t, http.StatusBadRequest, code)
+	var js mw.JSend
+	assert.NoError(t, json.Unmarshal([]byte(body), &js))
+	assert.Equal(t, `{"accepted":1,"line_errors":[],"series_errors":["1 points rejected: principal 'a' does not have write access to series 'b.cpu'"]}`,
+		string(js.Data))
+
+	// writes that are refused don't use up the series' quota
+	limits := config.Default().Limits
+	limits.SeriesOverrides = map[string]config.Rate{"b.cpu": {Points: 1}}
+	defer setupLimits(limits)()
+	for i := 0; i < 3; i++ {
+		code, _ = authzRequest(t, "POST", "/write", "key-a", "b.cpu v=1 1\nb.cpu v=2 2")
+		assert.Equal(t, http.StatusBadRequest, code)
+	}
+	code, _ = authzRequest(t, "POST", "/write", "key-root", "b.cpu v=1 1")
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, body = authzRequest(t, "GET", "/api/v1/query_range?query=cpu&series=b.cpu&start=0&end=1&step=1", "key-a", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, `{"status":"error","errorType":"forbidden","error":"principal 'a' does not have read access to series 'b.cpu'"}`, body)
+	code, _ = authzRequest(t, "GET", "/api/v1/query_range?query=cpu&series=b.cpu&start=0&end=1&step=1", "key-b", "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestAuthzAdmin(t *testing.T) {
+	defer setupAuthz(t)()
+
+	code, body := authzRequest(t, "GET", "/admin/grants", "key-a", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, `{"status":"error","message":"principal 'a' is not an administrator"}`, body)
+	code, _ = authzRequest(t, "GET", "/admin/config", "key-a", "")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, body = authzRequest(t, "GET", "/admin/grants", "key-root", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `{"principal":"b","pattern":"b.*","scopes":["read"]}`)
+
+	// give b write access
+	code, body = authzRequest(t, "POST", "/admin/grants", "key-root",
+		`{"principal":"b","pattern":"b.*","scopes":["read","write"]}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, `{"status":"success","data":{"grant":{"principal":"b","pattern":"b.*","scopes":["read","write"]}}}`, body)
+	assert.True(t, authz.GetPolicy().Allowed("b", "b.cpu", authz.ScopeWrite))
+
+	code, body = authzRequest(t, "POST", "/admin/grants", "key-root", `{"principal":"b","pattern":"b.*","scopes":["all"]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `{"status":"error","message":"invalid scope 'all'"}`, body)
+
+	// and take it all away
+	code, _ = authzRequest(t, "DELETE", "/admin/grants?principal=b&pattern=b.*", "key-root", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, authz.GetPolicy().Allowed("b", "b.cpu", authz.ScopeRead))
+	code, body = authzRequest(t, "DELETE", "/admin/grants?principal=b&pattern=b.*", "key-root", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, `{"status":"error","message":"no grant for principal 'b' on pattern 'b.*'"}`, body)
+
+	code, _ = authzRequest(t, "POST", "/admin/series/b.new", "key-a", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, body = authzRequest(t, "POST", "/admin/series/b.new", "key-root", "")
+	defer teardownDataSeries("b.new")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, `{"status":"success","data":{"series":{"engine":"MemTree","id":"b.new"}}}`, body)
+	assert.True(t, mw.GetSeriesMgr().Has("b.new"))
+	code, body = authzRequest(t, "POST", "/admin/series/b.new", "key-root", "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, `{"status":"error","message":"series 'b.new' already exists"}`, body)
+}
@@ -0,0 +1,81 @@
+package ctl
+
+import (
+	"encoding/json"
+	"equinox/internal/authz"
+	"equinox/internal/ingest"
+	"equinox/internal/mw"
+	"equinox/internal/ratelimit"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Number of points added to the series at a time during an import
+const importBatch = 1000
+
+// Imports points into a series from an uploaded CSV file. The request is a
+// multipart form with the CSV in the "file" field and an ingest.CSVMapping as
+// JSON in the "mapping" field. Valid rows are imported even if others are
+// rejected; in that case the response is a JSend fail with the summary.
+func PointImport(c *gin.Context) {
+	// get the data series
+	sid := c.Param("id")
+	if !authorizeSeries(c, sid, authz.ScopeWrite) {
+		return
+	}
+	s, err := mw.GetSeriesMgr().Get(sid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	// rows aren't counted until they're parsed, so only byte limits apply
+	// here and points are admitted a batch at a time as they're added
+	size, ok := requestBytes(c)
+	if !ok {
+		return
+	}
+	if !admitWrite(c, size, []ratelimit.SeriesLoad{{Id: sid, Bytes: size}}) {
+		return
+	}
+
+	m := &ingest.CSVMapping{}
+	err = json.Unmarshal([]byte(c.PostForm("mapping")), m)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error("invalid mapping: "+err.Error()))
+		return
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+	defer f.Close()
+
+	aio := &admittedIO{PointIO: seriesIO(s), c: c, sid: sid}
+	sum, err := ingest.ImportCSV(f, m, aio, importBatch)
+	recordIngested(c, sid, sum.Accepted)
+	if aio.Denied != nil {
+		rejectWrite(c, aio.Denied, fmt.Sprintf("%d points were imported", sum.Accepted))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	if sum.Rejected > 0 {
+		c.JSON(http.StatusBadRequest, mw.Fail(sum))
+		return
+	}
+
+	c.JSON(http.StatusCreated, mw.Success(sum))
+}
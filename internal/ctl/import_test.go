@@ -0,0 +1,81 @@
+package ctl_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"equinox/internal/mw"
+	"equinox/internal/routers"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postImport(t *testing.T, path string, csv string, mapping string) (int, *mw.JSend) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if csv != "" {
+		fw, err := w.CreateFormFile("file", "data.csv")
+		assert.NoError(t, err)
+		fw.Write([]byte(csv))
+	}
+	w.WriteField("mapping", mapping)
+	w.Close()
+
+	router := routers.SetupRouter()
+	req, err := http.NewRequest("POST", path, &body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	var js mw.JSend
+	err = json.Unmarshal(rec.Body.Bytes(), &js)
+	assert.NoError(t, err)
+	return rec.Code, &js
+}
+
+func TestPointImport(t *testing.T) {
+	sid := "foobar"
+	setupDataSeries(sid)
+	defer teardownDataSeries(sid)
+	ds, _ := mw.GetSeriesMgr().Get(sid)
+
+	csv := "time,area,color\n2024-01-10T23:01:02Z,43.1,red\n2024-01-10T23:02:02Z,44,blue\n"
+	mapping := `{"ts":"time","vals":{"area":"area"},"attrs":{"color":"color"}}`
+
+	code, js := postImport(t, "/series/foobar/import", csv, mapping)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, js.IsSuccess())
+	assert.Equal(t, `{"accepted":2,"rejected":0,"errors":[]}`, string(js.Data))
+	assert.Equal(t, 2, ds.IO.Len())
+
+	// partially rejected
+	csv = "time,area,color\n2024-01-10T23:03:02Z,45,red\n2024-01-10T23:04:02Z,big,blue\n"
+	code, js = postImport(t, "/series/foobar/import", csv, mapping)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.True(t, js.IsFail())
+	assert.Equal(t, `{"accepted":1,"rejected":1,"errors":[{"line":3,"error":"invalid number 'big' for value 'area'"}]}`, string(js.Data))
+	assert.Equal(t, 3, ds.IO.Len())
+}
+
+func TestPointImportErrors(t *testing.T) {
+	sid := "foobar"
+	setupDataSeries(sid)
+	defer teardownDataSeries(sid)
+
+	csv := "time,area\n2024-01-10T23:01:02Z,43.1\n"
+	fn := func(path string, csv string, mapping string, msg string) {
+		code, js := postImport(t, path, csv, mapping)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.True(t, js.IsError())
+		assert.Equal(t, msg, js.Message)
+	}
+
+	fn("/series/nope/import", csv, `{"ts":"time","vals":{"area":"area"}}`, "series 'nope' does not exist")
+	fn("/series/foobar/import", csv, `{"ts":`, "invalid mapping: unexpected end of JSON input")
+	fn("/series/foobar/import", "", `{"ts":"time","vals":{"area":"area"}}`, "http: no such file")
+	fn("/series/foobar/import", csv, `{"ts":"ts","vals":{"area":"area"}}`, "column 'ts' not found in CSV header")
+}
@@ -0,0 +1,114 @@
+package ctl
+
+import (
+	"equinox/internal/authz"
+	"equinox/internal/core"
+	"equinox/internal/ingest"
+	"equinox/internal/models"
+	"equinox/internal/mw"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ingests points written in InfluxDB line protocol. The measurement of each
+// line is used as the series id and the "precision" query parameter sets the
+// units of the timestamps (default ns). Lines that are valid are saved even if
+// other lines fail; in that case the response is a JSend fail listing the
+// errors for each rejected line.
+func LineProtocolWrite(c *gin.Context) {
+	prec, err := ingest.ParsePrecision(c.Query("precision"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+	size, ok := requestBytes(c)
+	if !ok {
+		return
+	}
+
+	pts, lerrs, err := ingest.ParseLineProtocol(c.Request.Body, prec, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	accepted, serrs, admitted := addSeriesPoints(c, size, pts)
+	if !admitted {
+		return
+	}
+
+	if len(lerrs) > 0 || len(serrs) > 0 {
+		if lerrs == nil {
+			lerrs = []ingest.LineError{} // marshal as [] rather than null
+		}
+		c.JSON(http.StatusBadRequest, mw.Fail(gin.H{
+			"accepted":      accepted,
+			"line_errors":   lerrs,
+			"series_errors": serrs,
+		}))
+		return
+	}
+
+	c.JSON(http.StatusCreated, mw.Success(gin.H{"accepted": accepted}))
+}
+
+/*
+Generates ids for the given points and adds them to their series, grouping
+them so each series gets a single Add. Returns the number of points added and
+an error message for each series that rejected its points, including those
+the caller isn't allowed to write to.
+
+The write of size bytes is first admitted against the rate limits of the
+series that can be written to; if it's rejected then nothing is added, a 429
+response has been sent and the last return value is false.
+*/
+func addSeriesPoints(c *gin.Context, size int, pts []ingest.SeriesPoint) (int, []string, bool) {
+	bySeries := make(map[string][]*core.Point)
+	var order []string
+	for _, sp := range pts {
+		if _, exists := bySeries[sp.Series]; !exists {
+			order = append(order, sp.Series)
+		}
+		sp.Point.GenerateId()
+		bySeries[sp.Series] = append(bySeries[sp.Series], sp.Point)
+	}
+
+	// series that are rejected here aren't charged against the limits
+	serrs := []string{}
+	var writable []string
+	found := make(map[string]*models.Series, len(order))
+	counts := make(map[string]int, len(order))
+	for _, sid := range order {
+		ps := bySeries[sid]
+		err := checkSeriesScope(c, sid, authz.ScopeWrite)
+		if err == nil {
+			found[sid], err = mw.GetSeriesMgr().Get(sid)
+		}
+		if err != nil {
+			serrs = append(serrs, fmt.Sprintf("%d points rejected: %s", len(ps), err.Error()))
+			continue
+		}
+		writable = append(writable, sid)
+		counts[sid] = len(ps)
+	}
+	if !admitWrite(c, size, seriesLoads(size, writable, counts)) {
+		return 0, nil, false
+	}
+
+	accepted := 0
+	for _, sid := range writable {
+		ps := bySeries[sid]
+		err := seriesIO(found[sid]).Add(ps...)
+		if err != nil {
+			serrs = append(serrs, fmt.Sprintf("%d points rejected: %s", len(ps), err.Error()))
+			continue
+		}
+		accepted += len(ps)
+		recordIngested(c, sid, len(ps))
+	}
+
+	return accepted, serrs, true
+}
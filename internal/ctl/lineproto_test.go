@@ -0,0 +1,76 @@
+package ctl_test
+
+import (
+	"encoding/json"
+	"equinox/internal/mw"
+	"equinox/internal/routers"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postLineProtocol(t *testing.T, path string, body string) (int, *mw.JSend) {
+	router := routers.SetupRouter()
+	req, err := http.NewRequest("POST", path, strings.NewReader(body))
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	var js mw.JSend
+	err = json.Unmarshal(rec.Body.Bytes(), &js)
+	assert.NoError(t, err)
+	return rec.Code, &js
+}
+
+func TestLineProtocolWrite(t *testing.T) {
+	setupDataSeries("cpu")
+	defer teardownDataSeries("cpu")
+	setupDataSeries("mem")
+	defer teardownDataSeries("mem")
+	cpu, _ := mw.GetSeriesMgr().Get("cpu")
+	mem, _ := mw.GetSeriesMgr().Get("mem")
+
+	body := `cpu,host=a usage=1 1704927662
+cpu,host=b usage=2 1704927663
+mem,host=a free=10i 1704927662`
+
+	code, js := postLineProtocol(t, "/write?precision=s", body)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, js.IsSuccess())
+	assert.Equal(t, `{"accepted":3}`, string(js.Data))
+	assert.Equal(t, 2, cpu.IO.Len())
+	assert.Equal(t, 1, mem.IO.Len())
+
+	// v2 path works the same
+	code, js = postLineProtocol(t, "/api/v2/write?precision=s", "cpu,host=c usage=3 1704927664")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, js.IsSuccess())
+	assert.Equal(t, 3, cpu.IO.Len())
+}
+
+func TestLineProtocolWriteErrors(t *testing.T) {
+	setupDataSeries("cpu")
+	defer teardownDataSeries("cpu")
+	cpu, _ := mw.GetSeriesMgr().Get("cpu")
+
+	// valid lines are saved, invalid ones reported
+	body := `cpu,host=a usage=1 1704927662
+cpu,host=b usage=x 1704927663
+disk,host=a used=1 1704927662`
+
+	code, js := postLineProtocol(t, "/write?precision=s", body)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.True(t, js.IsFail())
+	assert.Equal(t, `{"accepted":1,"line_errors":[{"line":2,"error":"invalid value for field 'usage': invalid float 'x'"}],"series_errors":["1 points rejected: series 'disk' does not exist"]}`, string(js.Data))
+	assert.Equal(t, 1, cpu.IO.Len())
+
+	// bad precision
+	code, js = postLineProtocol(t, "/write?precision=h", body)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.True(t, js.IsError())
+	assert.Equal(t, "invalid precision 'h'", js.Message)
+	assert.Equal(t, 1, cpu.IO.Len())
+}
@@ -0,0 +1,30 @@
+package ctl
+
+import (
+	"equinox/internal/metrics"
+	"equinox/internal/middleware"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var pointsIngested = metrics.MustRegister(metrics.NewCounterVec(
+	"equinox_points_ingested_total", "Number of points added to each series.",
+	"series"))
+
+// Records n points added to a series, in the metrics and the request log
+func recordIngested(c *gin.Context, sid string, n int) {
+	pointsIngested.With(sid).Add(float64(n))
+	middleware.LogSeries(c, sid)
+	middleware.LogPoints(c, n)
+}
+
+// Serves all metrics in the Prometheus text exposition format
+func Metrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	err := metrics.Default().WriteText(c.Writer)
+	if err != nil {
+		c.Error(err)
+	}
+}
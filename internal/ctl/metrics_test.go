@@ -0,0 +1,82 @@
+package ctl_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"equinox/internal/routers"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	router := routers.SetupRouter()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	return rec.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	setupDataSeries("metrics.cpu")
+	defer teardownDataSeries("metrics.cpu")
+
+	rec := quotaRequest(t, "/write", "metrics.cpu v=1 1\nmetrics.cpu v=2 2")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = quotaRequest(t, "/series/metrics.cpu/query", `{}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	body := scrapeMetrics(t)
+	assert.Contains(t, body, "\nequinox_points_ingested_total{series=\"metrics.cpu\"} 2\n")
+	assert.Contains(t, body, "\nequinox_series_points{series=\"metrics.cpu\",engine=\"MemTree\"} 2\n")
+	assert.Contains(t, body, "\nequinox_http_requests_total{method=\"POST\",route=\"/write\",code=\"201\"} ")
+	assert.Contains(t, body, "\nequinox_http_request_duration_seconds_count{method=\"POST\",route=\"/series/:id/query\"} ")
+	assert.Contains(t, body, "# TYPE equinox_query_execs_total counter\n")
+	assert.Contains(t, body, "# TYPE equinox_query_duration_seconds histogram\n")
+	assert.Contains(t, body, "# TYPE equinox_vacuum_duration_seconds histogram\n")
+
+	// every line is a comment or a sample
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		assert.True(t, strings.HasPrefix(line, "# ") || strings.HasPrefix(line, "equinox_"), line)
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	setupDataSeries("log.cpu")
+	defer teardownDataSeries("log.cpu")
+	setupDataSeries("log.mem")
+	defer teardownDataSeries("log.mem")
+
+	entry := func() map[string]any {
+		var e map[string]any
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+		buf.Reset()
+		return e
+	}
+
+	rec := quotaRequest(t, "/write", "log.cpu v=1 1\nlog.mem v=2 2\nlog.cpu v=3 3")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	e := entry()
+	assert.Equal(t, "/write", e["route"])
+	assert.Equal(t, []any{"log.cpu", "log.mem"}, e["series"])
+	assert.Equal(t, 3.0, e["points"])
+
+	rec = quotaRequest(t, "/series/log.cpu/query", `{"start":"1970-01-01T00:00:00Z","end":"1970-01-01T00:00:01Z"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	e = entry()
+	assert.Equal(t, "/series/:id/query", e["route"])
+	assert.Equal(t, []any{"log.cpu"}, e["series"])
+	assert.Equal(t, 2.0, e["points"])
+	assert.Equal(t, rec.Header().Get("X-Request-Id"), e["request_id"])
+}
@@ -1,7 +1,9 @@
 package ctl
 
 import (
+	"equinox/internal/authz"
 	"equinox/internal/core"
+	"equinox/internal/ratelimit"
 	"net/http"
 	"time"
 
@@ -13,12 +15,20 @@ import (
 func PointAdd(c *gin.Context) {
 	// get the data series
 	sid := c.Param("id")
+	if !authorizeSeries(c, sid, authz.ScopeWrite) {
+		return
+	}
 	s, err := mw.GetSeriesMgr().Get(sid)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
 		return
 	}
 
+	size, ok := requestBytes(c)
+	if !ok {
+		return
+	}
+
 	// read the JSON into a point
 	p := core.NewPointEmpty()
 	err = c.BindJSON(p)
@@ -41,12 +51,17 @@ func PointAdd(c *gin.Context) {
 	if p.Ts == empty_ts {
 		p.Ts = time.Now().UTC()
 	}
+	if !admitWrite(c, size, []ratelimit.SeriesLoad{{Id: sid, Points: 1, Bytes: size}}) {
+		return
+	}
+
 	// save the point
-	err = s.IO.Add(p)
+	err = seriesIO(s).Add(p)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
 		return
 	}
+	recordIngested(c, sid, 1)
 
 	c.JSON(http.StatusCreated, mw.Success(gin.H{"point": p}))
 }
@@ -0,0 +1,154 @@
+package ctl
+
+import (
+	"equinox/internal/authz"
+	"equinox/internal/middleware"
+	"equinox/internal/mw"
+	"equinox/internal/promql"
+	"equinox/internal/query"
+	"equinox/internal/ratelimit"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prometheus-compatible range query supporting a single instant vector
+// selector, e.g. up{job="api",instance=~"a|b"}. Responds in the Prometheus
+// JSON matrix format so that Grafana's Prometheus datasource can read from
+// equinox. As with remote write, the metric name is the series id unless the
+// "series" parameter is given. Parameters may be passed in the URL or as a
+// form body.
+func PromQueryRange(c *gin.Context) {
+	param := func(k string) string {
+		if v, exists := c.GetPostForm(k); exists {
+			return v
+		}
+		return c.Query(k)
+	}
+	badData := func(err error) {
+		c.JSON(http.StatusBadRequest, promql.ErrorResponse("bad_data", err.Error()))
+	}
+
+	ms, err := promql.ParseSelector(param("query"))
+	if err != nil {
+		badData(err)
+		return
+	}
+	name, err := promql.MetricName(ms)
+	if err != nil {
+		badData(err)
+		return
+	}
+	fa, err := promql.MatchersToFilterAttr(ms)
+	if err != nil {
+		badData(err)
+		return
+	}
+
+	start, err := promql.ParseTime(param("start"))
+	if err != nil {
+		badData(err)
+		return
+	}
+	end, err := promql.ParseTime(param("end"))
+	if err != nil {
+		badData(err)
+		return
+	}
+	step, err := promql.ParseDuration(param("step"))
+	if err != nil {
+		badData(err)
+		return
+	}
+	lookback := promql.DefaultLookback
+	if v := param("lookback_delta"); v != "" {
+		lookback, err = promql.ParseDuration(v)
+		if err != nil {
+			badData(err)
+			return
+		}
+	}
+
+	// like Prometheus, an unknown metric is just an empty result
+	sid, key := promql.Target(name, param("series"))
+	err = checkSeriesScope(c, sid, authz.ScopeRead)
+	if err != nil {
+		c.JSON(http.StatusForbidden, promql.ErrorResponse("forbidden", err.Error()))
+		return
+	}
+	s, err := mw.GetSeriesMgr().Get(sid)
+	if err != nil {
+		c.JSON(http.StatusOK, promql.MatrixResponse(nil))
+		return
+	}
+
+	ss, err := promql.EvalRange(readIO(c, s), name, key, fa, start, end, step, lookback)
+	if err != nil {
+		badData(err)
+		return
+	}
+	logSamples(c, sid, ss)
+
+	c.JSON(http.StatusOK, promql.MatrixResponse(ss))
+}
+
+// Serves Prometheus remote read requests, returning the raw samples matching
+// each query. Only the samples response type is supported. Request bodies are
+// limited in the same way as remote write.
+func PromRemoteRead(c *gin.Context) {
+	body, ok := readBody(c)
+	if !ok {
+		return
+	}
+
+	rqs, err := promql.DecodeReadRequest(body, ratelimit.GetQuotas().MaxDecodedBytes())
+	if err != nil {
+		decodeFailed(c, err)
+		return
+	}
+
+	results := make([][]*promql.Series, 0, len(rqs))
+	for _, rq := range rqs {
+		name, err := promql.MetricName(rq.Matchers)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+			return
+		}
+		fa, err := promql.MatchersToFilterAttr(rq.Matchers)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+			return
+		}
+
+		sid, key := promql.Target(name, c.Query("series"))
+		if !authorizeSeries(c, sid, authz.ScopeRead) {
+			return
+		}
+		s, err := mw.GetSeriesMgr().Get(sid)
+		if err != nil {
+			results = append(results, nil)
+			continue
+		}
+
+		ss, err := promql.Select(readIO(c, s), name, key, query.NewQuery(rq.Start, rq.End, fa))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, mw.Error(err.Error()))
+			return
+		}
+		logSamples(c, sid, ss)
+		results = append(results, ss)
+	}
+
+	c.Header("Content-Encoding", "snappy")
+	c.Data(http.StatusOK, "application/x-protobuf", promql.EncodeReadResponse(results))
+}
+
+// Records the series read and number of samples returned in the request log
+func logSamples(c *gin.Context, sid string, ss []*promql.Series) {
+	n := 0
+	for _, s := range ss {
+		n += len(s.Samples)
+	}
+	middleware.LogSeries(c, sid)
+	middleware.LogPoints(c, n)
+}
@@ -0,0 +1,155 @@
+package ctl_test
+
+import (
+	"bytes"
+	"equinox/internal/config"
+	"equinox/internal/ingest"
+	"equinox/internal/promql"
+	"equinox/internal/routers"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+// writes samples to the "up" series via remote write
+func setupPromData(t *testing.T) {
+	body := ingest.EncodeRemoteWrite([]ingest.PromTimeSeries{
+		{
+			Labels:  map[string]string{"__name__": "up", "job": "api", "instance": "a"},
+			Samples: []ingest.PromSample{{Value: 1, Ts: 1704927600000}, {Value: 0, Ts: 1704927660000}},
+		},
+		{
+			Labels:  map[string]string{"__name__": "up", "job": "web", "instance": "b"},
+			Samples: []ingest.PromSample{{Value: 1, Ts: 1704927600000}},
+		},
+	})
+	rec := postRemoteWrite(t, "/api/v1/write", body)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestPromQueryRange(t *testing.T) {
+	setupDataSeries("up")
+	defer teardownDataSeries("up")
+	setupPromData(t)
+	router := routers.SetupRouter()
+
+	fn := func(req *http.Request, code int, exp string) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, code, rec.Code)
+		assert.Equal(t, exp, rec.Body.String())
+	}
+
+	params := url.Values{}
+	params.Set("query", `up{job=~"api|db"}`)
+	params.Set("start", "1704927600")
+	params.Set("end", "2024-01-10T23:02:00Z")
+	params.Set("step", "30s")
+	exp := `{"status":"success","data":{"result":[{"metric":{"__name__":"up","instance":"a","job":"api"},"values":[[1704927600,"1"],[1704927630,"1"],[1704927660,"0"],[1704927690,"0"],[1704927720,"0"]]}],"resultType":"matrix"}}`
+
+	req, _ := http.NewRequest("GET", "/api/v1/query_range?"+params.Encode(), nil)
+	fn(req, http.StatusOK, exp)
+
+	// same query as a form post
+	req, _ = http.NewRequest("POST", "/api/v1/query_range", strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	fn(req, http.StatusOK, exp)
+
+	// unknown metric is empty
+	params.Set("query", `down`)
+	req, _ = http.NewRequest("GET", "/api/v1/query_range?"+params.Encode(), nil)
+	fn(req, http.StatusOK, `{"status":"success","data":{"result":[],"resultType":"matrix"}}`)
+
+	// errors
+	params.Set("query", `up{job=~"("}`)
+	req, _ = http.NewRequest("GET", "/api/v1/query_range?"+params.Encode(), nil)
+	fn(req, http.StatusBadRequest, `{"status":"error","errorType":"bad_data","error":"invalid regex in matcher job=~\"(\": error parsing regexp: missing closing ): `+"`^(?:()$`"+`"}`)
+
+	params.Set("query", `up`)
+	params.Set("step", "-1")
+	req, _ = http.NewRequest("GET", "/api/v1/query_range?"+params.Encode(), nil)
+	fn(req, http.StatusBadRequest, `{"status":"error","errorType":"bad_data","error":"step must be positive"}`)
+}
+
+func TestPromRemoteRead(t *testing.T) {
+	setupDataSeries("up")
+	defer teardownDataSeries("up")
+	setupPromData(t)
+	router := routers.SetupRouter()
+
+	start := time.UnixMilli(1704927600000)
+	body := promql.EncodeReadRequest([]*promql.ReadQuery{
+		{
+			Start:    start,
+			End:      start.Add(time.Hour),
+			Matchers: []*promql.Matcher{promql.NewMatcher(promql.MatchEqual, "__name__", "up")},
+		},
+		{
+			Start: start,
+			End:   start.Add(time.Hour),
+			Matchers: []*promql.Matcher{
+				promql.NewMatcher(promql.MatchEqual, "__name__", "up"),
+				promql.NewMatcher(promql.MatchNotEqual, "job", "api"),
+			},
+		},
+		{
+			Start:    start,
+			End:      start.Add(time.Hour),
+			Matchers: []*promql.Matcher{promql.NewMatcher(promql.MatchEqual, "__name__", "down")},
+		},
+	})
+
+	req, _ := http.NewRequest("POST", "/api/v1/read", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "snappy", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", rec.Header().Get("Content-Type"))
+
+	results, err := promql.DecodeReadResponse(rec.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(results))
+
+	assert.Equal(t, 2, len(results[0]))
+	assert.Equal(t, 2, len(results[0][0].Samples))
+	assert.Equal(t, 1, len(results[0][1].Samples))
+
+	assert.Equal(t, 1, len(results[1]))
+	assert.Equal(t, "web", results[1][0].Labels["job"])
+
+	assert.Equal(t, 0, len(results[2]))
+}
+
+func TestPromRemoteReadLimits(t *testing.T) {
+	router := routers.SetupRouter()
+	body := promql.EncodeReadRequest([]*promql.ReadQuery{{
+		Start:    time.UnixMilli(1704927600000),
+		End:      time.UnixMilli(1704931200000),
+		Matchers: []*promql.Matcher{promql.NewMatcher(promql.MatchEqual, "__name__", "up")},
+	}})
+	decoded, _ := snappy.DecodedLen(body)
+
+	fn := func(limits config.LimitsConfig, msg string) {
+		defer setupLimits(limits)()
+		req, _ := http.NewRequest("POST", "/api/v1/read", bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		assert.Contains(t, rec.Body.String(), msg)
+	}
+
+	limits := config.Default().Limits
+	limits.MaxRequestBytes = len(body) - 1
+	fn(limits, fmt.Sprintf("request body is over %d bytes", len(body)-1))
+
+	limits = config.Default().Limits
+	limits.MaxDecodedBytes = decoded - 1
+	fn(limits, "decompressed size exceeds the limit")
+}
@@ -0,0 +1,49 @@
+package ctl
+
+import (
+	"equinox/internal/ingest"
+	"equinox/internal/mw"
+	"equinox/internal/ratelimit"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Receives samples from Prometheus remote write. By default the metric name
+// of each time series is used as the series id; if the "series" query
+// parameter is given then all samples go to that series and the metric name
+// is used as the value key. Responds with 204 on success as Prometheus
+// expects. Bodies over limits.max_request_bytes, or over
+// limits.max_decoded_bytes once decompressed, get a 413. Errors use 4xx codes
+// so that Prometheus drops the batch instead of retrying it forever.
+func PromRemoteWrite(c *gin.Context) {
+	body, ok := readBody(c)
+	if !ok {
+		return
+	}
+	size := len(body)
+
+	tss, err := ingest.DecodeRemoteWrite(body, ratelimit.GetQuotas().MaxDecodedBytes())
+	if err != nil {
+		decodeFailed(c, err)
+		return
+	}
+
+	pts, err := ingest.PromToPoints(tss, c.Query("series"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	_, serrs, admitted := addSeriesPoints(c, size, pts)
+	if !admitted {
+		return
+	}
+	if len(serrs) > 0 {
+		c.JSON(http.StatusBadRequest, mw.Error(strings.Join(serrs, "; ")))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+package ctl_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"equinox/internal/config"
+	"equinox/internal/ingest"
+	"equinox/internal/mw"
+	"equinox/internal/routers"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func postRemoteWrite(t *testing.T, path string, body []byte) *httptest.ResponseRecorder {
+	router := routers.SetupRouter()
+	req, err := http.NewRequest("POST", path, bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPromRemoteWrite(t *testing.T) {
+	setupDataSeries("up")
+	defer teardownDataSeries("up")
+	up, _ := mw.GetSeriesMgr().Get("up")
+
+	body := ingest.EncodeRemoteWrite([]ingest.PromTimeSeries{
+		{
+			Labels: map[string]string{"__name__": "up", "job": "api", "instance": "a"},
+			Samples: []ingest.PromSample{
+				{Value: 1, Ts: 1704927662000},
+				{Value: 0, Ts: 1704927677000},
+			},
+		},
+		{
+			Labels:  map[string]string{"__name__": "up", "job": "api", "instance": "b"},
+			Samples: []ingest.PromSample{{Value: 1, Ts: 1704927662000}},
+		},
+	})
+
+	rec := postRemoteWrite(t, "/api/v1/write", body)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, 3, up.IO.Len())
+
+	// all metrics into one series
+	setupDataSeries("prom")
+	defer teardownDataSeries("prom")
+	prom, _ := mw.GetSeriesMgr().Get("prom")
+
+	rec = postRemoteWrite(t, "/api/v1/write?series=prom", body)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, 3, prom.IO.Len())
+	assert.Equal(t, 3, up.IO.Len())
+}
+
+func TestPromRemoteWriteErrors(t *testing.T) {
+	fn := func(body []byte, msg string) {
+		rec := postRemoteWrite(t, "/api/v1/write", body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		var js mw.JSend
+		err := json.Unmarshal(rec.Body.Bytes(), &js)
+		assert.NoError(t, err)
+		assert.True(t, js.IsError())
+		assert.Contains(t, js.Message, msg)
+	}
+
+	fn([]byte("garbage"), "failed to decompress remote write request")
+
+	fn(ingest.EncodeRemoteWrite([]ingest.PromTimeSeries{
+		{Labels: map[string]string{"job": "api"}, Samples: []ingest.PromSample{{Value: 1, Ts: 1}}},
+	}), "time series is missing the __name__ label")
+
+	fn(ingest.EncodeRemoteWrite([]ingest.PromTimeSeries{
+		{Labels: map[string]string{"__name__": "nope"}, Samples: []ingest.PromSample{{Value: 1, Ts: 1}}},
+	}), "1 points rejected: series 'nope' does not exist")
+}
+
+func TestPromRemoteWriteLimits(t *testing.T) {
+	setupDataSeries("up")
+	defer teardownDataSeries("up")
+	up, _ := mw.GetSeriesMgr().Get("up")
+
+	body := ingest.EncodeRemoteWrite([]ingest.PromTimeSeries{{
+		Labels:  map[string]string{"__name__": "up", "job": "api"},
+		Samples: []ingest.PromSample{{Value: 1, Ts: 1704927662000}},
+	}})
+	decoded, _ := snappy.DecodedLen(body)
+
+	fn := func(limits config.LimitsConfig, msg string) {
+		defer setupLimits(limits)()
+		rec := postRemoteWrite(t, "/api/v1/write", body)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+		var js mw.JSend
+		err := json.Unmarshal(rec.Body.Bytes(), &js)
+		assert.NoError(t, err)
+		assert.True(t, js.IsError())
+		assert.Contains(t, js.Message, msg)
+	}
+
+	limits := config.Default().Limits
+	limits.MaxRequestBytes = len(body) - 1
+	fn(limits, fmt.Sprintf("request body is over %d bytes", len(body)-1))
+
+	limits = config.Default().Limits
+	limits.MaxDecodedBytes = decoded - 1
+	fn(limits, "decompressed size exceeds the limit")
+	assert.Equal(t, 0, up.IO.Len())
+
+	// exactly at both limits
+	limits.MaxRequestBytes = len(body)
+	limits.MaxDecodedBytes = decoded
+	defer setupLimits(limits)()
+	rec := postRemoteWrite(t, "/api/v1/write", body)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, 1, up.IO.Len())
+}
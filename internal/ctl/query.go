@@ -0,0 +1,258 @@
+package ctl
+
+import (
+	"encoding/json"
+	"equinox/internal/authz"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/export"
+	"equinox/internal/middleware"
+	"equinox/internal/models"
+	"equinox/internal/mw"
+	"equinox/internal/query"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mimeJSON   = "application/json"
+	mimeCSV    = "text/csv"
+	mimeNDJSON = "application/x-ndjson"
+)
+
+// Runs the query in the request body against a series. The response format
+// is chosen by the Accept header: JSend JSON (the default), CSV or NDJSON.
+// CSV and NDJSON results are streamed rather than buffered. CSV columns may be
+// given with the comma-separated "vals" and "attrs" parameters; otherwise
+// they're every key in the results, which needs an extra pass over the query
+// that isn't counted in query metrics or the audit log.
+func PointQuery(c *gin.Context) {
+	// get the data series
+	sid := c.Param("id")
+	if !authorizeSeries(c, sid, authz.ScopeRead) {
+		return
+	}
+	s, err := mw.GetSeriesMgr().Get(sid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	// read the JSON into a query
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+	q := &query.Query{}
+	err = q.UnmarshalText(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	sio := readIO(c, s)
+	qe, err := sio.Search(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, mw.Error(err.Error()))
+		return
+	}
+	defer qe.Close()
+
+	var enc export.Encoder
+	switch c.NegotiateFormat(mimeJSON, mimeCSV, mimeNDJSON) {
+	case mimeCSV:
+		vals, attrs := splitParam(c.Query("vals")), splitParam(c.Query("attrs"))
+		if vals == nil && attrs == nil {
+			// the columns come from a probe so the query is only counted once
+			var pqe *query.QueryExec
+			pqe, err = sio.Search(q.AsProbe())
+			if err == nil {
+				vals, attrs, err = export.Columns(pqe, export.DefaultBatch)
+				pqe.Close()
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, mw.Error(err.Error()))
+				return
+			}
+		}
+		enc = export.NewCSVEncoder(c.Writer, vals, attrs)
+	case mimeNDJSON:
+		enc = export.NewNDJSONEncoder(c.Writer)
+	default:
+		ps := []*core.Point{}
+		for {
+			batch, err := qe.Fetch(export.DefaultBatch)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, mw.Error(err.Error()))
+				return
+			}
+			if len(batch) == 0 {
+				break
+			}
+			ps = append(ps, batch...)
+		}
+		middleware.LogPoints(c, len(ps))
+		c.JSON(http.StatusOK, mw.Success(gin.H{"points": ps}))
+		return
+	}
+
+	// once streaming starts the status can't change, so errors just cut the
+	// response short
+	c.Header("Content-Type", enc.ContentType())
+	c.Status(http.StatusOK)
+	n, err := export.WriteQuery(qe, enc, export.DefaultBatch)
+	middleware.LogPoints(c, n)
+	if err != nil {
+		c.Error(err)
+	}
+}
+
+/*
+Runs the query in the request body against several series, given in its
+"series" field as IDs or globs such as "sensor-*", and responds with the
+points of all of them in time order, each tagged with its series. Series
+matched by a glob that the caller can't read are left out, whereas naming
+one is forbidden. As with PointQuery the Accept header chooses JSend, CSV or
+NDJSON, and CSV has a series column before the id.
+*/
+func MultiQuery(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+	var sel struct {
+		Series []string `json:"series"`
+	}
+	err = json.Unmarshal(body, &sel)
+	if err == nil && len(sel.Series) == 0 {
+		err = fmt.Errorf("no series to query")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+	q := &query.Query{}
+	err = q.UnmarshalText(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	for _, pat := range sel.Series {
+		if !mw.IsSeriesGlob(pat) && !authorizeSeries(c, pat, authz.ScopeRead) {
+			return
+		}
+	}
+	ss, err := mw.GetSeriesMgr().Match(sel.Series...)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		return
+	}
+
+	var readable []*models.Series
+	var ids []string
+	var qes []*query.QueryExec
+	for _, s := range ss {
+		if checkSeriesScope(c, s.Id, authz.ScopeRead) != nil {
+			continue
+		}
+		qe, err := readIO(c, s).Search(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, mw.Error(err.Error()))
+			return
+		}
+		defer qe.Close()
+		readable = append(readable, s)
+		ids = append(ids, s.Id)
+		qes = append(qes, qe)
+	}
+	me := query.NewMergeExec(q, ids, qes)
+
+	var enc export.SeriesEncoder
+	switch c.NegotiateFormat(mimeJSON, mimeCSV, mimeNDJSON) {
+	case mimeCSV:
+		vals, attrs := splitParam(c.Query("vals")), splitParam(c.Query("attrs"))
+		if vals == nil && attrs == nil {
+			vals, attrs, err = probeColumns(readable, q)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, mw.Error(err.Error()))
+				return
+			}
+		}
+		enc = export.NewSeriesCSVEncoder(c.Writer, vals, attrs)
+	case mimeNDJSON:
+		enc = export.NewNDJSONEncoder(c.Writer)
+	default:
+		ps := []*query.SeriesPoint{}
+		for {
+			batch, err := me.Fetch(export.DefaultBatch)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, mw.Error(err.Error()))
+				return
+			}
+			if len(batch) == 0 {
+				break
+			}
+			ps = append(ps, batch...)
+		}
+		middleware.LogPoints(c, len(ps))
+		c.JSON(http.StatusOK, mw.Success(gin.H{"points": ps}))
+		return
+	}
+
+	c.Header("Content-Type", enc.ContentType())
+	c.Status(http.StatusOK)
+	n, err := export.WriteMerge(me, enc, export.DefaultBatch)
+	middleware.LogPoints(c, n)
+	if err != nil {
+		c.Error(err)
+	}
+}
+
+// Finds the CSV columns for a query over several series with a probe of each
+func probeColumns(ss []*models.Series, q *query.Query) ([]string, []string, error) {
+	qes := make([]*query.QueryExec, len(ss))
+	for i, s := range ss {
+		qe, err := s.IO.Search(q.AsProbe())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer qe.Close()
+		qes[i] = qe
+	}
+	return export.MergedColumns(qes, export.DefaultBatch)
+}
+
+// Engine that attributes its queries to a series and the caller
+type sourcedIO struct {
+	engine.PointIO
+	src query.Source
+}
+
+func (s *sourcedIO) Search(q *query.Query) (*query.QueryExec, error) {
+	qe, err := s.PointIO.Search(q)
+	if err == nil {
+		qe.SetSource(s.src)
+	}
+	return qe, err
+}
+
+// Returns the series' engine for reading, with queries attributed to the
+// series and the caller in the audit log
+func readIO(c *gin.Context, s *models.Series) engine.PointIO {
+	return &sourcedIO{PointIO: s.IO, src: query.Source{Principal: quotaPrincipal(c), Series: s.Id}}
+}
+
+// Splits a comma-separated parameter, returning nil if it's empty
+func splitParam(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
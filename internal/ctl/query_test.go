@@ -0,0 +1,309 @@
+package ctl_test
+
+import (
+	"encoding/json"
+	"equinox/internal/core"
+	"equinox/internal/mw"
+	"equinox/internal/query"
+	"equinox/internal/routers"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupQueryData(sid string) []*core.Point {
+	setupDataSeries(sid)
+	ds, _ := mw.GetSeriesMgr().Get(sid)
+
+	p1 := testNewPoint()
+	p1.GenerateId()
+	p2 := testNewPoint()
+	p2.GenerateId()
+	p2.Ts = p2.Ts.Add(time.Minute)
+	p2.Attrs["color"] = "blue"
+	delete(p2.Vals, "area")
+	p3 := testNewPoint()
+	p3.GenerateId()
+	p3.Ts = p3.Ts.Add(time.Hour)
+
+	ps := []*core.Point{p1, p2, p3}
+	ds.IO.Add(ps...)
+	return ps
+}
+
+func postQuery(t *testing.T, path string, accept string, body string) *httptest.ResponseRecorder {
+	router := routers.SetupRouter()
+	req, err := http.NewRequest("POST", path, strings.NewReader(body))
+	assert.NoError(t, err)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+const testQueryBody = `{"start":"2024-01-10T23:00:00Z","end":"2024-01-10T23:30:00Z"}`
+
+func TestPointQueryJSON(t *testing.T) {
+	sid := "foobar"
+	ps := setupQueryData(sid)
+	defer teardownDataSeries(sid)
+
+	rec := postQuery(t, "/series/foobar/query", "", testQueryBody)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var js mw.JSend
+	err := json.Unmarshal(rec.Body.Bytes(), &js)
+	assert.NoError(t, err)
+	assert.True(t, js.IsSuccess())
+
+	res := make(map[string][]*core.Point)
+	err = json.Unmarshal(js.Data, &res)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res["points"]))
+	assert.True(t, ps[0].Identical(res["points"][0]))
+	assert.True(t, ps[1].Identical(res["points"][1]))
+
+	// with an attribute filter
+	body := `{"start":"2024-01-10T23:00:00Z","end":"2024-01-11T01:00:00Z","filterattr":{"op":"equal","attr":"color","val":"red"}}`
+	rec = postQuery(t, "/series/foobar/query", "application/json", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	json.Unmarshal(rec.Body.Bytes(), &js)
+	json.Unmarshal(js.Data, &res)
+	assert.Equal(t, 2, len(res["points"]))
+	assert.True(t, ps[2].Identical(res["points"][1]))
+}
+
+func TestPointQueryCSV(t *testing.T) {
+	sid := "foobar"
+	ps := setupQueryData(sid)
+	defer teardownDataSeries(sid)
+
+	// finding the columns takes a second pass, which isn't audited
+	var rows []int
+	query.SetDoneHook(func(q *query.Query, src query.Source, n int, d time.Duration, err error) {
+		rows = append(rows, n)
+	})
+	defer query.SetDoneHook(nil)
+
+	rec := postQuery(t, "/series/foobar/query", "text/csv", testQueryBody)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	exp := "ts,id,area,temp,color,shape\n" +
+		"2024-01-10T23:01:02Z," + ps[0].Id.String() + ",43.1,21.1,red,square\n" +
+		"2024-01-10T23:02:02Z," + ps[1].Id.String() + ",,21.1,blue,square\n"
+	assert.Equal(t, exp, rec.Body.String())
+	assert.Equal(t, []int{2}, rows)
+
+	// explicit columns
+	rec = postQuery(t, "/series/foobar/query?vals=temp&attrs=shape,color", "text/csv", testQueryBody)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	exp = "ts,id,temp,shape,color\n" +
+		"2024-01-10T23:01:02Z," + ps[0].Id.String() + ",21.1,square,red\n" +
+		"2024-01-10T23:02:02Z," + ps[1].Id.String() + ",21.1,square,blue\n"
+	assert.Equal(t, exp, rec.Body.String())
+}
+
+func TestPointQueryNDJSON(t *testing.T) {
+	sid := "foobar"
+	ps := setupQueryData(sid)
+	defer teardownDataSeries(sid)
+
+	rec := postQuery(t, "/series/foobar/query", "application/x-ndjson", testQueryBody)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	assert.Equal(t, 2, len(lines))
+	for i, line := range lines {
+		p := core.NewPointEmpty()
+		err := json.Unmarshal([]byte(line), p)
+		assert.NoError(t, err)
+		assert.True(t, ps[i].Identical(p))
+	}
+}
+
+// ResponseRecorder whose writes fail, like a client that's gone away
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestPointQueryAudit(t *testing.T) {
+	setupQueryData("foobar")
+	defer teardownDataSeries("foobar")
+
+	var srcs []query.Source
+	var errs []error
+	query.SetDoneHook(func(q *query.Query, src query.Source, n int, d time.Duration, err error) {
+		srcs = append(srcs, src)
+		errs = append(errs, err)
+	})
+	defer query.SetDoneHook(nil)
+
+	rec := postQuery(t, "/series/foobar/query", "application/x-ndjson", testQueryBody)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []query.Source{{Principal: "ip:", Series: "foobar"}}, srcs)
+	assert.Equal(t, []error{nil}, errs)
+
+	// an export cut short by the client is still audited
+	srcs, errs = nil, nil
+	router := routers.SetupRouter()
+	req, err := http.NewRequest("POST", "/series/foobar/query", strings.NewReader(testQueryBody))
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "text/csv")
+	router.ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+	assert.Equal(t, []query.Source{{Principal: "ip:", Series: "foobar"}}, srcs)
+	assert.Equal(t, []error{query.ErrClosed}, errs)
+}
+
+func TestPointQueryErrors(t *testing.T) {
+	sid := "foobar"
+	setupQueryData(sid)
+	defer teardownDataSeries(sid)
+
+	fn := func(path string, body string, msg string) {
+		rec := postQuery(t, path, "text/csv", body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		var js mw.JSend
+		err := json.Unmarshal(rec.Body.Bytes(), &js)
+		assert.NoError(t, err)
+		assert.True(t, js.IsError())
+		assert.Contains(t, js.Message, msg)
+	}
+
+	fn("/series/nope/query", testQueryBody, "series 'nope' does not exist")
+	fn("/series/foobar/query", `{"start":"yesterday"}`, `cannot parse "yesterday`)
+	fn("/series/foobar/query", `{"start":"2024-01-10T23:00:00Z","end":"2024-01-10T23:30:00Z","filterattr":{"op":"bogus"}}`, "unrecognized filter operator bogus")
+}
+
+// Results of a multi-series query, as its series and points
+func multiQueryResults(t *testing.T, rec *httptest.ResponseRecorder) ([]string, []*core.Point) {
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var js mw.JSend
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &js))
+	res := make(map[string][]*query.SeriesPoint)
+	assert.NoError(t, json.Unmarshal(js.Data, &res))
+
+	ids := []string{}
+	ps := []*core.Point{}
+	for _, sp := range res["points"] {
+		ids = append(ids, sp.Series)
+		ps = append(ps, sp.Point)
+	}
+	return ids, ps
+}
+
+func TestMultiQuery(t *testing.T) {
+	for _, sid := range []string{"sensor-1", "sensor-2", "pump-1"} {
+		setupQueryData(sid)
+		defer teardownDataSeries(sid)
+	}
+	ds, _ := mw.GetSeriesMgr().Get("sensor-2")
+	late := testNewPoint()
+	late.GenerateId()
+	late.Ts = late.Ts.Add(90 * time.Second)
+	ds.IO.Add(late)
+
+	body := `{"series":["sensor-*"],"start":"2024-01-10T23:00:00Z","end":"2024-01-10T23:30:00Z"}`
+	ids, ps := multiQueryResults(t, postQuery(t, "/query", "", body))
+	assert.Equal(t, []string{"sensor-1", "sensor-2", "sensor-1", "sensor-2", "sensor-2"}, ids)
+	for i := 1; i < len(ps); i++ {
+		assert.False(t, ps[i].Ts.Before(ps[i-1].Ts))
+	}
+	assert.True(t, late.Identical(ps[4]))
+
+	// by list, with a filter
+	body = `{"series":["pump-1","sensor-1"],"start":"2024-01-10T23:00:00Z","end":"2024-01-11T01:00:00Z","filterattr":{"op":"equal","attr":"color","val":"blue"}}`
+	ids, ps = multiQueryResults(t, postQuery(t, "/query", "", body))
+	assert.Equal(t, []string{"pump-1", "sensor-1"}, ids)
+	assert.Equal(t, "blue", ps[1].Attrs["color"])
+
+	ids, _ = multiQueryResults(t, postQuery(t, "/query", "", `{"series":["valve-*"]}`))
+	assert.Empty(t, ids)
+
+	fn := func(body string, msg string) {
+		rec := postQuery(t, "/query", "", body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		var js mw.JSend
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &js))
+		assert.Equal(t, msg, js.Message)
+	}
+	fn(`{"start":"2024-01-10T23:00:00Z"}`, "no series to query")
+	fn(`{"series":"sensor-1"}`, "json: cannot unmarshal string into Go struct field .series of type []string")
+	fn(`{"series":["sensor-*","valve-1"]}`, "series 'valve-1' does not exist")
+	fn(`{"series":["sensor-["]}`, "invalid series pattern 'sensor-[': syntax error in pattern")
+}
+
+func TestMultiQueryNDJSON(t *testing.T) {
+	ps1 := setupQueryData("sensor-1")
+	defer teardownDataSeries("sensor-1")
+	ps2 := setupQueryData("sensor-2")
+	defer teardownDataSeries("sensor-2")
+
+	rec := postQuery(t, "/query", "application/x-ndjson", `{"series":["sensor-*"],"start":"2024-01-10T23:00:00Z","end":"2024-01-10T23:30:00Z"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	assert.Equal(t, 4, len(lines))
+	exp := []struct {
+		series string
+		p      *core.Point
+	}{{"sensor-1", ps1[0]}, {"sensor-2", ps2[0]}, {"sensor-1", ps1[1]}, {"sensor-2", ps2[1]}}
+	for i, line := range lines {
+		var sp query.SeriesPoint
+		err := json.Unmarshal([]byte(line), &sp)
+		assert.NoError(t, err)
+		assert.Equal(t, exp[i].series, sp.Series)
+		assert.True(t, exp[i].p.Identical(sp.Point))
+	}
+}
+
+func TestMultiQueryCSV(t *testing.T) {
+	ps1 := setupQueryData("sensor-1")
+	defer teardownDataSeries("sensor-1")
+	setupDataSeries("sensor-2")
+	defer teardownDataSeries("sensor-2")
+	ds, _ := mw.GetSeriesMgr().Get("sensor-2")
+	p := testNewPoint()
+	p.GenerateId()
+	p.Ts = p.Ts.Add(30 * time.Second)
+	p.Vals = map[string]float64{"pressure": 2}
+	p.Attrs = map[string]string{}
+	ds.IO.Add(p)
+
+	var rows []int
+	query.SetDoneHook(func(q *query.Query, src query.Source, n int, d time.Duration, err error) {
+		rows = append(rows, n)
+	})
+	defer query.SetDoneHook(nil)
+
+	body := `{"series":["sensor-*"],"start":"2024-01-10T23:00:00Z","end":"2024-01-10T23:30:00Z"}`
+	rec := postQuery(t, "/query", "text/csv", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	exp := "ts,series,id,area,pressure,temp,color,shape\n" +
+		"2024-01-10T23:01:02Z,sensor-1," + ps1[0].Id.String() + ",43.1,,21.1,red,square\n" +
+		"2024-01-10T23:01:32Z,sensor-2," + p.Id.String() + ",,2,,,\n" +
+		"2024-01-10T23:02:02Z,sensor-1," + ps1[1].Id.String() + ",,,21.1,blue,square\n"
+	assert.Equal(t, exp, rec.Body.String())
+	assert.ElementsMatch(t, []int{2, 1}, rows)
+
+	rec = postQuery(t, "/query?vals=temp&attrs=color", "text/csv", body)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	exp = "ts,series,id,temp,color\n" +
+		"2024-01-10T23:01:02Z,sensor-1," + ps1[0].Id.String() + ",21.1,red\n" +
+		"2024-01-10T23:01:32Z,sensor-2," + p.Id.String() + ",,\n" +
+		"2024-01-10T23:02:02Z,sensor-1," + ps1[1].Id.String() + ",21.1,blue\n"
+	assert.Equal(t, exp, rec.Body.String())
+}
@@ -0,0 +1,175 @@
+package ctl
+
+import (
+	"bytes"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/ingest"
+	"equinox/internal/middleware"
+	"equinox/internal/models"
+	"equinox/internal/mw"
+	"equinox/internal/ratelimit"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Name the caller's rate limits are tracked and queries audited under: the
+// principal name, or the client address when auth is disabled
+func quotaPrincipal(c *gin.Context) string {
+	if p := middleware.GetPrincipal(c); p != nil {
+		return p.Name
+	}
+	return "ip:" + c.ClientIP()
+}
+
+/*
+Returns the size of the request body. If the client didn't send a
+Content-Length then the body is read into memory to measure it, which is
+limited in the same way as readBody: a body that's too large or can't be read
+is refused and this returns false.
+*/
+func requestBytes(c *gin.Context) (int, bool) {
+	if c.Request.ContentLength >= 0 {
+		return int(c.Request.ContentLength), true
+	}
+	body, ok := readBody(c)
+	if !ok {
+		return 0, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+	return len(body), true
+}
+
+/*
+Reads the whole request body, up to the configured limits.max_request_bytes.
+A larger body is refused with a 413 and this returns false, as does a body
+that can't be read.
+*/
+func readBody(c *gin.Context) ([]byte, bool) {
+	max := ratelimit.GetQuotas().MaxRequestBytes()
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, int64(max)))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			c.JSON(http.StatusRequestEntityTooLarge, mw.Error(fmt.Sprintf("request body is over %d bytes", max)))
+		} else {
+			c.JSON(http.StatusBadRequest, mw.Error(err.Error()))
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+// Responds to a failure to decode a compressed request body: 413 if it was
+// too large once decompressed, otherwise 400
+func decodeFailed(c *gin.Context, err error) {
+	code := http.StatusBadRequest
+	if errors.Is(err, ingest.ErrDecodedTooLarge) {
+		code = http.StatusRequestEntityTooLarge
+	}
+	c.JSON(code, mw.Error(err.Error()))
+}
+
+// Splits the request's bytes across series in proportion to their points,
+// or evenly if there are no points
+func seriesLoads(size int, order []string, points map[string]int) []ratelimit.SeriesLoad {
+	total := 0
+	for _, sid := range order {
+		total += points[sid]
+	}
+	r := make([]ratelimit.SeriesLoad, len(order))
+	for i, sid := range order {
+		share := 1.0 / float64(len(order))
+		if total > 0 {
+			share = float64(points[sid]) / float64(total)
+		}
+		r[i] = ratelimit.SeriesLoad{Id: sid, Points: points[sid], Bytes: int(math.Round(share * float64(size)))}
+	}
+	return r
+}
+
+/*
+Admits a write of size bytes spread over the given series against the rate
+limits, and sets X-RateLimit headers describing the caller's remaining quota.
+If a limit would be exceeded then nothing is written: the response is a 429
+with a Retry-After header and this returns false.
+*/
+func admitWrite(c *gin.Context, size int, loads []ratelimit.SeriesLoad) bool {
+	d := admit(c, size, loads)
+	if !d.Allowed {
+		rejectWrite(c, d, "")
+		return false
+	}
+	return true
+}
+
+// Admits a write against the rate limits and sets the X-RateLimit headers,
+// leaving the response to the caller
+func admit(c *gin.Context, size int, loads []ratelimit.SeriesLoad) *ratelimit.Decision {
+	d := ratelimit.GetQuotas().Admit(&ratelimit.Request{
+		Principal: quotaPrincipal(c),
+		Bytes:     size,
+		Series:    loads,
+	})
+
+	if d.Points != nil {
+		c.Header("X-RateLimit-Limit-Points", strconv.FormatInt(d.Points.Limit, 10))
+		c.Header("X-RateLimit-Remaining-Points", strconv.FormatInt(max(d.Points.Remaining, 0), 10))
+	}
+	if d.Bytes != nil {
+		c.Header("X-RateLimit-Limit-Bytes", strconv.FormatInt(d.Bytes.Limit, 10))
+		c.Header("X-RateLimit-Remaining-Bytes", strconv.FormatInt(max(d.Bytes.Remaining, 0), 10))
+	}
+	return d
+}
+
+// Sends a 429 response for a write that wasn't admitted, with note appended
+// to the message if it's set
+func rejectWrite(c *gin.Context, d *ratelimit.Decision, note string) {
+	secs := int(math.Ceil(d.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(secs))
+	msg := fmt.Sprintf("rate limit exceeded for %s, retry after %ds", d.Reason, secs)
+	if note != "" {
+		msg += "; " + note
+	}
+	c.JSON(http.StatusTooManyRequests, mw.Error(msg))
+}
+
+/*
+Engine that admits the points of each Add against a series' points limits
+before adding them, for writes whose points aren't known until they're
+parsed. The first rejected Add is kept in Denied; it and every later Add
+return an error without adding anything.
+*/
+type admittedIO struct {
+	engine.PointIO
+	c      *gin.Context
+	sid    string
+	Denied *ratelimit.Decision
+}
+
+func (a *admittedIO) Add(ps ...*core.Point) error {
+	if a.Denied == nil {
+		d := admit(a.c, 0, []ratelimit.SeriesLoad{{Id: a.sid, Points: len(ps)}})
+		if !d.Allowed {
+			a.Denied = d
+		}
+	}
+	if a.Denied != nil {
+		return fmt.Errorf("rate limit exceeded for %s", a.Denied.Reason)
+	}
+	return a.PointIO.Add(ps...)
+}
+
+// Returns the series' engine with the configured maximum length applied, for
+// adding points
+func seriesIO(s *models.Series) engine.PointIO {
+	return engine.WithMaxLen(s.IO, ratelimit.GetQuotas().MaxSeriesLen())
+}
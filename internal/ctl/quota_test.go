@@ -0,0 +1,169 @@
+package ctl_test
+
+import (
+	"equinox/internal/config"
+	"equinox/internal/mw"
+	"equinox/internal/ratelimit"
+	"equinox/internal/routers"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Applies the given limits and returns a function that removes them
+func setupLimits(limits config.LimitsConfig) func() {
+	ratelimit.GetQuotas().Reset(&limits)
+	return func() {
+		ratelimit.GetQuotas().Reset(&config.Default().Limits)
+	}
+}
+
+func quotaRequest(t *testing.T, path string, body string) *httptest.ResponseRecorder {
+	router := routers.SetupRouter()
+	req, err := http.NewRequest("POST", path, strings.NewReader(body))
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestQuotaRateLimit(t *testing.T) {
+	setupDataSeries("cpu")
+	defer teardownDataSeries("cpu")
+	cpu, _ := mw.GetSeriesMgr().Get("cpu")
+
+	limits := config.Default().Limits
+	limits.Principal = config.Rate{Points: 2, Bytes: 1000}
+	defer setupLimits(limits)()
+
+	pt := `{"ts":"2024-01-10T23:01:02Z","vals":{"v":1}}`
+	rec := quotaRequest(t, "/series/cpu/points", pt)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("X-RateLimit-Limit-Points"))
+	assert.Equal(t, "1", rec.Header().Get("X-RateLimit-Remaining-Points"))
+	assert.Equal(t, "1000", rec.Header().Get("X-RateLimit-Limit-Bytes"))
+	assert.Equal(t, "956", rec.Header().Get("X-RateLimit-Remaining-Bytes"))
+
+	rec = quotaRequest(t, "/series/cpu/points", pt)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining-Points"))
+
+	rec = quotaRequest(t, "/series/cpu/points", pt)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, `{"status":"error","message":"rate limit exceeded for principal 'ip:' points, retry after 1s"}`,
+		rec.Body.String())
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, 2, cpu.IO.Len())
+
+	// a batch is admitted or rejected as a whole
+	rec = quotaRequest(t, "/write", "cpu v=1 1\ncpu v=2 2")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, 2, cpu.IO.Len())
+}
+
+func TestQuotaSeriesLimit(t *testing.T) {
+	setupDataSeries("cpu")
+	defer teardownDataSeries("cpu")
+	setupDataSeries("mem")
+	defer teardownDataSeries("mem")
+	mem, _ := mw.GetSeriesMgr().Get("mem")
+
+	limits := config.Default().Limits
+	limits.SeriesOverrides = map[string]config.Rate{"cpu": {Bytes: 10}}
+	defer setupLimits(limits)()
+
+	rec := quotaRequest(t, "/write", "mem v=1 1")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("X-RateLimit-Limit-Points"))
+
+	// cpu gets 2/3 of the 29 bytes, which is more than its burst so it's
+	// allowed only because the bucket is full, and leaves it in debt
+	rec = quotaRequest(t, "/write", "cpu v=1 1\ncpu v=2 2\nmem v=3 3")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = quotaRequest(t, "/write", "cpu v=1 1\nmem v=2 2")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, `{"status":"error","message":"rate limit exceeded for series 'cpu' bytes, retry after 2s"}`,
+		rec.Body.String())
+	assert.Equal(t, 2, mem.IO.Len())
+}
+
+func TestQuotaMaxSeriesLen(t *testing.T) {
+	setupDataSeries("cpu")
+	defer teardownDataSeries("cpu")
+	cpu, _ := mw.GetSeriesMgr().Get("cpu")
+
+	limits := config.Default().Limits
+	limits.MaxSeriesLen = 2
+	defer setupLimits(limits)()
+
+	rec := quotaRequest(t, "/write", "cpu v=1 1\ncpu v=2 2\ncpu v=3 3")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"series_errors":["3 points rejected: series is full: adding 3 points to 0 would exceed the maximum of 2"]`)
+
+	rec = quotaRequest(t, "/write", "cpu v=1 1\ncpu v=2 2")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = quotaRequest(t, "/series/cpu/points", `{"ts":"2024-01-10T23:01:02Z","vals":{"v":1}}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, `{"status":"error","message":"series is full: adding 1 points to 2 would exceed the maximum of 2"}`,
+		rec.Body.String())
+	assert.Equal(t, 2, cpu.IO.Len())
+}
+
+func TestQuotaImport(t *testing.T) {
+	setupDataSeries("cpu")
+	defer teardownDataSeries("cpu")
+	cpu, _ := mw.GetSeriesMgr().Get("cpu")
+
+	limits := config.Default().Limits
+	limits.SeriesOverrides = map[string]config.Rate{"cpu": {Points: 2}}
+	defer setupLimits(limits)()
+
+	// rows are charged a batch at a time once they're parsed
+	mapping := `{"ts":"time","vals":{"v":"v"}}`
+	code, _ := postImport(t, "/series/cpu/import", "time,v\n2024-01-10T23:01:02Z,1\n", mapping)
+	assert.Equal(t, http.StatusCreated, code)
+	csv := "time,v\n2024-01-10T23:02:02Z,2\n2024-01-10T23:03:02Z,3\n2024-01-10T23:04:02Z,4\n"
+	code, js := postImport(t, "/series/cpu/import", csv, mapping)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, "rate limit exceeded for series 'cpu' points, retry after 1s; 0 points were imported", js.Message)
+	assert.Equal(t, 1, cpu.IO.Len())
+}
+
+func TestQuotaChunked(t *testing.T) {
+	setupDataSeries("cpu")
+	defer teardownDataSeries("cpu")
+	cpu, _ := mw.GetSeriesMgr().Get("cpu")
+
+	limits := config.Default().Limits
+	limits.MaxRequestBytes = 20
+	defer setupLimits(limits)()
+
+	// a body without a Content-Length is measured by reading it, up to the
+	// request limit
+	fn := func(path string, body string) *httptest.ResponseRecorder {
+		router := routers.SetupRouter()
+		req, err := http.NewRequest("POST", path, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := fn("/write", "cpu v=1 1\ncpu v=2 2")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, 2, cpu.IO.Len())
+
+	rec = fn("/write", "cpu v=1 1\ncpu v=2 2\ncpu v=3 3")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Equal(t, `{"status":"error","message":"request body is over 20 bytes"}`, rec.Body.String())
+	rec = fn("/series/cpu/points", `{"ts":"2024-01-10T23:01:02Z","vals":{"v":1}}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	rec = fn("/series/cpu/import?mapping=%7B%7D", "time,v\n2024-01-10T23:02:02Z,2\n")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Equal(t, 2, cpu.IO.Len())
+}
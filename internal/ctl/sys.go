@@ -1,13 +1,39 @@
 package ctl
 
 import (
+	"equinox/internal/health"
+	"equinox/internal/mw"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+var startTime = time.Now()
+
 func Ping(c *gin.Context) {
 	resp := make(map[string]string, 1)
 	resp["message"] = "Hello World"
 	c.JSON(http.StatusOK, resp)
 }
+
+// Liveness probe. Succeeds whenever the process can serve requests at all, so
+// a failure means it should be restarted.
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, mw.Success(gin.H{
+		"alive":          true,
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	}))
+}
+
+// Readiness probe. Runs every readiness check and responds with 503 if any
+// fail, so traffic should not be routed here until they pass.
+func Readyz(c *gin.Context) {
+	results, ok := health.GetReadiness().Run()
+	data := gin.H{"ready": ok, "checks": results}
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, mw.Fail(data))
+		return
+	}
+	c.JSON(http.StatusOK, mw.Success(data))
+}
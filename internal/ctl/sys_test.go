@@ -1,6 +1,9 @@
 package ctl
 
 import (
+	"equinox/internal/config"
+	"equinox/internal/health"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -19,3 +22,64 @@ func TestSysPing(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rec.Code)
 	assert.Equal(t, "{\"message\":\"Hello World\"}", rec.Body.String())
 }
+
+func TestSysHealthz(t *testing.T) {
+	router := gin.Default()
+	router.GET("/healthz", Healthz)
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `{"status":"success","data":{"alive":true,"uptime_seconds":`)
+}
+
+func TestSysReadyz(t *testing.T) {
+	ready := health.GetReadiness()
+	ready.Reset()
+	defer ready.Reset()
+
+	var diskErr error
+	ready.Register("startup", func() error { return nil })
+	ready.Register("disk", func() error { return diskErr })
+
+	router := gin.Default()
+	router.GET("/readyz", Readyz)
+	get := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		assert.NoError(t, err)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `{"status":"success","data":{"checks":[{"name":"startup","ok":true,"duration_ms":`)
+	assert.Contains(t, rec.Body.String(), `"ready":true}}`)
+
+	diskErr = errors.New("disk full")
+	rec = get()
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), `{"status":"fail","data":{"checks":[{"name":"startup","ok":true,`)
+	assert.Contains(t, rec.Body.String(), `{"name":"disk","ok":false,"error":"disk full","duration_ms":`)
+	assert.Contains(t, rec.Body.String(), `"ready":false}}`)
+}
+
+func TestSysAdminConfig(t *testing.T) {
+	c := config.Default()
+	c.Auth.JWTSecret = "shh"
+	config.Set(c)
+	defer config.Set(nil)
+
+	router := gin.Default()
+	router.GET("/admin/config", AdminConfig)
+	req, err := http.NewRequest("GET", "/admin/config", nil)
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `{"status":"success","data":{"config":{"host":"localhost","port":8080,`)
+	assert.Contains(t, rec.Body.String(), `"jwt_secret":"\u003credacted\u003e"`)
+	assert.NotContains(t, rec.Body.String(), "shh")
+}
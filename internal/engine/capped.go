@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"equinox/internal/core"
+	"fmt"
+	"sync"
+)
+
+// Wraps a PointIO so that Add fails rather than growing it beyond a maximum
+// number of points. All other methods pass through.
+type Capped struct {
+	PointIO
+	max int
+	mu  sync.Mutex // held from checking the length until the points are added
+}
+
+// Returns io limited to max points, or io itself if max isn't positive
+func WithMaxLen(io PointIO, max int) PointIO {
+	if max <= 0 {
+		return io
+	}
+	return &Capped{PointIO: io, max: max}
+}
+
+// Adds the points if there's room for all of them; otherwise none are added
+func (c *Capped) Add(ps ...*core.Point) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.PointIO.Len()
+	if n+len(ps) > c.max {
+		return fmt.Errorf("series is full: adding %d points to %d would exceed the maximum of %d",
+			len(ps), n, c.max)
+	}
+	return c.PointIO.Add(ps...)
+}
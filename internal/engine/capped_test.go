@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"equinox/internal/core"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapped(t *testing.T) {
+	mt := NewMemTree()
+	assert.Same(t, mt, WithMaxLen(mt, 0))
+
+	io := WithMaxLen(mt, 5)
+	assert.NoError(t, io.Add(getPoint(1), getPoint(2), getPoint(3)))
+	assert.Equal(t, 3, io.Len())
+
+	err := io.Add(getPoint(4), getPoint(5), getPoint(6))
+	assert.Error(t, err)
+	assert.Equal(t, "series is full: adding 3 points to 3 would exceed the maximum of 5", err.Error())
+	assert.Equal(t, 3, mt.Len())
+
+	assert.NoError(t, io.Add(getPoint(4), getPoint(5)))
+	assert.Equal(t, 5, mt.Len())
+	assert.Error(t, io.Add(getPoint(6)))
+	assert.Equal(t, "MemTree", io.Name())
+}
+
+// MemTree that's slow to add points, widening any gap between a writer
+// checking the length and adding
+type slowAddIO struct {
+	*MemTree
+}
+
+func (s slowAddIO) Add(ps ...*core.Point) error {
+	time.Sleep(time.Millisecond)
+	return s.MemTree.Add(ps...)
+}
+
+func TestCappedConcurrent(t *testing.T) {
+	mt := NewMemTree()
+	io := WithMaxLen(slowAddIO{mt}, 10)
+
+	var wg sync.WaitGroup
+	var added atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i uint32) {
+			defer wg.Done()
+			if io.Add(getPoint(i), getPoint(i+100)) == nil {
+				added.Add(1)
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+	assert.Equal(t, int32(5), added.Load())
+	assert.Equal(t, 10, mt.Len())
+}
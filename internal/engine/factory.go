@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"equinox/internal/file"
+	"fmt"
+	"time"
+)
+
+// Names of the available engines, as used in configuration
+var Names = []string{"memtree", "memlist", "sharded"}
+
+// Time covered by each shard of a sharded engine created by NewPointIO
+const DefaultShardWindow = 24 * time.Hour
+
+/*
+Creates an engine of the given type. See Names for valid values. Disk-backed
+engines keep their files in dir, opening any already there, and write with
+durability d; in-memory engines ignore both and start empty.
+*/
+func NewPointIO(name string, dir string, d file.Durability) (PointIO, error) {
+	switch name {
+	case "memtree":
+		return NewMemTree(), nil
+	case "memlist":
+		return NewMemList(), nil
+	case "sharded":
+		s, err := NewSharded(dir, DefaultShardWindow)
+		if err != nil {
+			return nil, err
+		}
+		err = s.SetDurability(d)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unrecognized engine '%s'", name)
+	}
+}
+
+// Returns true if the named engine keeps its data on disk
+func IsDiskEngine(name string) bool {
+	return name == "sharded"
+}
@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"equinox/internal/file"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFactory(t *testing.T) {
+	for _, name := range Names {
+		io, err := NewPointIO(name, t.TempDir(), file.DurabilityWrite)
+		assert.NoError(t, err)
+		assert.Equal(t, name, strings.ToLower(io.Name()))
+		assert.Equal(t, 0, io.Len())
+		assert.Nil(t, Shutdown(io))
+	}
+
+	_, err := NewPointIO("disk", "", file.DurabilitySync)
+	assert.Error(t, err)
+	assert.Equal(t, "unrecognized engine 'disk'", err.Error())
+}
+
+func TestFactoryReopen(t *testing.T) {
+	dir := t.TempDir()
+	io, err := NewPointIO("sharded", dir, file.DurabilityBuffer)
+	assert.NoError(t, err)
+	assert.Equal(t, file.DurabilityBuffer, io.(*Sharded).durability)
+	assert.Nil(t, io.Add(getPoint(1), getPoint(2)))
+	assert.Nil(t, Shutdown(io))
+
+	io, err = NewPointIO("sharded", dir, file.DurabilitySync)
+	assert.NoError(t, err)
+	defer Shutdown(io)
+	assert.Equal(t, 2, io.Len())
+}
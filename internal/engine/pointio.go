@@ -2,7 +2,11 @@ package engine
 
 import (
 	"equinox/internal/core"
+	"equinox/internal/metrics"
 	"equinox/internal/query"
+	"errors"
+	"fmt"
+	"time"
 )
 
 type PointIO interface {
@@ -13,3 +17,57 @@ type PointIO interface {
 	Name() string
 	String() string
 }
+
+// Optional interface for engines that buffer points in memory before they're
+// written to persistent storage. Flush writes out anything buffered.
+type Flusher interface {
+	Flush() error
+}
+
+// Optional interface for engines that hold open files or other resources.
+// The engine can't be used after Close.
+type Closer interface {
+	Close() error
+}
+
+// Optional interface for engines whose storage can become unusable, e.g.
+// when a data file is closed or lost. Check returns nil if the engine can
+// serve reads and writes.
+type Checker interface {
+	Check() error
+}
+
+// Optional interface for engines that can drop old data in bulk, e.g. by
+// removing files. DropBefore removes data older than t, though it may keep
+// some of it, and returns the number of points removed.
+type Retainer interface {
+	DropBefore(t time.Time) (int, error)
+}
+
+var vacuumDuration = metrics.MustRegister(metrics.NewHistogramVec(
+	"equinox_vacuum_duration_seconds", "Time taken to vacuum a series.",
+	metrics.DefBuckets, "engine"))
+
+// Vacuums the engine, recording how long it took
+func Vacuum(io PointIO) error {
+	start := time.Now()
+	defer vacuumDuration.With(io.Name()).ObserveSince(start)
+	return io.Vacuum()
+}
+
+// Flushes the engine if it's a Flusher and then closes it if it's a Closer.
+// In-memory engines implement neither, so this is a no-op for them.
+func Shutdown(io PointIO) error {
+	var errs []error
+	if f, ok := io.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("flush failed: %s", err.Error()))
+		}
+	}
+	if c, ok := io.(Closer); ok {
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close failed: %s", err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,15 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVacuumMetrics(t *testing.T) {
+	ml := NewMemList()
+	before := vacuumDuration.With("MemList").Count()
+	assert.NoError(t, Vacuum(ml))
+	assert.NoError(t, Vacuum(ml))
+	assert.Equal(t, before+2, vacuumDuration.With("MemList").Count())
+}
@@ -0,0 +1,714 @@
+package engine
+
+import (
+	"cmp"
+	"encoding/json"
+	"equinox/internal/core"
+	"equinox/internal/file"
+	"equinox/internal/query"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File in a Sharded engine's directory holding the serializer's indexes
+const serializerFile = "serializer.json"
+
+/*
+Disk-backed engine that splits a series into shards by time window, so that
+each shard holds the points from [start, start+window). Every shard is its
+own data file, alongside a metadata file recording its time range and number
+of points. Searches only open the shards overlapping the query, skipping
+blocks within them that can't match it, and DropBefore removes whole shards,
+so deleting old data is a matter of deleting files.
+
+Files in dir, where start is the start of the window in Unix seconds:
+- serializer.json: the key and value indexes shared by every shard
+- shard-<start>.dat, shard-<start>.dat.idx, shard-<start>.dat.blk: the
+shard's data file and its indexes
+- shard-<start>.dat.bloom: the shard's Bloom filter, if SetBloom is used
+- shard-<start>.meta: the shard's shardMeta as JSON
+
+Metadata is saved by Flush and Close. A shard whose metadata is missing or
+doesn't match its data file, e.g. after a crash, has it rebuilt from the data
+file when the engine is opened.
+*/
+type Sharded struct {
+	mu         sync.Mutex
+	dir        string
+	window     time.Duration
+	ser        *file.Serializer
+	shards     []*shard // in time order
+	bloomRate  float64
+	durability file.Durability
+}
+
+// Shard metadata
+type shardMeta struct {
+	Start  int64 `json:"start"`  // Unix seconds
+	MinTs  int64 `json:"min_ts"` // Unix microseconds; not set if there are no points
+	MaxTs  int64 `json:"max_ts"`
+	Points int   `json:"points"`
+}
+
+type shard struct {
+	meta    shardMeta
+	path    string         // data file, whose other files share its prefix
+	df      *file.DataFile // nil until needed
+	mapped  *shardMap      // nil until the shard is sealed and read
+	bloom   *file.Bloom    // nil if there isn't an up to date one
+	dirty   bool           // meta has changed since it was saved
+	dropped bool
+}
+
+/*
+Opens the Sharded engine in dir, creating it if it doesn't exist. window is
+how much time each shard covers; it must be a whole number of seconds, and
+should be the same every time the engine is opened.
+*/
+func NewSharded(dir string, window time.Duration) (*Sharded, error) {
+	if window < time.Second || window%time.Second != 0 {
+		return nil, fmt.Errorf("shard window %s is not a whole number of seconds", window)
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sharded{dir: dir, window: window, ser: file.NewSerializer()}
+	b, err := os.ReadFile(filepath.Join(dir, serializerFile))
+	if err == nil {
+		err = json.Unmarshal(b, s.ser)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load %s: %s", serializerFile, err.Error())
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "shard-*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		sh, err := s.loadShard(path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, sh)
+	}
+	slices.SortFunc(s.shards, func(a, b *shard) int {
+		return cmp.Compare(a.meta.Start, b.meta.Start)
+	})
+
+	return s, nil
+}
+
+// Loads a shard's metadata, rebuilding it if it's out of date
+func (s *Sharded) loadShard(path string) (*shard, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "shard-"), ".dat")
+	start, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unrecognized shard file %s", path)
+	}
+	sh := &shard{path: path}
+
+	n, err := file.IndexLen(path)
+	if err != nil {
+		return nil, err
+	}
+	sh.bloom, err = file.LoadBloom(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(sh.metaPath())
+	if err == nil {
+		err = json.Unmarshal(b, &sh.meta)
+	}
+	if err == nil && sh.meta.Start == start && sh.meta.Points == n {
+		return sh, nil
+	}
+
+	// the data file was written after the metadata was saved
+	sh.meta = shardMeta{Start: start}
+	df, err := file.OpenMappedDF(path, s.ser)
+	if err != nil {
+		return nil, err
+	}
+	defer df.Close()
+	it := df.Range(0, uint32(n))
+	for {
+		p, err := it.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to rebuild metadata for %s: %s", path, err.Error())
+		}
+		if p == nil {
+			break
+		}
+		sh.record(p)
+	}
+	sh.dirty = true
+	return sh, sh.saveMeta()
+}
+
+func (sh *shard) metaPath() string {
+	return strings.TrimSuffix(sh.path, ".dat") + ".meta"
+}
+
+// Updates the metadata for a point added to the shard
+func (sh *shard) record(p *core.Point) {
+	ts := p.Ts.UnixMicro()
+	if sh.meta.Points == 0 || ts < sh.meta.MinTs {
+		sh.meta.MinTs = ts
+	}
+	if sh.meta.Points == 0 || ts > sh.meta.MaxTs {
+		sh.meta.MaxTs = ts
+	}
+	sh.meta.Points++
+	sh.dirty = true
+}
+
+func (sh *shard) saveMeta() error {
+	if !sh.dirty {
+		return nil
+	}
+	b, err := json.Marshal(sh.meta)
+	if err != nil {
+		return err
+	}
+	err = file.WriteFileAtomic(sh.metaPath(), b)
+	if err != nil {
+		return err
+	}
+	sh.dirty = false
+	return nil
+}
+
+// Mapping of a sealed shard's data file. Cursors read it without holding the
+// engine's lock, so once it's replaced or dropped it's left for the last of
+// them to unmap.
+type shardMap struct {
+	m       *file.MappedDF
+	points  int // meta.Points when the shard was mapped
+	readers int
+	retired bool
+}
+
+// Opens the shard's data file if it isn't already
+func (s *Sharded) open(sh *shard) error {
+	if sh.df != nil {
+		return nil
+	}
+	df, err := file.OpenExistingDF(sh.path, s.ser)
+	if errors.Is(err, os.ErrNotExist) {
+		df, err = file.OpenNewDF(sh.path, s.ser)
+	}
+	if err == nil && s.durability != file.DurabilitySync {
+		err = df.SetDurability(s.durability)
+	}
+	if err == nil && s.bloomRate > 0 {
+		err = df.SetBloom(s.bloomRate)
+	}
+	if err != nil {
+		return err
+	}
+	sh.df = df
+	return nil
+}
+
+/*
+Keeps a Bloom filter over each shard's attribute values with a false positive
+rate of about fpRate, so that searches for attributes equal to a value skip
+shards that don't have it without opening them. Filters are saved by Flush
+and Close, and a shard isn't skipped from when it's written to until then.
+0, the default, stops saving them.
+*/
+func (s *Sharded) SetBloom(fpRate float64) error {
+	if fpRate < 0 || fpRate >= 1 {
+		return fmt.Errorf("bloom filter false positive rate %g is not in [0, 1)", fpRate)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bloomRate = fpRate
+	for _, sh := range s.shards {
+		if sh.df != nil {
+			err := sh.df.SetBloom(fpRate)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sets how far writes to each shard go before Add returns; see
+// file.Durability. The default is file.DurabilitySync.
+func (s *Sharded) SetDurability(d file.Durability) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.durability = d
+	var errs []error
+	for _, sh := range s.shards {
+		if sh.df != nil {
+			errs = append(errs, sh.df.SetDurability(d))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Sharded) Name() string {
+	return "Sharded"
+}
+
+func (s *Sharded) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sstr []string
+	for _, sh := range s.shards {
+		sstr = append(sstr, fmt.Sprintf("%s: %d points", time.Unix(sh.meta.Start, 0).UTC(), sh.meta.Points))
+	}
+	return fmt.Sprintf("%s(%s, %s): {\n%s\n}", s.Name(), s.dir, s.window, strings.Join(sstr, "\n"))
+}
+
+// Start of the window holding t, in Unix seconds
+func (s *Sharded) windowStart(t time.Time) int64 {
+	w := int64(s.window / time.Second)
+	start := t.Unix()
+	if start%w < 0 {
+		return start - w - start%w
+	}
+	return start - start%w
+}
+
+// Returns the shard starting at start, creating it if it doesn't exist
+func (s *Sharded) getShard(start int64) *shard {
+	i, found := slices.BinarySearchFunc(s.shards, start, func(sh *shard, start int64) int {
+		return cmp.Compare(sh.meta.Start, start)
+	})
+	if found {
+		return s.shards[i]
+	}
+	sh := &shard{
+		path: filepath.Join(s.dir, fmt.Sprintf("shard-%d.dat", start)),
+		meta: shardMeta{Start: start},
+	}
+	s.shards = slices.Insert(s.shards, i, sh)
+	return sh
+}
+
+func (s *Sharded) Add(ps ...*core.Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the indexes have to be saved before the points that use them
+	learned := false
+	for _, p := range ps {
+		learned = s.ser.Learn(p) || learned
+	}
+	if learned {
+		err := s.saveSerializer()
+		if err != nil {
+			return err
+		}
+	}
+
+	batches := make(map[int64][]*core.Point)
+	for _, p := range ps {
+		start := s.windowStart(p.Ts)
+		batches[start] = append(batches[start], p)
+	}
+
+	var errs []error
+	for start, batch := range batches {
+		err := s.addToShard(s.getShard(start), batch)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shard %s: %s", time.Unix(start, 0).UTC(), err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Sharded) addToShard(sh *shard, ps []*core.Point) error {
+	err := s.open(sh)
+	if err != nil {
+		return err
+	}
+
+	// the filter doesn't cover the new points
+	sh.bloom = nil
+	recs := make([]file.Record, len(ps))
+	for i, p := range ps {
+		recs[i] = file.Record{Idx: uint32(sh.meta.Points + i), Point: p}
+	}
+	err = sh.df.WriteBatch(recs)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		sh.record(p)
+	}
+	return nil
+}
+
+func (s *Sharded) saveSerializer() error {
+	b, err := json.Marshal(s.ser)
+	if err != nil {
+		return err
+	}
+	return file.WriteFileAtomic(filepath.Join(s.dir, serializerFile), b)
+}
+
+func (s *Sharded) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, sh := range s.shards {
+		n += sh.meta.Points
+	}
+	return n
+}
+
+func (s *Sharded) Vacuum() error {
+	return nil
+}
+
+// Returns true if the shard may have points in the query's time range
+func (s *Sharded) overlaps(sh *shard, q *query.Query) bool {
+	start := time.Unix(sh.meta.Start, 0)
+	if q.End.Before(start) || !q.Start.Before(start.Add(s.window)) {
+		return false
+	}
+	return sh.meta.Points > 0 &&
+		q.Start.UnixMicro() <= sh.meta.MaxTs && q.End.UnixMicro() >= sh.meta.MinTs
+}
+
+func (s *Sharded) Search(q *query.Query) (*query.QueryExec, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc := &ShardedCursor{s: s, q: q}
+	for _, sh := range s.shards {
+		if s.overlaps(sh, q) && (sh.bloom == nil || sh.bloom.MayMatch(q, s.ser)) {
+			sc.shards = append(sc.shards, sh)
+		}
+	}
+	return query.NewQueryExec(q, sc), nil
+}
+
+/*
+Cursor over the shards overlapping a query. Shards are read a block at a time,
+keeping one open at once, and since shards don't overlap in time the results
+come out in time order.
+*/
+type ShardedCursor struct {
+	s      *Sharded
+	q      *query.Query
+	shards []*shard      // left to read
+	cur    *shardCursor  // being read, if any
+	buf    []*core.Point // ready to return
+}
+
+/*
+Position in the shard being read. The newest shard, which is still being
+written to, is read from its data file; older shards are sealed, and are read
+through a mapping of the file instead.
+*/
+type shardCursor struct {
+	sh      *shard
+	df      *file.DataFile
+	sm      *shardMap
+	n       uint32        // points to read
+	next    uint32        // index of the next block to read
+	minTs   []int64       // earliest timestamp in each block or any after, nil if unknown
+	pending []*core.Point // read, but a later block may hold earlier points
+}
+
+func (sc *ShardedCursor) Fetch(n int) ([]*core.Point, error) {
+	var r []*core.Point
+	for len(r) < n {
+		if len(sc.buf) == 0 {
+			if sc.cur == nil {
+				if len(sc.shards) == 0 {
+					break
+				}
+				cur, err := sc.openShard(sc.shards[0])
+				if err != nil {
+					return nil, err
+				}
+				sc.shards = sc.shards[1:]
+				sc.cur = cur
+				continue
+			}
+			err := sc.readBlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		k := min(n-len(r), len(sc.buf))
+		r = append(r, sc.buf[:k]...)
+		sc.buf = sc.buf[k:]
+	}
+	return r, nil
+}
+
+// Releases the shard being read, for when the query is closed before all
+// its results are fetched
+func (sc *ShardedCursor) Close() error {
+	sc.closeShard()
+	sc.shards = nil
+	sc.buf = nil
+	return nil
+}
+
+/*
+Starts reading a shard, returning nil if it's been dropped. The engine is only
+locked to find what to read, so a long search doesn't hold up writes.
+*/
+func (sc *ShardedCursor) openShard(sh *shard) (*shardCursor, error) {
+	s := sc.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sh.dropped {
+		return nil, nil
+	}
+
+	cur := &shardCursor{sh: sh}
+	if sh == s.shards[len(s.shards)-1] {
+		err := s.open(sh)
+		if err != nil {
+			return nil, err
+		}
+		cur.df = sh.df
+		cur.n = uint32(sh.meta.Points)
+		cur.minTs = cur.df.BlockMinTs(cur.n)
+	} else {
+		sm, err := s.mapShard(sh)
+		if err != nil {
+			return nil, err
+		}
+		cur.sm = sm
+		cur.n = uint32(sm.points)
+		cur.minTs = sm.m.BlockMinTs(cur.n)
+	}
+	for b := len(cur.minTs) - 2; b >= 0; b-- {
+		cur.minTs[b] = min(cur.minTs[b], cur.minTs[b+1])
+	}
+	return cur, nil
+}
+
+/*
+Reads the next block of the shard being read. Late points mean a block can
+hold points from before those in earlier ones, so the points read are only
+moved to the buffer once the block index shows no later block can come before
+them; files without one are buffered whole.
+*/
+func (sc *ShardedCursor) readBlock() error {
+	cur := sc.cur
+	end := min(cur.next+file.BlockRecords, cur.n)
+	err := cur.read(sc.q, cur.next, end)
+	if err != nil {
+		sc.closeShard()
+		// a shard dropped part way through is skipped from there, as it
+		// would have been if it was dropped before
+		s := sc.s
+		s.mu.Lock()
+		dropped := cur.sh.dropped
+		s.mu.Unlock()
+		if dropped {
+			return nil
+		}
+		return err
+	}
+	cur.next = end
+
+	slices.SortFunc(cur.pending, core.PointCmp)
+	k := len(cur.pending)
+	if end < cur.n {
+		before := int64(math.MinInt64)
+		if cur.minTs != nil {
+			before = cur.minTs[end/file.BlockRecords]
+		}
+		k, _ = slices.BinarySearchFunc(cur.pending, before, func(p *core.Point, ts int64) int {
+			return cmp.Compare(p.Ts.UnixMicro(), ts)
+		})
+	}
+	sc.buf = append(sc.buf, cur.pending[:k]...)
+	cur.pending = cur.pending[k:]
+	if end == cur.n {
+		sc.closeShard()
+	}
+	return nil
+}
+
+// Stops reading the current shard, releasing its mapping
+func (sc *ShardedCursor) closeShard() {
+	if sc.cur != nil && sc.cur.sm != nil {
+		sc.s.releaseMap(sc.cur.sm)
+	}
+	sc.cur = nil
+}
+
+// Adds the matching points from start up to end to the pending points
+func (cur *shardCursor) read(q *query.Query, start, end uint32) error {
+	if cur.sm != nil {
+		ps, err := file.NewMappedCursor(cur.sm.m, q, start, end).Fetch(int(end - start))
+		cur.pending = append(cur.pending, ps...)
+		return err
+	}
+
+	if !cur.df.BlockMayMatch(start, q) {
+		return nil
+	}
+	for i := start; i < end; i++ {
+		p, err := cur.df.Read(i)
+		if err != nil {
+			return err
+		}
+		if q.Match(p) {
+			cur.pending = append(cur.pending, p)
+		}
+	}
+	return nil
+}
+
+/*
+Returns the shard's mapping for a reader, who must release it with
+releaseMap. The shard is mapped if it isn't already, or mapped again if it's
+been written to since, as late points can be. Must be called with the lock
+held.
+*/
+func (s *Sharded) mapShard(sh *shard) (*shardMap, error) {
+	if sh.mapped == nil || sh.mapped.points != sh.meta.Points {
+		err := s.unmapShard(sh)
+		if err == nil && sh.df != nil {
+			// the mapping only sees what's been written to the file
+			err = sh.df.Flush()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := file.OpenMappedDF(sh.path, s.ser)
+		if err != nil {
+			return nil, err
+		}
+		sh.mapped = &shardMap{m: m, points: sh.meta.Points}
+	}
+	sh.mapped.readers++
+	return sh.mapped, nil
+}
+
+// Releases a mapping returned by mapShard, unmapping it if it's been retired
+// and this was the last reader
+func (s *Sharded) releaseMap(sm *shardMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sm.readers--
+	if sm.retired && sm.readers == 0 {
+		sm.m.Close()
+	}
+}
+
+// Retires the shard's mapping, unmapping it now if no one is reading it. Must
+// be called with the lock held.
+func (s *Sharded) unmapShard(sh *shard) error {
+	sm := sh.mapped
+	if sm == nil {
+		return nil
+	}
+	sh.mapped = nil
+	sm.retired = true
+	if sm.readers > 0 {
+		return nil
+	}
+	return sm.m.Close()
+}
+
+/*
+Removes every shard whose window ends at or before t, returning how many
+points were removed. Points older than t in the shard containing t are kept
+until the whole shard is.
+*/
+func (s *Sharded) DropBefore(t time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	var errs []error
+	for len(s.shards) > 0 {
+		sh := s.shards[0]
+		if time.Unix(sh.meta.Start, 0).Add(s.window).After(t) {
+			break
+		}
+
+		errs = append(errs, s.unmapShard(sh))
+		if sh.df != nil {
+			errs = append(errs, sh.df.Close())
+			sh.df = nil
+		}
+		for _, path := range []string{sh.path, sh.path + file.IndexSuffix, sh.path + file.BlockIndexSuffix, sh.path + file.BloomSuffix, sh.metaPath()} {
+			err := os.Remove(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+		sh.dropped = true
+		s.shards = s.shards[1:]
+		n += sh.meta.Points
+	}
+	return n, errors.Join(errs...)
+}
+
+// Syncs the open shards and saves their metadata, indexes and filters
+func (s *Sharded) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, sh := range s.shards {
+		if sh.df == nil {
+			continue
+		}
+		err := sh.df.Flush()
+		if err == nil {
+			err = sh.saveMeta()
+		}
+		if err == nil && sh.bloom == nil && s.bloomRate > 0 {
+			sh.bloom, err = file.LoadBloom(sh.path)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", sh.path, err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Sharded) Close() error {
+	err := s.Flush()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := []error{err}
+	for _, sh := range s.shards {
+		errs = append(errs, s.unmapShard(sh))
+		if sh.df != nil {
+			errs = append(errs, sh.df.Close())
+			sh.df = nil
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,382 @@
+package engine
+
+import (
+	"encoding/json"
+	"equinox/internal/core"
+	"equinox/internal/file"
+	"equinox/internal/query"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runs a query against the engine, returning every result
+func searchAll(t *testing.T, io PointIO, start, end time.Time) []*core.Point {
+	qe, err := io.Search(query.NewQuery(start, end, query.True()))
+	assert.Nil(t, err)
+	var r []*core.Point
+	for {
+		batch, err := qe.Fetch(7)
+		assert.Nil(t, err)
+		if len(batch) == 0 {
+			return r
+		}
+		r = append(r, batch...)
+	}
+}
+
+// number of shards with an open data file or mapping
+func openShards(s *Sharded) int {
+	n := 0
+	for _, sh := range s.shards {
+		if sh.df != nil || sh.mapped != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestShardedQuery(t *testing.T) {
+	for _, n := range []int{10, 100, 1000} {
+		s, err := NewSharded(t.TempDir(), time.Hour)
+		assert.Nil(t, err)
+		testPointIO(t, s, n, 9)
+		assert.Nil(t, s.Close())
+	}
+}
+
+func TestShardedWindow(t *testing.T) {
+	for _, w := range []time.Duration{0, time.Millisecond, 1500 * time.Millisecond} {
+		_, err := NewSharded(t.TempDir(), w)
+		assert.Equal(t, "shard window "+w.String()+" is not a whole number of seconds", err.Error())
+	}
+
+	s, err := NewSharded(t.TempDir(), 10*time.Second)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Equal(t, int64(20), s.windowStart(time.Unix(29, 999)))
+	assert.Equal(t, int64(30), s.windowStart(time.Unix(30, 0)))
+	assert.Equal(t, int64(-10), s.windowStart(time.Unix(-1, 0)))
+	assert.Equal(t, int64(-10), s.windowStart(time.Unix(-10, 0)))
+}
+
+func TestShardedPersist(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSharded(dir, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, "Sharded", s.Name())
+
+	// 23:01 to 01:30 the next day, over three shards
+	ps := getPointsShuffle(0, 150)
+	assert.Nil(t, s.Add(ps[:100]...))
+	assert.Nil(t, s.Add(ps[100:]...))
+	assert.Equal(t, 150, s.Len())
+	assert.Equal(t, 3, len(s.shards))
+	assert.Nil(t, s.Close())
+
+	for _, f := range []string{"serializer.json", "shard-1704927600.dat", "shard-1704927600.dat.idx", "shard-1704927600.dat.blk", "shard-1704927600.meta"} {
+		assert.FileExists(t, filepath.Join(dir, f))
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "shard-1704927600.meta"))
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"start": 1704927600, "min_ts": 1704927662000000, "max_ts": 1704931142000000, "points": 59}`, string(b))
+
+	s, err = NewSharded(dir, time.Hour)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Equal(t, 150, s.Len())
+	assert.Equal(t, 0, openShards(s))
+	assert.Equal(t, `Sharded(`+dir+`, 1h0m0s): {
+2024-01-10 23:00:00 +0000 UTC: 59 points
+2024-01-11 00:00:00 +0000 UTC: 60 points
+2024-01-11 01:00:00 +0000 UTC: 31 points
+}`, s.String())
+
+	// only the shards in range are opened, and results are in time order
+	r := searchAll(t, s, getPoint(70).Ts, getPoint(80).Ts)
+	assert.Equal(t, 11, len(r))
+	for i := range r {
+		assert.True(t, getPoint(uint32(70+i)).Equal(r[i]))
+	}
+	assert.Equal(t, 1, openShards(s))
+	assert.Empty(t, searchAll(t, s, getPoint(0).Ts.Add(-time.Hour), getPoint(0).Ts.Add(-time.Second)))
+	assert.Equal(t, 1, openShards(s))
+
+	cmpQResults(t, nil, getPoints(0, 150), searchAll(t, s, getPoint(0).Ts, getPoint(149).Ts))
+
+	// adding to an existing shard after reopening
+	assert.Nil(t, s.Add(getPoint(150)))
+	assert.Equal(t, 151, s.Len())
+	r = searchAll(t, s, getPoint(149).Ts, getPoint(150).Ts)
+	assert.Equal(t, 2, len(r))
+}
+
+func TestShardedRebuildMeta(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSharded(dir, time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Add(getPoints(0, 10)...))
+	assert.Nil(t, s.Close())
+
+	// metadata saved before the last points were written
+	meta := filepath.Join(dir, "shard-1704927600.meta")
+	stale, _ := json.Marshal(shardMeta{Start: 1704927600, MinTs: 1, MaxTs: 2, Points: 4})
+	assert.Nil(t, os.WriteFile(meta, stale, 0644))
+
+	s, err = NewSharded(dir, time.Hour)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Equal(t, 10, s.Len())
+	assert.Equal(t, shardMeta{
+		Start:  1704927600,
+		MinTs:  getPoint(0).Ts.UnixMicro(),
+		MaxTs:  getPoint(9).Ts.UnixMicro(),
+		Points: 10,
+	}, s.shards[0].meta)
+	assert.Equal(t, 0, openShards(s))
+	assert.Equal(t, 10, len(searchAll(t, s, getPoint(0).Ts, getPoint(9).Ts)))
+
+	os.Remove(meta)
+	s2, err := NewSharded(dir, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, s2.Len())
+	s2.Close()
+}
+
+func TestShardedBlocks(t *testing.T) {
+	s, err := NewSharded(t.TempDir(), 24*time.Hour)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// 541 points in the second shard, added out of order so that each block
+	// covers much of the day
+	ps := getPointsShuffle(0, 600)
+	for _, p := range ps {
+		i := p.Ts.Sub(getPoint(0).Ts) / time.Minute
+		p.Attrs["half"] = []string{"early", "late"}[i/300]
+		p.Attrs["index"] = fmt.Sprint(i)
+	}
+	assert.Nil(t, s.Add(ps...))
+
+	for _, q := range []*query.Query{
+		query.NewQuery(getPoint(0).Ts, getPoint(599).Ts, query.Equal("half", "late")),
+		query.NewQuery(getPoint(100).Ts, getPoint(399).Ts, query.Regex("index", "^1")),
+		query.NewQuery(getPoint(200).Ts, getPoint(210).Ts, query.True()),
+		query.NewQuery(getPoint(0).Ts, getPoint(599).Ts, query.Equal("index", "600")),
+	} {
+		var exp []*core.Point
+		for _, p := range ps {
+			if q.Match(p) {
+				exp = append(exp, p)
+			}
+		}
+		qe, err := s.Search(q)
+		assert.Nil(t, err)
+		r, err := qe.Fetch(1000)
+		assert.Nil(t, err)
+		cmpQResults(t, q, exp, r)
+	}
+}
+
+func TestShardedMapped(t *testing.T) {
+	s, err := NewSharded(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.SetDurability(file.DurabilityBuffer))
+
+	// 23:01 to 01:30 the next day, over three shards
+	ps := getPoints(0, 150)
+	assert.Nil(t, s.Add(ps...))
+	all := func() []*core.Point {
+		return searchAll(t, s, getPoint(0).Ts, getPoint(200).Ts)
+	}
+	assert.Equal(t, 150, len(all()))
+
+	// only the newest shard is read from its data file
+	assert.NotNil(t, s.shards[0].mapped)
+	assert.NotNil(t, s.shards[1].mapped)
+	assert.Nil(t, s.shards[2].mapped)
+
+	// a late point in a sealed shard is seen once it's mapped again, even
+	// though it was only buffered
+	late := core.NewPoint(getPoint(30).Ts.Add(time.Second))
+	assert.Nil(t, s.Add(late))
+	r := all()
+	assert.Equal(t, 151, len(r))
+	assert.True(t, slices.ContainsFunc(r, late.Equal))
+	assert.Equal(t, 60, s.shards[0].mapped.points)
+}
+
+func TestShardedConcurrent(t *testing.T) {
+	s, err := NewSharded(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.Add(getPoints(0, 150)...))
+	q := query.NewQuery(getPoint(0).Ts, getPoint(200).Ts, query.True())
+
+	// a mapping being read outlives its shard being dropped
+	sc := &ShardedCursor{s: s, q: q}
+	cur, err := sc.openShard(s.shards[0])
+	assert.Nil(t, err)
+	sc.cur = cur
+	n, err := s.DropBefore(time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC))
+	assert.Nil(t, err)
+	assert.Equal(t, 59, n)
+	assert.True(t, cur.sm.retired)
+	assert.Nil(t, sc.readBlock())
+	assert.Equal(t, 59, len(sc.buf))
+	assert.Nil(t, sc.cur)
+	assert.Equal(t, 0, cur.sm.readers)
+
+	// searches don't hold up writes, or each other
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.LessOrEqual(t, 91, len(searchAll(t, s, q.Start, q.End)))
+		}()
+		go func(i int) {
+			defer wg.Done()
+			late := core.NewPoint(getPoint(uint32(70 + i)).Ts.Add(time.Second))
+			assert.Nil(t, s.Add(late, getPoint(uint32(140+i))))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 99, len(searchAll(t, s, q.Start, q.End)))
+}
+
+func TestShardedStream(t *testing.T) {
+	// 23:01 to 15:40 the next day in one shard, and one point in the next
+	s, err := NewSharded(t.TempDir(), 48*time.Hour)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.Add(getPoints(0, 1000)...))
+	late := core.NewPoint(getPoint(500).Ts.Add(time.Second))
+	assert.Nil(t, s.Add(late, getPoint(2000)))
+	assert.Equal(t, 2, len(s.shards))
+	q := query.NewQuery(getPoint(0).Ts, getPoint(3000).Ts, query.True())
+
+	// only a block is read before returning the first points
+	sc := &ShardedCursor{s: s, q: q, shards: slices.Clone(s.shards)}
+	ps, err := sc.Fetch(10)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(ps))
+	assert.Equal(t, file.BlockRecords-10, len(sc.buf)+len(sc.cur.pending))
+	assert.Equal(t, 1, sc.cur.sm.readers)
+
+	// the late point is returned in order
+	for {
+		batch, err := sc.Fetch(100)
+		assert.Nil(t, err)
+		if len(batch) == 0 {
+			break
+		}
+		ps = append(ps, batch...)
+	}
+	assert.Equal(t, 1002, len(ps))
+	assert.True(t, slices.IsSortedFunc(ps, core.PointCmp))
+	assert.True(t, ps[501].Equal(late))
+	assert.Equal(t, 0, s.shards[0].mapped.readers)
+
+	// closing a query part way releases the shard it's reading
+	qe, err := s.Search(q)
+	assert.Nil(t, err)
+	ps, err = qe.Fetch(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ps))
+	assert.Equal(t, 1, s.shards[0].mapped.readers)
+	qe.Close()
+	assert.Equal(t, 0, s.shards[0].mapped.readers)
+}
+
+func TestShardedBloom(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSharded(dir, time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, s.SetBloom(0.01))
+	ps := getPoints(0, 150)
+	for i, p := range ps {
+		p.Attrs["request_id"] = fmt.Sprintf("req-%d", i)
+	}
+	assert.Nil(t, s.Add(ps...))
+	assert.Nil(t, s.Close())
+	assert.FileExists(t, filepath.Join(dir, "shard-1704927600.dat.bloom"))
+
+	s, err = NewSharded(dir, time.Hour)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.SetBloom(0.01))
+	search := func(fa query.FilterAttr) []*core.Point {
+		qe, err := s.Search(query.NewQuery(getPoint(0).Ts, getPoint(149).Ts, fa))
+		assert.Nil(t, err)
+		r, err := qe.Fetch(1000)
+		assert.Nil(t, err)
+		return r
+	}
+
+	// only the shard with the request is opened
+	r := search(query.Equal("request_id", "req-70"))
+	assert.Equal(t, 1, len(r))
+	assert.True(t, ps[70].Equal(r[0]))
+	assert.Equal(t, 1, openShards(s))
+	assert.Equal(t, 2, len(search(query.In("request_id", "req-0", "req-149", "req-150"))))
+	assert.Equal(t, 3, openShards(s))
+
+	// a shard written to isn't skipped until its filter is saved again
+	p := getPoint(1)
+	p.Attrs["request_id"] = "late"
+	assert.Nil(t, s.Add(p))
+	assert.Equal(t, 1, len(search(query.Equal("request_id", "late"))))
+	assert.Nil(t, s.shards[0].bloom)
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, 1, len(search(query.Equal("request_id", "late"))))
+	late := query.NewQuery(getPoint(0).Ts, getPoint(149).Ts, query.Equal("request_id", "late"))
+	assert.True(t, s.shards[0].bloom.MayMatch(late, s.ser))
+	assert.False(t, s.shards[1].bloom.MayMatch(late, s.ser))
+
+	assert.Equal(t, "bloom filter false positive rate -1 is not in [0, 1)", s.SetBloom(-1).Error())
+}
+
+func TestShardedDropBefore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSharded(dir, time.Hour)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.Add(getPoints(0, 150)...))
+
+	// a search started before the drop skips the dropped shards
+	qe, err := s.Search(query.NewQuery(getPoint(0).Ts, getPoint(149).Ts, query.True()))
+	assert.Nil(t, err)
+
+	// 00:30 is in the middle of the second shard, so only the first goes
+	n, err := s.DropBefore(getPoint(89).Ts)
+	assert.Nil(t, err)
+	assert.Equal(t, 59, n)
+	assert.Equal(t, 91, s.Len())
+	assert.NoFileExists(t, filepath.Join(dir, "shard-1704927600.dat"))
+	assert.NoFileExists(t, filepath.Join(dir, "shard-1704927600.dat.idx"))
+	assert.NoFileExists(t, filepath.Join(dir, "shard-1704927600.meta"))
+
+	r, err := qe.Fetch(1000)
+	assert.Nil(t, err)
+	assert.Equal(t, 91, len(r))
+	assert.True(t, getPoint(59).Equal(r[0]))
+
+	r = searchAll(t, s, getPoint(0).Ts, getPoint(149).Ts)
+	assert.Equal(t, 91, len(r))
+
+	n, err = s.DropBefore(getPoint(0).Ts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	n, err = s.DropBefore(getPoint(149).Ts.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 91, n)
+	assert.Equal(t, 0, s.Len())
+}
@@ -0,0 +1,311 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"equinox/internal/core"
+	"equinox/internal/query"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Number of points fetched from a query at a time when exporting
+const DefaultBatch = 1000
+
+// Interface for objects that stream points to an output format. Points are
+// written in the order given and may be buffered until Flush is called.
+type Encoder interface {
+	// Writes the given points
+	Encode(ps ...*core.Point) error
+
+	// Flushes any buffered output to the underlying writer
+	Flush() error
+
+	// MIME type of the output
+	ContentType() string
+}
+
+// Encoder that can also write points tagged with the series they're from, as
+// returned by multi-series queries
+type SeriesEncoder interface {
+	Encoder
+
+	// Writes the given points along with their series
+	EncodeSeries(ps ...*query.SeriesPoint) error
+}
+
+// Streams all results of the query to the encoder, fetching batch points at
+// a time and flushing after each batch. Returns the number of points written.
+func WriteQuery(qe *query.QueryExec, enc Encoder, batch int) (int, error) {
+	n := 0
+	for {
+		ps, err := qe.Fetch(batch)
+		if err != nil {
+			return n, err
+		}
+		if len(ps) == 0 {
+			break
+		}
+
+		err = enc.Encode(ps...)
+		if err != nil {
+			return n, err
+		}
+		n += len(ps)
+
+		err = enc.Flush()
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, enc.Flush()
+}
+
+// Streams all results of a multi-series query to the encoder, in the same way
+// as WriteQuery. Returns the number of points written.
+func WriteMerge(me *query.MergeExec, enc SeriesEncoder, batch int) (int, error) {
+	n := 0
+	for {
+		ps, err := me.Fetch(batch)
+		if err != nil {
+			return n, err
+		}
+		if len(ps) == 0 {
+			break
+		}
+
+		err = enc.EncodeSeries(ps...)
+		if err != nil {
+			return n, err
+		}
+		n += len(ps)
+
+		err = enc.Flush()
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, enc.Flush()
+}
+
+// Scans all results of the query and returns the sorted Vals keys and Attrs
+// keys found in them. This is used to determine CSV columns without
+// buffering the results; the query needs to be run again to export them.
+func Columns(qe *query.QueryExec, batch int) ([]string, []string, error) {
+	return MergedColumns([]*query.QueryExec{qe}, batch)
+}
+
+// Like Columns, but returns the keys found in the results of any of the
+// queries
+func MergedColumns(qes []*query.QueryExec, batch int) ([]string, []string, error) {
+	vals := make(map[string]bool)
+	attrs := make(map[string]bool)
+
+	for _, qe := range qes {
+		for {
+			ps, err := qe.Fetch(batch)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(ps) == 0 {
+				break
+			}
+
+			for _, p := range ps {
+				for k := range p.Vals {
+					vals[k] = true
+				}
+				for k := range p.Attrs {
+					attrs[k] = true
+				}
+			}
+		}
+	}
+
+	return sortedKeys(vals), sortedKeys(attrs), nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	r := make([]string, 0, len(m))
+	for k := range m {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return r
+}
+
+/****************************************************************************
+	CSVEncoder
+****************************************************************************/
+
+/*
+Writes points as CSV with a header row. Columns are:
+
+	ts, id, <vals...>, <attrs...>
+
+or for multi-series results:
+
+	ts, series, id, <vals...>, <attrs...>
+
+Timestamps are RFC3339 in UTC, and a value or attribute the point doesn't have
+is written as an empty field. Keys not in the configured columns are dropped.
+*/
+type CSVEncoder struct {
+	w      *csv.Writer
+	vals   []string
+	attrs  []string
+	series bool // whether there's a series column
+	header bool // whether the header has been written
+	rec    []string
+}
+
+// Creates a CSV encoder writing to w with the given value and attribute
+// columns, in that order.
+func NewCSVEncoder(w io.Writer, vals []string, attrs []string) *CSVEncoder {
+	return &CSVEncoder{w: csv.NewWriter(w), vals: vals, attrs: attrs}
+}
+
+// Creates a CSV encoder for multi-series results, which has a series column
+// before the id.
+func NewSeriesCSVEncoder(w io.Writer, vals []string, attrs []string) *CSVEncoder {
+	return &CSVEncoder{w: csv.NewWriter(w), vals: vals, attrs: attrs, series: true}
+}
+
+func (e *CSVEncoder) ContentType() string {
+	return "text/csv"
+}
+
+func (e *CSVEncoder) writeHeader() error {
+	rec := make([]string, 0, 3+len(e.vals)+len(e.attrs))
+	rec = append(rec, "ts")
+	if e.series {
+		rec = append(rec, "series")
+	}
+	rec = append(rec, "id")
+	rec = append(rec, e.vals...)
+	rec = append(rec, e.attrs...)
+	e.header = true
+	return e.w.Write(rec)
+}
+
+func (e *CSVEncoder) Encode(ps ...*core.Point) error {
+	for _, p := range ps {
+		err := e.write("", p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the points with their series. The series is dropped if the encoder
+// wasn't created with NewSeriesCSVEncoder.
+func (e *CSVEncoder) EncodeSeries(ps ...*query.SeriesPoint) error {
+	for _, sp := range ps {
+		err := e.write(sp.Series, sp.Point)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a row for the point, and the header first if it hasn't been yet
+func (e *CSVEncoder) write(series string, p *core.Point) error {
+	if !e.header {
+		err := e.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the record's slice is reused between rows
+	rec := e.rec[:0]
+	rec = append(rec, p.Ts.UTC().Format(time.RFC3339Nano))
+	if e.series {
+		rec = append(rec, series)
+	}
+	id := ""
+	if p.Id != nil {
+		id = p.Id.String()
+	}
+	rec = append(rec, id)
+
+	for _, k := range e.vals {
+		v, exists := p.Vals[k]
+		if exists {
+			rec = append(rec, strconv.FormatFloat(v, 'g', -1, 64))
+		} else {
+			rec = append(rec, "")
+		}
+	}
+	for _, k := range e.attrs {
+		rec = append(rec, p.Attrs[k])
+	}
+	e.rec = rec
+
+	return e.w.Write(rec)
+}
+
+// Flushes buffered rows. The header is written even if there were no points.
+func (e *CSVEncoder) Flush() error {
+	if !e.header {
+		err := e.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+/****************************************************************************
+	NDJSONEncoder
+****************************************************************************/
+
+// Writes points as newline-delimited JSON, one point per line in the same
+// representation used by the REST API. Multi-series results have an extra
+// Series field.
+type NDJSONEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func NewNDJSONEncoder(w io.Writer) *NDJSONEncoder {
+	bw := bufio.NewWriter(w)
+	return &NDJSONEncoder{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (e *NDJSONEncoder) ContentType() string {
+	return "application/x-ndjson"
+}
+
+func (e *NDJSONEncoder) Encode(ps ...*core.Point) error {
+	for _, p := range ps {
+		// json.Encoder terminates each value with a newline
+		err := e.enc.Encode(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *NDJSONEncoder) EncodeSeries(ps ...*query.SeriesPoint) error {
+	for _, sp := range ps {
+		err := e.enc.Encode(sp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *NDJSONEncoder) Flush() error {
+	return e.w.Flush()
+}
@@ -0,0 +1,154 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/query"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testStart = time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC)
+
+func testPoints() []*core.Point {
+	p1 := core.NewPoint(testStart)
+	p1.Vals["temp"] = 21.5
+	p1.Vals["area"] = 43
+	p1.Attrs["color"] = "red"
+
+	p2 := core.NewPoint(testStart.Add(90 * time.Second))
+	p2.Vals["temp"] = -1e-7
+	p2.Attrs["shape"] = "square, round"
+	p2.Attrs["color"] = `"blue"`
+
+	p3 := core.NewPoint(testStart.Add(time.Hour + 123456*time.Microsecond))
+	p3.Vals["humidity"] = 80
+
+	return []*core.Point{p1, p2, p3}
+}
+
+// returns engine containing testPoints, the points added, and a query that
+// matches all of them
+func testQueryExec(t *testing.T) (engine.PointIO, []*core.Point, *query.Query) {
+	io := engine.NewMemTree()
+	ps := testPoints()
+	err := io.Add(ps...)
+	assert.NoError(t, err)
+	q := query.NewQuery(testStart, testStart.Add(24*time.Hour), query.True())
+	return io, ps, q
+}
+
+func TestExportColumns(t *testing.T) {
+	io, _, q := testQueryExec(t)
+	qe, _ := io.Search(q)
+	vals, attrs, err := Columns(qe, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"area", "humidity", "temp"}, vals)
+	assert.Equal(t, []string{"color", "shape"}, attrs)
+}
+
+func TestExportCSV(t *testing.T) {
+	io, ps, q := testQueryExec(t)
+	qe, _ := io.Search(q)
+
+	var buf bytes.Buffer
+	enc := NewCSVEncoder(&buf, []string{"area", "humidity", "temp"}, []string{"color", "shape"})
+	assert.Equal(t, "text/csv", enc.ContentType())
+	n, err := WriteQuery(qe, enc, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, 5, len(lines))
+	assert.Equal(t, "ts,id,area,humidity,temp,color,shape", lines[0])
+	assert.Equal(t, "2024-01-10T23:01:02Z,"+ps[0].Id.String()+",43,,21.5,red,", lines[1])
+	assert.Equal(t, "2024-01-10T23:02:32Z,"+ps[1].Id.String()+`,,,-1e-07,"""blue""","square, round"`, lines[2])
+	assert.Equal(t, "2024-01-11T00:01:02.123456Z,"+ps[2].Id.String()+",,80,,,", lines[3])
+	assert.Equal(t, "", lines[4])
+
+	// subset of columns
+	qe, _ = io.Search(q)
+	buf.Reset()
+	_, err = WriteQuery(qe, NewCSVEncoder(&buf, []string{"temp"}, nil), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "ts,id,temp\n2024-01-10T23:01:02Z,"+ps[0].Id.String()+",21.5\n", strings.Join(strings.SplitAfter(buf.String(), "\n")[0:2], ""))
+
+	// header is written even without results
+	qe, _ = io.Search(query.NewQuery(testStart.Add(-time.Hour), testStart.Add(-time.Minute), query.True()))
+	buf.Reset()
+	n, err = WriteQuery(qe, NewCSVEncoder(&buf, []string{"temp"}, []string{"color"}), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "ts,id,temp,color\n", buf.String())
+}
+
+func TestExportNDJSON(t *testing.T) {
+	io, ps, q := testQueryExec(t)
+	qe, _ := io.Search(q)
+
+	var buf bytes.Buffer
+	enc := NewNDJSONEncoder(&buf)
+	assert.Equal(t, "application/x-ndjson", enc.ContentType())
+	n, err := WriteQuery(qe, enc, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, 3, len(lines))
+	for i, line := range lines {
+		p := core.NewPointEmpty()
+		err := json.Unmarshal([]byte(line), p)
+		assert.NoError(t, err)
+		assert.True(t, ps[i].Equal(p))
+	}
+	assert.Equal(t, `{"Ts":"2024-01-10T23:01:02Z","Vals":{"area":43,"temp":21.5},"Attrs":{"color":"red"},"Id":"`+ps[0].Id.String()+`"}`, lines[0])
+}
+
+func TestExportMerge(t *testing.T) {
+	io, ps, q := testQueryExec(t)
+	other := engine.NewMemTree()
+	p := core.NewPoint(testStart.Add(time.Minute))
+	p.Vals["pressure"] = 2
+	assert.NoError(t, other.Add(p))
+
+	search := func() *query.MergeExec {
+		qe1, _ := io.Search(q)
+		qe2, _ := other.Search(q)
+		return query.NewMergeExec(q, []string{"a", "b"}, []*query.QueryExec{qe1, qe2})
+	}
+
+	qe1, _ := io.Search(q)
+	qe2, _ := other.Search(q)
+	vals, attrs, err := MergedColumns([]*query.QueryExec{qe1, qe2}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"area", "humidity", "pressure", "temp"}, vals)
+	assert.Equal(t, []string{"color", "shape"}, attrs)
+
+	var buf bytes.Buffer
+	n, err := WriteMerge(search(), NewSeriesCSVEncoder(&buf, []string{"pressure", "temp"}, []string{"color"}), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	exp := "ts,series,id,pressure,temp,color\n" +
+		"2024-01-10T23:01:02Z,a," + ps[0].Id.String() + ",,21.5,red\n" +
+		"2024-01-10T23:02:02Z,b," + p.Id.String() + ",2,,\n" +
+		"2024-01-10T23:02:32Z,a," + ps[1].Id.String() + `,,-1e-07,"""blue"""` + "\n" +
+		"2024-01-11T00:01:02.123456Z,a," + ps[2].Id.String() + ",,,\n"
+	assert.Equal(t, exp, buf.String())
+
+	buf.Reset()
+	n, err = WriteMerge(search(), NewNDJSONEncoder(&buf), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, 4, len(lines))
+	var sp query.SeriesPoint
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &sp))
+	assert.Equal(t, "b", sp.Series)
+	assert.True(t, p.Equal(sp.Point))
+	assert.Equal(t, `{"Series":"a","Ts":"2024-01-10T23:01:02Z","Vals":{"area":43,"temp":21.5},"Attrs":{"color":"red"},"Id":"`+ps[0].Id.String()+`"}`, lines[0])
+}
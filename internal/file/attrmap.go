@@ -1,5 +1,7 @@
 package file
 
+import "encoding/json"
+
 type AttrMap struct {
 	str2int map[string]uint32
 	int2str map[uint32]string
@@ -41,6 +43,13 @@ func (m *AttrMap) HasAttr(s string) bool {
 	return exist
 }
 
+// Returns the index of the specified attribute along with bool specifying
+// whether it exists or not; does not create it if it doesn't exist
+func (m *AttrMap) Index(s string) (uint32, bool) {
+	idx, exist := m.str2int[s]
+	return idx, exist
+}
+
 // Transforms given attribute to an index, creating it in the map if it doesn't
 // already exist
 func (m *AttrMap) ToIndex(s string) uint32 {
@@ -65,3 +74,31 @@ func (m *AttrMap) DeleteAttr(s string) {
 	delete(m.int2str, idx)
 	delete(m.str2int, s)
 }
+
+// JSON form of an AttrMap. Next is kept so that indexes of deleted
+// attributes aren't reused.
+type attrMapJSON struct {
+	Next    uint32            `json:"next"`
+	Strings map[uint32]string `json:"strings"`
+}
+
+func (m *AttrMap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(attrMapJSON{Next: m.numattr, Strings: m.int2str})
+}
+
+func (m *AttrMap) UnmarshalJSON(b []byte) error {
+	j := attrMapJSON{}
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+
+	*m = *NewAttrMap()
+	m.numattr = j.Next
+	for idx, s := range j.Strings {
+		m.int2str[idx] = s
+		m.str2int[s] = idx
+		m.numattr = max(m.numattr, idx+1)
+	}
+	return nil
+}
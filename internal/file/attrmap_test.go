@@ -16,8 +16,14 @@ func TestBasic(t *testing.T) {
 	assert.Equal(t, uint32(0), m.Length())
 	assert.False(t, m.HasIndex(i1))
 	assert.False(t, m.HasAttr(s1))
+	_, exist := m.Index(s1)
+	assert.False(t, exist)
+	assert.Equal(t, uint32(0), m.Length())
 
 	i1 = m.ToIndex(s1)
+	idx, exist := m.Index(s1)
+	assert.True(t, exist)
+	assert.Equal(t, i1, idx)
 
 	assert.Equal(t, uint32(0), i1)
 	assert.True(t, m.HasIndex(i1))
@@ -0,0 +1,254 @@
+package file
+
+import (
+	"equinox/internal/core"
+	"fmt"
+)
+
+// How far a write goes before Write and WriteBatch return
+type Durability int
+
+const (
+	// Records are synced to disk. Writers that arrive while a sync is in
+	// progress are synced together by the next one.
+	DurabilitySync Durability = iota
+
+	// Records are handed to the OS, so they survive the process crashing
+	// but not the machine.
+	DurabilityWrite
+
+	// Records are kept in memory until WriteBufferSize bytes are buffered,
+	// or Flush or Close is called.
+	DurabilityBuffer
+)
+
+// Buffered bytes at which a DurabilityBuffer file writes out its records
+const WriteBufferSize = 1 << 20
+
+// Point to be written under an index
+type Record struct {
+	Idx   uint32
+	Point *core.Point
+}
+
+// Encoded records waiting to be written. Writers waiting on a sync wait for
+// the buffer holding their records to be done.
+type writeBuf struct {
+	data []byte
+	recs []bufRec
+	done chan struct{} // closed once written
+	err  error
+}
+
+type bufRec struct {
+	idx uint32
+	pos int // start of the record in data
+}
+
+func newWriteBuf() *writeBuf {
+	return &writeBuf{done: make(chan struct{})}
+}
+
+// Sets how far writes go before returning, flushing and syncing anything
+// already buffered. The default is DurabilitySync.
+func (df *DataFile) SetDurability(d Durability) error {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	df.durability = d
+	return df.flush(true)
+}
+
+func (df *DataFile) Write(idx uint32, p *core.Point) error {
+	return df.WriteBatch([]Record{{Idx: idx, Point: p}})
+}
+
+/*
+Writes a batch of records. The batch is encoded up front, so if any record
+can't be written, such as one that doesn't fit its slot, none are. With
+DurabilitySync, concurrent batches are written and synced together: the first
+writer syncs its batch while later ones buffer theirs, and the next writer
+to find the file idle syncs all of those at once.
+*/
+func (df *DataFile) WriteBatch(recs []Record) error {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	b := df.buf
+	nrecs, ndata := len(b.recs), len(b.data)
+	for _, r := range recs {
+		err := df.buffer(r.Idx, r.Point)
+		if err != nil {
+			b.recs, b.data = b.recs[:nrecs], b.data[:ndata]
+			return err
+		}
+	}
+
+	switch df.durability {
+	case DurabilityBuffer:
+		if len(b.data) < WriteBufferSize {
+			return nil
+		}
+		return df.flush(false)
+	case DurabilityWrite:
+		return df.flush(false)
+	}
+
+	for {
+		select {
+		case <-b.done:
+			// synced along with someone else's batch
+			return b.err
+		default:
+		}
+		if !df.flushing {
+			return df.flush(true)
+		}
+		df.cond.Wait()
+	}
+}
+
+// Writes out buffered records and syncs them, and saves the block index
+func (df *DataFile) Flush() error {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	err := df.flush(true)
+	if err != nil {
+		return err
+	}
+	return df.saveBlocks()
+}
+
+// Encodes a point into the write buffer
+func (df *DataFile) buffer(idx uint32, p *core.Point) error {
+	if df.version != FormatFixed && df.flags&dfFlagHasBase == 0 {
+		// timestamps are relative to the first one written, keeping deltas
+		// small
+		df.base_ts = p.Ts.UnixMicro()
+		df.flags |= dfFlagHasBase
+		err := df.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := df.encodeRecord(p)
+	if err != nil {
+		return err
+	}
+	df.buf.recs = append(df.buf.recs, bufRec{idx: idx, pos: len(df.buf.data)})
+	df.buf.data = append(df.buf.data, data...)
+	if df.blocks != nil {
+		df.blocks.add(idx, p)
+	}
+	return nil
+}
+
+/*
+Writes out the buffered records, syncing them if sync is set. Must be called
+with mu held, which is released during the write so that other writers can
+buffer the next batch; anything reading the file's state waits for flushing
+to be cleared.
+*/
+func (df *DataFile) flush(sync bool) error {
+	for df.flushing {
+		df.cond.Wait()
+	}
+	b := df.buf
+	if len(b.recs) == 0 && !sync {
+		return nil
+	}
+
+	df.buf = newWriteBuf()
+	df.flushing = true
+	df.mu.Unlock()
+	err := df.write(b, sync)
+	df.mu.Lock()
+	df.flushing = false
+
+	b.err = err
+	close(b.done)
+	df.cond.Broadcast()
+	return err
+}
+
+// Writes a buffer's records to disk, combining writes to consecutive indexes
+func (df *DataFile) write(b *writeBuf, sync bool) error {
+	if df.indexed() {
+		return df.append(b, sync)
+	}
+
+	size := int(df.record_size)
+	for i := 0; i < len(b.recs); {
+		j := i + 1
+		for j < len(b.recs) && b.recs[j].idx == b.recs[j-1].idx+1 && b.recs[j].pos == b.recs[j-1].pos+size {
+			j++
+		}
+		r := b.recs[i]
+		_, err := df.fd.WriteAt(b.data[r.pos:r.pos+(j-i)*size], df.getOffset(r.idx))
+		if err != nil {
+			return err
+		}
+		i = j
+	}
+
+	if sync {
+		return df.fd.Sync()
+	}
+	return nil
+}
+
+// Appends a buffer's records to an indexed file and points their indexes at
+// them. When syncing, the records are synced before the index is updated, so
+// the index never refers to a partly written record.
+func (df *DataFile) append(b *writeBuf, sync bool) error {
+	offset := df.end
+	_, err := df.fd.WriteAt(b.data, offset)
+	if err != nil {
+		return err
+	}
+	df.end += int64(len(b.data))
+	if sync {
+		err = df.fd.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range b.recs {
+		if int(r.idx) >= len(df.offsets) {
+			df.offsets = append(df.offsets, make([]int64, int(r.idx)+1-len(df.offsets))...)
+		}
+		df.offsets[r.idx] = offset + int64(r.pos)
+	}
+
+	for i := 0; i < len(b.recs); {
+		j := i + 1
+		for j < len(b.recs) && b.recs[j].idx == b.recs[j-1].idx+1 {
+			j++
+		}
+		first := b.recs[i].idx
+		entries := make([]byte, 0, (j-i)*8)
+		for idx := first; idx <= b.recs[j-1].idx; idx++ {
+			entries = byteord.AppendUint64(entries, uint64(df.offsets[idx]))
+		}
+		_, err = df.idxfd.WriteAt(entries, int64(first)*8)
+		if err != nil {
+			return fmt.Errorf("failed to write index %d: %s", first, err.Error())
+		}
+		i = j
+	}
+
+	if sync {
+		err = df.idxfd.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync index: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// Waits for any write in progress, and writes out buffered records so that
+// reads see them. Must be called with mu held.
+func (df *DataFile) settle() error {
+	return df.flush(len(df.buf.recs) > 0 && df.durability == DurabilitySync)
+}
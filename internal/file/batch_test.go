@@ -0,0 +1,225 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// returns a new data file in the current format, removed when the test ends
+func newTestDF(tb testing.TB, ser *Serializer) *DataFile {
+	fn, err := tempFileName()
+	assert.Nil(tb, err)
+	tb.Cleanup(func() {
+		os.Remove(fn)
+		os.Remove(fn + IndexSuffix)
+		os.Remove(fn + BlockIndexSuffix)
+	})
+
+	df, err := OpenNewDF(fn, ser)
+	assert.Nil(tb, err)
+	return df
+}
+
+func TestDFWriteBatch(t *testing.T) {
+	ser := NewSerializer()
+	df := newTestDF(t, ser)
+
+	// consecutive runs, a gap and a rewrite
+	var recs []Record
+	for _, i := range []uint32{0, 1, 2, 5, 6, 1} {
+		recs = append(recs, Record{Idx: i, Point: getPoint(i)})
+	}
+	recs[5].Point = getPoint(9)
+	assert.Nil(t, df.WriteBatch(recs))
+	assert.Nil(t, df.WriteBatch(nil))
+	df.Close()
+
+	df, err := OpenExistingDF(df.path, ser)
+	assert.Nil(t, err)
+	defer df.Close()
+	n, err := df.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+	for i, want := range map[uint32]uint32{0: 0, 1: 9, 2: 2, 5: 5, 6: 6} {
+		p, err := df.Read(i)
+		assert.Nil(t, err)
+		assert.True(t, getPoint(want).Equal(p), "index %d", i)
+	}
+	for _, i := range []uint32{3, 4} {
+		_, err := df.Read(i)
+		assert.ErrorIs(t, err, ErrEmptyRecord)
+	}
+}
+
+func TestDFWriteBatchSlots(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+
+	ser := NewSerializer()
+	df, err := openNewDF(fn, ser, 64, FormatCompact)
+	assert.Nil(t, err)
+	defer df.Close()
+
+	var recs []Record
+	for _, i := range []uint32{3, 4, 5, 0} {
+		recs = append(recs, Record{Idx: i, Point: getPoint(i)})
+	}
+	assert.Nil(t, df.WriteBatch(recs))
+
+	// a batch with a record that doesn't fit is not written at all
+	big := getPoint(1)
+	for i := 0; i < 10; i++ {
+		big.Vals[fmt.Sprintf("v%d", i)] = float64(i)
+	}
+	err = df.WriteBatch([]Record{{Idx: 1, Point: getPoint(1)}, {Idx: 2, Point: big}})
+	assert.Equal(t, "record of 121 bytes exceeds record size 64", err.Error())
+
+	for i := uint32(0); i < 6; i++ {
+		p, err := df.Read(i)
+		if i == 1 || i == 2 {
+			assert.ErrorIs(t, err, ErrEmptyRecord)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.True(t, getPoint(i).Equal(p))
+	}
+}
+
+func TestDFBuffered(t *testing.T) {
+	ser := NewSerializer()
+	df := newTestDF(t, ser)
+	assert.Nil(t, df.SetDurability(DurabilityBuffer))
+
+	for i := uint32(0); i < 10; i++ {
+		assert.Nil(t, df.Write(i, getPoint(i)))
+	}
+
+	// nothing but the header has been written yet
+	st, err := os.Stat(df.path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(headerSize(FormatVersion)), st.Size())
+
+	// reads see buffered records
+	p, err := df.Read(7)
+	assert.Nil(t, err)
+	assert.True(t, getPoint(7).Equal(p))
+	st, err = os.Stat(df.path)
+	assert.Nil(t, err)
+	assert.Greater(t, st.Size(), int64(headerSize(FormatVersion)))
+
+	assert.Nil(t, df.Write(10, getPoint(10)))
+	assert.Nil(t, df.Close())
+	df, err = OpenExistingDF(df.path, ser)
+	assert.Nil(t, err)
+	defer df.Close()
+	n, err := df.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 11, n)
+}
+
+func TestDFGroupCommit(t *testing.T) {
+	ser := NewSerializer()
+	df := newTestDF(t, ser)
+	defer df.Close()
+
+	var wg sync.WaitGroup
+	for w := uint32(0); w < 8; w++ {
+		wg.Add(1)
+		go func(w uint32) {
+			defer wg.Done()
+			for i := w * 20; i < (w+1)*20; i += 4 {
+				var recs []Record
+				for j := i; j < i+4; j++ {
+					recs = append(recs, Record{Idx: j, Point: getPoint(j)})
+				}
+				assert.Nil(t, df.WriteBatch(recs))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	n, err := df.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 160, n)
+	for i := uint32(0); i < 160; i++ {
+		p, err := df.Read(i)
+		assert.Nil(t, err)
+		assert.True(t, getPoint(i).Equal(p))
+	}
+}
+
+// Writes b.N points, batch at a time, so ns/op is per point
+func benchmarkWrite(b *testing.B, d Durability, batch int) {
+	ser := NewSerializer()
+	df := newTestDF(b, ser)
+	defer df.Close()
+	assert.Nil(b, df.SetDurability(d))
+
+	ps := make([]Record, 1000)
+	for i := range ps {
+		ps[i] = Record{Idx: uint32(i), Point: getPoint(uint32(i))}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batch {
+		recs := make([]Record, 0, batch)
+		for j := i; j < min(i+batch, b.N); j++ {
+			recs = append(recs, Record{Idx: uint32(j), Point: ps[j%len(ps)].Point})
+		}
+		err := df.WriteBatch(recs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err := df.Flush()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkDFWrite(b *testing.B) {
+	benchmarkWrite(b, DurabilitySync, 1)
+}
+
+func BenchmarkDFWriteBatch100(b *testing.B) {
+	benchmarkWrite(b, DurabilitySync, 100)
+}
+
+func BenchmarkDFWriteNoSync(b *testing.B) {
+	benchmarkWrite(b, DurabilityWrite, 1)
+}
+
+func BenchmarkDFWriteBuffered(b *testing.B) {
+	benchmarkWrite(b, DurabilityBuffer, 1)
+}
+
+// Concurrent single point writers, which group commit shares syncs between
+func BenchmarkDFWriteParallel(b *testing.B) {
+	ser := NewSerializer()
+	df := newTestDF(b, ser)
+	defer df.Close()
+	p := getPoint(0)
+
+	var mu sync.Mutex
+	next := uint32(0)
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.Lock()
+			idx := next
+			next++
+			mu.Unlock()
+			err := df.Write(idx, p)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package file
+
+import "errors"
+
+var errBitsExhausted = errors.New("bit stream exhausted")
+
+// Appends values to a byte slice bit by bit, most significant bit first
+type bitWriter struct {
+	b     []byte
+	nfree int // unused bits in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.nfree == 0 {
+		w.b = append(w.b, 0)
+		w.nfree = 8
+	}
+	w.nfree--
+	if bit {
+		w.b[len(w.b)-1] |= 1 << w.nfree
+	}
+}
+
+// Writes the low n bits of v
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for n > 0 {
+		if w.nfree == 0 {
+			w.b = append(w.b, 0)
+			w.nfree = 8
+		}
+		k := min(n, w.nfree)
+		n -= k
+		w.nfree -= k
+		chunk := byte(v>>n) & (1<<k - 1)
+		w.b[len(w.b)-1] |= chunk << w.nfree
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.b
+}
+
+// Reads values written by a bitWriter
+type bitReader struct {
+	b   []byte
+	pos int // bit position
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= 8*len(r.b) {
+		return false, errBitsExhausted
+	}
+	bit := r.b[r.pos/8]&(1<<(7-r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+// Reads n bits, returning them in the low bits of the result
+func (r *bitReader) readBits(n int) (uint64, error) {
+	if r.pos+n > 8*len(r.b) {
+		return 0, errBitsExhausted
+	}
+	var v uint64
+	for n > 0 {
+		used := r.pos % 8
+		k := min(n, 8-used)
+		chunk := uint64(r.b[r.pos/8]>>(8-used-k)) & (1<<k - 1)
+		v = v<<k | chunk
+		n -= k
+		r.pos += k
+	}
+	return v, nil
+}
@@ -0,0 +1,382 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"equinox/internal/core"
+	"equinox/internal/query"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"time"
+)
+
+/*
+Block format, for compressing a run of points:
+count: unsigned varint
+timestamps: length-prefixed Gorilla timestamp stream
+
+values columns: unsigned varint
+Then for each column:
+- key: unsigned varint
+- present: unsigned varint, the number of points with this value
+- bitmap: ceil(count/8) bytes marking those points, omitted if all have it
+- values: length-prefixed Gorilla float stream of the present values
+
+attribute sets: unsigned varint
+Then for each distinct set of attributes:
+- set length: unsigned varint
+- key, value: unsigned varint each
+
+runs: unsigned varint
+Then for each run of consecutive points with the same attributes:
+- set: unsigned varint
+- length: unsigned varint
+
+Points should be in time order for timestamps to compress well, and the
+BlockCursor relies on it. Regularly spaced points with slowly changing values
+take a few bits each per column.
+*/
+func (s *Serializer) EncodeBlock(ps []*core.Point) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(ps)))
+
+	te := timeEncoder{}
+	for _, p := range ps {
+		te.write(p.Ts.UnixMicro())
+	}
+	b = appendBytes(b, te.w.bytes())
+
+	// one column per value key, in a fixed order
+	var keys []string
+	seen := make(map[string]bool)
+	for _, p := range ps {
+		for k := range p.Vals {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		fe := floatEncoder{}
+		bitmap := make([]byte, (len(ps)+7)/8)
+		for i, p := range ps {
+			if v, exists := p.Vals[k]; exists {
+				fe.write(v)
+				bitmap[i/8] |= 1 << (7 - i%8)
+			}
+		}
+		b = binary.AppendUvarint(b, uint64(s.valkey.ToIndex(k)))
+		b = binary.AppendUvarint(b, uint64(fe.n))
+		if fe.n != len(ps) {
+			b = append(b, bitmap...)
+		}
+		b = appendBytes(b, fe.w.bytes())
+	}
+
+	// attributes as runs of distinct sets
+	var sets []map[string]string
+	var runs []blockRun
+	for _, p := range ps {
+		if len(runs) > 0 && maps.Equal(sets[runs[len(runs)-1].set], p.Attrs) {
+			runs[len(runs)-1].len++
+			continue
+		}
+		set := -1
+		for i := range sets {
+			if maps.Equal(sets[i], p.Attrs) {
+				set = i
+				break
+			}
+		}
+		if set < 0 {
+			set = len(sets)
+			sets = append(sets, p.Attrs)
+		}
+		runs = append(runs, blockRun{set: set, len: 1})
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(sets)))
+	for _, attrs := range sets {
+		b = binary.AppendUvarint(b, uint64(len(attrs)))
+		for k, v := range attrs {
+			b = binary.AppendUvarint(b, uint64(s.attrkey.ToIndex(k)))
+			b = binary.AppendUvarint(b, uint64(s.attrval.ToIndex(v)))
+		}
+	}
+	b = binary.AppendUvarint(b, uint64(len(runs)))
+	for _, r := range runs {
+		b = binary.AppendUvarint(b, uint64(r.set))
+		b = binary.AppendUvarint(b, uint64(r.len))
+	}
+
+	return b
+}
+
+// Run of points sharing an attribute set
+type blockRun struct {
+	set int
+	len int
+}
+
+type blockCol struct {
+	key     string
+	present []byte // bitmap, or nil if every point has a value
+	dec     floatDecoder
+}
+
+// Iterator over the points in a block, decoding them one at a time
+type BlockIter struct {
+	n     int
+	i     int
+	ts    timeDecoder
+	cols  []blockCol
+	sets  []map[string]string
+	runs  []blockRun
+	run   int // current run
+	inrun int // points left in the current run
+}
+
+/*
+Returns an iterator over the points in a block written by EncodeBlock. The
+block's layout and attributes are read straight away, so a malformed block is
+reported here; timestamps and values are decoded as the iterator advances.
+*/
+func (s *Serializer) DecodeBlock(b []byte) (*BlockIter, error) {
+	it, err := s.decodeBlock(b)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("block truncated after %d bytes", len(b))
+	}
+	return it, err
+}
+
+func (s *Serializer) decodeBlock(b []byte) (*BlockIter, error) {
+	buf := bytes.NewReader(b)
+	it := &BlockIter{}
+
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	it.n = int(n)
+	tsb, err := readBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	it.ts.r = bitReader{b: tsb}
+
+	ncols, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	it.cols = make([]blockCol, 0, min(ncols, uint64(buf.Len())))
+	for i := uint64(0); i < ncols; i++ {
+		k, err := readIndex(buf)
+		if err != nil {
+			return nil, err
+		}
+		key, exists := s.valkey.AtIndex(k)
+		if !exists {
+			return nil, fmt.Errorf("failed to find value key for index %d", k)
+		}
+		present, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		col := blockCol{key: key}
+		if present != n {
+			if (n+7)/8 > uint64(buf.Len()) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			col.present = make([]byte, (n+7)/8)
+			_, err = io.ReadFull(buf, col.present)
+			if err != nil {
+				return nil, err
+			}
+		}
+		vb, err := readBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+		col.dec.r = bitReader{b: vb}
+		it.cols = append(it.cols, col)
+	}
+
+	nsets, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	it.sets = make([]map[string]string, 0, min(nsets, uint64(buf.Len())))
+	for i := uint64(0); i < nsets; i++ {
+		nattrs, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		attrs := make(map[string]string, min(nattrs, uint64(buf.Len())))
+		for j := uint64(0); j < nattrs; j++ {
+			k, err := readIndex(buf)
+			if err != nil {
+				return nil, err
+			}
+			v, err := readIndex(buf)
+			if err != nil {
+				return nil, err
+			}
+			kstr, exists := s.attrkey.AtIndex(k)
+			if !exists {
+				return nil, fmt.Errorf("failed to find attr key for index %d", k)
+			}
+			vstr, exists := s.attrval.AtIndex(v)
+			if !exists {
+				return nil, fmt.Errorf("failed to find attr value for index %d", v)
+			}
+			attrs[kstr] = vstr
+		}
+		it.sets = append(it.sets, attrs)
+	}
+
+	nruns, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	total := uint64(0)
+	it.runs = make([]blockRun, 0, min(nruns, uint64(buf.Len())))
+	for i := uint64(0); i < nruns; i++ {
+		set, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		l, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		if set >= uint64(len(it.sets)) {
+			return nil, fmt.Errorf("attribute set %d out of range", set)
+		}
+		total += l
+		it.runs = append(it.runs, blockRun{set: int(set), len: int(l)})
+	}
+	if total != n {
+		return nil, fmt.Errorf("attribute runs cover %d of %d points", total, n)
+	}
+	if len(it.runs) > 0 {
+		it.inrun = it.runs[0].len
+	}
+
+	return it, nil
+}
+
+// Number of points in the block
+func (it *BlockIter) Len() int {
+	return it.n
+}
+
+// Returns the next point, or nil once every point has been returned
+func (it *BlockIter) Next() (*core.Point, error) {
+	if it.i >= it.n {
+		return nil, nil
+	}
+
+	ts, err := it.ts.next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode timestamp %d: %s", it.i, err.Error())
+	}
+	p := core.NewPoint(time.UnixMicro(ts).UTC())
+
+	for c := range it.cols {
+		col := &it.cols[c]
+		if col.present != nil && col.present[it.i/8]&(1<<(7-it.i%8)) == 0 {
+			continue
+		}
+		v, err := col.dec.next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode value '%s' %d: %s", col.key, it.i, err.Error())
+		}
+		p.Vals[col.key] = v
+	}
+
+	for it.inrun == 0 {
+		it.run++
+		it.inrun = it.runs[it.run].len
+	}
+	maps.Copy(p.Attrs, it.sets[it.runs[it.run].set])
+	it.inrun--
+
+	it.i++
+	return p, nil
+}
+
+// Cursor over the points in a sequence of blocks, whose points must be in
+// time order across blocks
+type BlockCursor struct {
+	ser    *Serializer
+	q      *query.Query
+	blocks [][]byte
+	it     *BlockIter
+}
+
+func NewBlockCursor(ser *Serializer, q *query.Query, blocks ...[]byte) *BlockCursor {
+	return &BlockCursor{ser: ser, q: q, blocks: blocks}
+}
+
+func (bc *BlockCursor) Fetch(n int) ([]*core.Point, error) {
+	r := make([]*core.Point, 0, n)
+	for len(r) < n {
+		if bc.it == nil {
+			if len(bc.blocks) == 0 {
+				break
+			}
+			it, err := bc.ser.DecodeBlock(bc.blocks[0])
+			if err != nil {
+				return nil, err
+			}
+			bc.it = it
+			bc.blocks = bc.blocks[1:]
+		}
+
+		p, err := bc.it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			bc.it = nil
+			continue
+		}
+
+		// points are in time order, so nothing after the end can match
+		if bc.q.CmpTime(p) > 0 {
+			bc.it = nil
+			bc.blocks = nil
+			break
+		}
+		if bc.q.Match(p) {
+			r = append(r, p)
+		}
+	}
+	return r, nil
+}
+
+// Appends b with its length as a varint
+func appendBytes(dst []byte, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// Reads bytes written by appendBytes
+func readBytes(buf *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(buf.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(buf, b)
+	return b, err
+}
@@ -0,0 +1,293 @@
+package file
+
+import (
+	"bytes"
+	"equinox/internal/core"
+	"equinox/internal/query"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// n points a second apart with slowly changing values and few attribute
+// combinations, like typical metrics
+func getBlockPoints(n int) []*core.Point {
+	ts := time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC)
+	ps := make([]*core.Point, n)
+	for i := range ps {
+		p := core.NewPoint(ts.Add(time.Duration(i) * time.Second))
+		p.Attrs["host"] = fmt.Sprintf("web%d", i/100%3)
+		p.Attrs["region"] = "us-east"
+		p.Vals["temp"] = 20 + float64(i%10)/2
+		p.Vals["load"] = math.Round(math.Sin(float64(i)/50)*100) / 100
+		ps[i] = p
+	}
+	return ps
+}
+
+func decodeAll(t *testing.T, s *Serializer, b []byte) []*core.Point {
+	it, err := s.DecodeBlock(b)
+	assert.Nil(t, err)
+	var ps []*core.Point
+	for {
+		p, err := it.Next()
+		assert.Nil(t, err)
+		if p == nil {
+			return ps
+		}
+		ps = append(ps, p)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	s := NewSerializer()
+	ps := getBlockPoints(1000)
+	b := s.EncodeBlock(ps)
+
+	it, err := s.DecodeBlock(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, it.Len())
+
+	act := decodeAll(t, s, b)
+	assert.Equal(t, len(ps), len(act))
+	for i := range ps {
+		assert.True(t, ps[i].Equal(act[i]), "point %d", i)
+	}
+
+	// a fraction of the size of a record per point
+	compact, _ := s.Serialize(ps[0])
+	assert.Less(t, len(b)*3, len(compact)*len(ps))
+}
+
+func TestBlockSparse(t *testing.T) {
+	s := NewSerializer()
+	ps := getPoints(20)
+	delete(ps[3].Vals, "area")
+	delete(ps[4].Vals, "area")
+	ps[7].Vals = map[string]float64{}
+	ps[8].Vals["extra"] = 1
+	ps[9].Attrs = map[string]string{}
+
+	act := decodeAll(t, s, s.EncodeBlock(ps))
+	assert.Equal(t, len(ps), len(act))
+	for i := range ps {
+		assert.True(t, ps[i].Equal(act[i]), "point %d", i)
+	}
+
+	// empty block
+	act = decodeAll(t, s, s.EncodeBlock(nil))
+	assert.Empty(t, act)
+}
+
+func getPoints(n int) []*core.Point {
+	ps := make([]*core.Point, n)
+	for i := range ps {
+		ps[i] = getPoint(uint32(i))
+	}
+	return ps
+}
+
+func TestBlockErrors(t *testing.T) {
+	s := NewSerializer()
+	b := s.EncodeBlock(getBlockPoints(10))
+
+	for _, n := range []int{0, 1, 10, len(b) - 1} {
+		_, err := s.DecodeBlock(b[:n])
+		assert.Equal(t, fmt.Sprintf("block truncated after %d bytes", n), err.Error())
+	}
+
+	_, err := NewSerializer().DecodeBlock(b)
+	assert.Equal(t, "failed to find value key for index 0", err.Error())
+
+	// runs that don't cover the points
+	bad := append([]byte(nil), b...)
+	bad[len(bad)-1] = 9
+	_, err = s.DecodeBlock(bad)
+	assert.Equal(t, "attribute runs cover 9 of 10 points", err.Error())
+
+	// a value stream cut short is reported by the iterator
+	bad = s.EncodeBlock([]*core.Point{getPoint(0), getPoint(1)})
+	it, err := s.DecodeBlock(bad)
+	assert.Nil(t, err)
+	it.cols[0].dec.r.b = it.cols[0].dec.r.b[:4]
+	_, err = it.Next()
+	assert.Equal(t, "failed to decode value 'area' 0: bit stream exhausted", err.Error())
+
+	// a value window wider than 64 bits
+	var w bitWriter
+	w.writeBits(math.Float64bits(1), 64)
+	w.writeBits(0b11, 2)
+	w.writeBits(31, 5)
+	w.writeBits(63, 6)
+	w.writeBits(0, 64)
+	it, err = s.DecodeBlock(bad)
+	assert.Nil(t, err)
+	it.cols[0].dec.r.b = w.bytes()
+	_, err = it.Next()
+	assert.Nil(t, err)
+	_, err = it.Next()
+	assert.Equal(t, "failed to decode value 'area' 1: invalid window of 31 leading zeros and 64 meaningful bits", err.Error())
+
+	// a timestamp with a 64 bit delta of delta that isn't all there
+	w = bitWriter{}
+	w.writeBits(1704927662000000, 64)
+	w.writeBits(0b11111, 5)
+	w.writeBits(0, 32)
+	it, err = s.DecodeBlock(bad)
+	assert.Nil(t, err)
+	it.ts.r.b = w.bytes()
+	_, err = it.Next()
+	assert.Nil(t, err)
+	_, err = it.Next()
+	assert.Equal(t, "failed to decode timestamp 1: bit stream exhausted", err.Error())
+
+	// and garbage in either stream is an error, never a panic
+	for i := 0; i < 256; i++ {
+		it, err = s.DecodeBlock(bad)
+		assert.Nil(t, err)
+		garbage := bytes.Repeat([]byte{byte(i)}, 12)
+		it.ts.r.b = garbage
+		it.cols[0].dec.r.b = garbage
+		for j := 0; j < 2; j++ {
+			if _, err = it.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func TestBlockCursor(t *testing.T) {
+	s := NewSerializer()
+	ps := getBlockPoints(300)
+	blocks := [][]byte{s.EncodeBlock(ps[:100]), s.EncodeBlock(ps[100:250]), s.EncodeBlock(ps[250:])}
+
+	fetchAll := func(q *query.Query) []*core.Point {
+		qe := query.NewQueryExec(q, NewBlockCursor(s, q, blocks...))
+		var r []*core.Point
+		for !qe.Done() {
+			batch, err := qe.Fetch(7)
+			assert.Nil(t, err)
+			r = append(r, batch...)
+		}
+		return r
+	}
+
+	// every point
+	r := fetchAll(query.NewQuery(ps[0].Ts, ps[299].Ts, query.True()))
+	assert.Equal(t, 300, len(r))
+	for i := range ps {
+		assert.True(t, ps[i].Equal(r[i]), "point %d", i)
+	}
+
+	// a time range spanning blocks, filtered by attribute
+	q := query.NewQuery(ps[50].Ts, ps[260].Ts, query.Equal("host", "web1"))
+	r = fetchAll(q)
+	assert.Equal(t, 100, len(r))
+	assert.True(t, ps[100].Equal(r[0]))
+	assert.True(t, ps[199].Equal(r[99]))
+
+	// nothing in range
+	r = fetchAll(query.NewQuery(ps[299].Ts.Add(time.Hour), ps[299].Ts.Add(2*time.Hour), query.True()))
+	assert.Empty(t, r)
+
+	// corrupt blocks are reported
+	bc := NewBlockCursor(s, q, []byte{1})
+	_, err := bc.Fetch(1)
+	assert.Equal(t, "block truncated after 1 bytes", err.Error())
+}
+
+/****************************************************************************
+	Benchmarks comparing the record formats with blocks. Each reports the
+	encoded size per point as B/point.
+****************************************************************************/
+
+const benchPoints = 1000
+
+func benchmarkRecords(b *testing.B, version uint16) {
+	s := NewSerializer()
+	ps := getBlockPoints(benchPoints)
+	base := ps[0].Ts.UnixMicro()
+	size := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		size = 0
+		for _, p := range ps {
+			rec, err := s.Encode(p, version, base)
+			if err != nil {
+				b.Fatal(err)
+			}
+			size += len(rec)
+		}
+	}
+	b.ReportMetric(float64(size)/benchPoints, "B/point")
+}
+
+func BenchmarkEncodeFixed(b *testing.B) {
+	benchmarkRecords(b, FormatFixed)
+}
+
+func BenchmarkEncodeCompact(b *testing.B) {
+	benchmarkRecords(b, FormatCompact)
+}
+
+func BenchmarkEncodeBlock(b *testing.B) {
+	s := NewSerializer()
+	ps := getBlockPoints(benchPoints)
+	var blk []byte
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk = s.EncodeBlock(ps)
+	}
+	b.ReportMetric(float64(len(blk))/benchPoints, "B/point")
+}
+
+func benchmarkDecodeRecords(b *testing.B, version uint16) {
+	s := NewSerializer()
+	ps := getBlockPoints(benchPoints)
+	base := ps[0].Ts.UnixMicro()
+	recs := make([][]byte, len(ps))
+	for i, p := range ps {
+		recs[i], _ = s.Encode(p, version, base)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, rec := range recs {
+			_, err := s.Decode(rec, version, base)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeFixed(b *testing.B) {
+	benchmarkDecodeRecords(b, FormatFixed)
+}
+
+func BenchmarkDecodeCompact(b *testing.B) {
+	benchmarkDecodeRecords(b, FormatCompact)
+}
+
+func BenchmarkDecodeBlock(b *testing.B) {
+	s := NewSerializer()
+	blk := s.EncodeBlock(getBlockPoints(benchPoints))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it, err := s.DecodeBlock(blk)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			p, err := it.Next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if p == nil {
+				break
+			}
+		}
+	}
+}
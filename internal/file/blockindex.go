@@ -0,0 +1,346 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"equinox/internal/core"
+	"equinox/internal/query"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Number of consecutive indexes summarized by each entry in a block index
+const BlockRecords = 128
+
+// Suffix of the block index file kept alongside an indexed data file
+const BlockIndexSuffix = ".blk"
+
+// Range of a value key's values within a block
+type ValRange struct {
+	Min float64
+	Max float64
+}
+
+/*
+Summary of the points written to a block of BlockRecords indexes, used to
+skip blocks that can't match a query without reading them. Summaries only
+ever widen, so they still cover points that have since been rewritten.
+*/
+type BlockSummary struct {
+	Points int   // records written, including rewrites
+	MinTs  int64 // Unix microseconds
+	MaxTs  int64
+	Vals   map[string]ValRange // NaNs are left out
+	Attrs  query.AttrValues
+}
+
+func (bs *BlockSummary) add(p *core.Point) {
+	ts := p.Ts.UnixMicro()
+	if bs.Points == 0 || ts < bs.MinTs {
+		bs.MinTs = ts
+	}
+	if bs.Points == 0 || ts > bs.MaxTs {
+		bs.MaxTs = ts
+	}
+	bs.Points++
+
+	for k, v := range p.Vals {
+		if math.IsNaN(v) {
+			continue
+		}
+		r, exists := bs.Vals[k]
+		if !exists {
+			r = ValRange{Min: v, Max: v}
+		}
+		bs.Vals[k] = ValRange{Min: min(r.Min, v), Max: max(r.Max, v)}
+	}
+	bs.Attrs.Add(p.Attrs)
+}
+
+// Returns false if no point in the block can match the query
+func (bs *BlockSummary) MayMatch(q *query.Query) bool {
+	return bs.Points > 0 &&
+		q.Start.UnixMicro() <= bs.MaxTs && q.End.UnixMicro() >= bs.MinTs &&
+		q.FA.MayMatch(bs.Attrs)
+}
+
+/*
+Summaries of each block of an indexed data file, saved at path +
+BlockIndexSuffix:
+end: 8 bytes, the size of the data file the summaries describe
+blocks: unsigned varint
+Then for each block:
+- points: unsigned varint
+- min_ts, max_ts: varint each
+- value keys: unsigned varint, then for each key its name as a
+length-prefixed string and its min and max as 8-byte floats
+- attribute keys: unsigned varint, then for each key its name, the number
+of values seen as an unsigned varint, and the values
+
+crc: 4 bytes, CRC32C of everything before it
+
+Every write to the data file changes its size, so an index saved before the
+last write is recognized by its end not matching.
+*/
+type blockIndex struct {
+	blocks []BlockSummary
+	dirty  bool // changed since it was saved
+}
+
+func newBlockIndex() *blockIndex {
+	return &blockIndex{}
+}
+
+// Adds the point written at idx to its block's summary
+func (bi *blockIndex) add(idx uint32, p *core.Point) {
+	b := int(idx / BlockRecords)
+	for len(bi.blocks) <= b {
+		bi.blocks = append(bi.blocks, BlockSummary{Vals: make(map[string]ValRange), Attrs: query.AttrValues{}})
+	}
+	bi.blocks[b].add(p)
+	bi.dirty = true
+}
+
+// Returns false if no point in the block holding idx can match the query
+func (bi *blockIndex) mayMatch(idx uint32, q *query.Query) bool {
+	b := int(idx / BlockRecords)
+	return b < len(bi.blocks) && bi.blocks[b].MayMatch(q)
+}
+
+// Returns the earliest timestamp written to each of the first n blocks
+func (bi *blockIndex) minTs(n int) []int64 {
+	r := make([]int64, n)
+	for b := range r {
+		r[b] = math.MinInt64 // a block missing from the index could hold anything
+		if b < len(bi.blocks) {
+			if bs := bi.blocks[b]; bs.Points > 0 {
+				r[b] = bs.MinTs
+			} else {
+				r[b] = math.MaxInt64
+			}
+		}
+	}
+	return r
+}
+
+func (bi *blockIndex) encode(end int64) []byte {
+	b := byteord.AppendUint64(nil, uint64(end))
+	b = binary.AppendUvarint(b, uint64(len(bi.blocks)))
+	for _, bs := range bi.blocks {
+		b = binary.AppendUvarint(b, uint64(bs.Points))
+		b = binary.AppendVarint(b, bs.MinTs)
+		b = binary.AppendVarint(b, bs.MaxTs)
+
+		b = binary.AppendUvarint(b, uint64(len(bs.Vals)))
+		for _, k := range sortedKeys(bs.Vals) {
+			b = appendBytes(b, []byte(k))
+			b = byteord.AppendUint64(b, math.Float64bits(bs.Vals[k].Min))
+			b = byteord.AppendUint64(b, math.Float64bits(bs.Vals[k].Max))
+		}
+
+		b = binary.AppendUvarint(b, uint64(len(bs.Attrs)))
+		for _, k := range sortedKeys(bs.Attrs) {
+			b = appendBytes(b, []byte(k))
+			b = binary.AppendUvarint(b, uint64(len(bs.Attrs[k])))
+			for _, v := range bs.Attrs[k] {
+				b = appendBytes(b, []byte(v))
+			}
+		}
+	}
+	return byteord.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// Decodes a block index, returning the data file size it was saved at
+func decodeBlockIndex(b []byte) (*blockIndex, int64, error) {
+	if len(b) < 8+crcSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	sum := byteord.Uint32(b[len(b)-crcSize:])
+	b = b[:len(b)-crcSize]
+	if crc32.Checksum(b, crcTable) != sum {
+		return nil, 0, ErrChecksum
+	}
+	end := int64(byteord.Uint64(b))
+	buf := bytes.NewReader(b[8:])
+
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	bi := &blockIndex{blocks: make([]BlockSummary, 0, min(n, uint64(buf.Len())))}
+	for i := uint64(0); i < n; i++ {
+		bs := BlockSummary{Vals: make(map[string]ValRange), Attrs: query.AttrValues{}}
+		points, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		bs.Points = int(points)
+		bs.MinTs, err = binary.ReadVarint(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		bs.MaxTs, err = binary.ReadVarint(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		nvals, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		for j := uint64(0); j < nvals; j++ {
+			k, err := readBytes(buf)
+			if err != nil {
+				return nil, 0, err
+			}
+			var r [2]uint64
+			err = binary.Read(buf, binary.BigEndian, &r)
+			if err != nil {
+				return nil, 0, err
+			}
+			bs.Vals[string(k)] = ValRange{Min: math.Float64frombits(r[0]), Max: math.Float64frombits(r[1])}
+		}
+
+		nattrs, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		for j := uint64(0); j < nattrs; j++ {
+			k, err := readBytes(buf)
+			if err != nil {
+				return nil, 0, err
+			}
+			nv, err := binary.ReadUvarint(buf)
+			if err != nil {
+				return nil, 0, err
+			}
+			vs := make([]string, 0, min(nv, uint64(buf.Len())))
+			for v := uint64(0); v < nv; v++ {
+				vb, err := readBytes(buf)
+				if err != nil {
+					return nil, 0, err
+				}
+				vs = append(vs, string(vb))
+			}
+			bs.Attrs[string(k)] = vs
+		}
+		bi.blocks = append(bi.blocks, bs)
+	}
+	if buf.Len() != 0 {
+		return nil, 0, fmt.Errorf("%d bytes left over", buf.Len())
+	}
+	return bi, end, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Loads the block index of an indexed data file, rebuilding it from the
+records if it's missing or out of date. If a record can't be read the file
+is left without a block index, so nothing is skipped, rather than failing to
+open a file that may only be partly damaged.
+*/
+func (df *DataFile) loadBlocks() {
+	b, err := os.ReadFile(df.path + BlockIndexSuffix)
+	if err == nil {
+		bi, end, err := decodeBlockIndex(b)
+		if err == nil && end == df.end {
+			df.blocks = bi
+			return
+		}
+	}
+
+	bi := newBlockIndex()
+	for i, off := range df.offsets {
+		if off == 0 {
+			continue
+		}
+		data, err := df.readIndexed(uint32(i))
+		if err != nil {
+			return
+		}
+		p, err := df.decode(data, uint32(i))
+		if err != nil {
+			return
+		}
+		bi.add(uint32(i), p)
+	}
+	df.blocks = bi
+}
+
+// Saves the block index, and the Bloom filter if there is one, if the index
+// has changed. Must be called with mu held and nothing buffered.
+func (df *DataFile) saveBlocks() error {
+	if df.blocks == nil || !df.blocks.dirty {
+		return nil
+	}
+	err := WriteFileAtomic(df.path+BlockIndexSuffix, df.blocks.encode(df.end))
+	if err != nil {
+		return fmt.Errorf("failed to save block index: %s", err.Error())
+	}
+	if df.bloomRate > 0 {
+		err = WriteFileAtomic(df.path+BloomSuffix, df.buildBloom().encode(df.end))
+		if err != nil {
+			return fmt.Errorf("failed to save bloom filter: %s", err.Error())
+		}
+	}
+	df.blocks.dirty = false
+	return nil
+}
+
+/*
+Returns false if no point in the block holding idx can match the query, so
+that the block's indexes can be skipped. Returns true for files without a
+block index.
+*/
+func (df *DataFile) BlockMayMatch(idx uint32, q *query.Query) bool {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	return df.blocks == nil || df.blocks.mayMatch(idx, q)
+}
+
+/*
+Returns the earliest timestamp, in Unix microseconds, of the points written to
+each block holding the first n indexes, or math.MaxInt64 for a block without
+any. Returns nil for files without a block index.
+*/
+func (df *DataFile) BlockMinTs(n uint32) []int64 {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if df.blocks == nil {
+		return nil
+	}
+	return df.blocks.minTs(int((n + BlockRecords - 1) / BlockRecords))
+}
+
+// Writes and syncs b to path by way of a temporary file, so that path is
+// either left as it was or fully written
+func WriteFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
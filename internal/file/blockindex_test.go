@@ -0,0 +1,148 @@
+package file
+
+import (
+	"equinox/internal/core"
+	"equinox/internal/query"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Writes getBlockPoints(300) to a new file, in three blocks: web0 and web1,
+// web1 and web2, and web2
+func writeBlocksDF(t *testing.T, ser *Serializer) *DataFile {
+	df := newTestDF(t, ser)
+	var recs []Record
+	for i, p := range getBlockPoints(300) {
+		recs = append(recs, Record{Idx: uint32(i), Point: p})
+	}
+	assert.Nil(t, df.WriteBatch(recs))
+	return df
+}
+
+func TestBlockSummary(t *testing.T) {
+	df := writeBlocksDF(t, NewSerializer())
+	defer df.Close()
+	ps := getBlockPoints(300)
+
+	assert.Equal(t, 3, len(df.blocks.blocks))
+	bs := df.blocks.blocks[1]
+	assert.Equal(t, 128, bs.Points)
+	assert.Equal(t, ps[128].Ts.UnixMicro(), bs.MinTs)
+	assert.Equal(t, ps[255].Ts.UnixMicro(), bs.MaxTs)
+	assert.Equal(t, ValRange{Min: 20, Max: 24.5}, bs.Vals["temp"])
+	assert.Equal(t, query.AttrValues{"host": {"web1", "web2"}, "region": {"us-east"}}, bs.Attrs)
+	assert.Equal(t, 44, df.blocks.blocks[2].Points)
+
+	mayMatch := func(idx uint32, start, end int, fa query.FilterAttr) bool {
+		return df.BlockMayMatch(idx, query.NewQuery(ps[start].Ts, ps[end].Ts, fa))
+	}
+	assert.True(t, mayMatch(0, 0, 299, query.True()))
+	assert.True(t, mayMatch(127, 0, 299, query.Equal("host", "web0")))
+	assert.False(t, mayMatch(128, 0, 299, query.Equal("host", "web0")))
+	assert.False(t, mayMatch(256, 0, 299, query.Regex("host", "[01]$")))
+	assert.True(t, mayMatch(256, 0, 299, query.And(query.Exists("region"), query.Not(query.Equal("host", "web2")))))
+
+	// time ranges touching either end of a block
+	assert.True(t, mayMatch(128, 0, 128, query.True()))
+	assert.False(t, mayMatch(128, 0, 127, query.True()))
+	assert.True(t, mayMatch(128, 255, 299, query.True()))
+	assert.False(t, mayMatch(128, 256, 299, query.True()))
+
+	// nothing written past the last block
+	assert.False(t, mayMatch(384, 0, 299, query.True()))
+}
+
+func TestBlockMinTs(t *testing.T) {
+	df := writeBlocksDF(t, NewSerializer())
+	defer df.Close()
+	ps := getBlockPoints(300)
+
+	exp := []int64{ps[0].Ts.UnixMicro(), ps[128].Ts.UnixMicro(), ps[256].Ts.UnixMicro()}
+	assert.Equal(t, exp, df.BlockMinTs(300))
+	assert.Equal(t, exp[:2], df.BlockMinTs(129))
+	assert.Equal(t, []int64{}, df.BlockMinTs(0))
+
+	// blocks the index doesn't cover could hold anything
+	assert.Equal(t, append(exp, math.MinInt64), df.BlockMinTs(400))
+
+	m, err := OpenMappedDF(df.path, df.ser)
+	assert.Nil(t, err)
+	defer m.Close()
+	assert.Equal(t, exp, m.BlockMinTs(300))
+}
+
+func TestBlockIndexEncode(t *testing.T) {
+	bi := newBlockIndex()
+	p := core.NewPoint(time.UnixMicro(-5))
+	p.Vals["inf"] = math.Inf(1)
+	p.Vals["nan"] = math.NaN()
+	p.Attrs["empty"] = ""
+	bi.add(1000, p)
+	bi.add(1, getPoint(1))
+
+	b := bi.encode(1234)
+	dec, end, err := decodeBlockIndex(b)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1234), end)
+	assert.Equal(t, bi.blocks, dec.blocks)
+	assert.Equal(t, map[string]ValRange{"inf": {Min: math.Inf(1), Max: math.Inf(1)}}, dec.blocks[7].Vals)
+
+	b[10] ^= 1
+	_, _, err = decodeBlockIndex(b)
+	assert.ErrorIs(t, err, ErrChecksum)
+	_, _, err = decodeBlockIndex(b[:5])
+	assert.NotNil(t, err)
+}
+
+func TestBlockIndexPersist(t *testing.T) {
+	ser := NewSerializer()
+	df := writeBlocksDF(t, ser)
+	blocks := df.blocks.blocks
+	assert.Nil(t, df.Close())
+	fn := df.path
+	saved, err := os.ReadFile(fn + BlockIndexSuffix)
+	assert.Nil(t, err)
+
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Equal(t, blocks, df.blocks.blocks)
+	assert.False(t, df.blocks.dirty)
+
+	// a later point in the first block
+	late := getBlockPoints(1000)[999]
+	assert.Nil(t, df.Write(5, late))
+	assert.Nil(t, df.Close())
+
+	// an index saved before that write is rebuilt
+	assert.Nil(t, os.WriteFile(fn+BlockIndexSuffix, saved, 0644))
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Equal(t, late.Ts.UnixMicro(), df.blocks.blocks[0].MaxTs)
+	// unlike a summary built up by writes, the rewritten point isn't counted
+	assert.Equal(t, 128, df.blocks.blocks[0].Points)
+	assert.Nil(t, df.Close())
+
+	os.Remove(fn + BlockIndexSuffix)
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Equal(t, late.Ts.UnixMicro(), df.blocks.blocks[0].MaxTs)
+	assert.Nil(t, df.Close())
+
+	// a damaged record leaves the file without a block index
+	os.Remove(fn + BlockIndexSuffix)
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	off := df.offsets[200]
+	assert.Nil(t, df.Close())
+	os.Remove(fn + BlockIndexSuffix)
+	flipBit(t, fn, off+10)
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	defer df.Close()
+	assert.Nil(t, df.blocks)
+	assert.True(t, df.BlockMayMatch(1000, query.NewQuery(late.Ts, late.Ts, query.True())))
+}
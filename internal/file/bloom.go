@@ -0,0 +1,207 @@
+package file
+
+import (
+	"equinox/internal/query"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+// Suffix of the Bloom filter file optionally kept alongside an indexed data
+// file
+const BloomSuffix = ".bloom"
+
+/*
+Bloom filter over the attribute key=value pairs in a data file, by their
+Serializer indexes. For high-cardinality attributes such as request IDs, the
+value sets in the block index are about as large as the records themselves;
+the filter answers whether a file may have a value in a few bits per value,
+without opening the file.
+
+File format, all integers big endian:
+end: 8 bytes, the size of the data file the filter describes
+hashes: 1 byte, the number of bits set for each pair
+bits: the filter, as 8-byte words
+crc: 4 bytes, CRC32C of everything before it
+*/
+type Bloom struct {
+	k    int
+	bits []uint64
+}
+
+// Creates a Bloom filter sized for n pairs with a false positive rate of
+// about fpRate
+func NewBloom(n int, fpRate float64) *Bloom {
+	n = max(n, 1)
+	m := -float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)
+	words := max(int(math.Ceil(m/64)), 1)
+	k := int(math.Round(float64(words*64) / float64(n) * math.Ln2))
+	return &Bloom{k: min(max(k, 1), math.MaxUint8), bits: make([]uint64, words)}
+}
+
+func (b *Bloom) Add(k, v uint32) {
+	h1, h2 := bloomHash(k, v)
+	m := uint64(len(b.bits)) * 64
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Returns false if the pair was never added
+func (b *Bloom) MayContain(k, v uint32) bool {
+	h1, h2 := bloomHash(k, v)
+	m := uint64(len(b.bits)) * 64
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns false if no point in the file can match the query's attribute
+// equality filters. ser must be the Serializer the file was written with.
+func (b *Bloom) MayMatch(q *query.Query, ser *Serializer) bool {
+	return q.FA.MayMatchPairs(func(k, v string) bool {
+		kidx, vidx, exist := ser.AttrPair(k, v)
+		return exist && b.MayContain(kidx, vidx)
+	})
+}
+
+// Two independent hashes of a pair, which are combined to pick each bit
+func bloomHash(k, v uint32) (uint64, uint64) {
+	h := mix64(uint64(k)<<32 | uint64(v))
+	return h, mix64(h) | 1
+}
+
+// Finalizer from splitmix64, spreading each input bit over the output
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (b *Bloom) encode(end int64) []byte {
+	buf := make([]byte, 0, 8+1+len(b.bits)*8+crcSize)
+	buf = byteord.AppendUint64(buf, uint64(end))
+	buf = append(buf, byte(b.k))
+	for _, w := range b.bits {
+		buf = byteord.AppendUint64(buf, w)
+	}
+	return byteord.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+// Decodes a Bloom filter, returning the data file size it was saved at
+func decodeBloom(data []byte) (*Bloom, int64, error) {
+	if len(data) < 8+1+8+crcSize || (len(data)-8-1-crcSize)%8 != 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	sum := byteord.Uint32(data[len(data)-crcSize:])
+	data = data[:len(data)-crcSize]
+	if crc32.Checksum(data, crcTable) != sum {
+		return nil, 0, ErrChecksum
+	}
+
+	end := int64(byteord.Uint64(data))
+	b := &Bloom{k: int(data[8])}
+	if b.k == 0 {
+		return nil, 0, fmt.Errorf("bloom filter has no hashes")
+	}
+	data = data[9:]
+	b.bits = make([]uint64, len(data)/8)
+	for i := range b.bits {
+		b.bits[i] = byteord.Uint64(data[i*8:])
+	}
+	return b, end, nil
+}
+
+/*
+Loads the Bloom filter saved alongside the data file at path. Returns nil if
+there isn't one, or if it's damaged or was saved before the data file was
+last written to; a data file with SetBloom rebuilds it when it's next
+flushed.
+*/
+func LoadBloom(path string) (*Bloom, error) {
+	data, err := os.ReadFile(path + BloomSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b, end, err := decodeBloom(data)
+	if err != nil || end != st.Size() {
+		return nil, nil
+	}
+	return b, nil
+}
+
+/*
+Keeps a Bloom filter over the file's attribute pairs with a false positive
+rate of about fpRate, which is saved along with the block index by Flush and
+Close. 0, the default, stops saving it.
+*/
+func (df *DataFile) SetBloom(fpRate float64) error {
+	if fpRate < 0 || fpRate >= 1 {
+		return fmt.Errorf("bloom filter false positive rate %g is not in [0, 1)", fpRate)
+	}
+
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if !df.indexed() {
+		return fmt.Errorf("bloom filters need an indexed data file, not format version %d", df.version)
+	}
+	df.bloomRate = fpRate
+	if fpRate == 0 || df.blocks == nil {
+		return nil
+	}
+
+	// save it next time if it's missing or out of date
+	err := df.settle()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(df.path + BloomSuffix)
+	if err == nil {
+		_, end, err := decodeBloom(data)
+		if err == nil && end == df.end {
+			return nil
+		}
+	}
+	df.blocks.dirty = true
+	return nil
+}
+
+// Builds a Bloom filter from the attribute values in the block index
+func (df *DataFile) buildBloom() *Bloom {
+	pairs := make(map[[2]uint32]bool)
+	for _, bs := range df.blocks.blocks {
+		for k, vs := range bs.Attrs {
+			for _, v := range vs {
+				kidx, vidx, exist := df.ser.AttrPair(k, v)
+				if exist {
+					pairs[[2]uint32{kidx, vidx}] = true
+				}
+			}
+		}
+	}
+
+	b := NewBloom(len(pairs), df.bloomRate)
+	for p := range pairs {
+		b.Add(p[0], p[1])
+	}
+	return b
+}
@@ -0,0 +1,111 @@
+package file
+
+import (
+	"equinox/internal/query"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloom(t *testing.T) {
+	b := NewBloom(10000, 0.01)
+	assert.Equal(t, 7, b.k)
+	assert.Equal(t, 1498, len(b.bits))
+	for v := uint32(0); v < 10000; v++ {
+		b.Add(1, v)
+	}
+	for v := uint32(0); v < 10000; v++ {
+		assert.True(t, b.MayContain(1, v))
+	}
+
+	// false positives for pairs that weren't added
+	fp := 0
+	for v := uint32(0); v < 10000; v++ {
+		if b.MayContain(2, v) {
+			fp++
+		}
+		if b.MayContain(1, v+10000) {
+			fp++
+		}
+	}
+	assert.Less(t, fp, 400)
+
+	dec, end, err := decodeBloom(b.encode(77))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(77), end)
+	assert.Equal(t, b, dec)
+
+	assert.Equal(t, 1, len(NewBloom(0, 0.01).bits))
+}
+
+func TestBloomDF(t *testing.T) {
+	ser := NewSerializer()
+	df := newTestDF(t, ser)
+	fn := df.path
+	defer os.Remove(fn + BloomSuffix)
+
+	// a request_id on every point, and a few hosts
+	var recs []Record
+	for i, p := range getBlockPoints(1000) {
+		p.Attrs["request_id"] = fmt.Sprintf("req-%d", i*7)
+		recs = append(recs, Record{Idx: uint32(i), Point: p})
+	}
+	assert.Nil(t, df.WriteBatch(recs))
+	assert.Equal(t, "bloom filter false positive rate 1 is not in [0, 1)", df.SetBloom(1).Error())
+	assert.Nil(t, df.SetBloom(0.001))
+	assert.Nil(t, df.Close())
+
+	b, err := LoadBloom(fn)
+	assert.Nil(t, err)
+	assert.NotNil(t, b)
+	mayMatch := func(fa query.FilterAttr) bool {
+		return b.MayMatch(query.NewQuery(recs[0].Point.Ts, recs[999].Point.Ts, fa), ser)
+	}
+	assert.True(t, mayMatch(query.Equal("request_id", "req-693")))
+	assert.True(t, mayMatch(query.In("host", "web9", "web2")))
+	assert.True(t, mayMatch(query.Regex("request_id", "^x")))
+	assert.False(t, mayMatch(query.In("host", "web9", "web10")))
+	assert.False(t, mayMatch(query.And(query.Exists("host"), query.Equal("region", "us-west"))))
+
+	// a value other points have under another key
+	assert.False(t, mayMatch(query.Equal("region", "web1")))
+	fp := 0
+	for i := 0; i < 1000; i++ {
+		if mayMatch(query.Equal("request_id", fmt.Sprintf("req-%d", i*7+1))) {
+			fp++
+		}
+	}
+	assert.Less(t, fp, 10)
+
+	// reopening without a filter keeps the saved one until the file changes
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Nil(t, df.Close())
+	b, err = LoadBloom(fn)
+	assert.Nil(t, err)
+	assert.NotNil(t, b)
+
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Nil(t, df.Write(1000, recs[0].Point))
+	assert.Nil(t, df.Close())
+	b, err = LoadBloom(fn)
+	assert.Nil(t, err)
+	assert.Nil(t, b)
+
+	// and turning it on again saves it even without a write
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Nil(t, df.SetBloom(0.01))
+	assert.Nil(t, df.Close())
+	b, err = LoadBloom(fn)
+	assert.Nil(t, err)
+	assert.NotNil(t, b)
+
+	os.Remove(fn + BloomSuffix)
+	b, err = LoadBloom(fn)
+	assert.Nil(t, err)
+	assert.Nil(t, b)
+}
@@ -4,21 +4,98 @@ import (
 	"bytes"
 	"encoding/binary"
 	"equinox/internal/core"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
-	"unsafe"
+	"path/filepath"
+	"sync"
 )
 
+// Identifies a versioned data file ("EQNX"). Files in FormatFixed start
+// with the record size instead, which would have to be over 1GB to be
+// mistaken for it.
+const dfMagic uint32 = 0x45514e58
+
+// Header flags
+const dfFlagHasBase uint16 = 1 // base_ts has been set by the first write
+
+// Suffix of the offset index file kept alongside an indexed data file
+const IndexSuffix = ".idx"
+
+// Returned, wrapped, when reading a record that was never written
+var ErrEmptyRecord = errors.New("empty record")
+
+// Returned, wrapped, when a header or record doesn't match its checksum
+var ErrChecksum = errors.New("checksum mismatch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const crcSize = 4
+
+/*
+File of points, where each point is stored under an index.
+
+Header:
+magic: 4 bytes
+format version: 2 bytes
+flags: 2 bytes
+record_size: 4 bytes, 0 in FormatIndexed
+base_ts: 8 bytes, the time compact timestamps are relative to
+header_crc: 4 bytes, CRC32C of the fields above, FormatChecked only
+
+FormatFixed files have no header besides the 4-byte record_size.
+
+FormatFixed and FormatCompact files are divided into slots of record_size
+bytes, and the idx'th point is stored in the idx'th slot. In FormatCompact
+each slot holds the record's length as a varint followed by the record, so a
+zero length marks an empty slot. A record that doesn't fit its slot is
+rejected.
+
+In FormatIndexed, records of any length are appended to the file, each
+prefixed by its length as a varint. The index file at path + IndexSuffix
+holds the file offset of each point's record as 8 bytes, so the idx'th offset
+is at idx*8 and 0 marks an empty index. Rewriting a point appends a new
+record and leaves the old one as garbage.
+Summaries of each block of indexes are kept at path + BlockIndexSuffix, see
+blockindex.go, and optionally a Bloom filter at path + BloomSuffix, see
+bloom.go.
+
+FormatChecked is FormatIndexed with a CRC32C of each record's length and
+bytes stored after it, so that a damaged record is reported rather than
+decoded into a wrong point.
+*/
 type DataFile struct {
 	path        string
-	num_records int
+	version     uint16
+	flags       uint16
 	header_size uint32
 	record_size uint32
+	base_ts     int64
 	fd          *os.File
 	ser         *Serializer
+
+	// FormatIndexed and later only
+	idxfd     *os.File
+	offsets   []int64
+	end       int64       // where the next record is appended
+	blocks    *blockIndex // nil if it couldn't be rebuilt, see blockindex.go
+	bloomRate float64     // 0 if there's no Bloom filter, see bloom.go
+
+	// see batch.go
+	mu         sync.Mutex
+	cond       *sync.Cond
+	flushing   bool
+	buf        *writeBuf
+	durability Durability
 }
 
 func OpenExistingDF(path string, ser *Serializer) (*DataFile, error) {
+	err := finishMigration(path)
+	if err != nil {
+		return nil, err
+	}
 	df, err := newDataFile(path, ser)
 	if err != nil {
 		return nil, err
@@ -31,14 +108,28 @@ func OpenExistingDF(path string, ser *Serializer) (*DataFile, error) {
 	}
 
 	err = df.parseHeader()
+	if err == nil && df.indexed() {
+		err = df.openIndex(0)
+	}
 	if err != nil {
+		df.Close()
 		return nil, err
 	}
+	if df.indexed() {
+		df.loadBlocks()
+	}
 
 	return df, nil
 }
 
-func OpenNewDF(path string, ser *Serializer, recsize uint32) (*DataFile, error) {
+// Creates a data file, and its index file, in the current format
+func OpenNewDF(path string, ser *Serializer) (*DataFile, error) {
+	return openNewDF(path, ser, 0, FormatVersion)
+}
+
+// Creates a data file in the given format. recsize is the slot size for
+// formats with fixed-size slots, including FormatCompact's length prefix.
+func openNewDF(path string, ser *Serializer, recsize uint32, version uint16) (*DataFile, error) {
 	df, err := newDataFile(path, ser)
 	if err != nil {
 		return nil, err
@@ -51,9 +142,16 @@ func OpenNewDF(path string, ser *Serializer, recsize uint32) (*DataFile, error)
 	}
 
 	// write the header
+	df.version = version
+	df.header_size = headerSize(version)
 	df.record_size = recsize
 	err = df.writeHeader()
+	if err == nil && df.indexed() {
+		err = df.openIndex(os.O_CREATE | os.O_EXCL)
+		df.blocks = newBlockIndex()
+	}
 	if err != nil {
+		df.Close()
 		return nil, err
 	}
 
@@ -63,13 +161,38 @@ func OpenNewDF(path string, ser *Serializer, recsize uint32) (*DataFile, error)
 func newDataFile(path string, ser *Serializer) (*DataFile, error) {
 	df := DataFile{}
 	df.path = path
-	df.num_records = 0
-	df.header_size = uint32(unsafe.Sizeof(df.header_size))
 	df.ser = ser
 	df.fd = nil
+	df.cond = sync.NewCond(&df.mu)
+	df.buf = newWriteBuf()
 	return &df, nil
 }
 
+func headerSize(version uint16) uint32 {
+	switch version {
+	case FormatFixed:
+		return 4
+	case FormatChecked:
+		return 20 + crcSize
+	}
+	return 20
+}
+
+// Whether records are located through the index file rather than slots
+func (df *DataFile) indexed() bool {
+	return df.version >= FormatIndexed
+}
+
+// Whether the header and records have checksums
+func (df *DataFile) checked() bool {
+	return df.version >= FormatChecked
+}
+
+// Format version of the file
+func (df *DataFile) Version() uint16 {
+	return df.version
+}
+
 func (df *DataFile) writeHeader() error {
 	_, err := df.fd.Seek(0, 0)
 	if err != nil {
@@ -77,15 +200,22 @@ func (df *DataFile) writeHeader() error {
 	}
 
 	var buf bytes.Buffer
-	err = binary.Write(&buf, binary.BigEndian, df.record_size)
-	if err != nil {
-		return fmt.Errorf("writeHeader: buffer write failed: %s", err.Error())
+	if df.version != FormatFixed {
+		binary.Write(&buf, binary.BigEndian, dfMagic)
+		binary.Write(&buf, binary.BigEndian, df.version)
+		binary.Write(&buf, binary.BigEndian, df.flags)
+	}
+	binary.Write(&buf, binary.BigEndian, df.record_size)
+	if df.version != FormatFixed {
+		binary.Write(&buf, binary.BigEndian, df.base_ts)
+	}
+	if df.checked() {
+		binary.Write(&buf, binary.BigEndian, crc32.Checksum(buf.Bytes(), crcTable))
 	}
 
 	_, err = df.fd.Write(buf.Bytes())
 	if err != nil {
 		return fmt.Errorf("writeHeader: header write failed: %s", err.Error())
-		return err
 	}
 
 	err = df.fd.Sync()
@@ -102,65 +232,217 @@ func (df *DataFile) parseHeader() error {
 		return err
 	}
 
-	data := make([]byte, df.header_size)
-	var n int
-	n, err = df.fd.Read(data)
+	var first uint32
+	err = binary.Read(df.fd, binary.BigEndian, &first)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to read header: %s", err.Error())
+	}
+	if first != dfMagic {
+		// no magic number, so this is a FormatFixed file
+		df.version = FormatFixed
+		df.header_size = headerSize(FormatFixed)
+		df.record_size = first
+		return nil
+	}
+
+	err = binary.Read(df.fd, binary.BigEndian, &df.version)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %s", err.Error())
+	}
+	if df.version < FormatCompact || df.version > FormatChecked {
+		return fmt.Errorf("unsupported data file format version %d in %s", df.version, df.path)
+	}
+	df.header_size = headerSize(df.version)
+
+	fields := []any{&df.flags, &df.record_size, &df.base_ts}
+	for _, f := range fields {
+		err = binary.Read(df.fd, binary.BigEndian, f)
+		if err != nil {
+			return fmt.Errorf("failed to read header: %s", err.Error())
+		}
+	}
+	if !df.checked() {
+		return nil
 	}
 
-	if uint32(n) != df.header_size {
-		return fmt.Errorf("bytes read (%d) doesn't match header size (%d)", n, df.header_size)
+	hdr := make([]byte, df.header_size)
+	_, err = df.fd.ReadAt(hdr, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %s", err.Error())
+	}
+	sum := byteord.Uint32(hdr[df.header_size-crcSize:])
+	if crc32.Checksum(hdr[:df.header_size-crcSize], crcTable) != sum {
+		return fmt.Errorf("%w in header of %s", ErrChecksum, df.path)
 	}
+	return nil
+}
 
-	buf := bytes.NewReader(data)
-	err = binary.Read(buf, binary.BigEndian, &df.record_size)
+// Opens the index file with the given extra flags and loads its offsets
+func (df *DataFile) openIndex(flag int) error {
+	var err error
+	df.idxfd, err = os.OpenFile(df.path+IndexSuffix, os.O_RDWR|flag, 0644)
 	if err != nil {
 		return err
 	}
 
+	b, err := io.ReadAll(df.idxfd)
+	if err != nil {
+		return fmt.Errorf("failed to read index: %s", err.Error())
+	}
+	df.offsets = make([]int64, len(b)/8)
+	for i := range df.offsets {
+		df.offsets[i] = int64(byteord.Uint64(b[i*8:]))
+	}
+
+	st, err := df.fd.Stat()
+	if err != nil {
+		return err
+	}
+	df.end = st.Size()
+	for i, off := range df.offsets {
+		if off != 0 && (off < int64(df.header_size) || off >= df.end) {
+			return fmt.Errorf("index %d has offset %d outside data file of %d bytes", i, off, df.end)
+		}
+	}
 	return nil
 }
 
+// Returns the number of indexes in an indexed data file from the size of its
+// index file, without opening the data file
+func IndexLen(path string) (int, error) {
+	st, err := os.Stat(path + IndexSuffix)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Size() / 8), nil
+}
+
+// Writes out and syncs any buffered records, saves the block index and
+// closes the file
 func (df *DataFile) Close() error {
-	if df.fd == nil {
-		return nil
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	var err error
+	// nothing to flush if the file failed to open
+	if df.fd != nil && (df.idxfd != nil || !df.indexed()) {
+		err = df.flush(true)
+		if err == nil {
+			err = df.saveBlocks()
+		}
 	}
-	fd := df.fd
-	df.fd = nil
-	return fd.Close()
+	return errors.Join(err, df.closeFiles())
+}
+
+func (df *DataFile) closeFiles() error {
+	var errs []error
+	if df.idxfd != nil {
+		errs = append(errs, df.idxfd.Close())
+		df.idxfd = nil
+	}
+	if df.fd != nil {
+		errs = append(errs, df.fd.Close())
+		df.fd = nil
+	}
+	return errors.Join(errs...)
 }
 
-// File offset of the idx'th record
+// File offset of the idx'th record slot
 func (df *DataFile) getOffset(idx uint32) int64 {
-	return int64(df.header_size + idx*df.record_size)
+	return int64(df.header_size) + int64(idx)*int64(df.record_size)
 }
 
-func (df *DataFile) Write(idx uint32, p *core.Point) error {
-	data, err := df.ser.Serialize(p)
+// Number of indexes in the file, including empty ones
+func (df *DataFile) Len() (int, error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	err := df.settle()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = df.fd.Seek(df.getOffset(idx), 0)
-	if err != nil {
-		return err
+	if df.indexed() {
+		return len(df.offsets), nil
 	}
 
-	_, err = df.fd.Write(data)
+	st, err := df.fd.Stat()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	data := st.Size() - int64(df.header_size)
+	if data <= 0 || df.record_size == 0 {
+		return 0, nil
 	}
+	return int((data + int64(df.record_size) - 1) / int64(df.record_size)), nil
+}
 
-	err = df.fd.Sync()
+// Encodes a point, with its length prefix unless it's FormatFixed. Records
+// in formats with slots are padded to fill them.
+func (df *DataFile) encodeRecord(p *core.Point) ([]byte, error) {
+	rec, err := df.ser.Encode(p, df.version, df.base_ts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	b := make([]byte, 0, binary.MaxVarintLen64+max(len(rec), int(df.record_size)))
+	if df.version != FormatFixed {
+		b = binary.AppendUvarint(b, uint64(len(rec)))
+	}
+	b = append(b, rec...)
+	if df.checked() {
+		b = byteord.AppendUint32(b, crc32.Checksum(b, crcTable))
+	}
+	if df.indexed() {
+		return b, nil
+	}
+
+	if uint32(len(b)) > df.record_size {
+		return nil, fmt.Errorf("record of %d bytes exceeds record size %d", len(b), df.record_size)
+	}
+
+	// pad so that reading the last slot doesn't hit the end of the file
+	return b[:df.record_size], nil
 }
 
 func (df *DataFile) Read(idx uint32) (*core.Point, error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	err := df.settle()
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if df.indexed() {
+		data, err = df.readIndexed(idx)
+	} else {
+		data, err = df.readSlot(idx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return df.decode(data, idx)
+}
+
+// Decodes the record read for an index
+func (df *DataFile) decode(data []byte, idx uint32) (*core.Point, error) {
+	p, err := df.ser.Decode(data, df.version, df.base_ts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize %d bytes fo data for index %d: %s",
+			len(data), idx, err.Error())
+	}
+
+	// if the timestamp is 0 then we consider this an invalid read because
+	// we must have written sparse points to the file
+	if df.version == FormatFixed && p.Ts.UnixMicro() == 0 {
+		return nil, fmt.Errorf("%w at index %d: read empty timestamp", ErrEmptyRecord, idx)
+	}
+
+	return p, nil
+}
+
+// Returns the record in the idx'th slot
+func (df *DataFile) readSlot(idx uint32) ([]byte, error) {
 	offset := df.getOffset(idx)
 	_, err := df.fd.Seek(offset, 0)
 	if err != nil {
@@ -168,31 +450,221 @@ func (df *DataFile) Read(idx uint32) (*core.Point, error) {
 			offset, df.record_size, idx, err.Error())
 	}
 
+	// files written before slots were padded may end with a short record
 	data := make([]byte, df.record_size)
-	var n int
-	n, err = df.fd.Read(data)
-	if err != nil {
+	_, err = io.ReadFull(df.fd, data)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
 		return nil, fmt.Errorf("failed to read %d bytes from position %d for index %d: %s",
 			df.record_size, offset, idx, err.Error())
 	}
 
-	if uint32(n) != df.record_size {
-		return nil, fmt.Errorf("bytes read (%d) doesn't match record size (%d)",
-			n, df.record_size)
+	return df.unwrapSlot(data, idx)
+}
+
+// Strips the length prefix, if any, and padding from a slot
+func (df *DataFile) unwrapSlot(data []byte, idx uint32) ([]byte, error) {
+	if df.version == FormatFixed {
+		return data, nil
+	}
+	n, l := binary.Uvarint(data)
+	if l <= 0 || n > uint64(len(data)-l) {
+		return nil, fmt.Errorf("invalid record length at index %d", idx)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w at index %d", ErrEmptyRecord, idx)
+	}
+	return data[l : l+int(n)], nil
+}
+
+// Returns the record the index points to
+func (df *DataFile) readIndexed(idx uint32) ([]byte, error) {
+	if int(idx) >= len(df.offsets) || df.offsets[idx] == 0 {
+		return nil, fmt.Errorf("%w at index %d", ErrEmptyRecord, idx)
 	}
+	offset := df.offsets[idx]
 
-	var p *core.Point
-	p, err = df.ser.Deserialize(data)
+	var lb [binary.MaxVarintLen64]byte
+	m, err := df.fd.ReadAt(lb[:], offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read record length at position %d for index %d: %s",
+			offset, idx, err.Error())
+	}
+	size, l, err := df.indexedSize(lb[:m], offset, idx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to deserialize %d bytes fo data for index %d: %s",
-			len(data), idx, err.Error())
+		return nil, err
 	}
 
-	// if the timestamp is 0 then we consider this an invalid read because
-	// we must have written sparse points to the file
-	if p.Ts.UnixMicro() == 0 {
-		return nil, fmt.Errorf("read empty timestamp at index %d: %s", idx, p.String())
+	data := make([]byte, size)
+	_, err = df.fd.ReadAt(data, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %d bytes from position %d for index %d: %s",
+			size, offset, idx, err.Error())
+	}
+	return df.unwrapIndexed(data, l, idx)
+}
+
+// Returns the size of the indexed record at offset, including its length
+// prefix and checksum, from the bytes at the start of it. Also returns the
+// length of the prefix.
+func (df *DataFile) indexedSize(b []byte, offset int64, idx uint32) (int64, int, error) {
+	// a corrupt length can be too large for an int64, so it's checked against
+	// the rest of the file before converting
+	n, l := binary.Uvarint(b)
+	if l <= 0 || n == 0 || n > uint64(df.end-offset) {
+		return 0, 0, fmt.Errorf("invalid record length at index %d", idx)
+	}
+	size := int64(l) + int64(n)
+	if df.checked() {
+		size += crcSize
 	}
+	if offset+size > df.end {
+		return 0, 0, fmt.Errorf("invalid record length at index %d", idx)
+	}
+	return size, l, nil
+}
 
-	return p, nil
+// Strips the length prefix and checksum from an indexed record, checking
+// the checksum
+func (df *DataFile) unwrapIndexed(data []byte, l int, idx uint32) ([]byte, error) {
+	if df.checked() {
+		size := len(data)
+		sum := byteord.Uint32(data[size-crcSize:])
+		data = data[:size-crcSize]
+		if crc32.Checksum(data, crcTable) != sum {
+			return nil, fmt.Errorf("%w in record at index %d", ErrChecksum, idx)
+		}
+	}
+	return data[l:], nil
+}
+
+// Suffix of the new files written by MigrateDF, and of the marker committing
+// them
+const (
+	migrateSuffix     = ".migrate"
+	migrateDoneSuffix = ".migrate.done"
+)
+
+/*
+Rewrites the data file at path in the current format if it's in an older
+one, keeping every point at the same index. The new files are written
+alongside, and once they're complete a marker is saved committing the
+migration before they're renamed over the old ones. A data file can't be read
+with another format's index, so if the renames are interrupted they're
+finished by the next OpenExistingDF; a migration interrupted before the marker
+is saved leaves the original untouched. Returns true if the file was
+migrated.
+*/
+func MigrateDF(path string, ser *Serializer) (bool, error) {
+	old, err := OpenExistingDF(path, ser)
+	if err != nil {
+		return false, err
+	}
+	defer old.Close()
+	if old.version == FormatVersion {
+		return false, nil
+	}
+
+	n, err := old.Len()
+	if err != nil {
+		return false, err
+	}
+
+	// new files left by a migration that wasn't committed may be incomplete
+	err = removeMigration(path)
+	if err != nil {
+		return false, err
+	}
+	df, err := OpenNewDF(path+migrateSuffix, ser)
+	if err != nil {
+		return false, err
+	}
+	committed := false
+	defer func() {
+		df.Close()
+		if !committed {
+			removeMigration(path)
+		}
+	}()
+	// synced by Close
+	err = df.SetDurability(DurabilityBuffer)
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < n; i++ {
+		p, err := old.Read(uint32(i))
+		if errors.Is(err, ErrEmptyRecord) {
+			continue
+		}
+		if err == nil {
+			err = df.Write(uint32(i), p)
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to migrate %s: %s", path, err.Error())
+		}
+	}
+
+	err = errors.Join(df.Close(), old.Close())
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err == nil {
+		err = WriteFileAtomic(path+migrateDoneSuffix, nil)
+	}
+	if err != nil {
+		return false, err
+	}
+	committed = true
+	err = finishMigration(path)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Finishes a migration of the data file at path that was committed but not
+// completed, renaming the new files over the old ones
+func finishMigration(path string) error {
+	_, err := os.Stat(path + migrateDoneSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the data file goes last, so a missing one means every rename is done
+	tmp := path + migrateSuffix
+	for _, suffix := range []string{IndexSuffix, BlockIndexSuffix, ""} {
+		err := os.Rename(tmp+suffix, path+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to finish migrating %s: %s", path, err.Error())
+		}
+	}
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	return os.Remove(path + migrateDoneSuffix)
+}
+
+// Removes the new files of a migration of the data file at path
+func removeMigration(path string) error {
+	tmp := path + migrateSuffix
+	for _, suffix := range []string{"", IndexSuffix, BlockIndexSuffix} {
+		err := os.Remove(tmp + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Syncs a directory, making the renames and removals in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
 }
@@ -1,6 +1,7 @@
 package file
 
 import (
+	"encoding/binary"
 	"equinox/internal/core"
 	"fmt"
 	"math"
@@ -50,11 +51,12 @@ func TestDFNew(t *testing.T) {
 	assert.Nil(t, err)
 	defer os.Remove(fn)
 
-	ser := NewSerializer()
+	defer os.Remove(fn + IndexSuffix)
+	defer os.Remove(fn + BlockIndexSuffix)
 
-	b, _ := ser.Serialize(getPoint(0))
+	ser := NewSerializer()
 
-	df, err := OpenNewDF(fn, ser, uint32(len(b)))
+	df, err := OpenNewDF(fn, ser)
 	assert.Nil(t, err)
 	defer df.Close()
 
@@ -104,11 +106,12 @@ func TestDFNonseq(t *testing.T) {
 	assert.Nil(t, err)
 	defer os.Remove(fn)
 
-	ser := NewSerializer()
+	defer os.Remove(fn + IndexSuffix)
+	defer os.Remove(fn + BlockIndexSuffix)
 
-	b, _ := ser.Serialize(getPoint(0))
+	ser := NewSerializer()
 
-	df, err := OpenNewDF(fn, ser, uint32(len(b)))
+	df, err := OpenNewDF(fn, ser)
 	assert.Nil(t, err)
 	defer df.Close()
 
@@ -137,3 +140,411 @@ func TestDFNonseq(t *testing.T) {
 		assert.NotNil(t, err)
 	}
 }
+
+func TestDFCompact(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+
+	ser := NewSerializer()
+	df, err := openNewDF(fn, ser, 64, FormatCompact)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatCompact, df.Version())
+	n, err := df.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	p := getPoint(0)
+	assert.Nil(t, df.Write(0, p))
+	assert.Nil(t, df.Write(3, getPoint(3)))
+	n, err = df.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	df.Close()
+
+	b, err := os.ReadFile(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, "EQNX", string(b[:4]))
+	assert.Equal(t, FormatCompact, byteord.Uint16(b[4:6]))
+	assert.Equal(t, uint32(64), byteord.Uint32(b[8:12]))
+	assert.Equal(t, p.Ts.UnixMicro(), int64(byteord.Uint64(b[12:20])))
+	assert.Equal(t, 20+4*64, len(b))
+
+	// the base time is kept when reopened
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	defer df.Close()
+	p2, err := df.Read(3)
+	assert.Nil(t, err)
+	assert.True(t, getPoint(3).Equal(p2))
+	_, err = df.Read(1)
+	assert.ErrorIs(t, err, ErrEmptyRecord)
+
+	// records must fit their slots
+	big := getPoint(4)
+	for i := 0; i < 10; i++ {
+		big.Vals[fmt.Sprintf("v%d", i)] = float64(i)
+	}
+	assert.Equal(t, "record of 122 bytes exceeds record size 64", df.Write(4, big).Error())
+}
+
+func TestDFUnsupportedVersion(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+
+	hdr := []byte("EQNX\x00\x09\x00\x00\x00\x00\x00\x40\x00\x00\x00\x00\x00\x00\x00\x00")
+	assert.Nil(t, os.WriteFile(fn, hdr, 0644))
+	_, err = OpenExistingDF(fn, NewSerializer())
+	assert.Equal(t, "unsupported data file format version 9 in "+fn, err.Error())
+
+	assert.Nil(t, os.WriteFile(fn, []byte("EQ"), 0644))
+	_, err = OpenExistingDF(fn, NewSerializer())
+	assert.Contains(t, err.Error(), "failed to read header")
+}
+
+// writes points 0-9, skipping 5, to a FormatFixed file
+func writeFixedDF(t *testing.T, fn string, ser *Serializer) {
+	b, _ := ser.Encode(getPoint(0), FormatFixed, 0)
+	df, err := openNewDF(fn, ser, uint32(len(b)), FormatFixed)
+	assert.Nil(t, err)
+	defer df.Close()
+	for i := uint32(0); i < 10; i++ {
+		if i != 5 {
+			assert.Nil(t, df.Write(i, getPoint(i)))
+		}
+	}
+}
+
+func TestDFReadFixed(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+
+	ser := NewSerializer()
+	writeFixedDF(t, fn, ser)
+
+	// the old header is just the record size
+	b, err := os.ReadFile(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(64), byteord.Uint32(b[:4]))
+	assert.Equal(t, 4+10*64, len(b))
+
+	df, err := OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	defer df.Close()
+	assert.Equal(t, FormatFixed, df.Version())
+	for i := uint32(0); i < 10; i++ {
+		p, err := df.Read(i)
+		if i == 5 {
+			assert.ErrorIs(t, err, ErrEmptyRecord)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.True(t, getPoint(i).Equal(p))
+	}
+}
+
+func TestDFMigrate(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+	defer os.Remove(fn + IndexSuffix)
+	defer os.Remove(fn + BlockIndexSuffix)
+
+	ser := NewSerializer()
+	writeFixedDF(t, fn, ser)
+	st, err := os.Stat(fn)
+	assert.Nil(t, err)
+	oldSize := st.Size()
+
+	migrated, err := MigrateDF(fn, ser)
+	assert.Nil(t, err)
+	assert.True(t, migrated)
+	assert.NoFileExists(t, fn+".migrate")
+	assert.NoFileExists(t, fn+".migrate"+IndexSuffix)
+	assert.NoFileExists(t, fn+".migrate"+BlockIndexSuffix)
+	assert.NoFileExists(t, fn+migrateDoneSuffix)
+	assert.FileExists(t, fn+IndexSuffix)
+	assert.FileExists(t, fn+BlockIndexSuffix)
+
+	st, err = os.Stat(fn)
+	assert.Nil(t, err)
+	assert.Less(t, st.Size(), oldSize)
+
+	df, err := OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatVersion, df.Version())
+	n, err := df.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	for i := uint32(0); i < 10; i++ {
+		p, err := df.Read(i)
+		if i == 5 {
+			assert.ErrorIs(t, err, ErrEmptyRecord)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.True(t, getPoint(i).Equal(p))
+	}
+	df.Close()
+
+	// already current
+	migrated, err = MigrateDF(fn, ser)
+	assert.Nil(t, err)
+	assert.False(t, migrated)
+
+	_, err = MigrateDF(fn+".missing", ser)
+	assert.NotNil(t, err)
+}
+
+func TestDFMigrateInterrupted(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+	defer os.Remove(fn + IndexSuffix)
+	defer os.Remove(fn + BlockIndexSuffix)
+
+	// a v3 file, which has an index of its own
+	ser := NewSerializer()
+	write := func(path string, version uint16) {
+		df, err := openNewDF(path, ser, 0, version)
+		assert.Nil(t, err)
+		for i := uint32(0); i < 10; i++ {
+			assert.Nil(t, df.Write(i, getPoint(i)))
+		}
+		assert.Nil(t, df.Close())
+	}
+	write(fn, FormatIndexed)
+	readAll := func() {
+		df, err := OpenExistingDF(fn, ser)
+		assert.Nil(t, err)
+		defer df.Close()
+		for i := uint32(0); i < 10; i++ {
+			p, err := df.Read(i)
+			assert.Nil(t, err)
+			assert.True(t, getPoint(i).Equal(p))
+		}
+	}
+
+	// new files left before the migration was committed are ignored, then
+	// replaced by the next migration
+	tmp := fn + migrateSuffix
+	write(tmp, FormatVersion)
+	readAll()
+	migrated, err := MigrateDF(fn, ser)
+	assert.Nil(t, err)
+	assert.True(t, migrated)
+	readAll()
+
+	// a crash after the new index was renamed into place is finished on open
+	os.Remove(fn)
+	os.Remove(fn + IndexSuffix)
+	os.Remove(fn + BlockIndexSuffix)
+	write(fn, FormatIndexed)
+	write(tmp, FormatVersion)
+	assert.Nil(t, os.WriteFile(fn+migrateDoneSuffix, nil, 0644))
+	assert.Nil(t, os.Rename(tmp+IndexSuffix, fn+IndexSuffix))
+	readAll()
+	assert.NoFileExists(t, tmp)
+	assert.NoFileExists(t, tmp+BlockIndexSuffix)
+	assert.NoFileExists(t, fn+migrateDoneSuffix)
+	df, err := OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatVersion, df.Version())
+	assert.Nil(t, df.Close())
+}
+
+func TestDFIndexed(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+	defer os.Remove(fn + IndexSuffix)
+	defer os.Remove(fn + BlockIndexSuffix)
+
+	ser := NewSerializer()
+	df, err := openNewDF(fn, ser, 0, FormatIndexed)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatIndexed, df.Version())
+
+	// points of very different sizes
+	small := getPoint(0)
+	big := getPoint(1)
+	for i := 0; i < 100; i++ {
+		big.Vals[fmt.Sprintf("v%d", i)] = float64(i)
+	}
+	assert.Nil(t, df.Write(0, small))
+	assert.Nil(t, df.Write(1, big))
+	assert.Nil(t, df.Write(4, getPoint(4)))
+	n, err := df.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	// rewriting a point replaces it
+	small.Vals["extra"] = 1
+	assert.Nil(t, df.Write(0, small))
+	df.Close()
+
+	b, err := os.ReadFile(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, "EQNX", string(b[:4]))
+	assert.Equal(t, FormatIndexed, byteord.Uint16(b[4:6]))
+	assert.Equal(t, uint32(0), byteord.Uint32(b[8:12]))
+	assert.Equal(t, getPoint(0).Ts.UnixMicro(), int64(byteord.Uint64(b[12:20])))
+	idx, err := os.ReadFile(fn + IndexSuffix)
+	assert.Nil(t, err)
+	assert.Equal(t, 5*8, len(idx))
+	n, err = IndexLen(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	defer df.Close()
+	n, err = df.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	p, err := df.Read(0)
+	assert.Nil(t, err)
+	assert.True(t, small.Equal(p))
+	p, err = df.Read(1)
+	assert.Nil(t, err)
+	assert.True(t, big.Equal(p))
+	p, err = df.Read(4)
+	assert.Nil(t, err)
+	assert.True(t, getPoint(4).Equal(p))
+	for _, i := range []uint32{2, 3, 5, 1000} {
+		_, err = df.Read(i)
+		assert.ErrorIs(t, err, ErrEmptyRecord)
+	}
+
+	// appends after reopening don't overwrite existing records
+	assert.Nil(t, df.Write(2, getPoint(2)))
+	p, err = df.Read(2)
+	assert.Nil(t, err)
+	assert.True(t, getPoint(2).Equal(p))
+	p, err = df.Read(1)
+	assert.Nil(t, err)
+	assert.True(t, big.Equal(p))
+}
+
+func TestDFIndexedCorrupt(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+	defer os.Remove(fn + IndexSuffix)
+	defer os.Remove(fn + BlockIndexSuffix)
+
+	ser := NewSerializer()
+	df, err := OpenNewDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Nil(t, df.Write(0, getPoint(0)))
+	assert.Nil(t, df.Write(1, getPoint(1)))
+	df.Close()
+
+	// a record cut short by a truncated data file is an error, not garbage
+	st, err := os.Stat(fn)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(fn, st.Size()-3))
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	_, err = df.Read(0)
+	assert.Nil(t, err)
+	_, err = df.Read(1)
+	assert.Equal(t, "invalid record length at index 1", err.Error())
+	df.Close()
+
+	// an offset past the end of the file is rejected on open
+	idx := make([]byte, 8)
+	byteord.PutUint64(idx, uint64(st.Size()*2))
+	assert.Nil(t, os.WriteFile(fn+IndexSuffix, idx, 0644))
+	_, err = OpenExistingDF(fn, ser)
+	assert.Contains(t, err.Error(), "index 0 has offset")
+
+	// as is a missing index
+	os.Remove(fn + IndexSuffix)
+	_, err = OpenExistingDF(fn, ser)
+	assert.NotNil(t, err)
+}
+
+func TestDFIndexedHugeLength(t *testing.T) {
+	ser := NewSerializer()
+	df := newTestDF(t, ser)
+	for i := uint32(0); i < 3; i++ {
+		assert.Nil(t, df.Write(i, getPoint(i)))
+	}
+	off := df.offsets[1]
+	assert.Nil(t, df.Close())
+
+	// a record length that overflows an int64
+	b, err := os.ReadFile(df.path)
+	assert.Nil(t, err)
+	binary.PutUvarint(b[off:], 1<<63+5)
+	assert.Nil(t, os.WriteFile(df.path, b, 0644))
+
+	df, err = OpenExistingDF(df.path, ser)
+	assert.Nil(t, err)
+	_, err = df.Read(0)
+	assert.Nil(t, err)
+	_, err = df.Read(1)
+	assert.Equal(t, "invalid record length at index 1", err.Error())
+	assert.Nil(t, df.Close())
+
+	m, err := OpenMappedDF(df.path, ser)
+	assert.Nil(t, err)
+	_, err = m.Read(1)
+	assert.Equal(t, "invalid record length at index 1", err.Error())
+	assert.Nil(t, m.Close())
+
+	bad, err := VerifyDF(df.path, ser)
+	assert.Nil(t, err)
+	assert.Len(t, bad, 1)
+	assert.Equal(t, 1, bad[0].Index)
+	assert.Equal(t, off, bad[0].Offset)
+}
+
+// flips a bit in the file at offset
+func flipBit(t *testing.T, fn string, offset int64) {
+	b, err := os.ReadFile(fn)
+	assert.Nil(t, err)
+	b[offset] ^= 0x10
+	assert.Nil(t, os.WriteFile(fn, b, 0644))
+}
+
+func TestDFChecksum(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+	defer os.Remove(fn + IndexSuffix)
+	defer os.Remove(fn + BlockIndexSuffix)
+
+	ser := NewSerializer()
+	df, err := OpenNewDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatChecked, df.Version())
+	for i := uint32(0); i < 3; i++ {
+		assert.Nil(t, df.Write(i, getPoint(i)))
+	}
+	off := df.offsets[1]
+	df.Close()
+
+	// damage the last byte of the second record's value
+	flipBit(t, fn, off+10)
+	df, err = OpenExistingDF(fn, ser)
+	assert.Nil(t, err)
+	_, err = df.Read(0)
+	assert.Nil(t, err)
+	_, err = df.Read(1)
+	assert.ErrorIs(t, err, ErrChecksum)
+	assert.Equal(t, "checksum mismatch in record at index 1", err.Error())
+	_, err = df.Read(2)
+	assert.Nil(t, err)
+	df.Close()
+
+	// damage base_ts in the header
+	flipBit(t, fn, 15)
+	_, err = OpenExistingDF(fn, ser)
+	assert.ErrorIs(t, err, ErrChecksum)
+	assert.Equal(t, "checksum mismatch in header of "+fn, err.Error())
+}
@@ -0,0 +1,222 @@
+package file
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+/*
+Timestamp and float compression from the Gorilla paper (Pelkonen et al.,
+"Gorilla: A Fast, Scalable, In-Memory Time Series Database", VLDB 2015).
+
+Timestamps are stored as the difference between consecutive deltas, which
+is 0 for regularly spaced points, in the smallest bucket that fits its
+zigzag encoding:
+
+	0                      delta-of-delta is 0
+	10    + 7 bits
+	110   + 14 bits
+	1110  + 20 bits
+	11110 + 32 bits
+	11111 + 64 bits
+
+Floats are XORed with the previous value. Identical values take a single 0
+bit; otherwise the meaningful bits of the XOR are stored, reusing the
+previous leading/trailing zero window when they fit in it:
+
+	0                                   same as the previous value
+	10 + meaningful bits                fits the previous window
+	11 + 5 bits leading zeros
+	   + 6 bits meaningful length - 1
+	   + meaningful bits
+
+The first timestamp and float are stored in full.
+*/
+
+var timeBuckets = []int{7, 14, 20, 32, 64}
+
+type timeEncoder struct {
+	w     bitWriter
+	n     int
+	prev  int64
+	delta int64
+}
+
+func (e *timeEncoder) write(ts int64) {
+	if e.n == 0 {
+		e.w.writeBits(uint64(ts), 64)
+	} else {
+		delta := ts - e.prev
+		dod := delta - e.delta
+		e.delta = delta
+		if dod == 0 {
+			e.w.writeBit(false)
+		} else {
+			zz := zigzag(dod)
+			for _, nb := range timeBuckets {
+				e.w.writeBit(true)
+				if nb == 64 || zz < 1<<nb {
+					if nb != 64 {
+						e.w.writeBit(false)
+					}
+					e.w.writeBits(zz, nb)
+					break
+				}
+			}
+		}
+	}
+	e.prev = ts
+	e.n++
+}
+
+type timeDecoder struct {
+	r     bitReader
+	n     int
+	prev  int64
+	delta int64
+}
+
+func (d *timeDecoder) next() (int64, error) {
+	if d.n == 0 {
+		v, err := d.r.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		d.prev = int64(v)
+		d.n++
+		return d.prev, nil
+	}
+
+	// count leading 1s to find the bucket
+	nb := 0
+	for i, b := range timeBuckets {
+		bit, err := d.r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			if i > 0 {
+				nb = timeBuckets[i-1]
+			}
+			break
+		}
+		if i == len(timeBuckets)-1 {
+			nb = b // 64-bit bucket has no terminating 0
+		}
+	}
+
+	var dod int64
+	if nb > 0 {
+		zz, err := d.r.readBits(nb)
+		if err != nil {
+			return 0, err
+		}
+		dod = unzigzag(zz)
+	}
+	d.delta += dod
+	d.prev += d.delta
+	d.n++
+	return d.prev, nil
+}
+
+type floatEncoder struct {
+	w     bitWriter
+	n     int
+	prev  uint64
+	lead  int
+	trail int
+}
+
+func (e *floatEncoder) write(v float64) {
+	vb := math.Float64bits(v)
+	if e.n == 0 {
+		e.w.writeBits(vb, 64)
+		e.lead = -1 // no window yet
+	} else {
+		x := vb ^ e.prev
+		if x == 0 {
+			e.w.writeBit(false)
+		} else {
+			e.w.writeBit(true)
+			lead := min(bits.LeadingZeros64(x), 31) // must fit in 5 bits
+			trail := bits.TrailingZeros64(x)
+			if e.lead >= 0 && lead >= e.lead && trail >= e.trail {
+				e.w.writeBit(false)
+				e.w.writeBits(x>>e.trail, 64-e.lead-e.trail)
+			} else {
+				sig := 64 - lead - trail
+				e.w.writeBit(true)
+				e.w.writeBits(uint64(lead), 5)
+				e.w.writeBits(uint64(sig-1), 6)
+				e.w.writeBits(x>>trail, sig)
+				e.lead, e.trail = lead, trail
+			}
+		}
+	}
+	e.prev = vb
+	e.n++
+}
+
+type floatDecoder struct {
+	r     bitReader
+	n     int
+	prev  uint64
+	lead  int
+	trail int
+}
+
+func (d *floatDecoder) next() (float64, error) {
+	if d.n == 0 {
+		v, err := d.r.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		d.prev = v
+		d.n++
+		return math.Float64frombits(v), nil
+	}
+
+	changed, err := d.r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if changed {
+		newWindow, err := d.r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if newWindow {
+			lead, err := d.r.readBits(5)
+			if err != nil {
+				return 0, err
+			}
+			sig, err := d.r.readBits(6)
+			if err != nil {
+				return 0, err
+			}
+			// the encoder never writes a window wider than 64 bits, so this
+			// is a corrupt block
+			if int(lead)+int(sig+1) > 64 {
+				return 0, fmt.Errorf("invalid window of %d leading zeros and %d meaningful bits", lead, sig+1)
+			}
+			d.lead = int(lead)
+			d.trail = 64 - d.lead - int(sig+1)
+		}
+		x, err := d.r.readBits(64 - d.lead - d.trail)
+		if err != nil {
+			return 0, err
+		}
+		d.prev ^= x << d.trail
+	}
+	d.n++
+	return math.Float64frombits(d.prev), nil
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
@@ -0,0 +1,110 @@
+package file
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitStream(t *testing.T) {
+	w := bitWriter{}
+	w.writeBit(true)
+	w.writeBits(0x5, 3)
+	w.writeBits(0xabcdef, 24)
+	w.writeBit(false)
+	w.writeBits(math.MaxUint64, 64)
+	assert.Equal(t, 12, len(w.bytes())) // 93 bits
+
+	r := bitReader{b: w.bytes()}
+	bit, err := r.readBit()
+	assert.Nil(t, err)
+	assert.True(t, bit)
+	v, err := r.readBits(3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0x5), v)
+	v, err = r.readBits(24)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0xabcdef), v)
+	bit, err = r.readBit()
+	assert.Nil(t, err)
+	assert.False(t, bit)
+	v, err = r.readBits(64)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), v)
+
+	// padding bits in the last byte, then nothing
+	_, err = r.readBits(3)
+	assert.Nil(t, err)
+	_, err = r.readBit()
+	assert.Equal(t, errBitsExhausted, err)
+	_, err = r.readBits(1)
+	assert.Equal(t, errBitsExhausted, err)
+}
+
+func TestTimeCompression(t *testing.T) {
+	// regular intervals, jitter, gaps of every bucket size and going backwards
+	ts := []int64{1704927662000000, 1704927663000000, 1704927664000000, 1704927665000000,
+		1704927666000100, 1704927667000000, 1704927667000000, 1704927700000000,
+		1704930000000000, 1800000000000000, 1704927662000000, -5, 0, math.MaxInt64 / 2}
+
+	e := timeEncoder{}
+	for _, v := range ts {
+		e.write(v)
+	}
+	d := timeDecoder{r: bitReader{b: e.w.bytes()}}
+	for _, v := range ts {
+		act, err := d.next()
+		assert.Nil(t, err)
+		assert.Equal(t, v, act)
+	}
+
+	// a regular series takes a bit per point after the first two
+	e = timeEncoder{}
+	for i := int64(0); i < 1000; i++ {
+		e.write(1704927662000000 + i*1000000)
+	}
+	assert.Equal(t, (64+5+32+998+7)/8, len(e.w.bytes()))
+}
+
+func TestFloatCompression(t *testing.T) {
+	vals := []float64{12, 12, 12.5, 13, 24, 24, -0.1, math.Pi, math.Inf(1), math.SmallestNonzeroFloat64,
+		math.MaxFloat64, 0, math.Copysign(0, -1), 1e-300, 12}
+
+	e := floatEncoder{}
+	for _, v := range vals {
+		e.write(v)
+	}
+	d := floatDecoder{r: bitReader{b: e.w.bytes()}}
+	for _, v := range vals {
+		act, err := d.next()
+		assert.Nil(t, err)
+		assert.Equal(t, math.Float64bits(v), math.Float64bits(act))
+	}
+
+	// NaN round trips bit for bit
+	e = floatEncoder{}
+	e.write(math.NaN())
+	e.write(1)
+	d = floatDecoder{r: bitReader{b: e.w.bytes()}}
+	act, _ := d.next()
+	assert.True(t, math.IsNaN(act))
+	act, _ = d.next()
+	assert.Equal(t, 1.0, act)
+
+	// repeated values take a bit each
+	e = floatEncoder{}
+	for i := 0; i < 1000; i++ {
+		e.write(21.5)
+	}
+	assert.Equal(t, (64+999+7)/8, len(e.w.bytes()))
+}
+
+func TestZigzag(t *testing.T) {
+	for _, v := range []int64{0, -1, 1, -64, 64, math.MinInt64, math.MaxInt64} {
+		assert.Equal(t, v, unzigzag(zigzag(v)))
+	}
+	assert.Equal(t, uint64(0), zigzag(0))
+	assert.Equal(t, uint64(1), zigzag(-1))
+	assert.Equal(t, uint64(2), zigzag(1))
+}
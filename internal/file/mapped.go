@@ -0,0 +1,196 @@
+package file
+
+import (
+	"equinox/internal/core"
+	"equinox/internal/query"
+	"errors"
+	"fmt"
+)
+
+/*
+Read-only view of a data file mapped into memory, for files that are no
+longer written to. Records are decoded straight from the mapping, without a
+syscall or a copy per record. Writes made to the file after it's mapped may
+not be seen, and the file must not be truncated while it's mapped.
+*/
+type MappedDF struct {
+	df   *DataFile // header and index; its files are closed
+	data []byte
+}
+
+func OpenMappedDF(path string, ser *Serializer) (*MappedDF, error) {
+	df, err := OpenExistingDF(path, ser)
+	if err != nil {
+		return nil, err
+	}
+	defer df.closeFiles()
+
+	size, err := df.size()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mmap(df.fd, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map %s: %s", path, err.Error())
+	}
+	df.end = size
+	return &MappedDF{df: df, data: data}, nil
+}
+
+func (m *MappedDF) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := munmap(m.data)
+	m.data = nil
+	return err
+}
+
+// Format version of the file
+func (m *MappedDF) Version() uint16 {
+	return m.df.version
+}
+
+// Number of indexes in the file, including empty ones
+func (m *MappedDF) Len() int {
+	if m.df.indexed() {
+		return len(m.df.offsets)
+	}
+	data := int64(len(m.data)) - int64(m.df.header_size)
+	if data <= 0 || m.df.record_size == 0 {
+		return 0
+	}
+	return int((data + int64(m.df.record_size) - 1) / int64(m.df.record_size))
+}
+
+func (m *MappedDF) Read(idx uint32) (*core.Point, error) {
+	data, err := m.record(idx)
+	if err != nil {
+		return nil, err
+	}
+	return m.df.decode(data, idx)
+}
+
+// Returns the record for an index, which points into the mapping
+func (m *MappedDF) record(idx uint32) ([]byte, error) {
+	df := m.df
+	if df.indexed() {
+		if int(idx) >= len(df.offsets) || df.offsets[idx] == 0 {
+			return nil, fmt.Errorf("%w at index %d", ErrEmptyRecord, idx)
+		}
+		offset := df.offsets[idx]
+		size, l, err := df.indexedSize(m.data[offset:], offset, idx)
+		if err != nil {
+			return nil, err
+		}
+		return df.unwrapIndexed(m.data[offset:offset+size], l, idx)
+	}
+
+	offset := df.getOffset(idx)
+	if offset >= int64(len(m.data)) {
+		return nil, fmt.Errorf("index %d is past the end of the file", idx)
+	}
+	data := m.data[offset:min(offset+int64(df.record_size), int64(len(m.data)))]
+	if len(data) < int(df.record_size) {
+		// files written before slots were padded may end with a short record
+		data = append(make([]byte, 0, df.record_size), data...)
+		data = data[:df.record_size]
+	}
+	return df.unwrapSlot(data, idx)
+}
+
+// Returns false if no point in the block holding idx can match the query.
+// Returns true for files without a block index.
+func (m *MappedDF) BlockMayMatch(idx uint32, q *query.Query) bool {
+	return m.df.blocks == nil || m.df.blocks.mayMatch(idx, q)
+}
+
+// Like DataFile.BlockMinTs
+func (m *MappedDF) BlockMinTs(n uint32) []int64 {
+	if m.df.blocks == nil {
+		return nil
+	}
+	return m.df.blocks.minTs(int((n + BlockRecords - 1) / BlockRecords))
+}
+
+// Iterator over the points at a range of indexes, skipping empty ones
+type MappedIter struct {
+	m    *MappedDF
+	next uint32
+	end  uint32
+	idx  uint32
+}
+
+// Returns an iterator over the points from index start up to, but not
+// including, end
+func (m *MappedDF) Range(start, end uint32) *MappedIter {
+	return &MappedIter{m: m, next: start, end: min(end, uint32(m.Len()))}
+}
+
+// Returns the next point, or nil once every point in the range has been
+// returned
+func (it *MappedIter) Next() (*core.Point, error) {
+	for it.next < it.end {
+		idx := it.next
+		it.next++
+		p, err := it.m.Read(idx)
+		if errors.Is(err, ErrEmptyRecord) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		it.idx = idx
+		return p, nil
+	}
+	return nil, nil
+}
+
+// Index of the point last returned by Next
+func (it *MappedIter) Index() uint32 {
+	return it.idx
+}
+
+// Cursor over the points in a range of a mapped file that match a query,
+// skipping blocks whose summaries rule them out
+type MappedCursor struct {
+	m    *MappedDF
+	q    *query.Query
+	next uint32 // start of the next block to read
+	end  uint32
+	it   *MappedIter // over the current block
+}
+
+func NewMappedCursor(m *MappedDF, q *query.Query, start, end uint32) *MappedCursor {
+	return &MappedCursor{m: m, q: q, next: start, end: min(end, uint32(m.Len()))}
+}
+
+func (mc *MappedCursor) Fetch(n int) ([]*core.Point, error) {
+	var r []*core.Point
+	for len(r) < n {
+		if mc.it == nil {
+			if mc.next >= mc.end {
+				break
+			}
+			start := mc.next
+			mc.next = min((start/BlockRecords+1)*BlockRecords, mc.end)
+			if mc.m.BlockMayMatch(start, mc.q) {
+				mc.it = mc.m.Range(start, mc.next)
+			}
+			continue
+		}
+
+		p, err := mc.it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			mc.it = nil
+			continue
+		}
+		if mc.q.Match(p) {
+			r = append(r, p)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,210 @@
+package file
+
+import (
+	"equinox/internal/core"
+	"equinox/internal/query"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMappedDF(t *testing.T) {
+	ser := NewSerializer()
+	df := newTestDF(t, ser)
+	for i := uint32(0); i < 20; i++ {
+		if i%5 != 3 {
+			assert.Nil(t, df.Write(i, getPoint(i)))
+		}
+	}
+	assert.Nil(t, df.Close())
+
+	m, err := OpenMappedDF(df.path, ser)
+	assert.Nil(t, err)
+	defer m.Close()
+	assert.Equal(t, FormatVersion, m.Version())
+	assert.Equal(t, 20, m.Len())
+
+	for i := uint32(0); i < 22; i++ {
+		p, err := m.Read(i)
+		if i%5 == 3 || i >= 20 {
+			assert.ErrorIs(t, err, ErrEmptyRecord)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.True(t, getPoint(i).Equal(p))
+	}
+
+	// ranges skip empty indexes and stop at the end of the file
+	it := m.Range(7, 100)
+	var idxs []uint32
+	for {
+		p, err := it.Next()
+		assert.Nil(t, err)
+		if p == nil {
+			break
+		}
+		assert.True(t, getPoint(it.Index()).Equal(p))
+		idxs = append(idxs, it.Index())
+	}
+	assert.Equal(t, []uint32{7, 9, 10, 11, 12, 14, 15, 16, 17, 19}, idxs)
+
+	assert.Nil(t, m.Close())
+	assert.Nil(t, m.Close())
+}
+
+func TestMappedDFCorrupt(t *testing.T) {
+	ser := NewSerializer()
+	df := newTestDF(t, ser)
+	for i := uint32(0); i < 3; i++ {
+		assert.Nil(t, df.Write(i, getPoint(i)))
+	}
+	off := df.offsets[1]
+	assert.Nil(t, df.Close())
+	flipBit(t, df.path, off+10)
+
+	m, err := OpenMappedDF(df.path, ser)
+	assert.Nil(t, err)
+	defer m.Close()
+	_, err = m.Read(1)
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	it := m.Range(0, 3)
+	_, err = it.Next()
+	assert.Nil(t, err)
+	_, err = it.Next()
+	assert.Equal(t, "checksum mismatch in record at index 1", err.Error())
+}
+
+func TestMappedDFSlots(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+
+	ser := NewSerializer()
+	writeFixedDF(t, fn, ser)
+
+	m, err := OpenMappedDF(fn, ser)
+	assert.Nil(t, err)
+	defer m.Close()
+	assert.Equal(t, FormatFixed, m.Version())
+	assert.Equal(t, 10, m.Len())
+	for i := uint32(0); i < 10; i++ {
+		p, err := m.Read(i)
+		if i == 5 {
+			assert.ErrorIs(t, err, ErrEmptyRecord)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.True(t, getPoint(i).Equal(p))
+	}
+	_, err = m.Read(10)
+	assert.Equal(t, "index 10 is past the end of the file", err.Error())
+}
+
+func TestMappedCursor(t *testing.T) {
+	ser := NewSerializer()
+	df := newTestDF(t, ser)
+	ps := getBlockPoints(300)
+	var recs []Record
+	for i, p := range ps {
+		recs = append(recs, Record{Idx: uint32(i), Point: p})
+	}
+	assert.Nil(t, df.WriteBatch(recs))
+	assert.Nil(t, df.Close())
+
+	m, err := OpenMappedDF(df.path, ser)
+	assert.Nil(t, err)
+	defer m.Close()
+
+	fetchAll := func(q *query.Query, start, end uint32) []*core.Point {
+		qe := query.NewQueryExec(q, NewMappedCursor(m, q, start, end))
+		var r []*core.Point
+		for !qe.Done() {
+			batch, err := qe.Fetch(7)
+			assert.Nil(t, err)
+			r = append(r, batch...)
+		}
+		return r
+	}
+
+	r := fetchAll(query.NewQuery(ps[0].Ts, ps[299].Ts, query.True()), 0, 300)
+	assert.Equal(t, 300, len(r))
+	for i := range ps {
+		assert.True(t, ps[i].Equal(r[i]), "point %d", i)
+	}
+
+	// filtered by time and attribute within an index range
+	q := query.NewQuery(ps[50].Ts, ps[260].Ts, query.Equal("host", "web1"))
+	r = fetchAll(q, 150, 300)
+	assert.Equal(t, 50, len(r))
+	assert.True(t, ps[150].Equal(r[0]))
+	assert.True(t, ps[199].Equal(r[49]))
+
+	// blocks the query can't match aren't read, so damage to them goes
+	// unnoticed
+	off := m.df.offsets[200]
+	assert.Nil(t, m.Close())
+	flipBit(t, df.path, off+10)
+	m, err = OpenMappedDF(df.path, ser)
+	assert.Nil(t, err)
+	defer m.Close()
+	r = fetchAll(query.NewQuery(ps[0].Ts, ps[299].Ts, query.Equal("host", "web0")), 0, 300)
+	assert.Equal(t, 100, len(r))
+	qe := query.NewQueryExec(q, NewMappedCursor(m, q, 0, 300))
+	_, err = qe.Fetch(300)
+	assert.ErrorContains(t, err, "checksum mismatch in record at index 200")
+}
+
+/****************************************************************************
+	Benchmarks reading every point of a file through the DataFile and a
+	mapping. ns/op is per point.
+****************************************************************************/
+
+func writeBenchDF(b *testing.B, ser *Serializer, n int) string {
+	df := newTestDF(b, ser)
+	assert.Nil(b, df.SetDurability(DurabilityBuffer))
+	recs := make([]Record, n)
+	for i, p := range getBlockPoints(n) {
+		recs[i] = Record{Idx: uint32(i), Point: p}
+	}
+	assert.Nil(b, df.WriteBatch(recs))
+	assert.Nil(b, df.Close())
+	return df.path
+}
+
+func BenchmarkDFRead(b *testing.B) {
+	ser := NewSerializer()
+	df, err := OpenExistingDF(writeBenchDF(b, ser, 10000), ser)
+	assert.Nil(b, err)
+	defer df.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := df.Read(uint32(i % 10000))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMappedRange(b *testing.B) {
+	ser := NewSerializer()
+	m, err := OpenMappedDF(writeBenchDF(b, ser, 10000), ser)
+	assert.Nil(b, err)
+	defer m.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	it := m.Range(0, 10000)
+	for i := 0; i < b.N; i++ {
+		p, err := it.Next()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if p == nil {
+			it = m.Range(0, 10000)
+		}
+	}
+}
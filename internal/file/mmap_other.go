@@ -0,0 +1,21 @@
+//go:build !unix
+
+package file
+
+import (
+	"os"
+)
+
+// Reads the first size bytes of a file into memory, as there's no mmap
+func mmap(f *os.File, size int64) ([]byte, error) {
+	b := make([]byte, size)
+	_, err := f.ReadAt(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -3,11 +3,37 @@ package file
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"equinox/internal/core"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"time"
 )
 
+// Record formats. The version is stored in each DataFile's header so that
+// files written in older formats can still be read.
+const (
+	// Fixed-width fields: 8-byte timestamps, 4-byte counts and indexes and
+	// 8-byte floats. Files in this format have no magic number or version.
+	FormatFixed uint16 = 1
+
+	// Varint counts and indexes, and timestamps as a varint delta from a base
+	// time stored in the file header.
+	FormatCompact uint16 = 2
+
+	// FormatCompact records of any length, located through an offset index
+	// rather than fixed-size slots.
+	FormatIndexed uint16 = 3
+
+	// FormatIndexed with a CRC32C checksum after the header and each record.
+	FormatChecked uint16 = 4
+)
+
+// Format used for new records
+const FormatVersion = FormatChecked
+
 type Serializer struct {
 	valkey  *AttrMap
 	attrkey *AttrMap
@@ -24,7 +50,204 @@ func NewSerializer() *Serializer {
 	return &s
 }
 
+// Total number of keys and values that have been given indexes
+func (s *Serializer) Size() int {
+	return int(s.valkey.Length() + s.attrkey.Length() + s.attrval.Length())
+}
+
+// Gives indexes to any of the point's keys and values that don't have one,
+// returning true if there were any. Points can only be decoded by a
+// Serializer that knows their indexes, so callers persisting the Serializer
+// can use this to save it before writing points that depend on it.
+func (s *Serializer) Learn(p *core.Point) bool {
+	n := s.Size()
+	for k := range p.Vals {
+		s.valkey.ToIndex(k)
+	}
+	for k, v := range p.Attrs {
+		s.attrkey.ToIndex(k)
+		s.attrval.ToIndex(v)
+	}
+	return s.Size() != n
+}
+
+// Returns the indexes of an attribute key and value, or false if either
+// doesn't have one, in which case no point encoded by this Serializer has
+// that attribute
+func (s *Serializer) AttrPair(k, v string) (uint32, uint32, bool) {
+	kidx, kexist := s.attrkey.Index(k)
+	vidx, vexist := s.attrval.Index(v)
+	return kidx, vidx, kexist && vexist
+}
+
+// JSON form of a Serializer, for persisting its indexes
+type serializerJSON struct {
+	ValKey  *AttrMap `json:"val_keys"`
+	AttrKey *AttrMap `json:"attr_keys"`
+	AttrVal *AttrMap `json:"attr_vals"`
+}
+
+func (s *Serializer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(serializerJSON{ValKey: s.valkey, AttrKey: s.attrkey, AttrVal: s.attrval})
+}
+
+func (s *Serializer) UnmarshalJSON(b []byte) error {
+	j := serializerJSON{ValKey: NewAttrMap(), AttrKey: NewAttrMap(), AttrVal: NewAttrMap()}
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	s.valkey, s.attrkey, s.attrval = j.ValKey, j.AttrKey, j.AttrVal
+	return nil
+}
+
+// Serializes a point in the current format, with its timestamp relative to
+// the Unix epoch
+func (s *Serializer) Serialize(p *core.Point) ([]byte, error) {
+	return s.Encode(p, FormatVersion, 0)
+}
+
+// Deserializes a point written by Serialize
 func (s *Serializer) Deserialize(b []byte) (*core.Point, error) {
+	return s.Decode(b, FormatVersion, 0)
+}
+
+// Serializes a point in the given format. base is the time, in microseconds
+// since the Unix epoch, that compact timestamps are relative to; it's ignored
+// by the fixed format.
+func (s *Serializer) Encode(p *core.Point, version uint16, base int64) ([]byte, error) {
+	switch version {
+	case FormatFixed:
+		return s.encodeFixed(p)
+	case FormatCompact, FormatIndexed, FormatChecked:
+		return s.encodeCompact(p, base), nil
+	}
+	return nil, fmt.Errorf("unsupported format version %d", version)
+}
+
+// Deserializes a point written by Encode with the same version and base. Any
+// bytes after the point are ignored.
+func (s *Serializer) Decode(b []byte, version uint16, base int64) (*core.Point, error) {
+	switch version {
+	case FormatFixed:
+		return s.decodeFixed(b)
+	case FormatCompact, FormatIndexed, FormatChecked:
+		p, err := s.decodeCompact(b, base)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("record truncated after %d bytes", len(b))
+		}
+		return p, err
+	}
+	return nil, fmt.Errorf("unsupported format version %d", version)
+}
+
+/*
+Compact format:
+timestamp: signed varint, microseconds relative to base
+values map length: unsigned varint
+Then for each entry:
+- key: unsigned varint
+- value: 8 bytes (64-bit float)
+
+attributes map length: unsigned varint
+Then for each entry:
+- key: unsigned varint
+- value: unsigned varint
+
+Indexes below 128 take one byte, so a point with few distinct keys takes
+about 2 + 9*num_values + 2*num_attrs bytes plus its timestamp delta.
+*/
+func (s *Serializer) encodeCompact(p *core.Point, base int64) []byte {
+	b := make([]byte, 0, 3*binary.MaxVarintLen64+9*len(p.Vals)+2*len(p.Attrs))
+
+	b = binary.AppendVarint(b, p.Ts.UnixMicro()-base)
+
+	b = binary.AppendUvarint(b, uint64(len(p.Vals)))
+	for key, val := range p.Vals {
+		b = binary.AppendUvarint(b, uint64(s.valkey.ToIndex(key)))
+		b = byteord.AppendUint64(b, math.Float64bits(val))
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(p.Attrs)))
+	for key, val := range p.Attrs {
+		b = binary.AppendUvarint(b, uint64(s.attrkey.ToIndex(key)))
+		b = binary.AppendUvarint(b, uint64(s.attrval.ToIndex(val)))
+	}
+
+	return b
+}
+
+func (s *Serializer) decodeCompact(b []byte, base int64) (*core.Point, error) {
+	buf := bytes.NewReader(b)
+
+	delta, err := binary.ReadVarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	p := core.NewPoint(time.UnixMicro(base + delta).UTC())
+
+	// values
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		k, err := readIndex(buf)
+		if err != nil {
+			return nil, err
+		}
+		var bits uint64
+		err = binary.Read(buf, byteord, &bits)
+		if err != nil {
+			return nil, err
+		}
+		str, exists := s.valkey.AtIndex(k)
+		if !exists {
+			return nil, fmt.Errorf("failed to find value key for index %d", k)
+		}
+		p.Vals[str] = math.Float64frombits(bits)
+	}
+
+	// attributes
+	n, err = binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		k, err := readIndex(buf)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readIndex(buf)
+		if err != nil {
+			return nil, err
+		}
+		kstr, exists := s.attrkey.AtIndex(k)
+		if !exists {
+			return nil, fmt.Errorf("failed to find attr key for index %d", k)
+		}
+		vstr, exists := s.attrval.AtIndex(v)
+		if !exists {
+			return nil, fmt.Errorf("failed to find attr value for index %d", v)
+		}
+		p.Attrs[kstr] = vstr
+	}
+	return p, nil
+}
+
+// Reads a varint AttrMap index
+func readIndex(r io.ByteReader) (uint32, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxUint32 {
+		return 0, fmt.Errorf("index %d out of range", v)
+	}
+	return uint32(v), nil
+}
+
+func (s *Serializer) decodeFixed(b []byte) (*core.Point, error) {
 	buf := bytes.NewReader(b)
 	var i, numvals uint32
 
@@ -95,7 +318,7 @@ func (s *Serializer) Deserialize(b []byte) (*core.Point, error) {
 }
 
 /*
-Serialization format:
+Fixed format:
 timestamp: 8 bytes (64-bit)
 values map length: 4 bytes (32-bit)
 Then for each entry:
@@ -109,7 +332,7 @@ Then for each entry:
 
 Expected size (bytes) =  16 + 12*num_values + 8*num_attrs
 */
-func (s *Serializer) Serialize(p *core.Point) ([]byte, error) {
+func (s *Serializer) encodeFixed(p *core.Point) ([]byte, error) {
 	var buf bytes.Buffer
 
 	// timestamp => 64-bit = 8 bytes
@@ -1,6 +1,7 @@
 package file
 
 import (
+	"encoding/json"
 	"equinox/internal/core"
 	"testing"
 	"time"
@@ -23,16 +24,90 @@ func TestSerialize(t *testing.T) {
 
 	s := NewSerializer()
 
-	data, err := s.Serialize(p)
+	data, err := s.Encode(p, FormatFixed, 0)
 
 	assert.Nil(t, err)
 
 	// expected size: 16 + 12*num_values + 8*num_attrs = 16 + 24 + 16 = 56
 	assert.Equal(t, 56, len(data))
 
-	p2, err := s.Deserialize(data)
+	p2, err := s.Decode(data, FormatFixed, 0)
 
 	assert.Nil(t, err)
 	assert.True(t, p2.Equal(p))
 
+	// compact: 8-byte timestamp delta from the epoch + 2 + 9*2 + 2*2 = 32
+	data, err = s.Serialize(p)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, len(data))
+
+	p2, err = s.Deserialize(data)
+	assert.Nil(t, err)
+	assert.True(t, p2.Equal(p))
+
+	// a nearby base shrinks the timestamp to a byte
+	base := ts.Add(-time.Microsecond).UnixMicro()
+	data, err = s.Encode(p, FormatCompact, base)
+	assert.Nil(t, err)
+	assert.Equal(t, 25, len(data))
+
+	p2, err = s.Decode(append(data, 0, 0, 0), FormatCompact, base) // trailing padding
+	assert.Nil(t, err)
+	assert.True(t, p2.Equal(p))
+}
+
+func TestSerializeErrors(t *testing.T) {
+	p := core.NewPoint(time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC))
+	p.Vals["area"] = 43.1
+	s := NewSerializer()
+
+	_, err := s.Encode(p, 9, 0)
+	assert.Equal(t, "unsupported format version 9", err.Error())
+	_, err = s.Decode([]byte{0}, 0, 0)
+	assert.Equal(t, "unsupported format version 0", err.Error())
+
+	data, err := s.Serialize(p)
+	assert.Nil(t, err)
+	_, err = s.Deserialize(data[:len(data)-2])
+	assert.Equal(t, "record truncated after 17 bytes", err.Error())
+
+	// indexes not known to this serializer
+	_, err = NewSerializer().Deserialize(data)
+	assert.Equal(t, "failed to find value key for index 0", err.Error())
+}
+
+func TestSerializerJSON(t *testing.T) {
+	p := core.NewPoint(time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC))
+	p.Vals["area"] = 43.1
+	p.Attrs["color"] = "red"
+	p.Attrs["shape"] = "square"
+
+	s := NewSerializer()
+	assert.Equal(t, 0, s.Size())
+	assert.True(t, s.Learn(p))
+	assert.Equal(t, 5, s.Size())
+	assert.False(t, s.Learn(p))
+	data, err := s.Serialize(p)
+	assert.Nil(t, err)
+
+	// a restored serializer decodes the same points
+	b, err := json.Marshal(s)
+	assert.Nil(t, err)
+	s2 := NewSerializer()
+	assert.Nil(t, json.Unmarshal(b, s2))
+	assert.Equal(t, 5, s2.Size())
+	p2, err := s2.Deserialize(data)
+	assert.Nil(t, err)
+	assert.True(t, p.Equal(p2))
+
+	// indexes of deleted strings aren't reused
+	s.attrval.DeleteAttr("square")
+	b, err = json.Marshal(s)
+	assert.Nil(t, err)
+	s2 = NewSerializer()
+	assert.Nil(t, json.Unmarshal(b, s2))
+	assert.Equal(t, 4, s2.Size())
+	assert.Equal(t, uint32(2), s2.attrval.ToIndex("blue"))
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"val_keys": 1}`), s2))
 }
@@ -0,0 +1,97 @@
+package file
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Damaged part of a data file found by VerifyDF
+type Corruption struct {
+	Index  int   // index of the damaged record, or -1 for the header
+	Offset int64 // start of the damaged bytes in the data file
+	Size   int64
+	Err    error
+}
+
+func (c Corruption) String() string {
+	what := fmt.Sprintf("index %d", c.Index)
+	if c.Index < 0 {
+		what = "header"
+	}
+	return fmt.Sprintf("%s: bytes %d-%d: %s", what, c.Offset, c.Offset+c.Size, c.Err.Error())
+}
+
+/*
+Reads every record of the data file at path and returns the ones that are
+damaged: records that fail their checksum, run past the end of the file or
+don't decode. A damaged header is reported on its own, since the records
+can't be located without it. The error is only set if the file couldn't be
+checked at all.
+
+Files older than FormatChecked have no checksums, so damage that still decodes
+goes unnoticed in them.
+*/
+func VerifyDF(path string, ser *Serializer) ([]Corruption, error) {
+	df, err := OpenExistingDF(path, ser)
+	if errors.Is(err, ErrChecksum) {
+		return []Corruption{{Index: -1, Size: int64(headerSize(FormatChecked)), Err: err}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer df.Close()
+
+	n, err := df.Len()
+	if err != nil {
+		return nil, err
+	}
+	size, err := df.size()
+	if err != nil {
+		return nil, err
+	}
+
+	var bad []Corruption
+	for i := 0; i < n; i++ {
+		_, err := df.Read(uint32(i))
+		if err == nil || errors.Is(err, ErrEmptyRecord) {
+			continue
+		}
+		offset, length := df.recordSpan(uint32(i), size)
+		bad = append(bad, Corruption{Index: i, Offset: offset, Size: length, Err: err})
+	}
+	return bad, nil
+}
+
+func (df *DataFile) size() (int64, error) {
+	if df.indexed() {
+		return df.end, nil
+	}
+	st, err := df.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// Returns the offset and length of the idx'th record, cut short at the end of
+// the file. A record whose length can't be read runs to the end of the file.
+func (df *DataFile) recordSpan(idx uint32, size int64) (int64, int64) {
+	offset := df.getOffset(idx)
+	n := int64(df.record_size)
+	if df.indexed() {
+		offset = df.offsets[idx]
+		n = size - offset
+
+		var lb [binary.MaxVarintLen64]byte
+		m, _ := df.fd.ReadAt(lb[:], offset)
+		rec, l := binary.Uvarint(lb[:m])
+		if l > 0 && rec < uint64(size) {
+			if df.checked() {
+				rec += crcSize
+			}
+			n = min(n, int64(l)+int64(rec))
+		}
+	}
+	return offset, max(0, min(n, size-offset))
+}
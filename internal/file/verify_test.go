@@ -0,0 +1,77 @@
+package file
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyDF(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+	defer os.Remove(fn + IndexSuffix)
+	defer os.Remove(fn + BlockIndexSuffix)
+
+	ser := NewSerializer()
+	df, err := OpenNewDF(fn, ser)
+	assert.Nil(t, err)
+	for i := uint32(0); i < 6; i++ {
+		if i != 3 {
+			assert.Nil(t, df.Write(i, getPoint(i)))
+		}
+	}
+	offsets := append([]int64{}, df.offsets...)
+	end := df.end
+	df.Close()
+
+	bad, err := VerifyDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Empty(t, bad)
+
+	// a damaged record, and one torn by a truncated file
+	flipBit(t, fn, offsets[1]+5)
+	assert.Nil(t, os.Truncate(fn, end-2))
+	bad, err = VerifyDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Len(t, bad, 2)
+	assert.Equal(t, 1, bad[0].Index)
+	assert.Equal(t, offsets[1], bad[0].Offset)
+	assert.Equal(t, offsets[2]-offsets[1], bad[0].Size)
+	assert.ErrorIs(t, bad[0].Err, ErrChecksum)
+	assert.Equal(t, 5, bad[1].Index)
+	assert.Equal(t, offsets[5], bad[1].Offset)
+	assert.Equal(t, end-2-offsets[5], bad[1].Size)
+	assert.Equal(t, "index 5: bytes 162-196: invalid record length at index 5",
+		bad[1].String())
+
+	// a damaged header hides the records
+	flipBit(t, fn, 6)
+	bad, err = VerifyDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Len(t, bad, 1)
+	assert.Equal(t, -1, bad[0].Index)
+	assert.Equal(t, "header: bytes 0-24: checksum mismatch in header of "+fn, bad[0].String())
+
+	_, err = VerifyDF(fn+".missing", ser)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyDFFixed(t *testing.T) {
+	fn, err := tempFileName()
+	assert.Nil(t, err)
+	defer os.Remove(fn)
+
+	ser := NewSerializer()
+	writeFixedDF(t, fn, ser)
+
+	// an attribute index no serializer has seen
+	flipBit(t, fn, 4+2*64+60)
+	bad, err := VerifyDF(fn, ser)
+	assert.Nil(t, err)
+	assert.Len(t, bad, 1)
+	assert.Equal(t, 2, bad[0].Index)
+	assert.Equal(t, int64(4+2*64), bad[0].Offset)
+	assert.Equal(t, int64(64), bad[0].Size)
+}
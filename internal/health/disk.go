@@ -0,0 +1,43 @@
+package health
+
+import (
+	"fmt"
+	"os"
+)
+
+// Returns a check that passes if a file can be created, written, synced and
+// removed in dir
+func DirWritable(dir string) func() error {
+	return func() error {
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return fmt.Errorf("cannot create file in %s: %s", dir, err.Error())
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		_, err = f.Write([]byte("ok"))
+		if err == nil {
+			err = f.Sync()
+		}
+		if err != nil {
+			return fmt.Errorf("cannot write to %s: %s", dir, err.Error())
+		}
+		return nil
+	}
+}
+
+// Returns a check that passes if the filesystem holding dir has at least min
+// bytes available to unprivileged users
+func MinFreeSpace(dir string, min uint64) func() error {
+	return func() error {
+		free, err := FreeSpace(dir)
+		if err != nil {
+			return fmt.Errorf("cannot get free space for %s: %s", dir, err.Error())
+		}
+		if free < min {
+			return fmt.Errorf("%d bytes free in %s, below the minimum of %d", free, dir, min)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package health
+
+import "errors"
+
+// Returns the number of bytes available to unprivileged users on the
+// filesystem holding path. Not supported on this platform.
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space check not supported on this platform")
+}
@@ -0,0 +1,45 @@
+package health
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirWritable(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, DirWritable(dir)())
+
+	// the probe file is cleaned up
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	missing := filepath.Join(dir, "missing")
+	err = DirWritable(missing)()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot create file in "+missing)
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("free space not supported")
+	}
+	dir := t.TempDir()
+	free, err := FreeSpace(dir)
+	assert.NoError(t, err)
+	assert.Greater(t, free, uint64(0))
+
+	assert.NoError(t, MinFreeSpace(dir, 1)())
+
+	err = MinFreeSpace(dir, 1<<62)()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "below the minimum of 4611686018427387904")
+
+	err = MinFreeSpace(filepath.Join(dir, "missing"), 1)()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot get free space for")
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package health
+
+import "syscall"
+
+// Returns the number of bytes available to unprivileged users on the
+// filesystem holding path
+func FreeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,101 @@
+package health
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outcome of running a check
+type Result struct {
+	Name     string  `json:"name"`
+	OK       bool    `json:"ok"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+}
+
+type check struct {
+	name string
+	fn   func() error
+}
+
+// Set of named checks that together decide whether the server is ready.
+// Safe for concurrent use.
+type Checker struct {
+	mu     sync.RWMutex
+	checks []check
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Singleton instance of Checker
+var readinessInst = NewChecker()
+
+// Returns the checker used for readiness
+func GetReadiness() *Checker {
+	return readinessInst
+}
+
+// Adds a check; fn returns nil if it passes. Checks run in the order added.
+func (c *Checker) Register(name string, fn func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// Removes all checks
+func (c *Checker) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = nil
+}
+
+// Runs every check and returns their results, and whether they all passed
+func (c *Checker) Run() ([]Result, bool) {
+	c.mu.RLock()
+	checks := append([]check(nil), c.checks...)
+	c.mu.RUnlock()
+
+	ok := true
+	r := make([]Result, len(checks))
+	for i, ch := range checks {
+		start := time.Now()
+		err := ch.fn()
+		r[i] = Result{
+			Name:     ch.name,
+			OK:       err == nil,
+			Duration: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			r[i].Error = err.Error()
+			ok = false
+		}
+	}
+	return r, ok
+}
+
+// Check that fails until it's marked done, for startup work such as
+// replaying the WAL and opening data files
+type Gate struct {
+	msg  string
+	done atomic.Bool
+}
+
+// Creates a gate that fails with msg until Done is called
+func NewGate(msg string) *Gate {
+	return &Gate{msg: msg}
+}
+
+func (g *Gate) Done() {
+	g.done.Store(true)
+}
+
+func (g *Gate) Check() error {
+	if !g.done.Load() {
+		return errors.New(g.msg)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package health
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckerRun(t *testing.T) {
+	c := NewChecker()
+	r, ok := c.Run()
+	assert.True(t, ok)
+	assert.Empty(t, r)
+
+	fail := errors.New("disk gone")
+	c.Register("a", func() error { return nil })
+	c.Register("b", func() error { return fail })
+	c.Register("c", func() error { return nil })
+
+	r, ok = c.Run()
+	assert.False(t, ok)
+	assert.Len(t, r, 3)
+	assert.Equal(t, "a", r[0].Name)
+	assert.True(t, r[0].OK)
+	assert.Empty(t, r[0].Error)
+	assert.Equal(t, "b", r[1].Name)
+	assert.False(t, r[1].OK)
+	assert.Equal(t, "disk gone", r[1].Error)
+	assert.Equal(t, "c", r[2].Name)
+	assert.True(t, r[2].OK)
+
+	c.Reset()
+	r, ok = c.Run()
+	assert.True(t, ok)
+	assert.Empty(t, r)
+}
+
+func TestGate(t *testing.T) {
+	g := NewGate("not yet")
+	err := g.Check()
+	assert.Error(t, err)
+	assert.Equal(t, "not yet", err.Error())
+
+	g.Done()
+	assert.NoError(t, g.Check())
+}
@@ -0,0 +1,291 @@
+package ingest
+
+import (
+	"encoding/csv"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum number of row errors kept in an ImportSummary
+const MaxImportErrors = 100
+
+/*
+Describes how the columns of a CSV file map onto points. The file must have a
+header row, and columns are referenced by their header names. Vals and Attrs
+map a column name to the key it's stored under in the point; columns that
+aren't mapped are ignored. Example:
+
+	{
+		"ts": "time",
+		"ts_format": "2006-01-02 15:04",
+		"timezone": "America/Chicago",
+		"vals": {"Temp (C)": "temp", "Humidity": "humidity"},
+		"attrs": {"Station": "station"}
+	}
+
+TsFormat is one of "rfc3339" (the default), "unix", "unix_ms", "unix_us",
+"unix_ns", or a Go time layout. TimeZone is an IANA zone name used for layouts
+that don't include a zone; it defaults to UTC.
+*/
+type CSVMapping struct {
+	Ts       string            `json:"ts"`
+	TsFormat string            `json:"ts_format,omitempty"`
+	TimeZone string            `json:"timezone,omitempty"`
+	Vals     map[string]string `json:"vals,omitempty"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+}
+
+// Results of an import
+type ImportSummary struct {
+	Accepted int         `json:"accepted"`
+	Rejected int         `json:"rejected"`
+	Errors   []LineError `json:"errors"` // at most MaxImportErrors
+}
+
+// Mapping resolved against a specific header row
+type csvColumns struct {
+	ts    int
+	vals  map[int]string // column index => val key
+	attrs map[int]string // column index => attr key
+	parse func(s string) (time.Time, error)
+}
+
+// Validates the mapping against the given header row and returns the column
+// indexes to use.
+func (m *CSVMapping) resolve(header []string) (*csvColumns, error) {
+	if m.Ts == "" {
+		return nil, fmt.Errorf("mapping must specify the timestamp column")
+	}
+
+	idx := make(map[string]int, len(header))
+	for i, h := range header {
+		idx[strings.TrimSpace(h)] = i
+	}
+	find := func(col string) (int, error) {
+		i, exists := idx[col]
+		if !exists {
+			return 0, fmt.Errorf("column '%s' not found in CSV header", col)
+		}
+		return i, nil
+	}
+
+	cols := csvColumns{vals: make(map[int]string), attrs: make(map[int]string)}
+	var err error
+	cols.ts, err = find(m.Ts)
+	if err != nil {
+		return nil, err
+	}
+	for col, key := range m.Vals {
+		i, err := find(col)
+		if err != nil {
+			return nil, err
+		}
+		cols.vals[i] = key
+	}
+	for col, key := range m.Attrs {
+		i, err := find(col)
+		if err != nil {
+			return nil, err
+		}
+		cols.attrs[i] = key
+	}
+	if len(cols.vals) == 0 {
+		return nil, fmt.Errorf("mapping must specify at least one value column")
+	}
+
+	cols.parse, err = m.tsParser()
+	if err != nil {
+		return nil, err
+	}
+
+	return &cols, nil
+}
+
+// Returns a function that parses timestamps according to the mapping
+func (m *CSVMapping) tsParser() (func(s string) (time.Time, error), error) {
+	loc := time.UTC
+	if m.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(m.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone '%s': %s", m.TimeZone, err.Error())
+		}
+	}
+
+	unix := func(unit time.Duration) func(s string) (time.Time, error) {
+		return func(s string) (time.Time, error) {
+			// parse the integer and fractional parts separately so that
+			// large timestamps don't lose precision in a float64
+			ip, fp, _ := strings.Cut(s, ".")
+			i, err := strconv.ParseInt(ip, 10, 64)
+			if err != nil && !(ip == "" && fp != "") {
+				return time.Time{}, fmt.Errorf("invalid timestamp '%s'", s)
+			}
+			var frac float64
+			if fp != "" {
+				frac, err = strconv.ParseFloat("0."+fp, 64)
+				if err != nil || strings.ContainsAny(fp, "+-eE") {
+					return time.Time{}, fmt.Errorf("invalid timestamp '%s'", s)
+				}
+			}
+			if strings.HasPrefix(ip, "-") {
+				frac = -frac
+			}
+			f := int64(math.Round(frac * float64(unit)))
+			if m := math.MaxInt64 / int64(unit); i > m || i < -m {
+				return time.Time{}, fmt.Errorf("timestamp '%s' is out of range", s)
+			}
+			ns := i * int64(unit)
+			if (f > 0 && ns > math.MaxInt64-f) || (f < 0 && ns < math.MinInt64-f) {
+				return time.Time{}, fmt.Errorf("timestamp '%s' is out of range", s)
+			}
+			ns += f
+			return time.Unix(0, ns).UTC(), nil
+		}
+	}
+
+	switch m.TsFormat {
+	case "", "rfc3339":
+		return func(s string) (time.Time, error) {
+			ts, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid timestamp '%s'", s)
+			}
+			return ts.UTC(), nil
+		}, nil
+	case "unix":
+		return unix(time.Second), nil
+	case "unix_ms":
+		return unix(time.Millisecond), nil
+	case "unix_us":
+		return unix(time.Microsecond), nil
+	case "unix_ns":
+		return unix(time.Nanosecond), nil
+	default:
+		layout := m.TsFormat
+		return func(s string) (time.Time, error) {
+			ts, err := time.ParseInLocation(layout, s, loc)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid timestamp '%s' for format '%s'", s, layout)
+			}
+			return ts.UTC(), nil
+		}, nil
+	}
+}
+
+// Converts a CSV record into a point. Empty value and attribute cells are
+// skipped; a row must have a timestamp and at least one value.
+func (cols *csvColumns) toPoint(rec []string) (*core.Point, error) {
+	if cols.ts >= len(rec) {
+		return nil, fmt.Errorf("missing timestamp")
+	}
+	ts, err := cols.parse(strings.TrimSpace(rec[cols.ts]))
+	if err != nil {
+		return nil, err
+	}
+
+	p := core.NewPointEmptyId(ts)
+	for i, key := range cols.vals {
+		if i >= len(rec) || strings.TrimSpace(rec[i]) == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(rec[i]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' for value '%s'", rec[i], key)
+		}
+		p.Vals[key] = v
+	}
+	if len(p.Vals) == 0 {
+		return nil, fmt.Errorf("no values")
+	}
+
+	for i, key := range cols.attrs {
+		if i >= len(rec) || rec[i] == "" {
+			continue
+		}
+		p.Attrs[key] = rec[i]
+	}
+
+	return p, nil
+}
+
+/*
+Imports CSV data from r into pio using the given mapping. Points are given new
+ids and added batch at a time. Rows that can't be parsed are rejected and
+reported in the summary without stopping the import; the line numbers
+reported are those in the input, counting the header as line 1.
+
+An error is returned if the header or mapping is invalid, if the CSV itself
+is malformed, or if adding points to pio fails. The summary reflects the rows
+processed up to that point.
+*/
+func ImportCSV(r io.Reader, m *CSVMapping, pio engine.PointIO, batch int) (*ImportSummary, error) {
+	sum := &ImportSummary{Errors: []LineError{}}
+	if batch <= 0 {
+		return sum, fmt.Errorf("invalid batch size %d", batch)
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // allow ragged rows; missing cells are empty
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return sum, fmt.Errorf("failed to read CSV header: %s", err.Error())
+	}
+	cols, err := m.resolve(header)
+	if err != nil {
+		return sum, err
+	}
+
+	ps := make([]*core.Point, 0, batch)
+	flush := func() error {
+		if len(ps) == 0 {
+			return nil
+		}
+		err := pio.Add(ps...)
+		if err != nil {
+			return fmt.Errorf("failed to add %d points: %s", len(ps), err.Error())
+		}
+		sum.Accepted += len(ps)
+		ps = make([]*core.Point, 0, batch)
+		return nil
+	}
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sum, fmt.Errorf("failed to read CSV: %s", err.Error())
+		}
+
+		p, err := cols.toPoint(rec)
+		if err != nil {
+			sum.Rejected++
+			if len(sum.Errors) < MaxImportErrors {
+				line, _ := cr.FieldPos(0)
+				sum.Errors = append(sum.Errors, LineError{Line: line, Msg: err.Error()})
+			}
+			continue
+		}
+
+		p.GenerateId()
+		ps = append(ps, p)
+		if len(ps) >= batch {
+			err = flush()
+			if err != nil {
+				return sum, err
+			}
+		}
+	}
+
+	return sum, flush()
+}
@@ -0,0 +1,147 @@
+package ingest
+
+import (
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/query"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// returns all points in io in time order
+func allPoints(t *testing.T, io engine.PointIO) []*core.Point {
+	q := query.NewQuery(time.Unix(0, 0), time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), query.True())
+	qe, err := io.Search(q)
+	assert.NoError(t, err)
+	ps, err := qe.Fetch(1000)
+	assert.NoError(t, err)
+	return ps
+}
+
+func TestCSVImport(t *testing.T) {
+	input := `time,Temp (C),Humidity,Station,notes
+2024-01-10 17:01,21.5,40,north,ignored
+2024-01-10 17:02, -3 ,,south,
+2024-01-10 17:03,1e2,41
+`
+	m := &CSVMapping{
+		Ts:       "time",
+		TsFormat: "2006-01-02 15:04",
+		TimeZone: "America/Chicago",
+		Vals:     map[string]string{"Temp (C)": "temp", "Humidity": "humidity"},
+		Attrs:    map[string]string{"Station": "station"},
+	}
+
+	io := engine.NewMemTree()
+	sum, err := ImportCSV(strings.NewReader(input), m, io, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, sum.Accepted)
+	assert.Equal(t, 0, sum.Rejected)
+	assert.Equal(t, 0, len(sum.Errors))
+
+	ps := allPoints(t, io)
+	assert.Equal(t, 3, len(ps))
+	assert.Equal(t, "[2024-01-10 23:01:00 +0000 UTC] val[humidity: 40.000000, temp: 21.500000] attr[station: north]", ps[0].String())
+	assert.Equal(t, "[2024-01-10 23:02:00 +0000 UTC] val[temp: -3.000000] attr[station: south]", ps[1].String())
+	assert.Equal(t, "[2024-01-10 23:03:00 +0000 UTC] val[humidity: 41.000000, temp: 100.000000] attr[]", ps[2].String())
+	assert.NotNil(t, ps[0].Id)
+}
+
+func TestCSVImportRejected(t *testing.T) {
+	input := `ts,v
+1704927662,1
+,2
+1704927663,abc
+1704927664,
+yesterday,5
+1704927665.5,6
+`
+	m := &CSVMapping{Ts: "ts", TsFormat: "unix", Vals: map[string]string{"v": "val"}}
+
+	io := engine.NewMemTree()
+	sum, err := ImportCSV(strings.NewReader(input), m, io, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sum.Accepted)
+	assert.Equal(t, 4, sum.Rejected)
+	assert.Equal(t, []LineError{
+		{Line: 3, Msg: "invalid timestamp ''"},
+		{Line: 4, Msg: "invalid number 'abc' for value 'val'"},
+		{Line: 5, Msg: "no values"},
+		{Line: 6, Msg: "invalid timestamp 'yesterday'"},
+	}, sum.Errors)
+
+	ps := allPoints(t, io)
+	assert.Equal(t, 2, len(ps))
+	assert.Equal(t, time.Date(2024, 01, 10, 23, 1, 5, 500000000, time.UTC), ps[1].Ts)
+}
+
+func TestCSVImportTsFormats(t *testing.T) {
+	exp := time.Date(2024, 01, 10, 23, 1, 2, 123000000, time.UTC)
+
+	fn := func(format string, tz string, ts string) {
+		m := &CSVMapping{Ts: "ts", TsFormat: format, TimeZone: tz, Vals: map[string]string{"v": "v"}}
+		io := engine.NewMemTree()
+		sum, err := ImportCSV(strings.NewReader("ts,v\n"+ts+",1\n"), m, io, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, sum.Accepted, format)
+		ps := allPoints(t, io)
+		if assert.Equal(t, 1, len(ps)) {
+			assert.Equal(t, exp, ps[0].Ts, format)
+		}
+	}
+
+	fn("", "", "2024-01-10T23:01:02.123Z")
+	fn("rfc3339", "America/Chicago", "2024-01-10T17:01:02.123-06:00")
+	fn("unix", "", "1704927662.123")
+	fn("unix_ms", "", "1704927662123")
+	fn("unix_us", "", "1704927662123000")
+	fn("unix_ns", "", "1704927662123000000")
+	fn("01/02/2006 15:04:05.000", "Asia/Tokyo", "01/11/2024 08:01:02.123")
+}
+
+func TestCSVImportTsRange(t *testing.T) {
+	fn := func(format string, ts string) []LineError {
+		m := &CSVMapping{Ts: "ts", TsFormat: format, Vals: map[string]string{"v": "v"}}
+		sum, err := ImportCSV(strings.NewReader("ts,v\n"+ts+",1\n"), m, engine.NewMemTree(), 10)
+		assert.NoError(t, err)
+		return sum.Errors
+	}
+
+	// values that would overflow once converted to nanoseconds are rejected
+	// rather than wrapping around
+	for _, c := range []struct{ format, ts string }{
+		{"unix", "9223372037"},
+		{"unix", "-9223372037"},
+		{"unix", "9223372036.9"},
+		{"unix_ms", "9223372036855"},
+		{"unix_us", "-9223372036854776"},
+	} {
+		assert.Equal(t, []LineError{{Line: 2, Msg: "timestamp '" + c.ts + "' is out of range"}}, fn(c.format, c.ts), c.ts)
+	}
+	assert.Empty(t, fn("unix", "9223372036.8"))
+	assert.Empty(t, fn("unix_us", "-9223372036854775"))
+}
+
+func TestCSVImportErrors(t *testing.T) {
+	fn := func(input string, m *CSVMapping, batch int, msg string) {
+		_, err := ImportCSV(strings.NewReader(input), m, engine.NewMemTree(), batch)
+		assert.Error(t, err)
+		if err != nil {
+			assert.Equal(t, msg, err.Error())
+		}
+	}
+
+	vals := map[string]string{"v": "v"}
+	fn("ts,v\n", &CSVMapping{Ts: "ts", Vals: vals}, 0, "invalid batch size 0")
+	fn("", &CSVMapping{Ts: "ts", Vals: vals}, 10, "failed to read CSV header: EOF")
+	fn("ts,v\n", &CSVMapping{Vals: vals}, 10, "mapping must specify the timestamp column")
+	fn("ts,v\n", &CSVMapping{Ts: "time", Vals: vals}, 10, "column 'time' not found in CSV header")
+	fn("ts,v\n", &CSVMapping{Ts: "ts", Vals: map[string]string{"x": "x"}}, 10, "column 'x' not found in CSV header")
+	fn("ts,v\n", &CSVMapping{Ts: "ts", Vals: vals, Attrs: map[string]string{"a": "a"}}, 10, "column 'a' not found in CSV header")
+	fn("ts,v\n", &CSVMapping{Ts: "ts"}, 10, "mapping must specify at least one value column")
+	fn("ts,v\n", &CSVMapping{Ts: "ts", Vals: vals, TimeZone: "Mars/Olympus"}, 10, "invalid timezone 'Mars/Olympus': unknown time zone Mars/Olympus")
+	fn("ts,v\n2024-01-10T23:01:02Z,\"1\n", &CSVMapping{Ts: "ts", Vals: vals}, 10, `failed to read CSV: parse error on line 2, column 25: extraneous or missing " in quoted-field`)
+}
@@ -0,0 +1,270 @@
+package ingest
+
+import (
+	"bufio"
+	"equinox/internal/core"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point parsed from a single line of input along with the id of the series it
+// should be added to.
+type SeriesPoint struct {
+	Series string
+	Point  *core.Point
+}
+
+// Error encountered while parsing a specific line of input. Line numbers start
+// at 1.
+type LineError struct {
+	Line int    `json:"line"`
+	Msg  string `json:"error"`
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Maximum length of a single line of line protocol input
+const maxLineLen = 1024 * 1024
+
+// Converts a line protocol precision string into the duration of one
+// timestamp unit. Accepts both the InfluxDB v1 (n, u, ms, s) and v2 (ns, us,
+// ms, s) spellings. An empty string means nanoseconds.
+func ParsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	default:
+		return 0, fmt.Errorf("invalid precision '%s'", s)
+	}
+}
+
+/*
+Parses InfluxDB line protocol from r, one point per line:
+
+	measurement[,tagkey=tagval...] fieldkey=fieldval[,fieldkey=fieldval...] [timestamp]
+
+The measurement becomes the series id, tags become Attrs and fields become
+Vals. Float, integer (i suffix), unsigned (u suffix) and boolean fields are
+stored as float64, with booleans mapping to 1.0 and 0.0; string fields are
+rejected since Vals can only hold numbers. Timestamps are integers in units of
+prec; lines without one are given the time now.
+
+Blank lines and comments (lines starting with #) are skipped. Lines that fail
+to parse are reported in the returned errors and don't stop parsing of the
+remaining lines. A non-nil error is returned only if reading from r fails.
+*/
+func ParseLineProtocol(r io.Reader, prec time.Duration, now time.Time) ([]SeriesPoint, []LineError, error) {
+	var pts []SeriesPoint
+	var lerrs []LineError
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLen)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		sid, p, err := ParseLine(line, prec, now)
+		if err != nil {
+			lerrs = append(lerrs, LineError{Line: n, Msg: err.Error()})
+			continue
+		}
+		pts = append(pts, SeriesPoint{Series: sid, Point: p})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return pts, lerrs, err
+	}
+
+	return pts, lerrs, nil
+}
+
+// Parses a single line of line protocol into the series id and point. See
+// ParseLineProtocol for details of the format. The returned point has no Id.
+func ParseLine(line string, prec time.Duration, now time.Time) (string, *core.Point, error) {
+	// split into the series key (measurement + tags), fields, and timestamp
+	sections, err := splitUnescaped(line, ' ', true)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(sections) < 2 {
+		return "", nil, fmt.Errorf("missing fields")
+	}
+	if len(sections) > 3 {
+		return "", nil, fmt.Errorf("unexpected content after timestamp")
+	}
+
+	p := core.NewPointEmpty()
+
+	// measurement and tags
+	keys, err := splitUnescaped(sections[0], ',', false)
+	if err != nil {
+		return "", nil, err
+	}
+	sid := unescape(keys[0])
+	if sid == "" {
+		return "", nil, fmt.Errorf("missing measurement")
+	}
+	for _, kv := range keys[1:] {
+		k, v, err := splitPair(kv)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid tag '%s': %s", kv, err.Error())
+		}
+		p.Attrs[k] = v
+	}
+
+	// fields
+	fields, err := splitUnescaped(sections[1], ',', true)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, kv := range fields {
+		k, v, err := splitPair(kv)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid field '%s': %s", kv, err.Error())
+		}
+		f, err := parseFieldVal(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid value for field '%s': %s", k, err.Error())
+		}
+		p.Vals[k] = f
+	}
+
+	// timestamp
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid timestamp '%s'", sections[2])
+		}
+		if m := math.MaxInt64 / int64(prec); ts > m || ts < -m {
+			return "", nil, fmt.Errorf("timestamp '%s' is out of range", sections[2])
+		}
+		p.Ts = time.Unix(0, ts*int64(prec)).UTC()
+	} else {
+		p.Ts = now.UTC()
+	}
+
+	return sid, p, nil
+}
+
+// Splits s on sep, ignoring separators that are escaped with a backslash.
+// If quotes is true then separators inside double-quoted strings are also
+// ignored. Escapes are left in the returned parts.
+func splitUnescaped(s string, sep byte, quotes bool) ([]string, error) {
+	var parts []string
+	inquote := false
+	st := 0
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++ // skip escaped char
+		case quotes && s[i] == '"':
+			inquote = !inquote
+		case s[i] == sep && !inquote:
+			parts = append(parts, s[st:i])
+			st = i + 1
+
+			// collapse runs of spaces between sections
+			for sep == ' ' && st < len(s) && s[st] == ' ' {
+				st++
+				i++
+			}
+		}
+	}
+
+	if inquote {
+		return nil, fmt.Errorf("unterminated string")
+	}
+
+	return append(parts, s[st:]), nil
+}
+
+// Splits an unescaped key=value pair, returning unescaped key and value
+func splitPair(s string) (string, string, error) {
+	kv, err := splitUnescaped(s, '=', true)
+	if err != nil {
+		return "", "", err
+	}
+	if len(kv) != 2 {
+		return "", "", fmt.Errorf("expected key=value")
+	}
+
+	k := unescape(kv[0])
+	if k == "" {
+		return "", "", fmt.Errorf("empty key")
+	}
+	if kv[1] == "" {
+		return "", "", fmt.Errorf("empty value")
+	}
+
+	// string field values are returned with their quotes so parseFieldVal
+	// can tell them apart
+	if kv[1][0] == '"' {
+		return k, kv[1], nil
+	}
+	return k, unescape(kv[1]), nil
+}
+
+// Removes backslash escapes from s
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Parses a field value into a float64
+func parseFieldVal(v string) (float64, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1.0, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0.0, nil
+	}
+
+	switch v[len(v)-1] {
+	case '"':
+		return 0, fmt.Errorf("string fields are not supported")
+	case 'i':
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer '%s'", v)
+		}
+		return float64(i), nil
+	case 'u':
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid unsigned integer '%s'", v)
+		}
+		return float64(u), nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid float '%s'", v)
+	}
+	return f, nil
+}
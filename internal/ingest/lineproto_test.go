@@ -0,0 +1,128 @@
+package ingest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineParse(t *testing.T) {
+	now := time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC)
+
+	line := `weather,location=us-midwest,season=summer temperature=82,humidity=71i,rain=t 1704927662000000000`
+	sid, p, err := ParseLine(line, time.Nanosecond, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "weather", sid)
+	assert.Equal(t, "[2024-01-10 23:01:02 +0000 UTC] val[humidity: 71.000000, rain: 1.000000, temperature: 82.000000] attr[location: us-midwest, season: summer]", p.String())
+	assert.Nil(t, p.Id)
+
+	// no tags, no timestamp => now
+	sid, p, err = ParseLine(`cpu usage=0.5,load=-3e2`, time.Nanosecond, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu", sid)
+	assert.Equal(t, "[2024-01-10 23:01:02 +0000 UTC] val[load: -300.000000, usage: 0.500000] attr[]", p.String())
+
+	// escaped characters
+	sid, p, err = ParseLine(`my\ meas\,ure,tag\ key=tag\,val\=ue field\=key=12u 1704927662`, time.Second, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "my meas,ure", sid)
+	assert.Equal(t, "tag,val=ue", p.Attrs["tag key"])
+	assert.Equal(t, 12.0, p.Vals["field=key"])
+	assert.Equal(t, now, p.Ts)
+}
+
+func TestLineParsePrecision(t *testing.T) {
+	exp := time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC)
+
+	fn := func(prec string, ts string) {
+		d, err := ParsePrecision(prec)
+		assert.NoError(t, err)
+		_, p, err := ParseLine("m f=1 "+ts, d, time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, exp, p.Ts, prec)
+	}
+
+	fn("", "1704927662000000000")
+	fn("n", "1704927662000000000")
+	fn("ns", "1704927662000000000")
+	fn("u", "1704927662000000")
+	fn("us", "1704927662000000")
+	fn("ms", "1704927662000")
+	fn("s", "1704927662")
+
+	_, err := ParsePrecision("h")
+	assert.Error(t, err)
+	assert.Equal(t, "invalid precision 'h'", err.Error())
+}
+
+func TestLineParseErrors(t *testing.T) {
+	fn := func(line string, msg string) {
+		_, _, err := ParseLine(line, time.Nanosecond, time.Now())
+		assert.Error(t, err, line)
+		if err != nil {
+			assert.Equal(t, msg, err.Error(), line)
+		}
+	}
+
+	fn(`cpu`, "missing fields")
+	fn(`cpu,host=a`, "missing fields")
+	fn(`,host=a f=1`, "missing measurement")
+	fn(`cpu,host f=1`, "invalid tag 'host': expected key=value")
+	fn(`cpu,host= f=1`, "invalid tag 'host=': empty value")
+	fn(`cpu f`, "invalid field 'f': expected key=value")
+	fn(`cpu =1`, "invalid field '=1': empty key")
+	fn(`cpu f=abc`, "invalid value for field 'f': invalid float 'abc'")
+	fn(`cpu f=1.5i`, "invalid value for field 'f': invalid integer '1.5i'")
+	fn(`cpu f=-1u`, "invalid value for field 'f': invalid unsigned integer '-1u'")
+	fn(`cpu f="hello world"`, "invalid value for field 'f': string fields are not supported")
+	fn(`cpu f="hello`, "unterminated string")
+	fn(`cpu f=1 abc`, "invalid timestamp 'abc'")
+	fn(`cpu f=1 123 456`, "unexpected content after timestamp")
+
+	// timestamps that would overflow once converted to nanoseconds
+	_, _, err := ParseLine(`cpu f=1 9223372036854775`, time.Second, time.Now())
+	assert.Equal(t, "timestamp '9223372036854775' is out of range", err.Error())
+	_, _, err = ParseLine(`cpu f=1 -9223372036854775`, time.Second, time.Now())
+	assert.Equal(t, "timestamp '-9223372036854775' is out of range", err.Error())
+	_, p, err := ParseLine(`cpu f=1 9223372036`, time.Second, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(9223372036, 0).UTC(), p.Ts)
+
+	pts, lerrs, err := ParseLineProtocol(strings.NewReader("cpu f=1 1704927662\ncpu f=2 99999999999999999"), time.Millisecond, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(pts))
+	assert.Equal(t, []LineError{{Line: 2, Msg: "timestamp '99999999999999999' is out of range"}}, lerrs)
+}
+
+func TestLineParseMulti(t *testing.T) {
+	now := time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC)
+	input := strings.Join([]string{
+		"# comment line",
+		"cpu,host=a usage=1 1704927662",
+		"",
+		"cpu,host=b usage=2 1704927663",
+		"cpu,host=c usage=oops 1704927664",
+		"mem,host=a free=10i 1704927665",
+		"   ",
+		"mem,host=b",
+	}, "\n")
+
+	pts, lerrs, err := ParseLineProtocol(strings.NewReader(input), time.Second, now)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(pts))
+	assert.Equal(t, "cpu", pts[0].Series)
+	assert.Equal(t, "a", pts[0].Point.Attrs["host"])
+	assert.Equal(t, "cpu", pts[1].Series)
+	assert.Equal(t, 2.0, pts[1].Point.Vals["usage"])
+	assert.Equal(t, "mem", pts[2].Series)
+	assert.Equal(t, now.Add(3*time.Second), pts[2].Point.Ts)
+
+	assert.Equal(t, 2, len(lerrs))
+	assert.Equal(t, 5, lerrs[0].Line)
+	assert.Equal(t, "line 5: invalid value for field 'usage': invalid float 'oops'", lerrs[0].Error())
+	assert.Equal(t, 8, lerrs[1].Line)
+	assert.Equal(t, "missing fields", lerrs[1].Msg)
+}
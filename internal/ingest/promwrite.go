@@ -0,0 +1,274 @@
+package ingest
+
+import (
+	"equinox/internal/core"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Label name that Prometheus uses for the metric name
+const PromNameLabel = "__name__"
+
+// Value key used for samples when the metric name is used as the series id
+const PromValueKey = "value"
+
+// Bit pattern Prometheus uses to mark a series as stale
+const promStaleNaN uint64 = 0x7ff0000000000002
+
+// Single time series from a Prometheus remote-write request
+type PromTimeSeries struct {
+	Labels  map[string]string
+	Samples []PromSample
+}
+
+// Single sample from a Prometheus time series. Ts is in milliseconds since
+// the Unix epoch.
+type PromSample struct {
+	Value float64
+	Ts    int64
+}
+
+/*
+Decodes a Prometheus remote-write request, which is a snappy-compressed (block
+format) protobuf WriteRequest. Only the fields we use are decoded; metadata,
+exemplars and native histograms are skipped, and requests over maxDecoded
+bytes once decompressed are rejected. The relevant parts of the protobuf
+schema are:
+
+	message WriteRequest { repeated TimeSeries timeseries = 1; }
+	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+	message Label { string name = 1; string value = 2; }
+	message Sample { double value = 1; int64 timestamp = 2; }
+*/
+func DecodeRemoteWrite(body []byte, maxDecoded int) ([]PromTimeSeries, error) {
+	b, err := DecodeSnappy(body, maxDecoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress remote write request: %w", err)
+	}
+
+	var tss []PromTimeSeries
+	err = WalkProto(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		ts, err := DecodeTimeSeries(v)
+		if err != nil {
+			return err
+		}
+		tss = append(tss, *ts)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode remote write request: %s", err.Error())
+	}
+
+	return tss, nil
+}
+
+// Returned by DecodeSnappy for data that's too large once decompressed
+var ErrDecodedTooLarge = errors.New("decompressed size exceeds the limit")
+
+// Decompresses snappy block format data, unless it would be more than max
+// bytes once decompressed. The size is read from the data's header, so it's
+// checked before anything is allocated.
+func DecodeSnappy(data []byte, max int) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, fmt.Errorf("%w: %d bytes is over %d", ErrDecodedTooLarge, n, max)
+	}
+	return snappy.Decode(nil, data)
+}
+
+// Converts Prometheus time series to points. Labels other than __name__
+// become Attrs. If series is empty then the metric name is used as the series
+// id and the sample is stored under the "value" key; otherwise all points go
+// to the given series and the metric name is used as the value key. Stale
+// markers are dropped.
+func PromToPoints(tss []PromTimeSeries, series string) ([]SeriesPoint, error) {
+	var pts []SeriesPoint
+
+	for _, ts := range tss {
+		name := ts.Labels[PromNameLabel]
+		if name == "" {
+			return nil, fmt.Errorf("time series is missing the %s label", PromNameLabel)
+		}
+
+		sid, key := name, PromValueKey
+		if series != "" {
+			sid, key = series, name
+		}
+
+		for _, s := range ts.Samples {
+			if math.Float64bits(s.Value) == promStaleNaN {
+				continue
+			}
+
+			p := core.NewPointEmptyId(time.UnixMilli(s.Ts).UTC())
+			p.Vals[key] = s.Value
+			for k, v := range ts.Labels {
+				if k != PromNameLabel {
+					p.Attrs[k] = v
+				}
+			}
+			pts = append(pts, SeriesPoint{Series: sid, Point: p})
+		}
+	}
+
+	return pts, nil
+}
+
+// Calls fn for each field in the protobuf message b. For length-delimited
+// fields v is the field contents; for fixed64 fields it's the 8 raw bytes;
+// for varints it's the varint encoding.
+func WalkProto(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes the protobuf encoding of a single TimeSeries message
+func DecodeTimeSeries(b []byte) (*PromTimeSeries, error) {
+	ts := PromTimeSeries{Labels: make(map[string]string)}
+
+	err := WalkProto(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			k, val, err := decodeLabel(v)
+			if err != nil {
+				return err
+			}
+			ts.Labels[k] = val
+		case 2:
+			s, err := decodeSample(v)
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, *s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ts, nil
+}
+
+func decodeLabel(b []byte) (string, string, error) {
+	var k, v string
+	err := WalkProto(b, func(num protowire.Number, typ protowire.Type, val []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			k = string(val)
+		case 2:
+			v = string(val)
+		}
+		return nil
+	})
+	return k, v, err
+}
+
+func decodeSample(b []byte) (*PromSample, error) {
+	s := PromSample{}
+	err := WalkProto(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			u, _ := protowire.ConsumeFixed64(v)
+			s.Value = math.Float64frombits(u)
+		case num == 2 && typ == protowire.VarintType:
+			u, _ := protowire.ConsumeVarint(v)
+			s.Ts = int64(u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Encodes time series as a snappy-compressed remote-write request. This is the
+// inverse of DecodeRemoteWrite and is mainly useful for testing and for
+// forwarding data to other remote-write receivers.
+func EncodeRemoteWrite(tss []PromTimeSeries) []byte {
+	var b []byte
+	for _, ts := range tss {
+		b = AppendTimeSeries(b, 1, &ts)
+	}
+	return snappy.Encode(nil, b)
+}
+
+// Appends the protobuf encoding of ts to b as field num of the enclosing
+// message, returning the extended buffer. Labels are written in sorted order
+// so the encoding is deterministic.
+func AppendTimeSeries(b []byte, num protowire.Number, ts *PromTimeSeries) []byte {
+	var tsb []byte
+
+	names := make([]string, 0, len(ts.Labels))
+	for k := range ts.Labels {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	for _, k := range names {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, k)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, ts.Labels[k])
+		tsb = protowire.AppendTag(tsb, 1, protowire.BytesType)
+		tsb = protowire.AppendBytes(tsb, lb)
+	}
+
+	for _, s := range ts.Samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Ts))
+		tsb = protowire.AppendTag(tsb, 2, protowire.BytesType)
+		tsb = protowire.AppendBytes(tsb, sb)
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, tsb)
+}
@@ -0,0 +1,97 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPromSeries() []PromTimeSeries {
+	return []PromTimeSeries{
+		{
+			Labels: map[string]string{"__name__": "http_requests_total", "job": "api", "code": "200"},
+			Samples: []PromSample{
+				{Value: 10, Ts: 1704927662000},
+				{Value: 12.5, Ts: 1704927663000},
+			},
+		},
+		{
+			Labels: map[string]string{"__name__": "up", "job": "api"},
+			Samples: []PromSample{
+				{Value: 1, Ts: 1704927662000},
+				{Value: math.Float64frombits(promStaleNaN), Ts: 1704927663000},
+			},
+		},
+	}
+}
+
+func TestPromRemoteWriteRoundtrip(t *testing.T) {
+	exp := testPromSeries()
+	b := EncodeRemoteWrite(exp)
+
+	act, err := DecodeRemoteWrite(b, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, len(exp), len(act))
+	for i := range exp {
+		assert.Equal(t, exp[i].Labels, act[i].Labels)
+		assert.Equal(t, len(exp[i].Samples), len(act[i].Samples))
+		for j := range exp[i].Samples {
+			assert.Equal(t, exp[i].Samples[j].Ts, act[i].Samples[j].Ts)
+			assert.Equal(t, math.Float64bits(exp[i].Samples[j].Value), math.Float64bits(act[i].Samples[j].Value))
+		}
+	}
+}
+
+func TestPromRemoteWriteErrors(t *testing.T) {
+	_, err := DecodeRemoteWrite([]byte("not snappy"), 1<<20)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to decompress remote write request")
+
+	// valid snappy wrapping truncated protobuf
+	b := EncodeRemoteWrite(testPromSeries())
+	raw, _ := snappy.Decode(nil, b)
+	_, err = DecodeRemoteWrite(snappy.Encode(nil, raw[:len(raw)-3]), 1<<20)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to decode remote write request")
+
+	// too large once decompressed, which is known from the header alone
+	_, err = DecodeRemoteWrite(b, len(raw)-1)
+	assert.ErrorIs(t, err, ErrDecodedTooLarge)
+	huge := binary.AppendUvarint(nil, 1<<30)
+	_, err = DecodeSnappy(huge, 1<<20)
+	assert.Equal(t, "decompressed size exceeds the limit: 1073741824 bytes is over 1048576", err.Error())
+}
+
+func TestPromToPoints(t *testing.T) {
+	ts := time.Date(2024, 01, 10, 23, 1, 2, 0, time.UTC)
+
+	// metric name => series id
+	pts, err := PromToPoints(testPromSeries(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(pts)) // stale marker dropped
+
+	assert.Equal(t, "http_requests_total", pts[0].Series)
+	assert.Equal(t, "[2024-01-10 23:01:02 +0000 UTC] val[value: 10.000000] attr[code: 200, job: api]", pts[0].Point.String())
+	assert.Equal(t, "http_requests_total", pts[1].Series)
+	assert.Equal(t, ts.Add(time.Second), pts[1].Point.Ts)
+	assert.Equal(t, "up", pts[2].Series)
+	assert.Nil(t, pts[2].Point.Id)
+
+	// single series => metric name is value key
+	pts, err = PromToPoints(testPromSeries(), "prom")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(pts))
+	assert.Equal(t, "prom", pts[0].Series)
+	assert.Equal(t, 10.0, pts[0].Point.Vals["http_requests_total"])
+	assert.Equal(t, "prom", pts[2].Series)
+	assert.Equal(t, "[2024-01-10 23:01:02 +0000 UTC] val[up: 1.000000] attr[job: api]", pts[2].Point.String())
+
+	// missing name
+	_, err = PromToPoints([]PromTimeSeries{{Labels: map[string]string{"job": "x"}}}, "")
+	assert.Error(t, err)
+	assert.Equal(t, "time series is missing the __name__ label", err.Error())
+}
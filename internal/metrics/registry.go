@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types as they appear in the text exposition format
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// Single value of a metric. Suffix is appended to the metric name, e.g.
+// "_bucket" for histogram buckets.
+type Sample struct {
+	Suffix string
+	Labels []string // alternating names and values
+	Value  float64
+}
+
+// Interface for anything that can be exposed by a Registry
+type Collector interface {
+	// Metric name, help text and type
+	Desc() (name string, help string, typ string)
+
+	// Current samples
+	Collect() []Sample
+}
+
+// Set of collectors exposed together. Safe for concurrent use.
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+var defaultRegistry = NewRegistry()
+
+// Returns the registry served at /metrics
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Adds a collector. Panics if one with the same name is already registered,
+// since that's a programming error.
+func (r *Registry) Register(c Collector) {
+	name, _, _ := c.Desc()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.collectors[name]; exists {
+		panic(fmt.Sprintf("metric '%s' already registered", name))
+	}
+	r.collectors[name] = c
+}
+
+// Adds a collector and returns it, for use in variable declarations
+func MustRegister[C Collector](c C) C {
+	Default().Register(c)
+	return c
+}
+
+/*
+Writes every metric in the Prometheus text exposition format, version 0.0.4.
+Metrics are sorted by name and samples by labels so the output is stable.
+*/
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	cs := make([]Collector, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		cs[i] = r.collectors[name]
+	}
+	r.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range cs {
+		name, help, typ := c.Desc()
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+
+		ss := c.Collect()
+		if typ != TypeHistogram {
+			// histogram samples are already in a meaningful order
+			sort.SliceStable(ss, func(i, j int) bool {
+				return strings.Join(ss[i].Labels, "\xff") < strings.Join(ss[j].Labels, "\xff")
+			})
+		}
+		for _, s := range ss {
+			bw.WriteString(name + s.Suffix)
+			writeLabels(bw, s.Labels)
+			bw.WriteByte(' ')
+			bw.WriteString(formatValue(s.Value))
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+func writeLabels(w *bufio.Writer, labels []string) {
+	if len(labels) == 0 {
+		return
+	}
+	w.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(labels[i])
+		w.WriteString(`="`)
+		w.WriteString(escapeLabel(labels[i+1]))
+		w.WriteByte('"')
+	}
+	w.WriteByte('}')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
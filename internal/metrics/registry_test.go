@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryText(t *testing.T) {
+	r := NewRegistry()
+	c := NewCounter("test_requests_total", "Requests.")
+	r.Register(c)
+	cv := NewCounterVec("test_points_total", "Points\nper \"series\".", "series", "host")
+	r.Register(cv)
+	r.Register(NewGaugeFunc("test_len", "Len.", func() []Sample {
+		return []Sample{
+			{Labels: []string{"series", "b"}, Value: math.Inf(1)},
+			{Labels: []string{"series", "a"}, Value: 1.5},
+		}
+	}))
+
+	c.Inc()
+	c.Add(2)
+	cv.With("cpu", `a"b\c`).Add(3)
+	cv.With("cpu", "line\nbreak").Inc()
+	cv.With("cpu", `a"b\c`).Inc()
+
+	var sb strings.Builder
+	assert.NoError(t, r.WriteText(&sb))
+	exp := `# HELP test_len Len.
+# TYPE test_len gauge
+test_len{series="a"} 1.5
+test_len{series="b"} +Inf
+# HELP test_points_total Points\nper "series".
+# TYPE test_points_total counter
+test_points_total{series="cpu",host="a\"b\\c"} 4
+test_points_total{series="cpu",host="line\nbreak"} 1
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total 3
+`
+	assert.Equal(t, exp, sb.String())
+
+	assert.PanicsWithValue(t, "metric 'test_len' already registered", func() {
+		r.Register(NewCounter("test_len", ""))
+	})
+	assert.Panics(t, func() { cv.With("cpu") })
+	assert.Panics(t, func() { c.Add(-1) })
+
+	cv.Delete("cpu", "line\nbreak")
+	assert.Len(t, cv.Collect(), 1)
+}
+
+func TestRegistryDefault(t *testing.T) {
+	// metrics registered by other packages are in the default registry, but
+	// this package doesn't import any
+	assert.NotNil(t, Default())
+	c := MustRegister(NewCounter("test_default_total", "Test."))
+	var sb strings.Builder
+	assert.NoError(t, Default().WriteText(&sb))
+	assert.Contains(t, sb.String(), "# TYPE test_default_total counter\ntest_default_total 0\n")
+	c.Inc()
+}
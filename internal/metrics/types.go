@@ -0,0 +1,309 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default histogram buckets, in seconds, suitable for request latencies
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// Float64 that can be added to atomically
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := f.bits.Load()
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if f.bits.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+/****************************************************************************
+	Vectors
+****************************************************************************/
+
+// Children of a metric with labels, keyed by their label values
+type vec[T any] struct {
+	desc
+	mu       sync.RWMutex
+	children map[string]*vecChild[T]
+	create   func() *T
+}
+
+type vecChild[T any] struct {
+	values []string
+	metric *T
+}
+
+// Returns the child for the given label values, creating it if needed. The
+// number of values must match the number of label names.
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic("wrong number of label values for metric " + v.name)
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, exists := v.children[key]
+	v.mu.RUnlock()
+	if exists {
+		return c.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, exists = v.children[key]; !exists {
+		c = &vecChild[T]{values: append([]string(nil), values...), metric: v.create()}
+		v.children[key] = c
+	}
+	return c.metric
+}
+
+// Removes the child for the given label values, e.g. when a series is
+// deleted
+func (v *vec[T]) delete(values []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.children, strings.Join(values, "\xff"))
+}
+
+// Calls fn with the labels and metric of each child
+func (v *vec[T]) each(fn func(labels []string, m *T)) {
+	v.mu.RLock()
+	cs := make([]*vecChild[T], 0, len(v.children))
+	for _, c := range v.children {
+		cs = append(cs, c)
+	}
+	v.mu.RUnlock()
+
+	sort.Slice(cs, func(i, j int) bool {
+		return strings.Join(cs[i].values, "\xff") < strings.Join(cs[j].values, "\xff")
+	})
+	for _, c := range cs {
+		labels := make([]string, 0, 2*len(v.labels))
+		for i, n := range v.labels {
+			labels = append(labels, n, c.values[i])
+		}
+		fn(labels, c.metric)
+	}
+}
+
+/****************************************************************************
+	Counter
+****************************************************************************/
+
+// Value that only goes up
+type Counter struct {
+	desc
+	v atomicFloat
+}
+
+func NewCounter(name string, help string) *Counter {
+	return &Counter{desc: desc{name: name, help: help}}
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Adds v, which must not be negative
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	c.v.Add(v)
+}
+
+func (c *Counter) Value() float64 {
+	return c.v.Load()
+}
+
+func (c *Counter) Desc() (string, string, string) {
+	return c.name, c.help, TypeCounter
+}
+
+func (c *Counter) Collect() []Sample {
+	return []Sample{{Value: c.Value()}}
+}
+
+// Counter with labels
+type CounterVec struct {
+	vec[Counter]
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{}
+	cv.vec = vec[Counter]{
+		desc:     desc{name: name, help: help, labels: labels},
+		children: make(map[string]*vecChild[Counter]),
+		create:   func() *Counter { return &Counter{} },
+	}
+	return cv
+}
+
+// Returns the counter for the given label values
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values)
+}
+
+func (cv *CounterVec) Delete(values ...string) {
+	cv.delete(values)
+}
+
+func (cv *CounterVec) Desc() (string, string, string) {
+	return cv.name, cv.help, TypeCounter
+}
+
+func (cv *CounterVec) Collect() []Sample {
+	var r []Sample
+	cv.each(func(labels []string, c *Counter) {
+		r = append(r, Sample{Labels: labels, Value: c.Value()})
+	})
+	return r
+}
+
+/****************************************************************************
+	GaugeFunc
+****************************************************************************/
+
+// Gauge whose samples are computed when collected, for values that are
+// already tracked elsewhere such as the number of points in each series
+type GaugeFunc struct {
+	desc
+	fn func() []Sample
+}
+
+func NewGaugeFunc(name string, help string, fn func() []Sample) *GaugeFunc {
+	return &GaugeFunc{desc: desc{name: name, help: help}, fn: fn}
+}
+
+func (g *GaugeFunc) Desc() (string, string, string) {
+	return g.name, g.help, TypeGauge
+}
+
+func (g *GaugeFunc) Collect() []Sample {
+	return g.fn()
+}
+
+/****************************************************************************
+	Histogram
+****************************************************************************/
+
+// Counts observations into cumulative buckets
+type Histogram struct {
+	desc
+	bounds []float64
+	counts []atomic.Uint64 // per bucket, not cumulative; the last is +Inf
+	sum    atomicFloat
+	count  atomic.Uint64
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	h.desc = desc{name: name, help: help}
+	return h
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+	h.count.Add(1)
+}
+
+// Observes the time elapsed since start, in seconds
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+func (h *Histogram) Desc() (string, string, string) {
+	return h.name, h.help, TypeHistogram
+}
+
+func (h *Histogram) Collect() []Sample {
+	return h.samples(nil)
+}
+
+func (h *Histogram) samples(labels []string) []Sample {
+	r := make([]Sample, 0, len(h.bounds)+3)
+	var cum uint64
+	for i := range h.counts {
+		cum += h.counts[i].Load()
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		bl := append(append([]string(nil), labels...), "le", formatValue(le))
+		r = append(r, Sample{Suffix: "_bucket", Labels: bl, Value: float64(cum)})
+	}
+	r = append(r,
+		Sample{Suffix: "_sum", Labels: labels, Value: h.sum.Load()},
+		Sample{Suffix: "_count", Labels: labels, Value: float64(h.count.Load())})
+	return r
+}
+
+// Histogram with labels
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	hv := &HistogramVec{}
+	hv.vec = vec[Histogram]{
+		desc:     desc{name: name, help: help, labels: labels},
+		children: make(map[string]*vecChild[Histogram]),
+		create:   func() *Histogram { return newHistogram(buckets) },
+	}
+	return hv
+}
+
+// Returns the histogram for the given label values
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values)
+}
+
+func (hv *HistogramVec) Desc() (string, string, string) {
+	return hv.name, hv.help, TypeHistogram
+}
+
+func (hv *HistogramVec) Collect() []Sample {
+	var r []Sample
+	hv.each(func(labels []string, h *Histogram) {
+		r = append(r, h.samples(labels)...)
+	})
+	return r
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := NewHistogram("test_seconds", "Durations.", []float64{1, 0.1, 0.5})
+	r.Register(h)
+	for _, v := range []float64{0.05, 0.1, 0.3, 0.7, 2, 3} {
+		h.Observe(v)
+	}
+	assert.Equal(t, uint64(6), h.Count())
+
+	var sb strings.Builder
+	assert.NoError(t, r.WriteText(&sb))
+	exp := `# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="0.5"} 3
+test_seconds_bucket{le="1"} 4
+test_seconds_bucket{le="+Inf"} 6
+test_seconds_sum 6.15
+test_seconds_count 6
+`
+	assert.Equal(t, exp, sb.String())
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	hv := NewHistogramVec("test_seconds", "Durations.", []float64{1}, "route")
+	r.Register(hv)
+	hv.With("/b").Observe(0.5)
+	hv.With("/a").Observe(2)
+
+	var sb strings.Builder
+	assert.NoError(t, r.WriteText(&sb))
+	exp := `# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/a",le="1"} 0
+test_seconds_bucket{route="/a",le="+Inf"} 1
+test_seconds_sum{route="/a"} 2
+test_seconds_count{route="/a"} 1
+test_seconds_bucket{route="/b",le="1"} 1
+test_seconds_bucket{route="/b",le="+Inf"} 1
+test_seconds_sum{route="/b"} 0.5
+test_seconds_count{route="/b"} 1
+`
+	assert.Equal(t, exp, sb.String())
+}
+
+func TestCounterConcurrent(t *testing.T) {
+	cv := NewCounterVec("test_total", "Test.", "k")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				cv.With("x").Add(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 4000.0, cv.With("x").Value())
+}
@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"equinox/internal/config"
+	"equinox/internal/mw"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Key under which the authenticated Principal is stored in the gin context
+const PrincipalKey = "equinox.principal"
+
+// Authentication methods
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+	MethodTLS    = "tls"
+)
+
+// Identity of an authenticated caller
+type Principal struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+}
+
+// Returned by an Authenticator when the request doesn't carry credentials of
+// the kind it handles, so the next one should be tried.
+var ErrNoCredentials = errors.New("authentication required")
+
+// Interface for objects that verify the credentials in a request
+type Authenticator interface {
+	// Returns the principal the request is authenticated as,
+	// ErrNoCredentials if it has no credentials this authenticator handles,
+	// or another error if the credentials are invalid.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+/*
+Returns middleware that requires each request to be authenticated by one of
+the given authenticators, tried in order. The principal is stored in the
+context under PrincipalKey; see GetPrincipal. Requests that can't be
+authenticated are aborted with 401 and a JSend error.
+*/
+func AuthMiddleware(auths ...Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, a := range auths {
+			p, err := a.Authenticate(c.Request)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			if err != nil {
+				abortUnauthorized(c, err.Error())
+				return
+			}
+			c.Set(PrincipalKey, p)
+			c.Next()
+			return
+		}
+		abortUnauthorized(c, ErrNoCredentials.Error())
+	}
+}
+
+func abortUnauthorized(c *gin.Context, msg string) {
+	c.Header("WWW-Authenticate", `Bearer realm="equinox"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, mw.Error(msg))
+}
+
+// Returns the principal the request was authenticated as, or nil if
+// authentication is disabled.
+func GetPrincipal(c *gin.Context) *Principal {
+	v, exists := c.Get(PrincipalKey)
+	if !exists {
+		return nil
+	}
+	p, _ := v.(*Principal)
+	return p
+}
+
+// Creates the authenticators enabled by the given configuration: client
+// certificates, then API keys, then JWTs. Returns nil if auth is disabled.
+func NewAuthenticators(cfg *config.Config) []Authenticator {
+	if !cfg.Auth.Enabled {
+		return nil
+	}
+	var auths []Authenticator
+	if cfg.TLS.VerifiesClients() {
+		auths = append(auths, &TLSAuth{})
+	}
+	if len(cfg.Auth.APIKeys) > 0 {
+		auths = append(auths, NewAPIKeyAuth(cfg.Auth.APIKeys))
+	}
+	if cfg.Auth.JWTSecret != "" {
+		auths = append(auths, NewJWTAuth([]byte(cfg.Auth.JWTSecret)))
+	}
+	return auths
+}
+
+// Extracts the credentials from an Authorization header with the given
+// scheme, e.g. "Bearer". Returns "" if there isn't one.
+func authHeader(r *http.Request, scheme string) string {
+	h := r.Header.Get("Authorization")
+	s, cred, found := strings.Cut(h, " ")
+	if !found || !strings.EqualFold(s, scheme) {
+		return ""
+	}
+	return strings.TrimSpace(cred)
+}
+
+// True if s looks like a JWT (three dot-separated parts) rather than an API
+// key
+func isJWT(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+/****************************************************************************
+	APIKeyAuth
+****************************************************************************/
+
+/*
+Authenticates requests with static API keys. The key is taken from the
+X-API-Key header, or an Authorization header with the "Token" scheme (as sent
+by InfluxDB clients) or the "Bearer" scheme (as sent by Prometheus).
+
+Keys are configured as "name:key" to give the principal a name, or just "key"
+in which case the principal is named "apikey-" plus the start of the key's
+SHA-256 hash so it can be identified without revealing the key.
+*/
+type APIKeyAuth struct {
+	keys []apiKey
+}
+
+type apiKey struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+func NewAPIKeyAuth(keys []string) *APIKeyAuth {
+	a := &APIKeyAuth{}
+	for _, k := range keys {
+		name, key, found := strings.Cut(k, ":")
+		if !found {
+			key = k
+		}
+		hash := sha256.Sum256([]byte(key))
+		if !found {
+			name = "apikey-" + hex.EncodeToString(hash[:4])
+		}
+		a.keys = append(a.keys, apiKey{name: name, hash: hash})
+	}
+	return a
+}
+
+func (a *APIKeyAuth) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = authHeader(r, "Token")
+	}
+	if key == "" {
+		if b := authHeader(r, "Bearer"); !isJWT(b) {
+			key = b
+		}
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	// comparing fixed-size hashes in constant time means neither the key
+	// length nor a matching prefix leaks through timing
+	hash := sha256.Sum256([]byte(key))
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			return &Principal{Name: k.name, Method: MethodAPIKey}, nil
+		}
+	}
+	return nil, errors.New("invalid API key")
+}
+
+/****************************************************************************
+	TLSAuth
+****************************************************************************/
+
+// Authenticates requests by their verified TLS client certificate, using the
+// certificate's common name as the principal name. The certificate chain has
+// already been verified against the client CAs during the handshake.
+type TLSAuth struct{}
+
+func (a *TLSAuth) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if cn == "" {
+		return nil, errors.New("client certificate has no common name")
+	}
+	return &Principal{Name: cn, Method: MethodTLS}, nil
+}
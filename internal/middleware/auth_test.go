@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"equinox/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Router with a single protected route that echoes the principal
+func testAuthRouter(auths ...Authenticator) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(AuthMiddleware(auths...))
+	r.GET("/whoami", func(c *gin.Context) {
+		c.JSON(http.StatusOK, GetPrincipal(c))
+	})
+	return r
+}
+
+func testAuthRequest(r *gin.Engine, hdrs map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/whoami", nil)
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthAPIKey(t *testing.T) {
+	r := testAuthRouter(NewAPIKeyAuth([]string{"ops:s3cret", "anon-key"}))
+
+	fn := func(hdrs map[string]string, code int, body string) {
+		rec := testAuthRequest(r, hdrs)
+		assert.Equal(t, code, rec.Code, hdrs)
+		assert.Equal(t, body, rec.Body.String(), hdrs)
+	}
+
+	ops := `{"name":"ops","method":"api_key"}`
+	fn(map[string]string{"X-API-Key": "s3cret"}, http.StatusOK, ops)
+	fn(map[string]string{"Authorization": "Token s3cret"}, http.StatusOK, ops)
+	fn(map[string]string{"Authorization": "bearer s3cret"}, http.StatusOK, ops)
+	fn(map[string]string{"X-API-Key": "anon-key"}, http.StatusOK, `{"name":"apikey-d359d70a","method":"api_key"}`)
+
+	fn(nil, http.StatusUnauthorized, `{"status":"error","message":"authentication required"}`)
+	fn(map[string]string{"Authorization": "Basic b3BzOnMzY3JldA=="}, http.StatusUnauthorized,
+		`{"status":"error","message":"authentication required"}`)
+	fn(map[string]string{"X-API-Key": "s3cre"}, http.StatusUnauthorized, `{"status":"error","message":"invalid API key"}`)
+	fn(map[string]string{"X-API-Key": "ops:s3cret"}, http.StatusUnauthorized, `{"status":"error","message":"invalid API key"}`)
+
+	rec := testAuthRequest(r, nil)
+	assert.Equal(t, `Bearer realm="equinox"`, rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestAuthChain(t *testing.T) {
+	ja := NewJWTAuth([]byte("jwt-secret"))
+	r := testAuthRouter(NewAPIKeyAuth([]string{"ci:k1"}), ja)
+
+	rec := testAuthRequest(r, map[string]string{"Authorization": "Bearer k1"})
+	assert.Equal(t, `{"name":"ci","method":"api_key"}`, rec.Body.String())
+
+	// JWTs are passed over by the API key authenticator
+	rec = testAuthRequest(r, map[string]string{"Authorization": "Bearer " + ja.Sign("alice", 0)})
+	assert.Equal(t, `{"name":"alice","method":"jwt"}`, rec.Body.String())
+
+	rec = testAuthRequest(r, map[string]string{"Authorization": "Bearer " + NewJWTAuth([]byte("other")).Sign("alice", 0)})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `{"status":"error","message":"invalid token: signature mismatch"}`, rec.Body.String())
+}
+
+func TestAuthFromConfig(t *testing.T) {
+	cfg := config.Default()
+	assert.Nil(t, NewAuthenticators(cfg))
+
+	cfg.Auth.Enabled = true
+	cfg.Auth.APIKeys = []string{"k"}
+	auths := NewAuthenticators(cfg)
+	assert.Len(t, auths, 1)
+	assert.IsType(t, &APIKeyAuth{}, auths[0])
+
+	cfg.Auth.JWTSecret = "s"
+	auths = NewAuthenticators(cfg)
+	assert.Len(t, auths, 2)
+	assert.IsType(t, &JWTAuth{}, auths[1])
+
+	cfg.TLS.ClientAuth = "require"
+	auths = NewAuthenticators(cfg)
+	assert.Len(t, auths, 3)
+	assert.IsType(t, &TLSAuth{}, auths[0])
+
+	// no principal without auth
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	assert.Nil(t, GetPrincipal(c))
+}
+
+func TestAuthTLS(t *testing.T) {
+	r := testAuthRouter(&TLSAuth{}, NewAPIKeyAuth([]string{"ops:s3cret"}))
+	fn := func(tlsState *tls.ConnectionState, hdrs map[string]string, code int, body string) {
+		req, _ := http.NewRequest("GET", "/whoami", nil)
+		req.TLS = tlsState
+		for k, v := range hdrs {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, code, rec.Code)
+		assert.Equal(t, body, rec.Body.String())
+	}
+	chain := func(cn string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	fn(chain("agent-1"), nil, http.StatusOK, `{"name":"agent-1","method":"tls"}`)
+	fn(chain(""), nil, http.StatusUnauthorized, `{"status":"error","message":"client certificate has no common name"}`)
+
+	// unverified or no certificate falls through to other methods
+	fn(&tls.ConnectionState{}, map[string]string{"X-API-Key": "s3cret"}, http.StatusOK, `{"name":"ops","method":"api_key"}`)
+	fn(nil, nil, http.StatusUnauthorized, `{"status":"error","message":"authentication required"}`)
+}
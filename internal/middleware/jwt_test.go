@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Builds a token with the given claims JSON, signed with secret using alg
+func testJWT(secret string, alg string, claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	s := enc([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) + "." + enc([]byte(claims))
+	sigAlg := alg
+	if _, exists := jwtAlgs[alg]; !exists {
+		sigAlg = "HS256" // sign anyway so only the algorithm is wrong
+	}
+	return s + "." + enc(NewJWTAuth([]byte(secret)).signature(sigAlg, s))
+}
+
+func TestJWTVerify(t *testing.T) {
+	a := NewJWTAuth([]byte("secret"))
+	a.now = func() time.Time { return time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC) }
+	now := a.now().Unix()
+
+	ok := func(tok string, exp string) {
+		sub, err := a.Verify(tok)
+		assert.NoError(t, err, tok)
+		assert.Equal(t, exp, sub, tok)
+	}
+	fail := func(tok string, msg string) {
+		_, err := a.Verify(tok)
+		assert.Error(t, err, tok)
+		if err != nil {
+			assert.Equal(t, msg, err.Error(), tok)
+		}
+	}
+
+	ok(a.Sign("alice", time.Hour), "alice")
+	ok(testJWT("secret", "HS384", `{"sub":"bob"}`), "bob")
+	ok(testJWT("secret", "HS512", `{"sub":"bob"}`), "bob")
+
+	fail("a.b", "malformed token")
+	fail("!!.b.c", "malformed header: illegal base64 data at input byte 0")
+	fail(testJWT("secret", "none", `{"sub":"bob"}`), "unsupported algorithm 'none'")
+	fail(testJWT("secret", "RS256", `{"sub":"bob"}`), "unsupported algorithm 'RS256'")
+	fail(testJWT("wrong", "HS256", `{"sub":"bob"}`), "signature mismatch")
+	fail(a.Sign("alice", 0)+"!", "malformed signature")
+	fail(testJWT("secret", "HS256", `{"sub":""}`), "missing sub claim")
+	fail(testJWT("secret", "HS256", `{"sub":"bob"`), "malformed claims: unexpected end of JSON input")
+
+	// expiry and not-before are checked with leeway
+	claims := func(field string, ts int64, frac string) string {
+		return fmt.Sprintf(`{"sub":"bob","%s":%d%s}`, field, ts, frac)
+	}
+	fail(testJWT("secret", "HS256", claims("exp", now-31, "")), "token has expired")
+	ok(testJWT("secret", "HS256", claims("exp", now-29, "")), "bob")
+	fail(testJWT("secret", "HS256", claims("nbf", now+30, ".5")), "token is not valid yet")
+	ok(testJWT("secret", "HS256", claims("nbf", now+29, ".5")), "bob")
+
+	// expired token signed by Sign
+	a.now = func() time.Time { return time.Date(2024, 6, 1, 14, 0, 0, 0, time.UTC) }
+	tok := a.Sign("alice", time.Hour)
+	a.now = func() time.Time { return time.Date(2024, 6, 1, 15, 1, 0, 0, time.UTC) }
+	fail(tok, "token has expired")
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header carrying the request id, in both requests and responses
+const RequestIdHeader = "X-Request-Id"
+
+// Keys under which the request id and log fields are stored in the gin
+// context
+const (
+	RequestIdKey = "equinox.request_id"
+	logFieldsKey = "equinox.log_fields"
+)
+
+// Longest client-supplied request id that's kept; longer ones are replaced
+const maxRequestIdLen = 64
+
+// Details filled in by handlers for the request log
+type logFields struct {
+	series []string
+	points int
+}
+
+/*
+Returns middleware that logs a structured line for every request once it's
+been handled: its id, method, route, status, latency, client and principal,
+plus the series it touched and the number of points written or returned as
+recorded by LogSeries and LogPoints. The request id is taken from the
+X-Request-Id header if the client sent a usable one, otherwise generated, and
+is echoed back in the response.
+*/
+func RequestLogger(log *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIdHeader)
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+		c.Set(RequestIdKey, id)
+		c.Header(RequestIdHeader, id)
+		lf := &logFields{}
+		c.Set(logFieldsKey, lf)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if p := GetPrincipal(c); p != nil {
+			attrs = append(attrs, slog.String("principal", p.Name))
+		}
+		series := lf.series
+		if sid := c.Param("id"); sid != "" && len(series) == 0 {
+			series = []string{sid}
+		}
+		if len(series) > 0 {
+			attrs = append(attrs, slog.Any("series", series))
+		}
+		if lf.points > 0 {
+			attrs = append(attrs, slog.Int("points", lf.points))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", c.Errors.String()))
+		}
+		log.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Returns the id of the request, or "" if it isn't being logged
+func GetRequestId(c *gin.Context) string {
+	return c.GetString(RequestIdKey)
+}
+
+// Records series the request touched, for the request log. Each id is only
+// recorded once.
+func LogSeries(c *gin.Context, ids ...string) {
+	lf := getLogFields(c)
+	if lf == nil {
+		return
+	}
+	for _, id := range ids {
+		if !slices.Contains(lf.series, id) {
+			lf.series = append(lf.series, id)
+		}
+	}
+}
+
+// Adds to the number of points the request wrote or returned, for the
+// request log
+func LogPoints(c *gin.Context, n int) {
+	if lf := getLogFields(c); lf != nil {
+		lf.points += n
+	}
+}
+
+func getLogFields(c *gin.Context) *logFields {
+	v, exists := c.Get(logFieldsKey)
+	if !exists {
+		return nil
+	}
+	return v.(*logFields)
+}
+
+// Returns true if a client-supplied request id is safe to log and echo back
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLen {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
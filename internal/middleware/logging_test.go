@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLogger(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var buf bytes.Buffer
+	r := gin.New()
+	r.Use(RequestLogger(slog.New(slog.NewJSONHandler(&buf, nil))))
+	r.POST("/series/:id/points", func(c *gin.Context) {
+		c.Set(PrincipalKey, &Principal{Name: "ops", Method: MethodAPIKey})
+		LogPoints(c, 1)
+		c.Status(http.StatusCreated)
+	})
+	r.POST("/write", func(c *gin.Context) {
+		LogSeries(c, "a", "b", "a")
+		LogPoints(c, 2)
+		LogPoints(c, 3)
+		c.Status(http.StatusNoContent)
+	})
+
+	entry := func(method string, path string, reqId string) (map[string]any, *httptest.ResponseRecorder) {
+		buf.Reset()
+		req, _ := http.NewRequest(method, path, nil)
+		if reqId != "" {
+			req.Header.Set(RequestIdHeader, reqId)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		var e map[string]any
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+		return e, rec
+	}
+
+	e, rec := entry("POST", "/series/cpu/points", "abc-123")
+	assert.Equal(t, "abc-123", rec.Header().Get(RequestIdHeader))
+	assert.Equal(t, "INFO", e["level"])
+	assert.Equal(t, "request", e["msg"])
+	assert.Equal(t, "abc-123", e["request_id"])
+	assert.Equal(t, "POST", e["method"])
+	assert.Equal(t, "/series/cpu/points", e["path"])
+	assert.Equal(t, "/series/:id/points", e["route"])
+	assert.Equal(t, 201.0, e["status"])
+	assert.Contains(t, e, "latency_ms")
+	assert.Equal(t, "ops", e["principal"])
+	assert.Equal(t, []any{"cpu"}, e["series"])
+	assert.Equal(t, 1.0, e["points"])
+
+	// unusable ids are replaced
+	e, rec = entry("POST", "/write", "bad id")
+	id := rec.Header().Get(RequestIdHeader)
+	assert.Len(t, id, 16)
+	assert.Equal(t, id, e["request_id"])
+	assert.NotContains(t, e, "principal")
+	assert.Equal(t, []any{"a", "b"}, e["series"])
+	assert.Equal(t, 5.0, e["points"])
+
+	e, _ = entry("GET", "/nope", strings.Repeat("x", 65))
+	assert.Len(t, e["request_id"], 16)
+	assert.Equal(t, "WARN", e["level"])
+	assert.Equal(t, 404.0, e["status"])
+	assert.Equal(t, "", e["route"])
+	assert.NotContains(t, e, "series")
+	assert.NotContains(t, e, "points")
+}
+
+func TestLogFieldsWithoutLogger(t *testing.T) {
+	// handlers can record fields even when requests aren't logged
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	LogSeries(c, "a")
+	LogPoints(c, 1)
+	assert.Equal(t, "", GetRequestId(c))
+}
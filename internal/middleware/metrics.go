@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"equinox/internal/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	httpRequests = metrics.MustRegister(metrics.NewCounterVec(
+		"equinox_http_requests_total", "Number of HTTP requests handled.",
+		"method", "route", "code"))
+	httpDuration = metrics.MustRegister(metrics.NewHistogramVec(
+		"equinox_http_request_duration_seconds", "Time taken to handle HTTP requests.",
+		metrics.DefBuckets, "method", "route"))
+)
+
+// Returns middleware that counts and times requests. Requests are labelled
+// by their route pattern, e.g. /series/:id/points, rather than the path so
+// that series ids don't multiply the number of metrics; requests that don't
+// match a route are labelled "unmatched".
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		httpRequests.With(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.With(method, route).ObserveSince(start)
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Metrics())
+	r.GET("/series/:id", func(c *gin.Context) {
+		c.Status(http.StatusAccepted)
+	})
+
+	get := func(path string) {
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	get("/series/a")
+	get("/series/b")
+	get("/nope")
+
+	assert.Equal(t, 2.0, httpRequests.With("GET", "/series/:id", "202").Value())
+	assert.Equal(t, 1.0, httpRequests.With("GET", "unmatched", "404").Value())
+	assert.Equal(t, uint64(2), httpDuration.With("GET", "/series/:id").Count())
+}
@@ -1,23 +1,56 @@
 package mw
 
 import (
+	"equinox/internal/engine"
+	"equinox/internal/metrics"
 	"equinox/internal/models"
+	"errors"
 	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Manages access to underlying data series objects, providing caching and
 // lookup
 type seriesMgr struct {
+	mu     sync.RWMutex
 	series map[string]*models.Series
+	newIO  func(id string) (engine.PointIO, error) // engine for Create
 }
 
 // Singleton instance of seriesMgr
 var seriesMgrInst *seriesMgr
 
+var _ = metrics.MustRegister(metrics.NewGaugeFunc(
+	"equinox_series_points", "Number of points held by each series.",
+	func() []metrics.Sample {
+		if seriesMgrInst == nil {
+			return nil
+		}
+		seriesMgrInst.mu.RLock()
+		defer seriesMgrInst.mu.RUnlock()
+		r := make([]metrics.Sample, 0, len(seriesMgrInst.series))
+		for id, s := range seriesMgrInst.series {
+			r = append(r, metrics.Sample{
+				Labels: []string{"series", id, "engine", s.IO.Name()},
+				Value:  float64(s.IO.Len()),
+			})
+		}
+		return r
+	}))
+
 // Returns singleton instance of the data series manager.
 func GetSeriesMgr() *seriesMgr {
 	if seriesMgrInst == nil {
-		seriesMgrInst = &seriesMgr{series: make(map[string]*models.Series)}
+		seriesMgrInst = &seriesMgr{
+			series: make(map[string]*models.Series),
+			newIO: func(id string) (engine.PointIO, error) {
+				return engine.NewMemTree(), nil
+			},
+		}
 	}
 
 	return seriesMgrInst
@@ -25,12 +58,16 @@ func GetSeriesMgr() *seriesMgr {
 
 // Returns number of elements currently in the series manager
 func (sm *seriesMgr) Size() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
 	return len(seriesMgrInst.series)
 }
 
 // Retrieves the data series with the given ID, returning an error if it does
 // not exist.
 func (sm *seriesMgr) Get(id string) (*models.Series, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
 	s, exist := seriesMgrInst.series[id]
 	if !exist {
 		return nil, fmt.Errorf("series '%s' does not exist", id)
@@ -39,8 +76,51 @@ func (sm *seriesMgr) Get(id string) (*models.Series, error) {
 	return s, nil
 }
 
+// Returns true if the pattern is a glob rather than a series id
+func IsSeriesGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// Retrieves the data series matching any of the patterns, sorted by ID. A
+// pattern is either an ID, which must exist, or a glob as in path.Match,
+// such as "sensor-*", which may match nothing.
+func (sm *seriesMgr) Match(patterns ...string) ([]*models.Series, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	found := make(map[string]*models.Series)
+	for _, pat := range patterns {
+		if !IsSeriesGlob(pat) {
+			s, exist := seriesMgrInst.series[pat]
+			if !exist {
+				return nil, fmt.Errorf("series '%s' does not exist", pat)
+			}
+			found[s.Id] = s
+			continue
+		}
+
+		for id, s := range seriesMgrInst.series {
+			match, err := path.Match(pat, id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid series pattern '%s': %s", pat, err.Error())
+			}
+			if match {
+				found[id] = s
+			}
+		}
+	}
+
+	r := make([]*models.Series, 0, len(found))
+	for _, s := range found {
+		r = append(r, s)
+	}
+	slices.SortFunc(r, func(a, b *models.Series) int { return strings.Compare(a.Id, b.Id) })
+	return r, nil
+}
+
 // Returns true if the data series with given id already exists, false othersie
 func (sm *seriesMgr) Has(id string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
 	_, exist := seriesMgrInst.series[id]
 	return exist
 }
@@ -48,6 +128,8 @@ func (sm *seriesMgr) Has(id string) bool {
 // Adds the given series to the manager if one with that id doesn't already
 // exist. If it exists then nothing is added an an error is returned.
 func (sm *seriesMgr) Add(s *models.Series) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 	_, exist := seriesMgrInst.series[s.Id]
 	if exist {
 		return fmt.Errorf("series '%s' already exists", s.Id)
@@ -58,8 +140,131 @@ func (sm *seriesMgr) Add(s *models.Series) error {
 	return nil
 }
 
+// Sets how Create makes the engine for a new series. The default is an empty
+// MemTree.
+func (sm *seriesMgr) SetEngine(newIO func(id string) (engine.PointIO, error)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.newIO = newIO
+}
+
+// Creates a series with the given id using the engine set by SetEngine. If
+// one with that id already exists then nothing is created and an error is
+// returned.
+func (sm *seriesMgr) Create(id string) (*models.Series, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if _, exist := seriesMgrInst.series[id]; exist {
+		return nil, fmt.Errorf("series '%s' already exists", id)
+	}
+
+	io, err := sm.newIO(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create series '%s': %s", id, err.Error())
+	}
+	s := &models.Series{Id: id, IO: io}
+	seriesMgrInst.series[id] = s
+	return s, nil
+}
+
 // Removes the given series from the manager if it exists. If it does not exist
 // then nothing is done.
 func (sm *seriesMgr) Remove(id string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 	delete(seriesMgrInst.series, id)
 }
+
+// Flushes and closes the engine of every series, e.g. on shutdown. All series
+// are attempted even if some fail; the returned error describes every
+// failure. The series remain in the manager but can't be used afterwards.
+func (sm *seriesMgr) CloseAll() error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var errs []error
+	for id, s := range seriesMgrInst.series {
+		if s.IO == nil {
+			continue
+		}
+		err := engine.Shutdown(s.IO)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("series '%s': %s", id, err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flushes the engine of every series that's an engine.Flusher, returning an
+// error describing every series that failed.
+func (sm *seriesMgr) FlushAll() error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var errs []error
+	for id, s := range seriesMgrInst.series {
+		f, ok := s.IO.(engine.Flusher)
+		if !ok {
+			continue
+		}
+		err := f.Flush()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("series '%s': %s", id, err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checks the engine of every series that's an engine.Checker, returning an
+// error describing every series whose storage is unusable.
+func (sm *seriesMgr) CheckAll() error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var errs []error
+	for id, s := range seriesMgrInst.series {
+		c, ok := s.IO.(engine.Checker)
+		if !ok {
+			continue
+		}
+		err := c.Check()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("series '%s': %s", id, err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Drops data older than t from every series whose engine is an
+// engine.Retainer, returning the number of points dropped and an error
+// describing every series that failed.
+func (sm *seriesMgr) DropBefore(t time.Time) (int, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	n := 0
+	var errs []error
+	for id, s := range seriesMgrInst.series {
+		r, ok := s.IO.(engine.Retainer)
+		if !ok {
+			continue
+		}
+		dropped, err := r.DropBefore(t)
+		n += dropped
+		if err != nil {
+			errs = append(errs, fmt.Errorf("series '%s': %s", id, err.Error()))
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// Vacuums every series with engine.Vacuum, returning an error describing every
+// series that failed.
+func (sm *seriesMgr) VacuumAll() error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var errs []error
+	for id, s := range seriesMgrInst.series {
+		err := engine.Vacuum(s.IO)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("series '%s': %s", id, err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -1,8 +1,12 @@
 package mw
 
 import (
+	"equinox/internal/core"
+	"equinox/internal/engine"
 	"equinox/internal/models"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -59,3 +63,200 @@ func TestSeriesMgrAdding(t *testing.T) {
 	mgr.Remove(s.Id)
 	assert.Equal(t, 0, mgr.Size()) // no op
 }
+
+// engine that records whether it was flushed and closed
+type testClosingIO struct {
+	*engine.MemList
+	flushed bool
+	closed  bool
+	err     error
+}
+
+func (io *testClosingIO) Flush() error {
+	io.flushed = true
+	return nil
+}
+
+func (io *testClosingIO) Close() error {
+	io.closed = true
+	return io.err
+}
+
+func TestSeriesMgrCloseAll(t *testing.T) {
+	mgr := GetSeriesMgr()
+	a := &testClosingIO{MemList: engine.NewMemList()}
+	b := &testClosingIO{MemList: engine.NewMemList(), err: fmt.Errorf("disk gone")}
+	mgr.Add(&models.Series{Id: "a", IO: a})
+	mgr.Add(&models.Series{Id: "b", IO: b})
+	mgr.Add(&models.Series{Id: "c", IO: engine.NewMemTree()})
+	defer func() {
+		mgr.Remove("a")
+		mgr.Remove("b")
+		mgr.Remove("c")
+	}()
+
+	err := mgr.CloseAll()
+	assert.Error(t, err)
+	assert.Equal(t, "series 'b': close failed: disk gone", err.Error())
+	assert.True(t, a.flushed)
+	assert.True(t, a.closed)
+	assert.True(t, b.flushed)
+	assert.True(t, b.closed)
+}
+
+func TestSeriesMgrCreate(t *testing.T) {
+	mgr := GetSeriesMgr()
+	s, err := mgr.Create("a")
+	assert.Nil(t, err)
+	defer mgr.Remove("a")
+	assert.Equal(t, "MemTree", s.IO.Name())
+	_, err = mgr.Create("a")
+	assert.Equal(t, "series 'a' already exists", err.Error())
+
+	var made []string
+	mgr.SetEngine(func(id string) (engine.PointIO, error) {
+		made = append(made, id)
+		if id == "bad" {
+			return nil, fmt.Errorf("disk gone")
+		}
+		return engine.NewMemList(), nil
+	})
+	defer mgr.SetEngine(func(id string) (engine.PointIO, error) { return engine.NewMemTree(), nil })
+
+	s, err = mgr.Create("b")
+	assert.Nil(t, err)
+	defer mgr.Remove("b")
+	assert.Equal(t, "MemList", s.IO.Name())
+	_, err = mgr.Create("bad")
+	assert.Equal(t, "failed to create series 'bad': disk gone", err.Error())
+	assert.False(t, mgr.Has("bad"))
+	assert.Equal(t, []string{"b", "bad"}, made)
+}
+
+func TestSeriesMgrFlushAll(t *testing.T) {
+	mgr := GetSeriesMgr()
+	a := &testClosingIO{MemList: engine.NewMemList()}
+	mgr.Add(&models.Series{Id: "a", IO: a})
+	mgr.Add(&models.Series{Id: "c", IO: engine.NewMemTree()})
+	defer func() {
+		mgr.Remove("a")
+		mgr.Remove("c")
+	}()
+
+	assert.Nil(t, mgr.FlushAll())
+	assert.True(t, a.flushed)
+	assert.False(t, a.closed)
+}
+
+// engine whose vacuum fails with err
+type testVacuumIO struct {
+	*engine.MemList
+	vacuumed int
+	err      error
+}
+
+func (io *testVacuumIO) Vacuum() error {
+	io.vacuumed++
+	return io.err
+}
+
+func TestSeriesMgrVacuumAll(t *testing.T) {
+	mgr := GetSeriesMgr()
+	a := &testVacuumIO{MemList: engine.NewMemList()}
+	b := &testVacuumIO{MemList: engine.NewMemList(), err: fmt.Errorf("disk gone")}
+	mgr.Add(&models.Series{Id: "a", IO: a})
+	mgr.Add(&models.Series{Id: "b", IO: b})
+	defer func() {
+		mgr.Remove("a")
+		mgr.Remove("b")
+	}()
+
+	err := mgr.VacuumAll()
+	assert.Error(t, err)
+	assert.Equal(t, "series 'b': disk gone", err.Error())
+	assert.Equal(t, 1, a.vacuumed)
+	assert.Equal(t, 1, b.vacuumed)
+}
+
+// engine whose storage check fails with err
+type testCheckingIO struct {
+	*engine.MemList
+	err error
+}
+
+func (io *testCheckingIO) Check() error {
+	return io.err
+}
+
+func TestSeriesMgrCheckAll(t *testing.T) {
+	mgr := GetSeriesMgr()
+	a := &testCheckingIO{MemList: engine.NewMemList()}
+	mgr.Add(&models.Series{Id: "a", IO: a})
+	mgr.Add(&models.Series{Id: "c", IO: engine.NewMemTree()})
+	defer func() {
+		mgr.Remove("a")
+		mgr.Remove("b")
+		mgr.Remove("c")
+	}()
+	assert.NoError(t, mgr.CheckAll())
+
+	b := &testCheckingIO{MemList: engine.NewMemList(), err: fmt.Errorf("data file closed")}
+	mgr.Add(&models.Series{Id: "b", IO: b})
+	err := mgr.CheckAll()
+	assert.Error(t, err)
+	assert.Equal(t, "series 'b': data file closed", err.Error())
+}
+
+func TestSeriesMgrDropBefore(t *testing.T) {
+	mgr := GetSeriesMgr()
+	a, err := engine.NewSharded(t.TempDir(), time.Hour)
+	assert.Nil(t, err)
+	defer a.Close()
+	ts := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, a.Add(core.NewPoint(ts.Add(time.Duration(i)*time.Hour))))
+	}
+	mgr.Add(&models.Series{Id: "a", IO: a})
+	mgr.Add(&models.Series{Id: "c", IO: engine.NewMemTree()})
+	defer func() {
+		mgr.Remove("a")
+		mgr.Remove("c")
+	}()
+
+	n, err := mgr.DropBefore(ts.Add(90 * time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, a.Len())
+}
+
+func TestSeriesMgrMatch(t *testing.T) {
+	mgr := GetSeriesMgr()
+	for _, id := range []string{"sensor-2", "sensor-1", "sensor-10", "pump-1"} {
+		assert.NoError(t, mgr.Add(&models.Series{Id: id}))
+		defer mgr.Remove(id)
+	}
+
+	ids := func(patterns ...string) []string {
+		ss, err := mgr.Match(patterns...)
+		assert.NoError(t, err)
+		r := []string{}
+		for _, s := range ss {
+			r = append(r, s.Id)
+		}
+		return r
+	}
+	assert.Equal(t, []string{"sensor-1", "sensor-10", "sensor-2"}, ids("sensor-*"))
+	assert.Equal(t, []string{"sensor-1", "sensor-2"}, ids("sensor-?"))
+	assert.Equal(t, []string{"pump-1", "sensor-1"}, ids("sensor-1", "pump-1", "sensor-1"))
+	assert.Equal(t, []string{"pump-1", "sensor-1", "sensor-2"}, ids("*-1", "sensor-[2-9]"))
+	assert.Equal(t, []string{}, ids("valve-*"))
+	assert.Equal(t, []string{}, ids())
+
+	_, err := mgr.Match("sensor-*", "valve-1")
+	assert.Equal(t, "series 'valve-1' does not exist", err.Error())
+	_, err = mgr.Match("sensor-[")
+	assert.Equal(t, "invalid series pattern 'sensor-[': syntax error in pattern", err.Error())
+
+	assert.True(t, IsSeriesGlob("a*"))
+	assert.False(t, IsSeriesGlob("sensor-1"))
+}
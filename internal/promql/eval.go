@@ -0,0 +1,222 @@
+package promql
+
+import (
+	"encoding/json"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/query"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default amount of time to look back for the latest sample at each step,
+// matching Prometheus' default lookback delta.
+const DefaultLookback = 5 * time.Minute
+
+// Maximum number of steps in a single range query, matching Prometheus
+const MaxSteps = 11000
+
+// Number of points fetched from the engine at a time
+const fetchBatch = 1000
+
+// Single sample in a Prometheus result
+type Sample struct {
+	Ts  time.Time
+	Val float64
+}
+
+// Implements json.Marshaler using the Prometheus [<unix secs>, "<value>"]
+// representation.
+func (s Sample) MarshalJSON() ([]byte, error) {
+	ts := float64(s.Ts.UnixMilli()) / 1000.0
+	return json.Marshal([]any{ts, strconv.FormatFloat(s.Val, 'f', -1, 64)})
+}
+
+// Single series in a Prometheus matrix result
+type Series struct {
+	Metric  map[string]string `json:"metric"`
+	Samples []Sample          `json:"values"`
+}
+
+// Prometheus HTTP API response envelope. This isn't JSend because Prometheus
+// clients such as Grafana expect this exact format.
+type APIResponse struct {
+	Status    string `json:"status"`
+	Data      any    `json:"data,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Returns a successful Prometheus API response containing a matrix
+func MatrixResponse(ss []*Series) *APIResponse {
+	if ss == nil {
+		ss = []*Series{} // marshal as [] rather than null
+	}
+	return &APIResponse{Status: "success", Data: map[string]any{
+		"resultType": "matrix",
+		"result":     ss,
+	}}
+}
+
+// Returns a Prometheus API error response
+func ErrorResponse(errType string, msg string) *APIResponse {
+	return &APIResponse{Status: "error", ErrorType: errType, Error: msg}
+}
+
+// Runs the query against io and returns all matching points that have a value
+// for key, grouped into one Series per distinct set of attributes. Samples are
+// in ascending time order and series are sorted by their labels. The metric
+// name is added to each series' labels.
+func Select(io engine.PointIO, name string, key string, q *query.Query) ([]*Series, error) {
+	qe, err := io.Search(q)
+	if err != nil {
+		return nil, err
+	}
+	defer qe.Close()
+
+	groups := make(map[string]*Series)
+	for {
+		ps, err := qe.Fetch(fetchBatch)
+		if err != nil {
+			return nil, err
+		}
+		if len(ps) == 0 {
+			break
+		}
+
+		for _, p := range ps {
+			v, exists := p.Vals[key]
+			if !exists {
+				continue
+			}
+
+			gk := labelsKey(p.Attrs)
+			s, exists := groups[gk]
+			if !exists {
+				s = &Series{Metric: pointLabels(p, name)}
+				groups[gk] = s
+			}
+			s.Samples = append(s.Samples, Sample{Ts: p.Ts, Val: v})
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ss := make([]*Series, 0, len(keys))
+	for _, k := range keys {
+		s := groups[k]
+		slices.SortStableFunc(s.Samples, func(a, b Sample) int {
+			return a.Ts.Compare(b.Ts)
+		})
+		ss = append(ss, s)
+	}
+
+	return ss, nil
+}
+
+/*
+Evaluates an instant vector selector over [start, end] at the given step, the
+way Prometheus does for query_range: at each step the value is the latest
+sample no more than lookback before it. Steps with no such sample are omitted,
+and series with no samples at all are dropped.
+*/
+func EvalRange(io engine.PointIO, name string, key string, fa query.FilterAttr,
+	start time.Time, end time.Time, step time.Duration, lookback time.Duration) ([]*Series, error) {
+
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("end time must not be before start time")
+	}
+	if end.Sub(start)/step >= MaxSteps {
+		return nil, fmt.Errorf("exceeded maximum resolution of %d points per series", MaxSteps)
+	}
+
+	// the earliest step can use samples from up to lookback before it
+	q := query.NewQuery(start.Add(-lookback), end, fa)
+	raw, err := Select(io, name, key, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var ss []*Series
+	for _, r := range raw {
+		s := &Series{Metric: r.Metric}
+		i := 0 // index of the first raw sample after the current step
+		for t := start; !t.After(end); t = t.Add(step) {
+			for i < len(r.Samples) && !r.Samples[i].Ts.After(t) {
+				i++
+			}
+			if i == 0 {
+				continue // no samples at or before this step
+			}
+			latest := r.Samples[i-1]
+			if t.Sub(latest.Ts) > lookback {
+				continue
+			}
+			s.Samples = append(s.Samples, Sample{Ts: t, Val: latest.Val})
+		}
+
+		if len(s.Samples) > 0 {
+			ss = append(ss, s)
+		}
+	}
+
+	return ss, nil
+}
+
+// Returns a string uniquely identifying a set of attributes
+func labelsKey(attrs map[string]string) string {
+	kvs := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// Converts a point to the labels Prometheus would see for it
+func pointLabels(p *core.Point, name string) map[string]string {
+	m := make(map[string]string, len(p.Attrs)+1)
+	for k, v := range p.Attrs {
+		m[k] = v
+	}
+	m[NameLabel] = name
+	return m
+}
+
+// Parses a Prometheus API timestamp, which is either RFC3339 or a (possibly
+// fractional) number of seconds since the Unix epoch.
+func ParseTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := math.Floor(f)
+		ns := math.Round((f - sec) * 1e9)
+		return time.Unix(int64(sec), int64(ns)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse '%s' to a valid timestamp", s)
+}
+
+// Parses a Prometheus API duration, which is either a number of seconds or a
+// duration string such as "15s" or "1m30s".
+func ParseDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	return 0, fmt.Errorf("cannot parse '%s' to a valid duration", s)
+}
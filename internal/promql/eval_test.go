@@ -0,0 +1,145 @@
+package promql
+
+import (
+	"encoding/json"
+	"equinox/internal/core"
+	"equinox/internal/engine"
+	"equinox/internal/query"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testStart = time.Date(2024, 01, 10, 23, 0, 0, 0, time.UTC)
+
+// MemTree with samples for two instances every 30s over 10 minutes; instance b
+// stops reporting after 2 minutes.
+func testEngine() engine.PointIO {
+	io := engine.NewMemTree()
+	for i := 0; i < 20; i++ {
+		ts := testStart.Add(time.Duration(i*30) * time.Second)
+
+		p := core.NewPoint(ts)
+		p.Attrs["job"] = "api"
+		p.Attrs["instance"] = "a"
+		p.Vals["value"] = float64(i)
+		io.Add(p)
+
+		if i < 4 {
+			p = core.NewPoint(ts)
+			p.Attrs["job"] = "api"
+			p.Attrs["instance"] = "b"
+			p.Vals["value"] = float64(100 + i)
+			p.Vals["other"] = 1.5
+			io.Add(p)
+		}
+	}
+	return io
+}
+
+func TestEvalSelect(t *testing.T) {
+	io := testEngine()
+
+	q := query.NewQuery(testStart, testStart.Add(time.Minute), query.True())
+	ss, err := Select(io, "up", "value", q)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(ss))
+	assert.Equal(t, map[string]string{"__name__": "up", "job": "api", "instance": "a"}, ss[0].Metric)
+	assert.Equal(t, 3, len(ss[0].Samples))
+	assert.Equal(t, "b", ss[1].Metric["instance"])
+	assert.Equal(t, 102.0, ss[1].Samples[2].Val)
+
+	// only points with the value key are returned
+	ss, err = Select(io, "other", "other", q)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ss))
+	assert.Equal(t, "b", ss[0].Metric["instance"])
+
+	b, err := json.Marshal(ss)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"metric":{"__name__":"other","instance":"b","job":"api"},"values":[[1704927600,"1.5"],[1704927630,"1.5"],[1704927660,"1.5"]]}]`, string(b))
+}
+
+func TestEvalRange(t *testing.T) {
+	io := testEngine()
+
+	fa := query.Equal("instance", "b")
+	ss, err := EvalRange(io, "up", "value", fa, testStart.Add(-time.Minute), testStart.Add(10*time.Minute), time.Minute, DefaultLookback)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ss))
+
+	// no value before the first sample; last sample at 1m30 is used for 5m
+	b, err := json.Marshal(ss[0].Samples)
+	assert.NoError(t, err)
+	assert.Equal(t, `[[1704927600,"100"],[1704927660,"102"],[1704927720,"103"],[1704927780,"103"],[1704927840,"103"],[1704927900,"103"],[1704927960,"103"]]`, string(b))
+
+	// shorter lookback
+	ss, err = EvalRange(io, "up", "value", fa, testStart, testStart.Add(10*time.Minute), time.Minute, 45*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ss))
+	assert.Equal(t, 3, len(ss[0].Samples))
+
+	// all series with a start that needs the lookback
+	ss, err = EvalRange(io, "up", "value", query.True(), testStart.Add(15*time.Second), testStart.Add(75*time.Second), 30*time.Second, DefaultLookback)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(ss))
+	b, _ = json.Marshal(ss[0].Samples)
+	assert.Equal(t, `[[1704927615,"0"],[1704927645,"1"],[1704927675,"2"]]`, string(b))
+
+	// nothing in range
+	ss, err = EvalRange(io, "up", "value", query.True(), testStart.Add(time.Hour), testStart.Add(2*time.Hour), time.Minute, DefaultLookback)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(ss))
+}
+
+func TestEvalRangeErrors(t *testing.T) {
+	io := testEngine()
+	fn := func(st time.Time, end time.Time, step time.Duration, msg string) {
+		_, err := EvalRange(io, "up", "value", query.True(), st, end, step, DefaultLookback)
+		assert.Error(t, err)
+		assert.Equal(t, msg, err.Error())
+	}
+
+	fn(testStart, testStart.Add(time.Hour), 0, "step must be positive")
+	fn(testStart, testStart.Add(-time.Hour), time.Minute, "end time must not be before start time")
+	fn(testStart, testStart.Add(24*time.Hour), time.Second, "exceeded maximum resolution of 11000 points per series")
+}
+
+func TestEvalParseParams(t *testing.T) {
+	exp := time.Date(2024, 01, 10, 23, 1, 2, 500000000, time.UTC)
+
+	ts, err := ParseTime("1704927662.5")
+	assert.NoError(t, err)
+	assert.Equal(t, exp, ts)
+
+	ts, err = ParseTime("2024-01-10T23:01:02.5Z")
+	assert.NoError(t, err)
+	assert.Equal(t, exp, ts)
+
+	_, err = ParseTime("yesterday")
+	assert.Error(t, err)
+	assert.Equal(t, "cannot parse 'yesterday' to a valid timestamp", err.Error())
+
+	d, err := ParseDuration("15")
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Second, d)
+
+	d, err = ParseDuration("1m30s")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, d)
+
+	_, err = ParseDuration("1 minute")
+	assert.Error(t, err)
+	assert.Equal(t, "cannot parse '1 minute' to a valid duration", err.Error())
+}
+
+func TestEvalResponse(t *testing.T) {
+	b, err := json.Marshal(MatrixResponse(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"status":"success","data":{"result":[],"resultType":"matrix"}}`, string(b))
+
+	b, err = json.Marshal(ErrorResponse("bad_data", "oops"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"status":"error","errorType":"bad_data","error":"oops"}`, string(b))
+}
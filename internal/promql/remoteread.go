@@ -0,0 +1,215 @@
+package promql
+
+import (
+	"equinox/internal/ingest"
+	"fmt"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Label matcher types as numbered in the remote-read protobuf schema
+var readMatchTypes = []MatchType{MatchEqual, MatchNotEqual, MatchRegex, MatchNotRegex}
+
+// Single query from a Prometheus remote-read request
+type ReadQuery struct {
+	Start    time.Time
+	End      time.Time
+	Matchers []*Matcher
+}
+
+// Returns the series id and value key that samples for the given metric are
+// stored under. This mirrors ingest.PromToPoints: by default the metric name
+// is the series id, but if series is given then the metric name is the value
+// key within that series.
+func Target(name string, series string) (string, string) {
+	if series != "" {
+		return series, name
+	}
+	return name, ingest.PromValueKey
+}
+
+/*
+Decodes a Prometheus remote-read request, which is a snappy-compressed
+protobuf ReadRequest, refusing requests over maxDecoded bytes once
+decompressed. Read hints and the accepted response types are ignored; we
+always respond with samples. The relevant parts of the schema are:
+
+	message ReadRequest { repeated Query queries = 1; }
+	message Query { int64 start_timestamp_ms = 1; int64 end_timestamp_ms = 2; repeated LabelMatcher matchers = 3; }
+	message LabelMatcher { Type type = 1; string name = 2; string value = 3; }
+*/
+func DecodeReadRequest(body []byte, maxDecoded int) ([]*ReadQuery, error) {
+	b, err := ingest.DecodeSnappy(body, maxDecoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress remote read request: %w", err)
+	}
+
+	var rqs []*ReadQuery
+	err = ingest.WalkProto(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		rq, err := decodeReadQuery(v)
+		if err != nil {
+			return err
+		}
+		rqs = append(rqs, rq)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode remote read request: %s", err.Error())
+	}
+
+	return rqs, nil
+}
+
+// Encodes queries as a snappy-compressed remote-read request. This is the
+// inverse of DecodeReadRequest.
+func EncodeReadRequest(rqs []*ReadQuery) []byte {
+	var b []byte
+	for _, rq := range rqs {
+		var qb []byte
+		qb = protowire.AppendTag(qb, 1, protowire.VarintType)
+		qb = protowire.AppendVarint(qb, uint64(rq.Start.UnixMilli()))
+		qb = protowire.AppendTag(qb, 2, protowire.VarintType)
+		qb = protowire.AppendVarint(qb, uint64(rq.End.UnixMilli()))
+
+		for _, m := range rq.Matchers {
+			var mb []byte
+			for i, t := range readMatchTypes {
+				if t == m.Type {
+					mb = protowire.AppendTag(mb, 1, protowire.VarintType)
+					mb = protowire.AppendVarint(mb, uint64(i))
+				}
+			}
+			mb = protowire.AppendTag(mb, 2, protowire.BytesType)
+			mb = protowire.AppendString(mb, m.Name)
+			mb = protowire.AppendTag(mb, 3, protowire.BytesType)
+			mb = protowire.AppendString(mb, m.Value)
+			qb = protowire.AppendTag(qb, 3, protowire.BytesType)
+			qb = protowire.AppendBytes(qb, mb)
+		}
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, qb)
+	}
+
+	return snappy.Encode(nil, b)
+}
+
+/*
+Encodes the results of each query as a snappy-compressed protobuf
+ReadResponse, with one QueryResult per query in the same order:
+
+	message ReadResponse { repeated QueryResult results = 1; }
+	message QueryResult { repeated TimeSeries timeseries = 1; }
+*/
+func EncodeReadResponse(results [][]*Series) []byte {
+	var b []byte
+	for _, ss := range results {
+		var rb []byte
+		for _, s := range ss {
+			rb = ingest.AppendTimeSeries(rb, 1, SeriesToProm(s))
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, rb)
+	}
+
+	return snappy.Encode(nil, b)
+}
+
+// Decodes a snappy-compressed ReadResponse. This is the inverse of
+// EncodeReadResponse.
+func DecodeReadResponse(body []byte) ([][]ingest.PromTimeSeries, error) {
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress remote read response: %s", err.Error())
+	}
+
+	var results [][]ingest.PromTimeSeries
+	err = ingest.WalkProto(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+
+		tss := []ingest.PromTimeSeries{}
+		err := ingest.WalkProto(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+			if num != 1 || typ != protowire.BytesType {
+				return nil
+			}
+			ts, err := ingest.DecodeTimeSeries(v)
+			if err != nil {
+				return err
+			}
+			tss = append(tss, *ts)
+			return nil
+		})
+		results = append(results, tss)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode remote read response: %s", err.Error())
+	}
+
+	return results, nil
+}
+
+// Converts a Series to the remote-read wire representation
+func SeriesToProm(s *Series) *ingest.PromTimeSeries {
+	ts := ingest.PromTimeSeries{Labels: s.Metric}
+	ts.Samples = make([]ingest.PromSample, 0, len(s.Samples))
+	for _, smp := range s.Samples {
+		ts.Samples = append(ts.Samples, ingest.PromSample{Value: smp.Val, Ts: smp.Ts.UnixMilli()})
+	}
+	return &ts
+}
+
+func decodeReadQuery(b []byte) (*ReadQuery, error) {
+	rq := ReadQuery{}
+	err := ingest.WalkProto(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			u, _ := protowire.ConsumeVarint(v)
+			rq.Start = time.UnixMilli(int64(u)).UTC()
+		case num == 2 && typ == protowire.VarintType:
+			u, _ := protowire.ConsumeVarint(v)
+			rq.End = time.UnixMilli(int64(u)).UTC()
+		case num == 3 && typ == protowire.BytesType:
+			m, err := decodeLabelMatcher(v)
+			if err != nil {
+				return err
+			}
+			rq.Matchers = append(rq.Matchers, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rq, nil
+}
+
+func decodeLabelMatcher(b []byte) (*Matcher, error) {
+	m := Matcher{Type: MatchEqual}
+	err := ingest.WalkProto(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			u, _ := protowire.ConsumeVarint(v)
+			if u >= uint64(len(readMatchTypes)) {
+				return fmt.Errorf("unrecognized label matcher type %d", u)
+			}
+			m.Type = readMatchTypes[u]
+		case num == 2 && typ == protowire.BytesType:
+			m.Name = string(v)
+		case num == 3 && typ == protowire.BytesType:
+			m.Value = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,68 @@
+package promql
+
+import (
+	"equinox/internal/ingest"
+	"equinox/internal/query"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteReadRequest(t *testing.T) {
+	exp := []*ReadQuery{
+		{
+			Start: testStart,
+			End:   testStart.Add(time.Hour),
+			Matchers: []*Matcher{
+				NewMatcher(MatchEqual, NameLabel, "up"),
+				NewMatcher(MatchNotEqual, "job", "web"),
+				NewMatcher(MatchRegex, "instance", "a|b"),
+				NewMatcher(MatchNotRegex, "zone", "us-.*"),
+			},
+		},
+		{Start: testStart, End: testStart, Matchers: []*Matcher{NewMatcher(MatchEqual, NameLabel, "down")}},
+	}
+
+	body := EncodeReadRequest(exp)
+	act, err := DecodeReadRequest(body, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, exp, act)
+
+	_, err = DecodeReadRequest([]byte("garbage"), 1<<20)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to decompress remote read request")
+
+	n, _ := snappy.DecodedLen(body)
+	_, err = DecodeReadRequest(body, n-1)
+	assert.ErrorIs(t, err, ingest.ErrDecodedTooLarge)
+}
+
+func TestRemoteReadResponse(t *testing.T) {
+	io := testEngine()
+	q := query.NewQuery(testStart, testStart.Add(time.Minute), query.True())
+	ss, err := Select(io, "up", "value", q)
+	assert.NoError(t, err)
+
+	results, err := DecodeReadResponse(EncodeReadResponse([][]*Series{ss, nil}))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, 0, len(results[1]))
+
+	assert.Equal(t, 2, len(results[0]))
+	assert.Equal(t, map[string]string{"__name__": "up", "job": "api", "instance": "a"}, results[0][0].Labels)
+	assert.Equal(t, 3, len(results[0][0].Samples))
+	assert.Equal(t, testStart.Add(30*time.Second).UnixMilli(), results[0][0].Samples[1].Ts)
+	assert.Equal(t, 101.0, results[0][1].Samples[1].Value)
+}
+
+func TestRemoteReadTarget(t *testing.T) {
+	sid, key := Target("up", "")
+	assert.Equal(t, "up", sid)
+	assert.Equal(t, "value", key)
+
+	sid, key = Target("up", "prom")
+	assert.Equal(t, "prom", sid)
+	assert.Equal(t, "up", key)
+}
@@ -0,0 +1,299 @@
+package promql
+
+import (
+	"equinox/internal/query"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Label name that Prometheus uses for the metric name
+const NameLabel = "__name__"
+
+// Enum-style type to represent the label matching operators
+type MatchType string
+
+const (
+	MatchEqual    MatchType = "="
+	MatchNotEqual MatchType = "!="
+	MatchRegex    MatchType = "=~"
+	MatchNotRegex MatchType = "!~"
+)
+
+// Single label matcher from a series selector, e.g. job=~"api|web"
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+func NewMatcher(t MatchType, name string, value string) *Matcher {
+	return &Matcher{Type: t, Name: name, Value: value}
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%s", m.Name, m.Type, strconv.Quote(m.Value))
+}
+
+/*
+Converts this matcher into the equivalent FilterAttr. Prometheus treats a
+missing label the same as an empty one, so a matcher that matches the empty
+string also matches points without the attribute, and a negated matcher that
+matches the empty string requires the attribute to exist:
+
+	a="x"   => a == 'x'
+	a=""    => !(a exists) || a == ''
+	a!="x"  => !(a == 'x')
+	a=~"x+" => a =~ /^(?:x+)$/
+	a!~"x*" => a exists && !(a =~ /^(?:x*)$/)
+
+Regexes are fully anchored as they are in Prometheus.
+*/
+func (m *Matcher) FilterAttr() (query.FilterAttr, error) {
+	var pos query.FilterAttr
+	var matchesEmpty bool
+
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+		pos = query.Equal(m.Name, m.Value)
+		matchesEmpty = m.Value == ""
+	case MatchRegex, MatchNotRegex:
+		anchored := "^(?:" + m.Value + ")$"
+		re, err := regexp.Compile(anchored)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex in matcher %s: %s", m.String(), err.Error())
+		}
+		pos = query.Regex(m.Name, anchored)
+		matchesEmpty = re.MatchString("")
+	default:
+		return nil, fmt.Errorf("unrecognized match type '%s'", m.Type)
+	}
+
+	switch m.Type {
+	case MatchEqual, MatchRegex:
+		if matchesEmpty {
+			return query.Or(query.Not(query.Exists(m.Name)), pos), nil
+		}
+		return pos, nil
+	default:
+		if matchesEmpty {
+			return query.And(query.Exists(m.Name), query.Not(pos)), nil
+		}
+		return query.Not(pos), nil
+	}
+}
+
+// Converts all of the given matchers except those on the metric name into
+// a single FilterAttr that matches when all of them do. Returns True if there
+// are no matchers to apply.
+func MatchersToFilterAttr(ms []*Matcher) (query.FilterAttr, error) {
+	var fas []query.FilterAttr
+	for _, m := range ms {
+		if m.Name == NameLabel {
+			continue
+		}
+		fa, err := m.FilterAttr()
+		if err != nil {
+			return nil, err
+		}
+		fas = append(fas, fa)
+	}
+
+	switch len(fas) {
+	case 0:
+		return query.True(), nil
+	case 1:
+		return fas[0], nil
+	default:
+		return query.And(fas...), nil
+	}
+}
+
+// Returns the metric name from the matchers, which must include exactly one
+// equality matcher on __name__ since every metric maps to a single series.
+func MetricName(ms []*Matcher) (string, error) {
+	name := ""
+	for _, m := range ms {
+		if m.Name != NameLabel {
+			continue
+		}
+		if m.Type != MatchEqual || m.Value == "" || name != "" {
+			return "", fmt.Errorf("selector must have a single non-empty equality matcher on the metric name")
+		}
+		name = m.Value
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("selector must specify a metric name")
+	}
+	return name, nil
+}
+
+/*
+Parses an instant vector selector, which is the subset of PromQL we support:
+
+	metric_name
+	metric_name{label="value", label2!="value", label3=~"regex", label4!~"regex"}
+	{__name__="metric_name", label="value"}
+
+The metric name, if present outside the braces, is returned as an equality
+matcher on __name__.
+*/
+func ParseSelector(s string) ([]*Matcher, error) {
+	p := selParser{s: strings.TrimSpace(s)}
+	var ms []*Matcher
+
+	name := p.ident(true)
+	if name != "" {
+		ms = append(ms, NewMatcher(MatchEqual, NameLabel, name))
+	}
+
+	p.skipSpace()
+	if p.done() {
+		if name == "" {
+			return nil, fmt.Errorf("empty selector")
+		}
+		return ms, nil
+	}
+
+	if !p.consume("{") {
+		return nil, p.errorf("expected '{'")
+	}
+
+	for {
+		p.skipSpace()
+		if p.consume("}") {
+			break
+		}
+
+		m, err := p.matcher()
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+
+		p.skipSpace()
+		if p.consume(",") {
+			continue
+		}
+		if p.consume("}") {
+			break
+		}
+		return nil, p.errorf("expected ',' or '}'")
+	}
+
+	p.skipSpace()
+	if !p.done() {
+		return nil, p.errorf("unexpected content after selector")
+	}
+	if len(ms) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+
+	return ms, nil
+}
+
+// Minimal recursive-descent parser state for selectors
+type selParser struct {
+	s   string
+	pos int
+}
+
+func (p *selParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *selParser) errorf(msg string) error {
+	return fmt.Errorf("%s at position %d in selector '%s'", msg, p.pos, p.s)
+}
+
+func (p *selParser) skipSpace() {
+	for !p.done() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\n') {
+		p.pos++
+	}
+}
+
+// Consumes tok if it's next in the input, returning whether it was
+func (p *selParser) consume(tok string) bool {
+	if strings.HasPrefix(p.s[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+// Consumes a label name, or a metric name (which may also contain colons)
+func (p *selParser) ident(metric bool) string {
+	st := p.pos
+	for ; !p.done(); p.pos++ {
+		c := p.s[p.pos]
+		alpha := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (metric && c == ':')
+		digit := c >= '0' && c <= '9'
+		if !alpha && !(digit && p.pos > st) {
+			break
+		}
+	}
+	return p.s[st:p.pos]
+}
+
+func (p *selParser) matcher() (*Matcher, error) {
+	name := p.ident(false)
+	if name == "" {
+		return nil, p.errorf("expected label name")
+	}
+
+	p.skipSpace()
+	var t MatchType
+	switch {
+	case p.consume(string(MatchNotEqual)):
+		t = MatchNotEqual
+	case p.consume(string(MatchRegex)):
+		t = MatchRegex
+	case p.consume(string(MatchNotRegex)):
+		t = MatchNotRegex
+	case p.consume(string(MatchEqual)):
+		t = MatchEqual
+	default:
+		return nil, p.errorf("expected match operator")
+	}
+
+	p.skipSpace()
+	val, err := p.str()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMatcher(t, name, val), nil
+}
+
+// Consumes a quoted string literal and returns its unquoted value
+func (p *selParser) str() (string, error) {
+	if p.done() || (p.s[p.pos] != '"' && p.s[p.pos] != '\'' && p.s[p.pos] != '`') {
+		return "", p.errorf("expected quoted string")
+	}
+
+	q := p.s[p.pos]
+	for i := p.pos + 1; i < len(p.s); i++ {
+		if p.s[i] == '\\' && q != '`' {
+			i++
+			continue
+		}
+		if p.s[i] == q {
+			lit := p.s[p.pos : i+1]
+			if q == '\'' {
+				// strconv only understands single quotes for runes
+				inner := strings.ReplaceAll(lit[1:len(lit)-1], `\'`, `'`)
+				lit = `"` + strings.ReplaceAll(inner, `"`, `\"`) + `"`
+			}
+			v, err := strconv.Unquote(lit)
+			if err != nil {
+				return "", p.errorf("invalid string literal")
+			}
+			p.pos = i + 1
+			return v, nil
+		}
+	}
+
+	return "", p.errorf("unterminated string")
+}
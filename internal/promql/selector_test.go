@@ -0,0 +1,122 @@
+package promql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectorParse(t *testing.T) {
+	fn := func(s string, exp string) {
+		ms, err := ParseSelector(s)
+		assert.NoError(t, err, s)
+		var act []string
+		for _, m := range ms {
+			act = append(act, m.String())
+		}
+		assert.Equal(t, exp, strings.Join(act, " "), s)
+	}
+
+	fn(`up`, `__name__="up"`)
+	fn(` job:requests:rate5m `, `__name__="job:requests:rate5m"`)
+	fn(`up{}`, `__name__="up"`)
+	fn(`up{job="api"}`, `__name__="up" job="api"`)
+	fn(`up{job="api", code!="500",instance=~"a|b" , path!~'/x.*',}`,
+		`__name__="up" job="api" code!="500" instance=~"a|b" path!~"/x.*"`)
+	fn(`{__name__="up",job="a\"b"}`, `__name__="up" job="a\"b"`)
+	fn("up{job=`a\\b`}", `__name__="up" job="a\\b"`)
+	fn(`up{job='it\'s'}`, `__name__="up" job="it's"`)
+}
+
+func TestSelectorParseErrors(t *testing.T) {
+	fn := func(s string, msg string) {
+		_, err := ParseSelector(s)
+		assert.Error(t, err, s)
+		if err != nil {
+			assert.Equal(t, msg, err.Error(), s)
+		}
+	}
+
+	fn(``, "empty selector")
+	fn(`{}`, "empty selector")
+	fn(`up[5m]`, "expected '{' at position 2 in selector 'up[5m]'")
+	fn(`rate(up[5m])`, "expected '{' at position 4 in selector 'rate(up[5m])'")
+	fn(`up{job}`, "expected match operator at position 6 in selector 'up{job}'")
+	fn(`up{="a"}`, "expected label name at position 3 in selector 'up{=\"a\"}'")
+	fn(`up{job=api}`, "expected quoted string at position 7 in selector 'up{job=api}'")
+	fn(`up{job="api}`, "unterminated string at position 7 in selector 'up{job=\"api}'")
+	fn(`up{job="a" x="b"}`, "expected ',' or '}' at position 11 in selector 'up{job=\"a\" x=\"b\"}'")
+	fn(`up{job="a"} + 1`, "unexpected content after selector at position 12 in selector 'up{job=\"a\"} + 1'")
+}
+
+func TestSelectorFilterAttr(t *testing.T) {
+	fn := func(m *Matcher, exp string, matches []map[string]string, nonmatches []map[string]string) {
+		fa, err := m.FilterAttr()
+		assert.NoError(t, err)
+		assert.Equal(t, exp, fa.String())
+		for _, a := range matches {
+			assert.True(t, fa.Match(a), "%s should match %v", m.String(), a)
+		}
+		for _, a := range nonmatches {
+			assert.False(t, fa.Match(a), "%s should not match %v", m.String(), a)
+		}
+	}
+
+	none := map[string]string{}
+	empty := map[string]string{"a": ""}
+	x := map[string]string{"a": "x"}
+	xx := map[string]string{"a": "xx"}
+	y := map[string]string{"a": "y"}
+
+	fn(NewMatcher(MatchEqual, "a", "x"), "a == 'x'",
+		[]map[string]string{x}, []map[string]string{none, empty, xx, y})
+	fn(NewMatcher(MatchEqual, "a", ""), "(!(a exists)) || (a == '')",
+		[]map[string]string{none, empty}, []map[string]string{x})
+	fn(NewMatcher(MatchNotEqual, "a", "x"), "!(a == 'x')",
+		[]map[string]string{none, empty, xx, y}, []map[string]string{x})
+	fn(NewMatcher(MatchNotEqual, "a", ""), "(a exists) && (!(a == ''))",
+		[]map[string]string{x}, []map[string]string{none, empty})
+	fn(NewMatcher(MatchRegex, "a", "x+"), "a =~ /^(?:x+)$/",
+		[]map[string]string{x, xx}, []map[string]string{none, empty, y})
+	fn(NewMatcher(MatchRegex, "a", "x*"), "(!(a exists)) || (a =~ /^(?:x*)$/)",
+		[]map[string]string{none, empty, x, xx}, []map[string]string{y})
+	fn(NewMatcher(MatchNotRegex, "a", "x|y"), "!(a =~ /^(?:x|y)$/)",
+		[]map[string]string{none, empty, xx}, []map[string]string{x, y})
+	fn(NewMatcher(MatchNotRegex, "a", "x*"), "(a exists) && (!(a =~ /^(?:x*)$/))",
+		[]map[string]string{y}, []map[string]string{none, empty, x, xx})
+
+	_, err := NewMatcher(MatchRegex, "a", "(").FilterAttr()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid regex in matcher a=~"(":`)
+}
+
+func TestSelectorMatchers(t *testing.T) {
+	ms, err := ParseSelector(`up{job="api",code!="500"}`)
+	assert.NoError(t, err)
+
+	name, err := MetricName(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, "up", name)
+
+	fa, err := MatchersToFilterAttr(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, "(job == 'api') && (!(code == '500'))", fa.String())
+
+	ms, _ = ParseSelector(`up`)
+	fa, err = MatchersToFilterAttr(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, "true", fa.String())
+
+	// name problems
+	fn := func(s string, msg string) {
+		ms, err := ParseSelector(s)
+		assert.NoError(t, err)
+		_, err = MetricName(ms)
+		assert.Error(t, err)
+		assert.Equal(t, msg, err.Error())
+	}
+	fn(`{job="api"}`, "selector must specify a metric name")
+	fn(`{__name__=~"up|down"}`, "selector must have a single non-empty equality matcher on the metric name")
+	fn(`up{__name__="down"}`, "selector must have a single non-empty equality matcher on the metric name")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -41,6 +42,15 @@ type FilterAttr interface {
 	// Returns true if the specified attributes match this filter
 	Match(attrs map[string]string) bool
 
+	// Returns false if no point whose attributes are drawn from seen can
+	// match this filter. May return true even though none do.
+	MayMatch(seen AttrValues) bool
+
+	// Returns false if no point can match this filter, given a function
+	// that returns false if no point has the attribute k equal to v. Only
+	// equality is checked, so may return true even though none do.
+	MayMatchPairs(has PairFilter) bool
+
 	// Human-readable string representation of the query
 	String() string
 
@@ -52,6 +62,28 @@ type FilterAttr interface {
 	unmarshalStruct(j *FilterAttrJson) error
 }
 
+// Attribute values seen across a set of points, with each key's values
+// sorted. Keys that aren't present are missing from every point.
+type AttrValues map[string][]string
+
+// Adds the values of a point's attributes, returning true if any weren't
+// already seen
+func (av AttrValues) Add(attrs map[string]string) bool {
+	added := false
+	for k, v := range attrs {
+		i, found := slices.BinarySearch(av[k], v)
+		if !found {
+			av[k] = slices.Insert(av[k], i, v)
+			added = true
+		}
+	}
+	return added
+}
+
+// Returns false if no point in a set has the attribute k equal to v, such as
+// by consulting a Bloom filter. May return true even though none do.
+type PairFilter func(k, v string) bool
+
 // Helper function that creates a slice of json.RawMessage attributes from a
 // slice of FilterAttrs
 func createExprs(fa ...FilterAttr) ([]json.RawMessage, error) {
@@ -126,6 +158,10 @@ type FATrue struct{}
 // Always returns true
 func (fa *FATrue) Match(attrs map[string]string) bool { return true }
 
+func (fa *FATrue) MayMatch(seen AttrValues) bool { return true }
+
+func (fa *FATrue) MayMatchPairs(has PairFilter) bool { return true }
+
 func (fa *FATrue) String() string { return "true" }
 
 // Implements TextMarshaler interface
@@ -173,6 +209,13 @@ func (fa *FAExists) Match(attrs map[string]string) bool {
 	return exists
 }
 
+// Returns true if any point has the attribute
+func (fa *FAExists) MayMatch(seen AttrValues) bool {
+	return len(seen[fa.k]) > 0
+}
+
+func (fa *FAExists) MayMatchPairs(has PairFilter) bool { return true }
+
 func (fa *FAExists) String() string {
 	return fmt.Sprintf("%s exists", fa.k)
 }
@@ -228,6 +271,17 @@ func (fa *FAEqual) Match(attrs map[string]string) bool {
 	return exists && (v == fa.v)
 }
 
+// Returns true if the value has been seen for the attribute
+func (fa *FAEqual) MayMatch(seen AttrValues) bool {
+	_, found := slices.BinarySearch(seen[fa.k], fa.v)
+	return found
+}
+
+// Returns true unless no point has the attribute value
+func (fa *FAEqual) MayMatchPairs(has PairFilter) bool {
+	return has(fa.k, fa.v)
+}
+
 func (fa *FAEqual) String() string {
 	return fmt.Sprintf("%s == '%s'", fa.k, fa.v)
 }
@@ -284,6 +338,13 @@ func (fa *FARegex) Match(attrs map[string]string) bool {
 	return exists && fa.re.MatchString(v)
 }
 
+// Returns true if any value seen for the attribute matches the regex
+func (fa *FARegex) MayMatch(seen AttrValues) bool {
+	return slices.ContainsFunc(seen[fa.k], fa.re.MatchString)
+}
+
+func (fa *FARegex) MayMatchPairs(has PairFilter) bool { return true }
+
 func (fa *FARegex) String() string {
 	return fmt.Sprintf("%s =~ /%s/", fa.k, fa.re.String())
 }
@@ -340,6 +401,14 @@ func (fa *FANot) Match(attrs map[string]string) bool {
 	return !fa.fa.Match(attrs)
 }
 
+// Always returns true: that some point matches the contained QueryAttr
+// doesn't mean they all do
+func (fa *FANot) MayMatch(seen AttrValues) bool {
+	return true
+}
+
+func (fa *FANot) MayMatchPairs(has PairFilter) bool { return true }
+
 func (fa *FANot) String() string {
 	return fmt.Sprintf("!(%s)", fa.fa.String())
 }
@@ -412,6 +481,36 @@ func (fa *FAAnd) Match(attrs map[string]string) bool {
 	return true
 }
 
+// Returns true if each of the contained QueryAttrs may match, though not
+// necessarily the same points
+func (fa *FAAnd) MayMatch(seen AttrValues) bool {
+	if len(fa.fa) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(fa.fa); i++ {
+		if !fa.fa[i].MayMatch(seen) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (fa *FAAnd) MayMatchPairs(has PairFilter) bool {
+	if len(fa.fa) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(fa.fa); i++ {
+		if !fa.fa[i].MayMatchPairs(has) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (fa *FAAnd) String() string {
 	var ret []string
 
@@ -492,6 +591,27 @@ func (fa *FAOr) Match(attrs map[string]string) bool {
 	return false
 }
 
+// Returns true if any of the contained QueryAttrs may match
+func (fa *FAOr) MayMatch(seen AttrValues) bool {
+	for i := 0; i < len(fa.fa); i++ {
+		if fa.fa[i].MayMatch(seen) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fa *FAOr) MayMatchPairs(has PairFilter) bool {
+	for i := 0; i < len(fa.fa); i++ {
+		if fa.fa[i].MayMatchPairs(has) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (fa *FAOr) String() string {
 	var ret []string
 
@@ -547,3 +667,12 @@ func (fa *FAOr) unmarshalStruct(j *FilterAttrJson) error {
 func Or(fa ...FilterAttr) *FAOr {
 	return &FAOr{fa: fa}
 }
+
+// Returns new QAOr object matching points whose attribute k is any of vs
+func In(k string, vs ...string) *FAOr {
+	fa := make([]FilterAttr, len(vs))
+	for i, v := range vs {
+		fa[i] = Equal(k, v)
+	}
+	return Or(fa...)
+}
@@ -195,6 +195,58 @@ func TestAttrLogicCombo(t *testing.T) {
 	runQATest(t, a, And(t5, t6, t7), true)
 }
 
+func TestAttrMayMatch(t *testing.T) {
+	seen := AttrValues{}
+	assert.True(t, seen.Add(testGetAttrs()))
+	assert.False(t, seen.Add(map[string]string{"color": "blue"}))
+	assert.True(t, seen.Add(map[string]string{"color": "aqua", "flavor": "sour"}))
+	assert.Equal(t, []string{"aqua", "blue"}, seen["color"])
+
+	fn := func(fa FilterAttr, exp bool) {
+		assert.Equal(t, exp, fa.MayMatch(seen), fa.String())
+	}
+	fn(True(), true)
+	fn(Exists("flavor"), true)
+	fn(Exists("hue"), false)
+	fn(Equal("color", "aqua"), true)
+	fn(Equal("color", "red"), false)
+	fn(Equal("hue", "blue"), false)
+	fn(Regex("color", "^a"), true)
+	fn(Regex("color", "^r"), false)
+	fn(Not(Equal("color", "blue")), true)
+	fn(Not(Equal("color", "red")), true)
+
+	// the matches for each side of an AND may come from different points
+	fn(And(Equal("color", "aqua"), Equal("animal", "moose")), true)
+	fn(And(Equal("color", "aqua"), Equal("animal", "goose")), false)
+	fn(Or(Equal("color", "red"), Exists("shape")), true)
+	fn(Or(Equal("color", "red"), Exists("hue")), false)
+	fn(And(), false)
+	fn(Or(), false)
+}
+
+func TestAttrMayMatchPairs(t *testing.T) {
+	pairs := map[string]bool{"color=blue": true, "animal=moose": true}
+	has := func(k, v string) bool { return pairs[k+"="+v] }
+
+	fn := func(fa FilterAttr, exp bool) {
+		assert.Equal(t, exp, fa.MayMatchPairs(has), fa.String())
+	}
+	fn(Equal("color", "blue"), true)
+	fn(Equal("color", "red"), false)
+	fn(In("color", "red", "blue"), true)
+	fn(In("color", "red", "green"), false)
+	fn(In("color"), false)
+	fn(And(Equal("color", "blue"), Equal("animal", "goose")), false)
+	fn(And(Equal("color", "blue"), Regex("animal", "oose$")), true)
+
+	// only equality is checked
+	fn(True(), true)
+	fn(Exists("hue"), true)
+	fn(Regex("color", "red"), true)
+	fn(Not(Equal("color", "blue")), true)
+}
+
 func TestFilterAttrJson(t *testing.T) {
 	f := func(fa FilterAttr, exp string) {
 		// first test marshaling
@@ -0,0 +1,134 @@
+package query
+
+import (
+	"container/heap"
+	"equinox/internal/core"
+	"fmt"
+)
+
+// Number of points fetched from each series at a time when merging
+const mergeBatch = 100
+
+// Point returned by a multi-series query, tagged with the id of the series
+// it's from
+type SeriesPoint struct {
+	Series string
+	*core.Point
+}
+
+// Results of one series being merged, buffered a batch at a time
+type mergeSrc struct {
+	series string
+	qe     *QueryExec
+	buf    []*core.Point
+	order  int // position in the series list, breaking ties between equal times
+}
+
+// Min-heap of sources by the time of their next point
+type mergeHeap []*mergeSrc
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	c := core.PointCmp(h[i].buf[0], h[j].buf[0])
+	return c < 0 || (c == 0 && h[i].order < h[j].order)
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeSrc)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	src := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return src
+}
+
+/*
+Runs a query against several series at once, merging their results into a
+single stream in time order. Each series' results must already be in time
+order, as every engine's are, so the merge only needs to hold a batch from
+each series at a time. Points at the same time are returned in the order of
+the series.
+*/
+type MergeExec struct {
+	q       *Query
+	pending []*mergeSrc // not yet fetched from
+	h       mergeHeap
+	done    bool
+	rows    int
+}
+
+// Creates a MergeExec over the results of the query for each series, where
+// qes[i] is the query's QueryExec for series[i]
+func NewMergeExec(q *Query, series []string, qes []*QueryExec) *MergeExec {
+	me := &MergeExec{q: q}
+	for i := range series {
+		me.pending = append(me.pending, &mergeSrc{series: series[i], qe: qes[i], order: i})
+	}
+	return me
+}
+
+// Fetches the next n results from the query. Returns an empty slice once
+// there are no more.
+func (me *MergeExec) Fetch(n int) ([]*SeriesPoint, error) {
+	if me.done {
+		return nil, fmt.Errorf("Fetch called on query that was already Done: %s", me.q.String())
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("invalid n of %d when fetching results for query %s", n, me.q.String())
+	}
+
+	// the first point of every series is needed before anything is returned
+	for len(me.pending) > 0 {
+		err := me.fill(me.pending[0])
+		if err != nil {
+			return nil, err
+		}
+		me.pending = me.pending[1:]
+	}
+
+	r := make([]*SeriesPoint, 0, min(n, mergeBatch))
+	for len(r) < n && len(me.h) > 0 {
+		src := heap.Pop(&me.h).(*mergeSrc)
+		r = append(r, &SeriesPoint{Series: src.series, Point: src.buf[0]})
+		src.buf = src.buf[1:]
+		err := me.fill(src)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r) == 0 {
+		me.done = true
+	}
+	me.rows += len(r)
+	return r, nil
+}
+
+// Fetches the source's next batch if it's run out, and puts it back on the
+// heap unless it's finished
+func (me *MergeExec) fill(src *mergeSrc) error {
+	if len(src.buf) == 0 && !src.qe.Done() {
+		ps, err := src.qe.Fetch(mergeBatch)
+		if err != nil {
+			return fmt.Errorf("series '%s': %s", src.series, err.Error())
+		}
+		src.buf = ps
+	}
+	if len(src.buf) > 0 {
+		heap.Push(&me.h, src)
+	}
+	return nil
+}
+
+// Number of points returned so far
+func (me *MergeExec) Rows() int {
+	return me.rows
+}
+
+// Returns true if we've returned all results from this query, false otherwise.
+func (me *MergeExec) Done() bool {
+	return me.done
+}
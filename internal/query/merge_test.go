@@ -0,0 +1,104 @@
+package query
+
+import (
+	"equinox/internal/core"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cursor returning a slice of points, then err if set
+type sliceCursor struct {
+	ps  []*core.Point
+	err error
+}
+
+func (c *sliceCursor) Fetch(n int) ([]*core.Point, error) {
+	if len(c.ps) == 0 && c.err != nil {
+		return nil, c.err
+	}
+	n = min(n, len(c.ps))
+	r := c.ps[:n]
+	c.ps = c.ps[n:]
+	return r, nil
+}
+
+// points at the given minutes past midnight on 2024-01-10
+func pointsAt(mins ...int) []*core.Point {
+	var ps []*core.Point
+	for _, m := range mins {
+		ps = append(ps, core.NewPoint(time.Date(2024, 1, 10, 0, m, 0, 0, time.UTC)))
+	}
+	return ps
+}
+
+func TestMergeExec(t *testing.T) {
+	q := NewQuery(time.Time{}, time.Time{}, True())
+	var long []int
+	for i := 0; i < 250; i++ {
+		long = append(long, i*3)
+	}
+	series := []string{"a", "b", "c", "d"}
+	qes := []*QueryExec{
+		NewQueryExec(q, &sliceCursor{ps: pointsAt(1, 5, 9)}),
+		NewQueryExec(q, &sliceCursor{ps: pointsAt(long...)}),
+		NewQueryExec(q, &sliceCursor{}),
+		NewQueryExec(q, &sliceCursor{ps: pointsAt(0, 5, 1000)}),
+	}
+	me := NewMergeExec(q, series, qes)
+
+	var r []*SeriesPoint
+	for !me.Done() {
+		batch, err := me.Fetch(7)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(batch), 7)
+		r = append(r, batch...)
+	}
+	assert.Equal(t, 256, len(r))
+	assert.Equal(t, 256, me.Rows())
+
+	var got []string
+	for i, sp := range r[:8] {
+		got = append(got, fmt.Sprintf("%s@%d", sp.Series, sp.Ts.Minute()))
+		if i > 0 {
+			assert.False(t, sp.Ts.Before(r[i-1].Ts))
+		}
+	}
+	// b and d both have a point at minute 5
+	assert.Equal(t, []string{"b@0", "d@0", "a@1", "b@3", "a@5", "d@5", "b@6", "a@9"}, got)
+	for i := 1; i < len(r); i++ {
+		assert.False(t, r[i].Ts.Before(r[i-1].Ts), "point %d", i)
+	}
+	assert.Equal(t, "d", r[255].Series)
+
+	_, err := me.Fetch(7)
+	assert.Error(t, err)
+}
+
+func TestMergeExecErrors(t *testing.T) {
+	q := NewQuery(time.Time{}, time.Time{}, True())
+	me := NewMergeExec(q, []string{"a", "b"}, []*QueryExec{
+		NewQueryExec(q, &sliceCursor{ps: pointsAt(1, 2)}),
+		NewQueryExec(q, &sliceCursor{ps: pointsAt(3), err: fmt.Errorf("disk gone")}),
+	})
+	_, err := me.Fetch(-1)
+	assert.Equal(t, "invalid n of -1 when fetching results for query "+q.String(), err.Error())
+
+	r, err := me.Fetch(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(r))
+
+	// b fails when it's refilled after its first point
+	_, err = me.Fetch(3)
+	assert.ErrorContains(t, err, "series 'b': error fetching results from cursor for query")
+	assert.ErrorContains(t, err, "disk gone")
+
+	// no series, no results
+	me = NewMergeExec(q, nil, nil)
+	r, err = me.Fetch(3)
+	assert.NoError(t, err)
+	assert.Empty(t, r)
+	assert.True(t, me.Done())
+}
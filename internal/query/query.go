@@ -14,6 +14,11 @@ type Query struct {
 	Start time.Time
 	End   time.Time
 	FA    FilterAttr
+
+	// Set on a pass over results that aren't returned to the client, such as
+	// finding CSV columns before exporting. Probes aren't counted in query
+	// metrics or passed to the done hook.
+	Probe bool
 }
 
 func NewQuery(start time.Time, end time.Time, fa FilterAttr) *Query {
@@ -27,6 +32,13 @@ func NewQuery(start time.Time, end time.Time, fa FilterAttr) *Query {
 	return &q
 }
 
+// Returns a copy of the query marked as a probe
+func (q *Query) AsProbe() *Query {
+	p := *q
+	p.Probe = true
+	return &p
+}
+
 // Returns string representation of the query
 func (q *Query) String() string {
 	return fmt.Sprintf("[%s-%s] [%s]", q.Start.UTC(), q.End.UTC(), q.FA.String())
@@ -97,10 +109,14 @@ func (q *Query) UnmarshalText(text []byte) error {
 		return err
 	}
 
-	// unmarshal the contained filter attributes
-	fa, err := UnmarshalFilterAttr(s.FilterAttr)
-	if err != nil {
-		return err
+	// unmarshal the contained filter attributes; if there aren't any then
+	// all points match
+	var fa FilterAttr = True()
+	if len(s.FilterAttr) > 0 {
+		fa, err = UnmarshalFilterAttr(s.FilterAttr)
+		if err != nil {
+			return err
+		}
 	}
 
 	// save all the data
@@ -2,6 +2,7 @@ package query
 
 import (
 	"equinox/internal/core"
+	"fmt"
 	"testing"
 	"time"
 
@@ -131,3 +132,121 @@ func TestJson(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, exp, string(b))
 }
+
+func TestJsonNoFilter(t *testing.T) {
+	// filterattr is optional and defaults to matching everything
+	q := Query{}
+	err := q.UnmarshalText([]byte(`{"start":"2024-01-12T13:00:00Z","end":"2024-01-14T13:00:00Z"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "[2024-01-12 13:00:00 +0000 UTC-2024-01-14 13:00:00 +0000 UTC] [true]", q.String())
+}
+
+// cursor returning a fixed number of batches of points
+type testCursor struct {
+	batches int
+	err     error
+}
+
+func (c *testCursor) Fetch(n int) ([]*core.Point, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.batches == 0 {
+		return nil, nil
+	}
+	c.batches--
+	return []*core.Point{core.NewPointEmpty(), core.NewPointEmpty()}, nil
+}
+
+func TestQueryExecMetrics(t *testing.T) {
+	execs, count, points := queryExecs.Value(), queryDuration.Count(), queryPoints.Value()
+
+	qe := NewQueryExec(NewQuery(time.Time{}, time.Time{}, True()), &testCursor{batches: 2})
+	assert.Equal(t, execs+1, queryExecs.Value())
+	for !qe.Done() {
+		_, err := qe.Fetch(2)
+		assert.NoError(t, err)
+	}
+
+	// duration is recorded once the query is done
+	assert.Equal(t, count+1, queryDuration.Count())
+	assert.Equal(t, points+4, queryPoints.Value())
+
+	// probes aren't counted
+	qe = NewQueryExec(NewQuery(time.Time{}, time.Time{}, True()).AsProbe(), &testCursor{batches: 2})
+	for !qe.Done() {
+		_, err := qe.Fetch(2)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 4, qe.Rows())
+	assert.Equal(t, execs+1, queryExecs.Value())
+	assert.Equal(t, count+1, queryDuration.Count())
+	assert.Equal(t, points+4, queryPoints.Value())
+}
+
+func TestQueryExecDoneHook(t *testing.T) {
+	type call struct {
+		q    *Query
+		src  Source
+		rows int
+		err  error
+	}
+	var calls []call
+	SetDoneHook(func(q *Query, src Source, rows int, d time.Duration, err error) {
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		calls = append(calls, call{q, src, rows, err})
+	})
+	defer SetDoneHook(nil)
+
+	q := NewQuery(time.Time{}, time.Time{}, True())
+	qe := NewQueryExec(q, &testCursor{batches: 3})
+	for !qe.Done() {
+		_, err := qe.Fetch(2)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 6, qe.Rows())
+	assert.Equal(t, []call{{q, Source{}, 6, nil}}, calls)
+
+	// closing a finished query does nothing
+	qe.Close()
+	assert.Len(t, calls, 1)
+
+	// a query closed part way is reported once, with who ran it
+	calls = nil
+	count := queryDuration.Count()
+	qe = NewQueryExec(q, &testCursor{batches: 3})
+	qe.SetSource(Source{Principal: "grafana", Series: "cpu"})
+	_, err := qe.Fetch(2)
+	assert.NoError(t, err)
+	qe.Close()
+	qe.Close()
+	assert.Equal(t, []call{{q, Source{Principal: "grafana", Series: "cpu"}, 2, ErrClosed}}, calls)
+	assert.Equal(t, count+1, queryDuration.Count())
+
+	// failed queries are reported too
+	calls = nil
+	qe = NewQueryExec(q, &testCursor{err: fmt.Errorf("disk gone")})
+	_, err = qe.Fetch(2)
+	assert.Error(t, err)
+	assert.Len(t, calls, 1)
+	assert.Equal(t, 0, calls[0].rows)
+	assert.Equal(t, err, calls[0].err)
+
+	// nor are probes
+	calls = nil
+	qe = NewQueryExec(q.AsProbe(), &testCursor{batches: 1})
+	qe.Fetch(2)
+	qe.Fetch(2)
+	assert.True(t, qe.Done())
+	assert.Empty(t, calls)
+	assert.False(t, q.Probe)
+
+	// no hook, no calls
+	SetDoneHook(nil)
+	calls = nil
+	qe = NewQueryExec(q, &testCursor{batches: 1})
+	qe.Fetch(2)
+	qe.Fetch(2)
+	assert.True(t, qe.Done())
+	assert.Empty(t, calls)
+}
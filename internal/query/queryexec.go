@@ -2,9 +2,51 @@ package query
 
 import (
 	"equinox/internal/core"
+	"equinox/internal/metrics"
+	"errors"
 	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	queryExecs = metrics.MustRegister(metrics.NewCounter(
+		"equinox_query_execs_total", "Number of queries started."))
+	queryDuration = metrics.MustRegister(metrics.NewHistogram(
+		"equinox_query_duration_seconds", "Time from starting a query until it finished or was closed.",
+		metrics.DefBuckets))
+	queryPoints = metrics.MustRegister(metrics.NewCounter(
+		"equinox_query_points_returned_total", "Number of points returned by queries."))
+)
+
+// Returned to the done hook for a query closed before all its results were
+// fetched, e.g. because the client went away
+var ErrClosed = errors.New("query closed before all results were fetched")
+
+// Who ran a query and against which series
+type Source struct {
+	Principal string
+	Series    string
+}
+
+// Function called once when a query finishes or is closed, with who ran it,
+// the number of points it returned and how long it ran. err is set if the
+// query failed or was closed early.
+type DoneFunc func(q *Query, src Source, rows int, d time.Duration, err error)
+
+var doneHook atomic.Pointer[DoneFunc]
+
+// Sets the function called when each query finishes, e.g. to audit queries.
+// A nil fn removes it.
+func SetDoneHook(fn DoneFunc) {
+	if fn == nil {
+		doneHook.Store(nil)
+		return
+	}
+	doneHook.Store(&fn)
+}
+
 // Internal interface used by QueryExec to retrieve results from the diferent
 // data stores.
 type Cursor interface {
@@ -14,13 +56,20 @@ type Cursor interface {
 }
 
 type QueryExec struct {
-	q    *Query
-	cur  Cursor
-	done bool // whether we've hit end of query already
+	q        *Query
+	cur      Cursor
+	src      Source
+	done     bool // whether we've hit end of query already
+	finished bool // whether the done hook has been called
+	rows     int
+	start    time.Time
 }
 
 func NewQueryExec(q *Query, cur Cursor) *QueryExec {
-	qe := QueryExec{q: q, cur: cur, done: false}
+	qe := QueryExec{q: q, cur: cur, done: false, start: time.Now()}
+	if !q.Probe {
+		queryExecs.Inc()
+	}
 	return &qe
 }
 
@@ -38,16 +87,61 @@ func (qe *QueryExec) Fetch(n int) ([]*core.Point, error) {
 
 	r, err := qe.cur.Fetch(n)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching results from cursor for query %s: %s", qe.q.String(), err.Error())
+		err = fmt.Errorf("error fetching results from cursor for query %s: %s", qe.q.String(), err.Error())
+		qe.finish(err)
+		return nil, err
 	}
 
 	if len(r) == 0 {
 		qe.done = true // latched to done
+		qe.finish(nil)
+	}
+	qe.rows += len(r)
+	if !qe.q.Probe {
+		queryPoints.Add(float64(len(r)))
 	}
 
 	return r, nil
 }
 
+// Records who ran the query, for the done hook
+func (qe *QueryExec) SetSource(src Source) {
+	qe.src = src
+}
+
+/*
+Releases the query, and anything its cursor holds on to until it's read to the
+end. If it hasn't finished then its duration is recorded and
+the done hook is called with ErrClosed, so that queries abandoned part way,
+such as by an export whose client went away, are still accounted for. Callers
+should defer this once the query is started; it does nothing after the first
+call or once the query has finished.
+*/
+func (qe *QueryExec) Close() {
+	if c, ok := qe.cur.(io.Closer); ok {
+		c.Close()
+	}
+	qe.finish(ErrClosed)
+}
+
+// Records the query's duration and calls the done hook, if any, the first
+// time the query finishes. Nothing is recorded for probes.
+func (qe *QueryExec) finish(err error) {
+	if qe.finished || qe.q.Probe {
+		return
+	}
+	qe.finished = true
+	queryDuration.ObserveSince(qe.start)
+	if fn := doneHook.Load(); fn != nil {
+		(*fn)(qe.q, qe.src, qe.rows, time.Since(qe.start), err)
+	}
+}
+
+// Number of points returned so far
+func (qe *QueryExec) Rows() int {
+	return qe.rows
+}
+
 // Returns true if we've returned all results from this query, false otherwise.
 func (qe *QueryExec) Done() bool {
 	return qe.done
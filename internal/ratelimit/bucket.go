@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+/*
+Token bucket. Tokens accumulate at rate per second up to capacity, and a
+request for n tokens is allowed if the bucket holds at least min(n, capacity)
+of them. Taking more tokens than the bucket holds leaves it in debt, so a
+request larger than the capacity still gets through once the bucket is full
+but delays the requests after it accordingly.
+*/
+type Bucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// Creates a full bucket. The capacity is burst's worth of tokens at rate.
+func NewBucket(rate float64, burst time.Duration, now time.Time) *Bucket {
+	capacity := rate * burst.Seconds()
+	return &Bucket{rate: rate, capacity: capacity, tokens: capacity, last: now}
+}
+
+// Adds the tokens accumulated since the last refill
+func (b *Bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.capacity, b.tokens+b.rate*now.Sub(b.last).Seconds())
+		b.last = now
+	}
+}
+
+// Returns how long until n tokens can be taken, or 0 if they can be taken
+// now. The bucket must have been refilled.
+func (b *Bucket) wait(n float64) time.Duration {
+	need := math.Min(n, b.capacity) - b.tokens
+	if need <= 0 {
+		return 0
+	}
+	return time.Duration(need / b.rate * float64(time.Second))
+}
+
+// Takes n tokens. The bucket must have been refilled.
+func (b *Bucket) take(n float64) {
+	b.tokens -= n
+}
+
+// Returns true if the bucket will be full at the given time, in which case
+// it's indistinguishable from a new one and can be discarded
+func (b *Bucket) fullAt(now time.Time) bool {
+	return b.tokens+b.rate*now.Sub(b.last).Seconds() >= b.capacity
+}
+
+// Number of whole tokens available, which is negative when in debt
+func (b *Bucket) Remaining() int64 {
+	return int64(math.Floor(b.tokens))
+}
+
+// Maximum number of tokens the bucket holds
+func (b *Bucket) Capacity() int64 {
+	return int64(math.Floor(b.capacity))
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+
+	// 10/s with 2s of burst
+	b := NewBucket(10, 2*time.Second, t0)
+	assert.Equal(t, int64(20), b.Capacity())
+	assert.Equal(t, int64(20), b.Remaining())
+
+	b.refill(at(0))
+	assert.Equal(t, time.Duration(0), b.wait(15))
+	b.take(15)
+	assert.Equal(t, int64(5), b.Remaining())
+	assert.Equal(t, 500*time.Millisecond, b.wait(10))
+
+	// refills at the rate, up to capacity
+	b.refill(at(500))
+	assert.Equal(t, int64(10), b.Remaining())
+	assert.Equal(t, time.Duration(0), b.wait(10))
+	b.refill(at(60000))
+	assert.Equal(t, int64(20), b.Remaining())
+	assert.True(t, b.fullAt(at(60000)))
+
+	// larger than capacity is allowed when full, leaving the bucket in debt
+	assert.Equal(t, time.Duration(0), b.wait(50))
+	b.take(50)
+	assert.Equal(t, int64(-30), b.Remaining())
+	assert.Equal(t, 3100*time.Millisecond, b.wait(1))
+	assert.Equal(t, 5*time.Second, b.wait(100))
+	assert.False(t, b.fullAt(at(64000)))
+	assert.True(t, b.fullAt(at(65000)))
+
+	// time going backwards doesn't add tokens
+	b.refill(at(0))
+	assert.Equal(t, int64(-30), b.Remaining())
+}
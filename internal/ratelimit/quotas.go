@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"equinox/internal/config"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Number of admissions between sweeps for full buckets
+const sweepInterval = 1024
+
+// Load a write puts on one series
+type SeriesLoad struct {
+	Id     string
+	Points int
+	Bytes  int
+}
+
+// Write to be admitted. Principal is the principal name, or the client
+// address if auth is disabled.
+type Request struct {
+	Principal string
+	Bytes     int
+	Series    []SeriesLoad
+}
+
+// State of one of the principal's buckets after an admission
+type Quota struct {
+	Limit     int64
+	Remaining int64
+}
+
+// Outcome of an admission
+type Decision struct {
+	Allowed bool
+
+	// Set when not allowed: what was exceeded and how long until the
+	// request would fit
+	Reason     string
+	RetryAfter time.Duration
+
+	// Principal quotas after the admission, or nil for unlimited ones
+	Points *Quota
+	Bytes  *Quota
+}
+
+// Bucket that a request needs tokens from
+type claim struct {
+	key  string
+	desc string
+	rate float64
+	n    float64
+}
+
+/*
+Applies the rate limits in a config.LimitsConfig. Buckets are created on first
+use and discarded once they've refilled, so idle principals and series cost
+nothing. Safe for concurrent use.
+*/
+type Quotas struct {
+	mu      sync.Mutex
+	cfg     config.LimitsConfig
+	buckets map[string]*Bucket
+	admits  int
+	now     func() time.Time
+}
+
+func NewQuotas(cfg *config.LimitsConfig) *Quotas {
+	return &Quotas{cfg: *cfg, buckets: make(map[string]*Bucket), now: time.Now}
+}
+
+// Singleton instance of Quotas
+var quotasInst *Quotas
+var quotasMu sync.Mutex
+
+// Returns the singleton quotas used by the server, which are configured from
+// config.Get() when first used
+func GetQuotas() *Quotas {
+	quotasMu.Lock()
+	defer quotasMu.Unlock()
+	if quotasInst == nil {
+		quotasInst = NewQuotas(&config.Get().Limits)
+	}
+	return quotasInst
+}
+
+// Replaces the limits and discards all buckets
+func (q *Quotas) Reset(cfg *config.LimitsConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cfg = *cfg
+	q.buckets = make(map[string]*Bucket)
+}
+
+// Maximum number of points a series may hold, or 0 for unlimited
+func (q *Quotas) MaxSeriesLen() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.cfg.MaxSeriesLen
+}
+
+// Maximum size of a compressed request body
+func (q *Quotas) MaxRequestBytes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.cfg.MaxRequestBytes
+}
+
+// Maximum size of a compressed request once it's decompressed
+func (q *Quotas) MaxDecodedBytes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.cfg.MaxDecodedBytes
+}
+
+func (q *Quotas) principalRate(name string) config.Rate {
+	if r, exists := q.cfg.PrincipalOverrides[name]; exists {
+		return r
+	}
+	return q.cfg.Principal
+}
+
+func (q *Quotas) seriesRate(id string) config.Rate {
+	if r, exists := q.cfg.SeriesOverrides[id]; exists {
+		return r
+	}
+	return q.cfg.Series
+}
+
+/*
+Admits a write if every limit it's subject to has room for it, taking tokens
+from all the relevant buckets. If any limit would be exceeded then nothing is
+taken, so a rejected request doesn't use up quota. Limits with a rate of 0
+are not applied.
+*/
+func (q *Quotas) Admit(req *Request) *Decision {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+
+	pr := q.principalRate(req.Principal)
+	points := 0
+	for _, sl := range req.Series {
+		points += sl.Points
+	}
+	claims := []claim{
+		{"p:points:" + req.Principal, fmt.Sprintf("principal '%s' points", req.Principal), pr.Points, float64(points)},
+		{"p:bytes:" + req.Principal, fmt.Sprintf("principal '%s' bytes", req.Principal), pr.Bytes, float64(req.Bytes)},
+	}
+	for _, sl := range req.Series {
+		sr := q.seriesRate(sl.Id)
+		claims = append(claims,
+			claim{"s:points:" + sl.Id, fmt.Sprintf("series '%s' points", sl.Id), sr.Points, float64(sl.Points)},
+			claim{"s:bytes:" + sl.Id, fmt.Sprintf("series '%s' bytes", sl.Id), sr.Bytes, float64(sl.Bytes)})
+	}
+
+	d := &Decision{Allowed: true}
+	bs := make([]*Bucket, len(claims))
+	for i, cl := range claims {
+		if cl.rate <= 0 {
+			continue
+		}
+		b, exists := q.buckets[cl.key]
+		if !exists {
+			b = NewBucket(cl.rate, time.Duration(q.cfg.Burst), now)
+			q.buckets[cl.key] = b
+		}
+		b.refill(now)
+		bs[i] = b
+
+		// report the longest wait so the retry isn't immediately rejected
+		// by another limit
+		if w := b.wait(cl.n); w > 0 && (d.Allowed || w > d.RetryAfter) {
+			d.Allowed = false
+			d.Reason = cl.desc
+			d.RetryAfter = w
+		}
+	}
+
+	if d.Allowed {
+		for i, b := range bs {
+			if b != nil {
+				b.take(claims[i].n)
+			}
+		}
+	}
+	if bs[0] != nil {
+		d.Points = &Quota{Limit: bs[0].Capacity(), Remaining: bs[0].Remaining()}
+	}
+	if bs[1] != nil {
+		d.Bytes = &Quota{Limit: bs[1].Capacity(), Remaining: bs[1].Remaining()}
+	}
+
+	q.admits++
+	if q.admits%sweepInterval == 0 {
+		q.sweep(now)
+	}
+
+	return d
+}
+
+// Discards buckets that have refilled. Must be called with the lock held.
+func (q *Quotas) sweep(now time.Time) {
+	for k, b := range q.buckets {
+		if b.fullAt(now) {
+			delete(q.buckets, k)
+		}
+	}
+}
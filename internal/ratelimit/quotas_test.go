@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"equinox/internal/config"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testQuotas(cfg *config.LimitsConfig) (*Quotas, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := NewQuotas(cfg)
+	q.now = func() time.Time { return now }
+	return q, &now
+}
+
+func TestQuotasPrincipal(t *testing.T) {
+	cfg := config.Default().Limits
+	cfg.Principal = config.Rate{Points: 100, Bytes: 1000}
+	cfg.PrincipalOverrides = map[string]config.Rate{"bulk": {Points: 0, Bytes: 10}}
+	q, now := testQuotas(&cfg)
+
+	write := func(principal string, points int, bytes int) *Decision {
+		return q.Admit(&Request{Principal: principal, Bytes: bytes,
+			Series: []SeriesLoad{{Id: "cpu", Points: points, Bytes: bytes}}})
+	}
+
+	d := write("a", 60, 100)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, &Quota{Limit: 100, Remaining: 40}, d.Points)
+	assert.Equal(t, &Quota{Limit: 1000, Remaining: 900}, d.Bytes)
+
+	// nothing is taken from any bucket when rejected
+	d = write("a", 60, 100)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "principal 'a' points", d.Reason)
+	assert.Equal(t, 200*time.Millisecond, d.RetryAfter)
+	assert.Equal(t, &Quota{Limit: 100, Remaining: 40}, d.Points)
+	assert.Equal(t, &Quota{Limit: 1000, Remaining: 900}, d.Bytes)
+
+	// other principals have their own buckets
+	assert.True(t, write("b", 100, 100).Allowed)
+
+	*now = now.Add(200 * time.Millisecond)
+	assert.True(t, write("a", 60, 100).Allowed)
+
+	// overrides replace the defaults, and 0 is unlimited
+	d = write("bulk", 1000000, 10)
+	assert.True(t, d.Allowed)
+	assert.Nil(t, d.Points)
+	assert.Equal(t, &Quota{Limit: 10, Remaining: 0}, d.Bytes)
+	d = write("bulk", 1, 5)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "principal 'bulk' bytes", d.Reason)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter)
+}
+
+func TestQuotasSeries(t *testing.T) {
+	cfg := config.Default().Limits
+	cfg.Series = config.Rate{Points: 10}
+	cfg.SeriesOverrides = map[string]config.Rate{"mem": {Points: 1}}
+	cfg.Burst = config.Duration(2 * time.Second)
+	q, now := testQuotas(&cfg)
+
+	d := q.Admit(&Request{Principal: "a", Series: []SeriesLoad{{Id: "cpu", Points: 15}, {Id: "mem", Points: 2}}})
+	assert.True(t, d.Allowed)
+	assert.Nil(t, d.Points)
+	assert.Nil(t, d.Bytes)
+
+	// the longest wait is reported
+	d = q.Admit(&Request{Principal: "b", Series: []SeriesLoad{{Id: "cpu", Points: 10}, {Id: "mem", Points: 1}}})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "series 'mem' points", d.Reason)
+	assert.Equal(t, time.Second, d.RetryAfter)
+
+	d = q.Admit(&Request{Principal: "b", Series: []SeriesLoad{{Id: "cpu", Points: 10}}})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, "series 'cpu' points", d.Reason)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter)
+
+	*now = now.Add(time.Second)
+	d = q.Admit(&Request{Principal: "b", Series: []SeriesLoad{{Id: "cpu", Points: 10}, {Id: "mem", Points: 1}}})
+	assert.True(t, d.Allowed)
+}
+
+func TestQuotasSweep(t *testing.T) {
+	cfg := config.Default().Limits
+	cfg.Series = config.Rate{Points: 10}
+	cfg.MaxSeriesLen = 7
+	q, now := testQuotas(&cfg)
+	assert.Equal(t, 7, q.MaxSeriesLen())
+	assert.Equal(t, 16<<20, q.MaxRequestBytes())
+	assert.Equal(t, 64<<20, q.MaxDecodedBytes())
+
+	for i := 0; i < sweepInterval-1; i++ {
+		q.Admit(&Request{Principal: "a", Series: []SeriesLoad{{Id: fmt.Sprint(i), Points: 1}}})
+	}
+	assert.Len(t, q.buckets, sweepInterval-1)
+
+	// buckets that have refilled are dropped
+	*now = now.Add(time.Second)
+	q.Admit(&Request{Principal: "a", Series: []SeriesLoad{{Id: "x", Points: 1}}})
+	assert.Len(t, q.buckets, 1)
+
+	q.Reset(&config.LimitsConfig{Burst: config.Duration(time.Second)})
+	assert.Len(t, q.buckets, 0)
+	assert.Equal(t, 0, q.MaxSeriesLen())
+	assert.True(t, q.Admit(&Request{Principal: "a", Series: []SeriesLoad{{Id: "x", Points: 1000}}}).Allowed)
+	assert.Len(t, q.buckets, 0)
+}
@@ -1,25 +1,54 @@
 package routers
 
 import (
+	"equinox/internal/config"
 	"equinox/internal/ctl"
+	"equinox/internal/middleware"
+	"log/slog"
 
 	"github.com/gin-gonic/gin"
 )
 
 func SetupRouter() *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(middleware.RequestLogger(slog.Default()), gin.Recovery(), middleware.Metrics())
 
 	// Public routes
 	public := router.Group("/")
 	{
 		public.GET("/ping", ctl.Ping)
+		public.GET("/healthz", ctl.Healthz)
+		public.GET("/readyz", ctl.Readyz)
+		public.GET("/metrics", ctl.Metrics)
 	}
 
 	// Protected routes
 	protected := router.Group("/")
-	// protected.Use(middleware.AuthMiddleware()) TODO add auth
+	if auths := middleware.NewAuthenticators(config.Get()); auths != nil {
+		protected.Use(middleware.AuthMiddleware(auths...))
+	}
 	{
 		protected.POST("/series/:id/points", ctl.PointAdd)
+		protected.POST("/series/:id/query", ctl.PointQuery)
+		protected.POST("/series/:id/import", ctl.PointImport)
+		protected.POST("/query", ctl.MultiQuery)
+
+		// InfluxDB-compatible line protocol ingestion (v1 and v2 paths)
+		protected.POST("/write", ctl.LineProtocolWrite)
+		protected.POST("/api/v2/write", ctl.LineProtocolWrite)
+
+		// Prometheus remote write/read and range queries
+		protected.POST("/api/v1/write", ctl.PromRemoteWrite)
+		protected.POST("/api/v1/read", ctl.PromRemoteRead)
+		protected.GET("/api/v1/query_range", ctl.PromQueryRange)
+		protected.POST("/api/v1/query_range", ctl.PromQueryRange)
+
+		// Administration
+		protected.GET("/admin/config", ctl.AdminConfig)
+		protected.GET("/admin/grants", ctl.AdminGrantList)
+		protected.POST("/admin/grants", ctl.AdminGrantAdd)
+		protected.DELETE("/admin/grants", ctl.AdminGrantRemove)
+		protected.POST("/admin/series/:id", ctl.AdminSeriesCreate)
 	}
 
 	return router